@@ -0,0 +1,67 @@
+package ahrs
+
+import "math"
+
+const (
+	accelClipMargin = 0.98 // Fraction of the full-scale range at which an acceleration counts as clipped
+	accelClipError  = 1.0  // Error, 1σ, G, taken in a clipped acceleration, which may be far beyond the range
+)
+
+// accelClipping tracks the accelerometer readings reaching the full-scale range of the sensor, beyond which
+// they clip and no longer show the direction of gravity.
+type accelClipping struct {
+	limits    [3]float64 // Full-scale range of each accelerometer axis, G; 0 for unlimited
+	magnitude float64    // Full-scale range of the magnitude of the acceleration, G; 0 for unlimited
+	clipped   bool       // Whether the latest reading clipped
+	count     int        // Number of readings that clipped
+	tStart    float64    // Time when the readings started to clip
+	persist   float64    // Time, s, for which the readings must keep clipping to be reported
+	reported  bool       // Whether the current clipping has been reported
+	onPersist func(t, duration float64)
+}
+
+// SetAccelFullScale sets the full-scale range of each accelerometer axis, G, e.g. 2 for a ±2 G setting,
+// and of the magnitude of the acceleration.  A reading at or near any of them is taken to have clipped:
+// it is counted and left out of the accelerometer's aiding of the attitude and of the bias estimates,
+// while the gyro carries the attitude on.  A range of 0, the default, leaves it unchecked.
+func (s *State) SetAccelFullScale(r1, r2, r3, magnitude float64) {
+	s.accelClip.limits = [3]float64{r1, r2, r3}
+	s.accelClip.magnitude = magnitude
+}
+
+// SetAccelClipCallback sets a function to be called from Compute once the accelerometer has kept clipping
+// for longer than d, s, with the time and how long it has been clipping, as when the sensor's range is
+// misconfigured for the aircraft.  It is called again only after the readings have come back within range.
+func (s *State) SetAccelClipCallback(d float64, f func(t, duration float64)) {
+	s.accelClip.persist, s.accelClip.onPersist = d, f
+}
+
+// CalcAccelClips returns the number of accelerometer readings that have clipped, and whether the latest did.
+func (s *State) CalcAccelClips() (n int, clipped bool) {
+	return s.accelClip.count, s.accelClip.clipped
+}
+
+// checkAccelClip records whether the accelerometer reading of m clipped and returns it.
+func (s *State) checkAccelClip(m *Measurement) (clipped bool) {
+	c := &s.accelClip
+	for i, a := range [3]float64{m.A1, m.A2, m.A3} {
+		clipped = clipped || (c.limits[i] > 0 && math.Abs(a) >= accelClipMargin*c.limits[i])
+	}
+	if c.magnitude > 0 && math.Sqrt(m.A1*m.A1+m.A2*m.A2+m.A3*m.A3) >= accelClipMargin*c.magnitude {
+		clipped = true
+	}
+	if !clipped {
+		c.clipped, c.reported = false, false
+		return
+	}
+	if !c.clipped {
+		c.tStart = m.T
+	}
+	c.clipped = true
+	c.count++
+	if d := m.T - c.tStart; !c.reported && c.onPersist != nil && d > c.persist {
+		c.reported = true
+		c.onPersist(m.T, d)
+	}
+	return
+}
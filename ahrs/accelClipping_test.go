@@ -0,0 +1,89 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+// bumpyTurnPath makes a level turn at rate tr (rad/s) and groundspeed gs (kt) through turbulence
+// that bounces the aircraft up and down, adding vertical accelerations of up to amp, G, at about 1 Hz.
+func bumpyTurnPath(gs, tr, amp float64) flightPath {
+	turn := turnPath(gs, 0, 0, tr)
+	return func(t float64) (float64, float64, float64, float64, float64, float64) {
+		roll, pitch, heading, w1, w2, _ := turn(t)
+		w3 := amp * G * (math.Sin(2*Pi*t)/(2*Pi) + math.Sin(2*Pi*1.3*t+1)/(2*Pi*1.3))
+		return roll, pitch, heading, w1, w2, w3
+	}
+}
+
+// withAccelClip clips the accelerometer readings in ms at ±limit, G, as an accelerometer with that
+// full-scale range would.
+func withAccelClip(ms []*Measurement, limit float64) []*Measurement {
+	for _, m := range ms {
+		m.A1 = math.Max(-limit, math.Min(limit, m.A1))
+		m.A2 = math.Max(-limit, math.Min(limit, m.A2))
+		m.A3 = math.Max(-limit, math.Min(limit, m.A3))
+	}
+	return ms
+}
+
+func TestAccelClipping(t *testing.T) {
+	const limit = 1.6
+	path := bumpyTurnPath(100, G/100, 0.8) // 45° of bank
+	for _, c := range []struct {
+		name string
+		new  func() AHRSProvider
+	}{
+		{"Simple", func() AHRSProvider { return NewSimpleAHRS() }},
+		{"EKF", func() AHRSProvider { return NewEKFAHRS() }},
+	} {
+		run := func(clip, aware bool) (e float64, p AHRSProvider) {
+			p = c.new()
+			if aware {
+				p.GetState().SetAccelFullScale(limit, limit, limit, 0)
+			}
+			ms := simMeasurements(path, 0, 60, 0.02)
+			if clip {
+				ms = withAccelClip(ms, limit)
+			}
+			return rmsTiltError(p, path, 10, ms), p
+		}
+		clean, _ := run(false, false)
+		unaware, _ := run(true, false)
+		aware, p := run(true, true)
+		n, _ := p.GetState().CalcAccelClips()
+		t.Logf("%s: RMS tilt error %.2f° unclipped, %.2f° clipped, %.2f° leaving out the %d clipped readings",
+			c.name, clean, unaware, aware, n)
+
+		if n == 0 {
+			t.Errorf("%s: no clipped readings counted", c.name)
+		}
+		if aware > unaware || aware > clean+0.5 {
+			t.Errorf("%s: RMS tilt error %.2f° leaving out clipped readings, %.2f° using them, %.2f° unclipped",
+				c.name, aware, unaware, clean)
+		}
+	}
+}
+
+func TestAccelClipCallback(t *testing.T) {
+	// A 1 G range is too small even for level flight, so the readings keep clipping.
+	path := straightPath(100, 0)
+	s := NewSimpleAHRS()
+	s.SetAccelFullScale(0, 0, 0, 1)
+	var events []float64
+	s.SetAccelClipCallback(2, func(tt, d float64) {
+		events = append(events, tt)
+		if d <= 2 {
+			t.Errorf("clipping reported at %.2f s after only %.2f s", tt, d)
+		}
+	})
+	for _, m := range simMeasurements(path, 0, 20, 0.05) {
+		s.Compute(m)
+	}
+	if n, clipped := s.CalcAccelClips(); n == 0 || !clipped {
+		t.Errorf("counted %d clipped readings, latest clipped %v", n, clipped)
+	}
+	if len(events) != 1 {
+		t.Errorf("persistent clipping reported at %v; expected once", events)
+	}
+}
@@ -3,8 +3,6 @@ package ahrs
 import (
 	"fmt"
 	"math"
-
-	"github.com/skelterjohn/go.matrix"
 )
 
 const (
@@ -19,7 +17,8 @@ const (
 
 // AHRSProvider defines an AHRS (Kalman or other) algorithm, such as ahrs_kalman, ahrs_simple, etc.
 type AHRSProvider interface {
-	// RollPitchHeading returns the current attitude values as estimated by the Kalman algorithm.
+	// RollPitchHeading returns the current attitude values, in radians, as estimated by the algorithm.
+	// The State's CalcRollPitchHeading returns them in degrees.
 	RollPitchHeading() (roll float64, pitch float64, heading float64)
 	// MagHeading returns the current magnetic heading in degrees as estimated by the Kalman algorithm.
 	MagHeading() (hdg float64)
@@ -30,6 +29,7 @@ type AHRSProvider interface {
 	// GLoad returns the current G load, in G's as estimated by the Kalman algorithm.
 	GLoad() (gLoad float64)
 	// Compute runs both the "predict" and "update" stages of the algorithm, for convenience.
+	// Providers must not retain m once Compute returns, so the caller is free to reuse it, e.g. via a MeasurementPool.
 	Compute(m *Measurement)
 	// SetSensorQuaternion changes the AHRS algorithm's sensor quaternion F.
 	SetSensorQuaternion(f *[4]float64)
@@ -49,11 +49,35 @@ type AHRSProvider interface {
 	Reset()
 	// GetState returns all the information about the current state.
 	GetState() *State
+	// CalcQuaternion returns the attitude quaternion, normalized and scalar first, rotating the aircraft
+	// frame into the earth frame: X_e = q*X_a*conj(q), with the frames described for ENU.
+	CalcQuaternion() (w, x, y, z float64)
+	// CalcQuaternionRate returns the rate of change, per second, of CalcQuaternion at the latest gyro rates.
+	CalcQuaternionRate() (w, x, y, z float64)
+	// CalcAttitude returns a compact copy of the attitude, turn rate and rate of climb, without the covariances.
+	CalcAttitude() Attitude
+	// Describe returns the name of the algorithm and its current tunables, for logging and reproducing results.
+	Describe() ProviderInfo
 	// GetLogMap returns a map customized for each AHRSProvider algorithm to provide more detailed information
 	// for debugging and logging.
 	GetLogMap() map[string]interface{}
 }
 
+// Attitude is a compact value copy of the attitude, for passing on to many consumers without the matrices of
+// a State.  Angles are in degrees, as are the other AHRSProvider outputs.
+type Attitude struct {
+	Roll, Pitch, Heading float64 // Attitude, °
+	TurnRate             float64 // Rate of turn, °/s, positive to the right
+	ROC                  float64 // Rate of climb, ft/min
+	T                    float64 // Time of the state, s
+}
+
+// ProviderInfo describes an AHRSProvider's algorithm and its current tunables.
+type ProviderInfo struct {
+	Name   string             // Name of the algorithm, as registered for NewAHRSProvider
+	Params map[string]float64 // Tunables, keyed by their param names in Config where they have one
+}
+
 // Measurement holds the measurements used for updating the Kalman filter:
 // true airspeed, groundspeed, accelerations, gyro rates, magnetometer, time;
 // along with variance accumulators and uncertainty matrix.
@@ -61,27 +85,60 @@ type AHRSProvider interface {
 // until appropriate sensors are working.
 type Measurement struct { // Order here also defines order in the matrices below
 	UValid, WValid, SValid, MValid bool // Do we have valid airspeed, GPS, accel/gyro, and magnetometer readings?
+	TempValid                      bool // Do we have a valid sensor temperature?
+	QValid                         bool // Do we have a valid attitude quaternion from an external AHRS?
 	// U, W, A, B, M
 	U1, U2, U3 float64 // Vector of measured airspeed, kt, aircraft (accelerated) frame
-	W1, W2, W3 float64 // Vector of GPS speed in N/S, E/W and U/D directions, kt, latlong axes, earth (inertial) frame
-	A1, A2, A3 float64 // Vector holding accelerometer readings, G, aircraft (accelerated) frame
-	B1, B2, B3 float64 // Vector of gyro rates in roll, pitch, heading axes, °/s, aircraft (accelerated) frame
+	W1, W2, W3 float64 // Vector of GPS speed east, north and up, kt, earth (inertial) frame; see GPSVelocity
+	A1, A2, A3 float64 // Vector holding accelerometer readings, G, aircraft (accelerated) frame; see SetIMU
+	B1, B2, B3 float64 // Vector of gyro rates in roll, pitch, heading axes, °/s, aircraft (accelerated) frame; see SetIMU
 	M1, M2, M3 float64 // Vector of magnetometer readings, µT, aircraft (accelerated) frame
 	TW, TU, T  float64 // Timestamp of GPS, airspeed and sensor readings
+	Temp       float64 // Temperature of the gyros, °C
+
+	Q0, Q1, Q2, Q3 float64 // Quaternion from an external AHRS rotating aircraft frame to earth frame, as E
 	//TODO westphae: track separate measurement timestamps for Gyro/Accel, Magnetometer, GPS, Baro
 
-	Accums [15]func(float64) (float64, float64, float64) // Accumulators to track means & variances of all variables
+	WUnits SpeedUnit `json:",omitempty"` // Unit of W, Knots by default; the providers read it in kt, leaving m as given
+
+	Accums [15]func(float64) (float64, float64, float64) `json:"-"` // Accumulators to track means & variances of all variables
 
-	M *matrix.DenseMatrix // Measurement noise covariance
+	M *Matrix `json:"-"` // Measurement noise covariance
 }
 
+// noMeasurement is an empty Measurement, never changed, from which the providers fill in their log maps
+// before the first measurement.
+var noMeasurement Measurement
+
 // NewMeasurement returns a pointer to an empty AHRS Measurement.
 // Uncertainty matrix and variance accumulators are properly initialized.
 func NewMeasurement() (m *Measurement) {
 	m = new(Measurement)
+	m.M = scaled(eye(15), Big)
+	m.initAccums()
+	return
+}
 
-	m.M = matrix.Scaled(matrix.Eye(15), Big)
+// Reset returns m to the state of a newly created Measurement, clearing all values and validity flags,
+// so that it can be reused without leaking stale data into the next reading.
+// The noise covariance is reset in place but the accumulators are replaced.
+func (m *Measurement) Reset() {
+	mm := m.M
+	*m = Measurement{}
+	if mm == nil || mm.rows != 15 || mm.cols != 15 {
+		mm = NewMatrix(15, 15)
+	}
+	for i := range mm.elements {
+		mm.elements[i] = 0
+	}
+	for i := 0; i < 15; i++ {
+		mm.elements[i*15+i] = Big
+	}
+	m.M = mm
+	m.initAccums()
+}
 
+func (m *Measurement) initAccums() {
 	m.Accums[0] = NewVarianceAccumulator(0, 1, MMDecay)
 	m.Accums[1] = NewVarianceAccumulator(0, 1, MMDecay)
 	m.Accums[2] = NewVarianceAccumulator(0, 1, MMDecay)
@@ -97,49 +154,135 @@ func NewMeasurement() (m *Measurement) {
 	m.Accums[12] = NewVarianceAccumulator(0, 80, MMDecay) // 70 typical from sensor
 	m.Accums[13] = NewVarianceAccumulator(0, 80, MMDecay)
 	m.Accums[14] = NewVarianceAccumulator(0, 80, MMDecay)
+}
 
-	return
+// Limits beyond which a measurement can't be real, well beyond the range of any sensor in use.
+const (
+	maxPlausibleSpeed = 2000  // kt
+	maxPlausibleAccel = 50    // G
+	maxPlausibleRate  = 5000  // °/s
+	maxPlausibleMag   = 10000 // µT
+	maxPlausibleTime  = 1e12  // s
+	maxPlausibleTemp  = 200   // °C
+
+	maxQuaternionNormError = 0.1 // Largest departure of an external quaternion's norm from 1
+)
+
+// inKnots returns m with its GPS velocity W in knots, the unit used internally: m itself if it already is,
+// or else buf filled with a copy of m converted, so that m is left as the caller gave it.
+func (m *Measurement) inKnots(buf *Measurement) *Measurement {
+	if m.WUnits != MetersPerSecond {
+		return m
+	}
+	k := buf
+	*k = *m
+	k.W1, k.W2, k.W3 = MSToKnots(m.W1), MSToKnots(m.W2), MSToKnots(m.W3)
+	k.WUnits = Knots
+	return k
 }
 
-// Regularize ensures that roll, pitch, and heading are in the correct ranges.
-// All in radians.
-func Regularize(roll, pitch, heading float64) (float64, float64, float64) {
-	for pitch > Pi {
-		pitch -= 2 * Pi
+// plausible returns whether the sensor readings in m are finite and within physical limits.
+// GPS and airspeed readings are only checked when flagged valid.
+func (m *Measurement) plausible() bool {
+	within := func(limit float64, vs ...float64) bool {
+		for _, v := range vs {
+			// NaN fails this test too
+			if !(math.Abs(v) <= limit) {
+				return false
+			}
+		}
+		return true
+	}
+	if !within(maxPlausibleTime, m.T) || !within(maxPlausibleAccel, m.A1, m.A2, m.A3) ||
+		!within(maxPlausibleRate, m.B1, m.B2, m.B3) || !within(maxPlausibleMag, m.M1, m.M2, m.M3) {
+		return false
+	}
+	if m.WValid && !(within(maxPlausibleSpeed, m.W1, m.W2, m.W3) && within(maxPlausibleTime, m.TW)) {
+		return false
 	}
-	for pitch <= -Pi {
-		pitch += 2 * Pi
+	if m.UValid && !(within(maxPlausibleSpeed, m.U1, m.U2, m.U3) && within(maxPlausibleTime, m.TU)) {
+		return false
 	}
+	if m.QValid && !(within(1+maxQuaternionNormError, m.Q0, m.Q1, m.Q2, m.Q3) &&
+		math.Abs(math.Sqrt(m.Q0*m.Q0+m.Q1*m.Q1+m.Q2*m.Q2+m.Q3*m.Q3)-1) <= maxQuaternionNormError) {
+		return false
+	}
+	return true
+}
+
+// Regularize returns the canonical form of the attitude roll, pitch, heading, all in radians:
+// pitch in [-π/2, π/2], heading in [0, 2π) and roll in (-π, π].
+// A pitch beyond the vertical is folded back, which turns the heading around and the aircraft over:
+// pitching up 100° on a heading of 0 is the same as pitching up 80° inverted on a heading of 180°.
+// At a pitch of exactly ±π/2 roll and heading aren't unique (gimbal lock) and are only wrapped.
+func Regularize(roll, pitch, heading float64) (float64, float64, float64) {
+	pitch = math.Remainder(pitch, 2*Pi)
 	if pitch > Pi/2 {
 		pitch = Pi - pitch
-		roll -= Pi
+		roll += Pi
 		heading += Pi
-	}
-	if pitch < -Pi/2 {
+	} else if pitch < -Pi/2 {
 		pitch = -Pi - pitch
-		roll -= Pi
+		roll += Pi
 		heading += Pi
 	}
 
-	for roll > Pi {
-		roll -= 2 * Pi
-	}
-	for roll < -Pi {
+	roll = math.Remainder(roll, 2*Pi)
+	if roll <= -Pi {
 		roll += 2 * Pi
 	}
 
-	for heading >= 2*Pi {
-		heading -= 2 * Pi
-	}
-	for heading < 0 {
+	heading = math.Mod(heading, 2*Pi)
+	if heading < 0 {
 		heading += 2 * Pi
 	}
+	if heading >= 2*Pi { // A tiny negative heading rounds up to 2π
+		heading = 0
+	}
 	return roll, pitch, heading
 }
 
 // MakeUnitVector re-scales the vector vec into a unit vector.
 func MakeUnitVector(vec [3]float64) (res *[3]float64, err error) {
-	res = new([3]float64)
+	v, err := unitVector(vec)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// MakeOrthogonal returns a vector close to the input target vector
+// but with the projection on the input ortho vector removed.
+func MakeOrthogonal(target, ortho [3]float64) (res *[3]float64) {
+	v := orthogonal(target, ortho)
+	return &v
+}
+
+// MakePerpendicular returns a vector that is perpendicular to both input vectors.
+// (Uses the cross product.)
+func MakePerpendicular(vec1, vec2 [3]float64) (res *[3]float64, err error) {
+	v, err := perpendicular(vec1, vec2)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// MakeHardSoftRotationMatrix constructs a rotation matrix that rotates the unit vector h1 exactly into the unit vector
+// h2 and the unit vector s1 as nearly as possible into the unit vector s2.  h1 is "hard-mapped" into h2 and
+// s1 is "soft-mapped" into s2.
+// It is up to the caller to ensure that all vectors are unit vectors.
+func MakeHardSoftRotationMatrix(h1, s1, h2, s2 [3]float64) (rotmat *[3][3]float64, err error) {
+	r, err := hardSoftRotationMatrix(h1, s1, h2, s2)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// The unexported versions of the above return values rather than pointers, so they don't allocate.
+
+func unitVector(vec [3]float64) (res [3]float64, err error) {
 	s := math.Sqrt(vec[0]*vec[0] + vec[1]*vec[1] + vec[2]*vec[2])
 	if s > 0 {
 		res[0] = vec[0] / s
@@ -147,13 +290,10 @@ func MakeUnitVector(vec [3]float64) (res *[3]float64, err error) {
 		res[2] = vec[2] / s
 		return res, nil
 	}
-	return nil, fmt.Errorf("Error: vector is length zero")
+	return res, fmt.Errorf("Error: vector is length zero")
 }
 
-// MakeOrthogonal returns a vector close to the input target vector
-// but with the projection on the input ortho vector removed.
-func MakeOrthogonal(target, ortho [3]float64) (res *[3]float64) {
-	res = new([3]float64)
+func orthogonal(target, ortho [3]float64) (res [3]float64) {
 	f := target[0]*ortho[0] + target[1]*ortho[1] + target[2]*ortho[2]
 	for i := 0; i < 3; i++ {
 		res[i] = target[i] - f*ortho[i]
@@ -161,51 +301,41 @@ func MakeOrthogonal(target, ortho [3]float64) (res *[3]float64) {
 	return
 }
 
-// MakePerpendicular returns a vector that is perpendicular to both input vectors.
-// (Uses the cross product.)
-func MakePerpendicular(vec1, vec2 [3]float64) (res *[3]float64, err error) {
-	res = new([3]float64)
+func perpendicular(vec1, vec2 [3]float64) (res [3]float64, err error) {
 	for i := 0; i < 3; i++ {
 		j := (i + 1) % 3
 		k := (i + 2) % 3
 		res[i] = vec1[j]*vec2[k] - vec1[k]*vec2[j]
 	}
-	res, err = MakeUnitVector(*res)
+	res, err = unitVector(res)
 	if err != nil {
-		return nil, fmt.Errorf("Error: vectors are parallel or length 0")
+		return res, fmt.Errorf("Error: vectors are parallel or length 0")
 	}
 	return res, nil
 }
 
-// MakeHardSoftRotationMatrix constructs a rotation matrix that rotates the unit vector h1 exactly into the unit vector
-// h2 and the unit vector s1 as nearly as possible into the unit vector s2.  h1 is "hard-mapped" into h2 and
-// s1 is "soft-mapped" into s2.
-// It is up to the caller to ensure that all vectors are unit vectors.
-func MakeHardSoftRotationMatrix(h1, s1, h2, s2 [3]float64) (rotmat *[3][3]float64, err error) {
-	rotmat = new([3][3]float64)
-	var (
-		v1, v2, w1, w2 *[3]float64
-	)
+func hardSoftRotationMatrix(h1, s1, h2, s2 [3]float64) (rotmat [3][3]float64, err error) {
+	var v1, v2, w1, w2 [3]float64
 
 	// The easiest way to "soft-rotate" s1 into s2 is by making s1 orthogonal to h1 and s2 orthogonal to h2
 	// and then mapping them exactly.
-	v1, err = MakeUnitVector(*MakeOrthogonal(s1, h1))
+	v1, err = unitVector(orthogonal(s1, h1))
 	if err != nil {
-		return nil, err
+		return rotmat, err
 	}
-	v2, err = MakeUnitVector(*MakeOrthogonal(s2, h2))
+	v2, err = unitVector(orthogonal(s2, h2))
 	if err != nil {
-		return nil, err
+		return rotmat, err
 	}
 
 	// Now construct a third unit vector orthogonal to h1, s1, and the same for h2, s2
-	w1, err = MakePerpendicular(h1, s1)
+	w1, err = perpendicular(h1, s1)
 	if err != nil {
-		return nil, err
+		return rotmat, err
 	}
-	w2, err = MakePerpendicular(h2, s2)
+	w2, err = perpendicular(h2, s2)
 	if err != nil {
-		return nil, err
+		return rotmat, err
 	}
 
 	// rotmat = [h2 v2 w2] @ [h1 v1 w1].T
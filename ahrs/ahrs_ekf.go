@@ -0,0 +1,818 @@
+/*
+The EKF AHRS algorithm is an error-state extended Kalman filter.  Its state is the attitude quaternion E,
+the gyro biases D and the earth-frame velocity; the filter itself tracks only the small errors in these:
+a rotation vector in the earth frame for the attitude, then the bias and velocity errors.
+
+The gyro drives the attitude and the accelerometer, rotated into the earth frame, drives the velocity,
+as in an inertial navigator.  GPS velocity corrects the velocity and, through their correlation, the roll
+and pitch and, when the aircraft accelerates, the heading and gyro biases; the GPS track corrects the
+heading directly.  Without GPS the last velocity is turned with the aircraft and the accelerometer is used
+as a reference for gravity plus the centripetal acceleration of the turn, while it reads close to that;
+the magnetometer holds the heading once it has been referenced to the GPS track, and the estimated biases
+keep the gyro integration honest.
+*/
+package ahrs
+
+import (
+	"log"
+	"math"
+)
+
+const (
+	ekfN = 9 // Size of the error state: attitude (earth-frame rotation vector), gyro biases, velocity
+
+	ekfGyroNoiseDefault     = 0.1   // Gyro angle random walk, °/√s
+	ekfGyroBiasNoiseDefault = 0.002 // Gyro bias random walk, °/s/√s
+	ekfAccelNoiseDefault    = 1.0   // Velocity random walk from accelerometer errors, kt/√s
+	ekfGPSNoiseDefault      = 2.0   // GPS velocity noise, kt
+	ekfTrackNoiseDefault    = 10.0  // Difference between heading and GPS track, °
+	ekfGravityNoiseDefault  = 0.05  // Accelerometer noise when used as a gravity reference, G
+	ekfMagNoiseDefault      = 5.0   // Magnetic heading noise, °
+	ekfInitTilt             = 5.0   // Initial roll and pitch uncertainty, °
+	ekfInitHeading          = 30.0  // Initial heading uncertainty without a GPS track, °
+	ekfInitBias             = 1.0   // Initial gyro bias uncertainty, °/s
+	ekfMaxTilt              = 20.0  // Above this roll or pitch uncertainty, °, the estimate isn't valid
+)
+
+type ekfMatrix [ekfN][ekfN]float64
+
+// EKFState is an AHRSProvider using an extended Kalman filter.
+// Its covariance M, in the order of the error state, is updated after each Compute,
+// and N holds the process noise per unit time.
+type EKFState struct {
+	State
+	p, phi                       ekfMatrix     // Covariance of the error state and its transition matrix
+	dx                           [ekfN]float64 // Error state estimated by the current update
+	v1, v2, v3                   float64       // Velocity, earth frame, kt
+	vValid                       bool          // Whether the velocity is being tracked, i.e. GPS is in use
+	tW                           float64       // Time of last GPS reading
+	w1, w2, w3, gs               float64       // Last GPS velocity and groundspeed, kt
+	smoothW1, smoothW2, smoothGS float64       // Smoothed groundspeed used to determine if stationary
+	eOld0, eOld1, eOld2, eOld3   float64       // Orientation quaternion before the latest update
+	dtLast                       float64       // Time interval of the latest update, s
+	magRef                       float64       // Bearing of the earth's magnetic field in the earth frame, Rad
+	magRefValid                  bool          // Whether magRef has been referenced to the GPS track
+	magValid                     bool          // Whether the latest measurement had a magnetometer reading
+	crab                         float64       // Angle of the nose right of the ground track, Rad (smoothed)
+	staticMode                   bool          // For low groundspeed or invalid GPS
+	headingValid                 bool          // Whether the heading has been taken from the GPS track
+	deadReckonOnly               bool          // Ignore the GPS entirely
+	minGS                        float64       // Below this smoothed GS, Kts, don't use any GPS data
+	maxDT                        float64       // Above this time interval, s, re-initialize--too stale
+	gpsNoise                     float64       // GPS velocity noise, kt
+	trackNoise                   float64       // Heading noise from the GPS track, Rad
+	gravityNoise                 float64       // Accelerometer noise as a gravity reference, G
+	magNoise                     float64       // Magnetic heading noise, Rad
+	ukf                          *ukfFilter    // Sigma-point buffers, if this is the unscented variant
+	smoother                     *Smoother     // Records the forward pass, if set
+	step                         *ekfStep      // Step being recorded for the smoother
+	logMapUsed                   bool          // Whether GetLogMap has been called, so logMap must be kept current
+}
+
+// NewEKFAHRS returns a new EKF AHRS object.
+func NewEKFAHRS() (s *EKFState) {
+	s = new(EKFState)
+	s.needsInitialization = true
+	s.aNorm = 1
+	s.E0 = 1
+	s.F0 = 1 // Initial guess is that it's oriented pointing forward and level
+	s.minGS = minGSDefault
+	s.maxDT = maxDTDefault
+	s.gpsNoise = ekfGPSNoiseDefault
+	s.trackNoise = DegToRad(ekfTrackNoiseDefault)
+	s.gravityNoise = ekfGravityNoiseDefault
+	s.magNoise = DegToRad(ekfMagNoiseDefault)
+	s.calcRotationMatrices()
+	s.M = NewMatrix(ekfN, ekfN)
+	s.N = NewMatrix(ekfN, ekfN)
+	s.setProcessNoise(ekfGyroNoiseDefault, ekfGyroBiasNoiseDefault, ekfAccelNoiseDefault)
+	s.logMap = make(map[string]interface{})
+	s.updateLogMap(&noMeasurement, s.logMap)
+	return
+}
+
+// setProcessNoise sets the diagonal of N from the gyro angle random walk gyro, °/√s,
+// the gyro bias random walk bias, °/s/√s, and the velocity random walk accel, kt/√s.
+func (s *EKFState) setProcessNoise(gyro, bias, accel float64) {
+	for i := 0; i < 3; i++ {
+		s.N.Set(i, i, DegToRad(gyro)*DegToRad(gyro))
+		s.N.Set(i+3, i+3, bias*bias)
+		s.N.Set(i+6, i+6, accel*accel)
+	}
+}
+
+func (s *EKFState) init(m *Measurement) {
+	s.State.init(m)
+
+	s.headingValid = false
+	s.magRefValid = false
+	s.crab = 0
+	s.vValid = false
+	if s.gpsValid(m) {
+		s.tW = m.TW
+		s.gs = math.Hypot(m.W1, m.W2)
+		s.smoothW1 = s.smoothW1 + verySlowSmoothConst*(m.W1-s.smoothW1)
+		s.smoothW2 = s.smoothW2 + verySlowSmoothConst*(m.W2-s.smoothW2)
+		s.smoothGS = math.Hypot(s.smoothW1, s.smoothW2)
+		s.w1, s.w2, s.w3 = m.W1, m.W2, m.W3
+		s.v1, s.v2, s.v3 = m.W1, m.W2, m.W3
+		s.vValid = true
+	} else {
+		s.gs = 0
+		s.smoothW1 = 0
+		s.smoothW2 = 0
+		s.smoothGS = 0
+		s.w1, s.w2, s.w3 = 0, 0, 0
+		s.v1, s.v2, s.v3 = 0, 0, 0
+	}
+	s.staticMode = !(s.gpsValid(m) && s.smoothGS > s.minGS)
+
+	// Start from the accelerometer's gravity vector and, if moving, the GPS track.
+	s.roll, s.pitch = s.CalcAccelAttitude(m)
+	s.heading = 0
+	sigmaHeading := DegToRad(ekfInitHeading)
+	if !s.staticMode {
+		_, _, s.heading = Regularize(0, 0, math.Atan2(m.W1, m.W2))
+		sigmaHeading = 2 * s.trackNoise
+		s.headingValid = true
+	}
+	s.E0, s.E1, s.E2, s.E3 = ToQuaternion(s.roll, s.pitch, s.heading)
+	s.eOld0, s.eOld1, s.eOld2, s.eOld3 = s.E0, s.E1, s.E2, s.E3
+	s.dtLast = 0
+	s.calcRotationMatrices()
+
+	s.p = ekfMatrix{}
+	s.dx = [ekfN]float64{}
+	for i := 0; i < 3; i++ {
+		s.p[i][i] = DegToRad(ekfInitTilt) * DegToRad(ekfInitTilt)
+		s.p[i+3][i+3] = ekfInitBias * ekfInitBias
+		s.p[i+6][i+6] = s.gpsNoise * s.gpsNoise
+	}
+	s.p[2][2] = sigmaHeading * sigmaHeading
+	s.syncCovariance()
+	if s.smoother != nil {
+		s.step.reset = true
+		s.recordStep(m.T)
+	}
+
+	if s.logMapUsed {
+		s.updateLogMap(m, s.logMap)
+	}
+}
+
+// Compute performs the EKF AHRS computations.
+func (s *EKFState) Compute(m *Measurement) {
+	m = m.inKnots(&s.mKnots)
+	if !m.plausible() {
+		return // Ignore corrupt readings rather than let them poison the state
+	}
+	if s.needsInitialization {
+		s.init(m)
+		return
+	}
+	dt := m.T - s.T
+	wValid := s.gpsValid(m)
+	var dtw float64
+	if wValid {
+		dtw = m.TW - s.tW
+	}
+
+	// Unlike the Simple algorithm, a stale GPS doesn't call for re-initializing: the velocity is
+	// restarted from the next fix, since it isn't tracked without the GPS, and the attitude is kept.
+	if dt > s.maxDT || dt < 0 {
+		log.Printf("AHRS Info: Reinitializing at %f\n", m.T)
+		s.init(m)
+		return
+	}
+	if dtw > s.maxDT {
+		s.vValid = false
+	}
+	s.updateGyroTemp(m, s.D1, s.D2, s.D3)
+	clipped := s.checkAccelClip(m)
+
+	newFix := wValid && dtw > minDT
+	if newFix {
+		s.gs = math.Hypot(m.W1, m.W2)
+		s.smoothW1 = s.smoothW1 + verySlowSmoothConst*(m.W1-s.smoothW1)
+		s.smoothW2 = s.smoothW2 + verySlowSmoothConst*(m.W2-s.smoothW2)
+		s.smoothGS = math.Hypot(s.smoothW1, s.smoothW2)
+	}
+	s.staticMode = !(wValid && s.smoothGS > s.minGS)
+
+	s.eOld0, s.eOld1, s.eOld2, s.eOld3 = s.E0, s.E1, s.E2, s.E3
+	s.dtLast = dt
+	s.predict(m, dt)
+	if axes, saturated := s.checkGyroSaturation(m); saturated {
+		s.inflateAttitude(axes, dt)
+	}
+	if clipped {
+		s.inflateVelocity(dt)
+	}
+	if s.smoother != nil {
+		s.step.pPred, s.step.phi = s.p, s.phi
+	}
+
+	a1, a2, a3 := s.rotateByF(m.A1, m.A2, m.A3, false)
+	a1, a2, a3 = a1/s.aNorm, a2/s.aNorm, a3/s.aNorm
+	m1, m2, m3 := s.rotateByF(s.K1*m.M1+s.L1, s.K2*m.M2+s.L2, s.K3*m.M3+s.L3, false)
+	var h [ekfN]float64
+	if newFix {
+		if !s.vValid {
+			s.resetVelocity(m)
+		}
+		// GPS velocity
+		for i, w := range [3]float64{m.W1, m.W2, m.W3} {
+			h = [ekfN]float64{}
+			h[6+i] = 1
+			s.observe(func() float64 { return w - [3]float64{s.v1, s.v2, s.v3}[i] }, &h, s.gpsNoise*s.gpsNoise)
+		}
+		// GPS track, assuming the nose points along it
+		if !s.staticMode {
+			_, _, heading := FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+			if !s.headingValid {
+				s.resetHeading(math.Atan2(m.W1, m.W2) - heading)
+				s.headingValid = true
+			} else {
+				h = [ekfN]float64{}
+				h[2] = -1 // A rotation about the up axis turns the nose to the left
+				s.observe(func() float64 {
+					_, _, heading := FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+					return AngleDiff(math.Atan2(m.W1, m.W2), heading)
+				}, &h, s.trackNoise*s.trackNoise)
+			}
+		}
+	}
+	if !wValid {
+		if s.vValid {
+			s.vValid = false
+			s.v3 = 0
+		}
+		// Gravity plus the centripetal acceleration of turning at the last known velocity,
+		// trusted only when the accelerometer reads close to that and didn't clip
+		f1, f2, f3 := s.specificForce()
+		ff := math.Sqrt(f1*f1 + f2*f2 + f3*f3)
+		aa := math.Sqrt(a1*a1 + a2*a2 + a3*a3)
+		if wAcc := 1 - math.Abs(aa-ff)/accelGTolerance; wAcc > 0 && !clipped {
+			r := s.gravityNoise * s.gravityNoise / wAcc
+			// d(E'f)/dθ = E'[f]x
+			var hf [3][3]float64
+			for j, c := range [3][3]float64{{0, f3, -f2}, {-f3, 0, f1}, {f2, -f1, 0}} {
+				hf[0][j], hf[1][j], hf[2][j] = s.rotateByE(c[0], c[1], c[2], true)
+			}
+			for i, a := range [3]float64{a1, a2, a3} {
+				h = [ekfN]float64{}
+				h[0], h[1], h[2] = hf[i][0], hf[i][1], hf[i][2]
+				s.observe(func() float64 {
+					var p [3]float64
+					f1, f2, f3 := s.specificForce()
+					p[0], p[1], p[2] = s.rotateByE(f1, f2, f3, true)
+					return a - p[i]
+				}, &h, r)
+			}
+		}
+	}
+	// A disturbed magnetometer is down-weighted.
+	rel := s.checkMag(s.H1, s.H2, s.H3, m1, m2, m3, dt, m.MValid)
+	if m.MValid && rel > Small {
+		// Bearing of the horizontal magnetic field in the earth frame, which should be constant
+		me1, me2, _ := s.rotateByE(m1, m2, m3, false)
+		if math.Hypot(me1, me2) > Small {
+			bearing := math.Atan2(me1, me2)
+			if !s.staticMode {
+				if !s.magRefValid {
+					s.magRef, s.magRefValid = bearing, true
+				}
+				s.magRef += slowSmoothConst * rel * AngleDiff(bearing, s.magRef)
+			} else if s.magRefValid {
+				h = [ekfN]float64{}
+				h[2] = -1
+				s.observe(func() float64 {
+					me1, me2, _ := s.rotateByE(m1, m2, m3, false)
+					return AngleDiff(s.magRef, math.Atan2(me1, me2))
+				}, &h, s.magNoise*s.magNoise/rel)
+			}
+		}
+	}
+	if s.smoother != nil {
+		s.step.dx = s.dx
+	}
+	s.correct()
+	if s.smoother != nil {
+		s.recordStep(m.T)
+	}
+
+	// Update the outputs from the corrected state
+	s.roll, s.pitch, s.heading = FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+
+	// Update Crab Angle: the track pulls the heading toward itself, so the nose is found from the bearing of
+	// the magnetic field in the earth frame, which is off from magnetic north by the heading's error.
+	s.magValid = m.MValid
+	if m.MValid && !s.staticMode {
+		me1, me2, _ := s.rotateByE(m1, m2, m3, false)
+		crab := AngleDiff(s.heading-math.Atan2(me1, me2)+s.declination, math.Atan2(s.w1, s.w2))
+		// Kept within (-π, π], so it can't wind up however long the crab keeps turning one way.
+		s.crab = math.Remainder(s.crab+slowSmoothConst*AngleDiff(crab, s.crab), 2*Pi)
+	}
+
+	dhM := AngleDiff(math.Atan2(m1, m2), s.headingMag)
+	s.headingMag += slowSmoothConst * dhM
+	for s.headingMag < 0 {
+		s.headingMag += 2 * Pi
+	}
+	for s.headingMag >= 2*Pi {
+		s.headingMag -= 2 * Pi
+	}
+	s.slipSkid += slowSmoothConst * (math.Atan2(-a2, a3) - s.slipSkid)
+	s.turnRate += slowSmoothConst * (-s.earthRate() - s.turnRate) // Positive to the right
+	s.gLoad += slowSmoothConst * (a3 - s.gLoad)
+
+	if s.logMapUsed {
+		s.updateLogMap(m, s.logMap)
+	}
+
+	s.T = m.T
+	if wValid {
+		s.tW = m.TW
+		s.w1, s.w2, s.w3 = m.W1, m.W2, m.W3
+	}
+}
+
+// predict propagates the state and its covariance over the interval dt using the gyro and accelerometer.
+func (s *EKFState) predict(m *Measurement, dt float64) {
+	if s.ukf != nil {
+		s.ukf.predict(s, m, dt)
+		return
+	}
+
+	f1, f2, f3 := s.measuredForce(m)
+
+	// Transition matrix of the error state, to first order in dt
+	s.phi = ekfMatrix{}
+	for i := 0; i < ekfN; i++ {
+		s.phi[i][i] = 1
+	}
+	for j := 0; j < 3; j++ {
+		// A gyro bias error turns the aircraft-frame rate error into an earth-frame attitude error.
+		var d [3]float64
+		d[j] = 1
+		c1, c2, c3 := s.rotateByF(d[0], d[1], d[2], false)
+		c1, c2, c3 = s.rotateByE(c1, c2, c3, false)
+		s.phi[0][3+j] = DegToRad(-c1) * dt
+		s.phi[1][3+j] = DegToRad(-c2) * dt
+		s.phi[2][3+j] = DegToRad(-c3) * dt
+	}
+	// An attitude error tilts the specific force: dv/dθ = -G[f]x
+	s.phi[6][1], s.phi[6][2] = G*f3*dt, -G*f2*dt
+	s.phi[7][0], s.phi[7][2] = -G*f3*dt, G*f1*dt
+	s.phi[8][0], s.phi[8][1] = G*f2*dt, -G*f1*dt
+
+	var t ekfMatrix
+	for i := 0; i < ekfN; i++ {
+		for j := 0; j < ekfN; j++ {
+			for k := 0; k < ekfN; k++ {
+				t[i][j] += s.phi[i][k] * s.p[k][j]
+			}
+		}
+	}
+	for i := 0; i < ekfN; i++ {
+		for j := 0; j < ekfN; j++ {
+			var v float64
+			for k := 0; k < ekfN; k++ {
+				v += t[i][k] * s.phi[j][k]
+			}
+			s.p[i][j] = v + s.N.Get(i, j)*dt
+		}
+	}
+	s.propagate(m, dt)
+}
+
+// propagate advances the attitude and velocity over the interval dt using the gyro and accelerometer.
+func (s *EKFState) propagate(m *Measurement, dt float64) {
+	s.H1, s.H2, s.H3 = s.rotateByF(m.B1-s.D1, m.B2-s.D2, m.B3-s.D3, false)
+	f1, f2, f3 := s.measuredForce(m)
+
+	s.E0, s.E1, s.E2, s.E3 = QuaternionRotate(s.E0, s.E1, s.E2, s.E3,
+		DegToRad(s.H1*dt), DegToRad(s.H2*dt), DegToRad(s.H3*dt))
+	if s.vValid {
+		s.v1 += G * f1 * dt
+		s.v2 += G * f2 * dt
+		s.v3 += G * (f3 - 1) * dt
+	} else {
+		// Assume the aircraft keeps its speed, turning with it.
+		sa, ca := math.Sincos(s.earthRate() * dt)
+		s.v1, s.v2 = ca*s.v1-sa*s.v2, sa*s.v1+ca*s.v2
+	}
+	s.calcRotationMatrices()
+}
+
+// earthRate returns the aircraft's rate of rotation about the earth's up axis, rad/s, positive to the left.
+func (s *EKFState) earthRate() float64 {
+	_, _, h3 := s.rotateByE(DegToRad(s.H1), DegToRad(s.H2), DegToRad(s.H3), false)
+	return h3
+}
+
+// measuredForce returns the specific force, G, earth frame, measured by the accelerometer.
+func (s *EKFState) measuredForce(m *Measurement) (f1, f2, f3 float64) {
+	a1, a2, a3 := s.rotateByF(m.A1, m.A2, m.A3, false)
+	return s.rotateByE(a1/s.aNorm, a2/s.aNorm, a3/s.aNorm, false)
+}
+
+// specificForce returns the specific force, G, earth frame, expected from gravity and the centripetal
+// acceleration of the velocity turning at the current rate.
+func (s *EKFState) specificForce() (f1, f2, f3 float64) {
+	h3 := s.earthRate()
+	return -h3 * s.v2 / G, h3 * s.v1 / G, 1
+}
+
+// observe applies a scalar measurement with variance r.  innov returns the measured value minus that
+// predicted from the current state, and h is its Jacobian with respect to the error state.
+func (s *EKFState) observe(innov func() float64, h *[ekfN]float64, r float64) {
+	if s.ukf != nil {
+		s.ukf.update(s, innov, r)
+		return
+	}
+	s.update(innov(), h, r)
+}
+
+// update applies a scalar measurement with innovation y, Jacobian h and variance r to the error state dx.
+// y is relative to the state before this Compute's corrections, which are applied all at once by correct.
+func (s *EKFState) update(y float64, h *[ekfN]float64, r float64) {
+	var ph [ekfN]float64 // P*h'
+	ss := r
+	for i := 0; i < ekfN; i++ {
+		for j := 0; j < ekfN; j++ {
+			ph[i] += s.p[i][j] * h[j]
+		}
+		ss += h[i] * ph[i]
+		y -= h[i] * s.dx[i]
+	}
+	for i := 0; i < ekfN; i++ {
+		k := ph[i] / ss
+		s.dx[i] += k * y
+		for j := 0; j < ekfN; j++ {
+			s.p[i][j] -= k * ph[j]
+		}
+	}
+}
+
+// correct folds the estimated error state into the state and resets it.
+func (s *EKFState) correct() {
+	d1, d2, d3 := s.dx[0]/2, s.dx[1]/2, s.dx[2]/2
+	s.E0, s.E1, s.E2, s.E3 = QuaternionNormalize(
+		s.E0-d1*s.E1-d2*s.E2-d3*s.E3,
+		s.E1+d1*s.E0+d2*s.E3-d3*s.E2,
+		s.E2-d1*s.E3+d2*s.E0+d3*s.E1,
+		s.E3+d1*s.E2-d2*s.E1+d3*s.E0,
+	)
+	s.calcRotationMatrices()
+	s.D1 += s.dx[3]
+	s.D2 += s.dx[4]
+	s.D3 += s.dx[5]
+	s.v1 += s.dx[6]
+	s.v2 += s.dx[7]
+	s.v3 += s.dx[8]
+	s.dx = [ekfN]float64{}
+	s.syncCovariance()
+}
+
+// resetVelocity starts tracking the velocity again from the GPS velocity in m, forgetting any correlations.
+func (s *EKFState) resetVelocity(m *Measurement) {
+	s.v1, s.v2, s.v3 = m.W1, m.W2, m.W3
+	for i := 6; i < ekfN; i++ {
+		for j := 0; j < ekfN; j++ {
+			s.p[i][j], s.p[j][i] = 0, 0
+		}
+		s.p[i][i] = s.gpsNoise * s.gpsNoise
+	}
+	s.vValid = true
+	if s.smoother != nil {
+		s.step.reset = true
+	}
+}
+
+// resetHeading turns the attitude by dh about the up axis, taking the heading from the GPS track.
+func (s *EKFState) resetHeading(dh float64) {
+	roll, pitch, heading := FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+	s.E0, s.E1, s.E2, s.E3 = ToQuaternion(roll, pitch, heading+dh)
+	s.calcRotationMatrices()
+	for j := 0; j < ekfN; j++ {
+		s.p[2][j], s.p[j][2] = 0, 0
+	}
+	s.p[2][2] = 4 * s.trackNoise * s.trackNoise
+	if s.smoother != nil {
+		s.step.reset = true
+	}
+}
+
+// SetSmoother sets a Smoother to record each step of the filter's forward pass, for smoothing after the flight,
+// or stops recording if sm is nil.  Recording costs memory, so it is off by default.
+// The UKF variant has no transition matrix, so its steps are recorded as restarts and aren't smoothed.
+func (s *EKFState) SetSmoother(sm *Smoother) {
+	s.smoother = sm
+	if sm != nil && s.step == nil {
+		s.step = new(ekfStep)
+	}
+}
+
+// recordStep passes the step just completed, at time t, to the smoother.
+func (s *EKFState) recordStep(t float64) {
+	st := s.step
+	st.t = t
+	st.e0, st.e1, st.e2, st.e3 = s.E0, s.E1, s.E2, s.E3
+	st.p = s.p
+	st.reset = st.reset || s.ukf != nil
+	s.smoother.add(st)
+	st.reset = false
+	st.dx = [ekfN]float64{}
+}
+
+// inflateAttitude widens the attitude uncertainty about the saturated gyro axes, whose rates may have
+// been off by gyroSaturationRate over the interval dt, s.  The error adds up over the saturation.
+func (s *EKFState) inflateAttitude(axes [3]bool, dt float64) {
+	for j, saturated := range axes {
+		if !saturated {
+			continue
+		}
+		var d [3]float64
+		d[j] = 1
+		c1, c2, c3 := s.rotateByF(d[0], d[1], d[2], false)
+		c1, c2, c3 = s.rotateByE(c1, c2, c3, false)
+		u := [3]float64{c1, c2, c3}
+		var v float64 // Variance of the attitude error about the axis
+		for a := 0; a < 3; a++ {
+			for b := 0; b < 3; b++ {
+				v += u[a] * s.p[a][b] * u[b]
+			}
+		}
+		sd := math.Sqrt(v) + DegToRad(gyroSaturationRate)*dt
+		for a := 0; a < 3; a++ {
+			for b := 0; b < 3; b++ {
+				s.p[a][b] += (sd*sd - v) * u[a] * u[b]
+			}
+		}
+	}
+	s.syncCovariance()
+}
+
+// inflateVelocity widens the velocity uncertainty by the error a clipped acceleration may have carried into
+// it over dt, so that the GPS corrects the velocity rather than tilting the attitude to explain it.
+func (s *EKFState) inflateVelocity(dt float64) {
+	for i := 6; i < 9; i++ {
+		sd := math.Sqrt(s.p[i][i]) + accelClipError*G*dt
+		s.p[i][i] = sd * sd
+	}
+	s.syncCovariance()
+}
+
+// syncCovariance symmetrizes the covariance and copies it into M.
+func (s *EKFState) syncCovariance() {
+	for i := 0; i < ekfN; i++ {
+		for j := 0; j < i; j++ {
+			v := (s.p[i][j] + s.p[j][i]) / 2
+			s.p[i][j], s.p[j][i] = v, v
+		}
+	}
+	for i := 0; i < ekfN; i++ {
+		for j := 0; j < ekfN; j++ {
+			s.M.Set(i, j, s.p[i][j])
+		}
+	}
+}
+
+// RollPitchHeading returns the current attitude values, in radians.
+// The heading is invalid until the GPS track has given it.
+func (s *EKFState) RollPitchHeading() (roll float64, pitch float64, heading float64) {
+	roll, pitch, heading = s.State.RollPitchHeading()
+	if s.staticMode {
+		heading = Invalid
+	}
+	return
+}
+
+// CalcTrack returns the ground track of the GPS velocity in degrees.  It is Invalid below MinGS.
+func (s *EKFState) CalcTrack() float64 {
+	if s.staticMode {
+		return Invalid
+	}
+	return trackFromVelocity(s.w1, s.w2)
+}
+
+// CalcCrabAngle returns the angle in degrees between the ground track and the heading from the magnetometer,
+// turned to true by the declination given to SetDeclination, positive when the nose points right of the
+// track, as into a crosswind from the right.  The EKF's heading is pulled toward the GPS track, so only the
+// magnetometer shows where the nose points.  It is Invalid without both the GPS and the magnetometer.
+func (s *EKFState) CalcCrabAngle() float64 {
+	if s.staticMode || !s.magValid {
+		return Invalid
+	}
+	return RadToDeg(s.crab)
+}
+
+// RateOfTurn returns the turn rate in degrees per second.
+func (s *EKFState) RateOfTurn() (turnRate float64) {
+	if s.staticMode {
+		return Invalid
+	}
+	return s.State.RateOfTurn()
+}
+
+// CalcAttitude returns a compact copy of the attitude, with the rate of turn as RateOfTurn and the rate of climb
+// of the velocity tracked, 0 while it isn't.
+func (s *EKFState) CalcAttitude() Attitude {
+	a := s.Attitude()
+	a.TurnRate = s.RateOfTurn()
+	a.ROC = 0
+	if s.vValid {
+		a.ROC = MSToFPM(KnotsToMS(s.v3))
+	}
+	return a
+}
+
+// RollPitchHeadingUncertainty returns the standard deviations of the attitude values, in radians,
+// from the covariance of the attitude error.
+func (s *EKFState) RollPitchHeadingUncertainty() (droll float64, dpitch float64, dheading float64) {
+	// Jacobian of roll, pitch and heading with respect to a rotation about each earth axis
+	const d = 1e-6
+	roll, pitch, heading := FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+	var j [3][3]float64
+	for k := 0; k < 3; k++ {
+		var r [3]float64
+		r[k] = d / 2
+		r0, r1, r2, r3 := QuaternionNormalize(
+			s.E0-r[0]*s.E1-r[1]*s.E2-r[2]*s.E3,
+			s.E1+r[0]*s.E0+r[1]*s.E3-r[2]*s.E2,
+			s.E2-r[0]*s.E3+r[1]*s.E0+r[2]*s.E1,
+			s.E3+r[0]*s.E2-r[1]*s.E1+r[2]*s.E0,
+		)
+		rr, pp, hh := FromQuaternion(r0, r1, r2, r3)
+		j[0][k] = AngleDiff(rr, roll) / d
+		j[1][k] = (pp - pitch) / d
+		j[2][k] = AngleDiff(hh, heading) / d
+	}
+	var v [3]float64
+	for i := 0; i < 3; i++ {
+		for k := 0; k < 3; k++ {
+			for l := 0; l < 3; l++ {
+				v[i] += j[i][k] * s.p[k][l] * j[i][l]
+			}
+		}
+	}
+	return math.Sqrt(v[0]), math.Sqrt(v[1]), math.Sqrt(v[2])
+}
+
+// CalcRollPitchHeadingUncertainty returns the standard deviations of the attitude values, in degrees.
+func (s *EKFState) CalcRollPitchHeadingUncertainty() (droll float64, dpitch float64, dheading float64) {
+	droll, dpitch, dheading = s.RollPitchHeadingUncertainty()
+	return RadToDeg(droll), RadToDeg(dpitch), RadToDeg(dheading)
+}
+
+// CalcGyroBias returns the estimated gyro biases, °/s, sensor frame.
+func (s *EKFState) CalcGyroBias() (b1, b2, b3 float64) {
+	return s.D1, s.D2, s.D3
+}
+
+// Covariance returns a copy of the covariance of the error state: the attitude error as an earth-frame
+// rotation vector, Rad, the gyro bias errors, °/s, and the velocity errors, kt.
+func (s *EKFState) Covariance() *Matrix {
+	c := NewMatrix(ekfN, ekfN)
+	for i := 0; i < ekfN; i++ {
+		for j := 0; j < ekfN; j++ {
+			c.Set(i, j, s.p[i][j])
+		}
+	}
+	return c
+}
+
+// Valid returns whether the current state is a valid estimate: the filter has been initialized,
+// its outputs and covariance are finite and its roll and pitch are known to within ekfMaxTilt.
+func (s *EKFState) Valid() (ok bool) {
+	if !s.State.Valid() {
+		return false
+	}
+	for i := 0; i < ekfN; i++ {
+		if v := s.p[i][i]; !(v >= 0) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	droll, dpitch, _ := s.RollPitchHeadingUncertainty()
+	return droll < DegToRad(ekfMaxTilt) && dpitch < DegToRad(ekfMaxTilt)
+}
+
+// PredictMeasurement returns the measurement that the current state implies:
+// gyro rates from the latest change in attitude plus the gyro biases, accelerometer from gravity
+// plus the centripetal acceleration of turning at the current rate and velocity, and GPS velocity from the
+// velocity state, valid while the GPS is in use.  Airspeed and the magnetometer aren't modeled.
+func (s *EKFState) PredictMeasurement() (m *Measurement) {
+	m = NewMeasurement()
+	m.T = s.T
+	if s.needsInitialization {
+		return
+	}
+
+	b1, b2, b3 := QuaternionRates(s.eOld0, s.eOld1, s.eOld2, s.eOld3, s.E0, s.E1, s.E2, s.E3, s.dtLast)
+	m.B1, m.B2, m.B3 = s.rotateByF(b1, b2, b3, true)
+	m.B1 += s.D1
+	m.B2 += s.D2
+	m.B3 += s.D3
+
+	f1, f2, f3 := s.specificForce()
+	a1, a2, a3 := s.rotateByE(f1, f2, f3, true)
+	m.A1, m.A2, m.A3 = s.rotateByF(a1*s.aNorm, a2*s.aNorm, a3*s.aNorm, true)
+	m.SValid = true
+
+	if s.vValid {
+		m.W1, m.W2, m.W3 = s.v1, s.v2, s.v3
+		m.TW = s.T
+		m.WValid = true
+	}
+	return
+}
+
+// SetDeadReckonOnly sets whether the GPS is ignored entirely, for bench testing or aircraft without a GPS.
+// In this mode the W fields of the measurement are never read and heading and rate of turn are reported as invalid.
+func (s *EKFState) SetDeadReckonOnly(deadReckonOnly bool) {
+	s.deadReckonOnly = deadReckonOnly
+}
+
+// gpsValid returns whether the GPS part of m is to be used.
+func (s *EKFState) gpsValid(m *Measurement) bool {
+	return m.WValid && !s.deadReckonOnly
+}
+
+// SetMinGS sets the smoothed groundspeed, in Kts, below which the GPS track isn't used for the heading.
+func (s *EKFState) SetMinGS(minGS float64) {
+	s.minGS = minGS
+}
+
+// SetMaxDT sets the interval, in seconds, between measurements above which the algorithm re-initializes.
+func (s *EKFState) SetMaxDT(maxDT float64) {
+	s.maxDT = maxDT
+}
+
+// Describe returns "ekf", or "ukf" for a UKFState, with the current minGS, maxDT and noise settings.
+func (s *EKFState) Describe() ProviderInfo {
+	name := "ekf"
+	if s.ukf != nil {
+		name = "ukf"
+	}
+	return ProviderInfo{Name: name, Params: map[string]float64{
+		"minGS":         s.minGS,
+		"maxDT":         s.maxDT,
+		"gyroNoise":     RadToDeg(math.Sqrt(s.N.Get(0, 0))),
+		"gyroBiasNoise": math.Sqrt(s.N.Get(3, 3)),
+		"accelNoise":    math.Sqrt(s.N.Get(6, 6)),
+		"gpsNoise":      s.gpsNoise,
+		"trackNoise":    RadToDeg(s.trackNoise),
+		"gravityNoise":  s.gravityNoise,
+		"magNoise":      RadToDeg(s.magNoise),
+	}}
+}
+
+// SetConfig lets the user alter the noise settings: gyroNoise (°/√s), gyroBiasNoise (°/s/√s),
+// accelNoise (kt/√s), gpsNoise (kt), trackNoise (°), gravityNoise (G) and magNoise (°).
+// Missing or non-positive values are left unchanged.
+func (s *EKFState) SetConfig(configMap map[string]float64) {
+	get := func(k string, v float64) float64 {
+		if c, ok := configMap[k]; ok && c > 0 {
+			return c
+		}
+		return v
+	}
+	s.setProcessNoise(
+		get("gyroNoise", RadToDeg(math.Sqrt(s.N.Get(0, 0)))),
+		get("gyroBiasNoise", math.Sqrt(s.N.Get(3, 3))),
+		get("accelNoise", math.Sqrt(s.N.Get(6, 6))),
+	)
+	s.gpsNoise = get("gpsNoise", s.gpsNoise)
+	s.trackNoise = DegToRad(get("trackNoise", RadToDeg(s.trackNoise)))
+	s.gravityNoise = get("gravityNoise", s.gravityNoise)
+	s.magNoise = DegToRad(get("magNoise", RadToDeg(s.magNoise)))
+}
+
+// GetLogMap returns a map providing current state and measurement values for analysis.
+// It is only kept up to date by Compute from the first call to GetLogMap on.
+func (s *EKFState) GetLogMap() (p map[string]interface{}) {
+	s.logMapUsed = true
+	return s.logMap
+}
+
+func (s *EKFState) updateLogMap(m *Measurement, p map[string]interface{}) {
+	s.State.updateLogMap(m, p)
+	droll, dpitch, dheading := s.CalcRollPitchHeadingUncertainty()
+	p["RollSigma"] = droll
+	p["PitchSigma"] = dpitch
+	p["HeadingSigma"] = dheading
+	p["GroundSpeed"] = s.gs
+	p["SmoothGroundSpeed"] = s.smoothGS
+	p["V1"] = s.v1
+	p["V2"] = s.v2
+	p["V3"] = s.v3
+	p["MagRef"] = RadToDeg(s.magRef)
+	for k, v := range map[string]bool{"staticMode": s.staticMode, "headingValid": s.headingValid,
+		"velocityValid": s.vValid, "magRefValid": s.magRefValid, "deadReckonOnly": s.deadReckonOnly} {
+		p[k] = 0.0
+		if v {
+			p[k] = 1.0
+		}
+	}
+}
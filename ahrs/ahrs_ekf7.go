@@ -0,0 +1,478 @@
+/*
+The EKF7 AHRS algorithm is a compact extended Kalman filter for IMU and magnetometer setups without a GPS.
+Unlike the EKF, which tracks the errors in its state, it estimates its seven state variables directly:
+the attitude quaternion E and the gyro biases D, °/s, sensor frame, with their full 7x7 covariance.
+
+The gyro rates, less the biases, turn the quaternion; the covariance grows with the gyro noise and with the
+bias uncertainty carried into the attitude.  The accelerometer, taken to read gravity alone while it reads
+close to 1 G, and the magnetometer, whose field is referenced to magnetic north when the filter starts,
+are then each compared one component at a time with the directions that the quaternion predicts for them.
+Their differences correct the attitude and, through the correlations built up as the gyro integrates,
+the biases: the accelerometer observes those about the horizontal axes and the magnetometer the one about
+the vertical.  Without a magnetometer the heading follows the gyro alone and is reported as invalid.
+*/
+package ahrs
+
+import (
+	"log"
+	"math"
+)
+
+const ekf7N = 7 // Size of the state: attitude quaternion, gyro biases
+
+type ekf7Matrix [ekf7N][ekf7N]float64
+
+// EKF7State is an AHRSProvider using a 7-state extended Kalman filter.
+// Its covariance M, in the order of the state, is updated after each Compute.
+type EKF7State struct {
+	State
+	p            ekf7Matrix // Covariance of the state
+	by, bz       float64    // Reference direction of the earth's magnetic field: north and up components
+	magValid     bool       // Whether the heading has been referenced to the magnetometer
+	gyroNoise    float64    // Gyro angle random walk, Rad/√s
+	biasNoise    float64    // Gyro bias random walk, °/s/√s
+	gravityNoise float64    // Accelerometer noise as a gravity reference, G
+	magNoise     float64    // Magnetometer direction noise, Rad
+	maxDT        float64    // Above this time interval, s, re-initialize--too stale
+	logMapUsed   bool       // Whether GetLogMap has been called, so logMap must be kept current
+}
+
+// NewEKF7AHRS returns a new EKF7 AHRS object.
+func NewEKF7AHRS() (s *EKF7State) {
+	s = new(EKF7State)
+	s.needsInitialization = true
+	s.aNorm = 1
+	s.E0 = 1
+	s.F0 = 1 // Initial guess is that it's oriented pointing forward and level
+	s.maxDT = maxDTDefault
+	s.gyroNoise = DegToRad(ekfGyroNoiseDefault)
+	s.biasNoise = ekfGyroBiasNoiseDefault
+	s.gravityNoise = ekfGravityNoiseDefault
+	s.magNoise = DegToRad(ekfMagNoiseDefault)
+	s.calcRotationMatrices()
+	s.M = NewMatrix(ekf7N, ekf7N)
+	s.logMap = make(map[string]interface{})
+	s.updateLogMap(&noMeasurement, s.logMap)
+	return
+}
+
+func (s *EKF7State) init(m *Measurement) {
+	s.State.init(m)
+
+	// Start from the accelerometer's gravity vector and, if there is one, the magnetometer.
+	s.roll, s.pitch = s.CalcAccelAttitude(m)
+	s.heading = 0
+	s.E0, s.E1, s.E2, s.E3 = ToQuaternion(s.roll, s.pitch, s.heading)
+	s.calcRotationMatrices()
+	s.p = ekf7Matrix{}
+	for i := 4; i < ekf7N; i++ {
+		s.p[i][i] = ekfInitBias * ekfInitBias
+	}
+	s.magValid = false
+	s.resetAttitude(DegToRad(ekfInitHeading))
+	if m1, m2, m3, ok := s.magnetometer(m); ok {
+		s.referenceMag(m1, m2, m3)
+	}
+
+	if s.logMapUsed {
+		s.updateLogMap(m, s.logMap)
+	}
+}
+
+// Compute performs the EKF7 AHRS computations.
+func (s *EKF7State) Compute(m *Measurement) {
+	m = m.inKnots(&s.mKnots)
+	if !m.plausible() || !m.SValid {
+		return // Ignore corrupt readings rather than let them poison the state
+	}
+	if s.needsInitialization {
+		s.init(m)
+		return
+	}
+	dt := m.T - s.T
+	if dt > s.maxDT || dt < 0 {
+		log.Printf("AHRS Info: Reinitializing at %f\n", m.T)
+		s.init(m)
+		return
+	}
+	if dt < minDT {
+		return
+	}
+
+	s.predict(m, dt)
+
+	// Gravity, trusted only when the accelerometer reads close to 1 G and didn't clip
+	a1, a2, a3 := s.rotateByF(m.A1, m.A2, m.A3, false)
+	a1, a2, a3 = a1/s.aNorm, a2/s.aNorm, a3/s.aNorm
+	clipped := s.checkAccelClip(m)
+	aa := math.Sqrt(a1*a1 + a2*a2 + a3*a3)
+	if wAcc := 1 - math.Abs(aa-1)/accelGTolerance; wAcc > 0 && !clipped {
+		s.observe([3]float64{a1 / aa, a2 / aa, a3 / aa}, [3]float64{0, 0, 1}, s.gravityNoise*s.gravityNoise/wAcc)
+	}
+
+	// The magnetic field, referenced to north the first time it is seen; a disturbed magnetometer is down-weighted.
+	m1, m2, m3, magOK := s.magnetometer(m)
+	rel := s.checkMag(s.H1, s.H2, s.H3, m1, m2, m3, dt, magOK)
+	if magOK && !s.magValid {
+		s.referenceMag(m1, m2, m3)
+	} else if magOK && rel > Small {
+		mm := math.Sqrt(m1*m1 + m2*m2 + m3*m3)
+		s.observe([3]float64{m1 / mm, m2 / mm, m3 / mm}, [3]float64{0, s.by, s.bz}, s.magNoise*s.magNoise/rel)
+	}
+	s.renormalize()
+
+	// Update the outputs from the new attitude
+	s.roll, s.pitch, s.heading = FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+	if magOK {
+		s.headingMag = s.heading
+	}
+	s.slipSkid += slowSmoothConst * (math.Atan2(-a2, a3) - s.slipSkid)
+	_, _, h3 := s.RotateBodyToEarth(DegToRad(s.H1), DegToRad(s.H2), DegToRad(s.H3))
+	s.turnRate += slowSmoothConst * (-h3 - s.turnRate) // Positive to the right
+	s.gLoad += slowSmoothConst * (a3 - s.gLoad)
+
+	if s.logMapUsed {
+		s.updateLogMap(m, s.logMap)
+	}
+
+	s.T = m.T
+}
+
+// xi returns the matrix Ξ(E) for which the quaternion product E*(0, w) is Ξ w, so that a small rotation w,
+// Rad, aircraft frame, changes E by Ξ w / 2.
+func (s *EKF7State) xi() [4][3]float64 {
+	q0, q1, q2, q3 := s.E0, s.E1, s.E2, s.E3
+	return [4][3]float64{{-q1, -q2, -q3}, {q0, -q3, q2}, {q3, q0, -q1}, {-q2, q1, q0}}
+}
+
+// predict propagates the state and its covariance over the interval dt using the gyro.
+func (s *EKF7State) predict(m *Measurement, dt float64) {
+	s.H1, s.H2, s.H3 = s.rotateByF(m.B1-s.D1, m.B2-s.D2, m.B3-s.D3, false)
+	w1, w2, w3 := DegToRad(s.H1), DegToRad(s.H2), DegToRad(s.H3)
+	xi := s.xi()
+
+	// Transition matrix, to first order in dt: dE/dt = E*(0, w)/2, and w falls as the biases rise.
+	var f ekf7Matrix
+	omega := [4][4]float64{{0, -w1, -w2, -w3}, {w1, 0, w3, -w2}, {w2, -w3, 0, w1}, {w3, w2, -w1, 0}}
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			f[i][j] = omega[i][j] * dt / 2
+		}
+		f[i][i]++
+	}
+	for j := 0; j < 3; j++ {
+		var d [3]float64
+		d[j] = 1
+		c1, c2, c3 := s.rotateByF(d[0], d[1], d[2], false)
+		for i := 0; i < 4; i++ {
+			f[i][4+j] = -DegToRad(xi[i][0]*c1+xi[i][1]*c2+xi[i][2]*c3) * dt / 2
+		}
+	}
+	for i := 4; i < ekf7N; i++ {
+		f[i][i] = 1
+	}
+
+	var t ekf7Matrix
+	for i := 0; i < ekf7N; i++ {
+		for j := 0; j < ekf7N; j++ {
+			for k := 0; k < ekf7N; k++ {
+				t[i][j] += f[i][k] * s.p[k][j]
+			}
+		}
+	}
+	for i := 0; i < ekf7N; i++ {
+		for j := 0; j < ekf7N; j++ {
+			var v float64
+			for k := 0; k < ekf7N; k++ {
+				v += t[i][k] * f[j][k]
+			}
+			s.p[i][j] = v
+		}
+	}
+	// Process noise: the gyro noise turns E through Ξ, and the biases wander.
+	q := s.gyroNoise * s.gyroNoise * dt / 4
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			s.p[i][j] += q * (xi[i][0]*xi[j][0] + xi[i][1]*xi[j][1] + xi[i][2]*xi[j][2])
+		}
+	}
+	for i := 4; i < ekf7N; i++ {
+		s.p[i][i] += s.biasNoise * s.biasNoise * dt
+	}
+
+	s.E0, s.E1, s.E2, s.E3 = QuaternionRotate(s.E0, s.E1, s.E2, s.E3, w1*dt, w2*dt, w3*dt)
+	s.calcRotationMatrices()
+}
+
+// predictDirection returns the direction v, earth frame, as the aircraft would see it with attitude E,
+// and its Jacobian with respect to E.  It is E'vE written so as to be homogeneous in E.
+func (s *EKF7State) predictDirection(v [3]float64) (p [3]float64, h [3][4]float64) {
+	q0, q1, q2, q3 := s.E0, s.E1, s.E2, s.E3
+	v1, v2, v3 := v[0], v[1], v[2]
+	p[0] = v1*(q0*q0+q1*q1-q2*q2-q3*q3) + 2*v2*(q1*q2+q0*q3) + 2*v3*(q1*q3-q0*q2)
+	p[1] = 2*v1*(q1*q2-q0*q3) + v2*(q0*q0-q1*q1+q2*q2-q3*q3) + 2*v3*(q2*q3+q0*q1)
+	p[2] = 2*v1*(q1*q3+q0*q2) + 2*v2*(q2*q3-q0*q1) + v3*(q0*q0-q1*q1-q2*q2+q3*q3)
+	h[0] = [4]float64{v1*q0 + v2*q3 - v3*q2, v1*q1 + v2*q2 + v3*q3, -v1*q2 + v2*q1 - v3*q0, -v1*q3 + v2*q0 + v3*q1}
+	h[1] = [4]float64{-v1*q3 + v2*q0 + v3*q1, v1*q2 - v2*q1 + v3*q0, v1*q1 + v2*q2 + v3*q3, -v1*q0 - v2*q3 + v3*q2}
+	h[2] = [4]float64{v1*q2 - v2*q1 + v3*q0, v1*q3 - v2*q0 - v3*q1, v1*q0 + v2*q3 - v3*q2, v1*q1 + v2*q2 + v3*q3}
+	for i := range h {
+		for j := range h[i] {
+			h[i][j] *= 2
+		}
+	}
+	return
+}
+
+// observe corrects the state with the measured direction z, aircraft frame, of the unit vector v, earth frame,
+// each of whose components has variance r.  The components are taken one at a time.
+func (s *EKF7State) observe(z, v [3]float64, r float64) {
+	for i := range z {
+		p, h := s.predictDirection(v)
+		var hh [ekf7N]float64
+		copy(hh[:4], h[i][:])
+		s.update(z[i]-p[i], &hh, r)
+	}
+}
+
+// update applies a scalar measurement with innovation y, Jacobian h and variance r to the state,
+// updating the covariance in the Joseph form (I-kh')P(I-kh')' + krk', which keeps it symmetric and positive.
+func (s *EKF7State) update(y float64, h *[ekf7N]float64, r float64) {
+	var ph [ekf7N]float64 // P*h'
+	ss := r
+	for i := 0; i < ekf7N; i++ {
+		for j := 0; j < ekf7N; j++ {
+			ph[i] += s.p[i][j] * h[j]
+		}
+		ss += h[i] * ph[i]
+	}
+	var k [ekf7N]float64
+	for i := range k {
+		k[i] = ph[i] / ss
+	}
+	s.E0 += k[0] * y
+	s.E1 += k[1] * y
+	s.E2 += k[2] * y
+	s.E3 += k[3] * y
+	s.D1 += k[4] * y
+	s.D2 += k[5] * y
+	s.D3 += k[6] * y
+
+	// (I-kh')P(I-kh')' + krk' = P - k(Ph')' - (Ph')k' + (h'Ph+r)kk'
+	for i := 0; i < ekf7N; i++ {
+		for j := 0; j < ekf7N; j++ {
+			s.p[i][j] += -k[i]*ph[j] - ph[i]*k[j] + ss*k[i]*k[j]
+		}
+	}
+}
+
+// renormalize brings E back to unit length and projects its covariance onto the unit sphere to match,
+// so that no uncertainty remains along E itself.
+func (s *EKF7State) renormalize() {
+	n := math.Sqrt(s.E0*s.E0 + s.E1*s.E1 + s.E2*s.E2 + s.E3*s.E3)
+	s.E0, s.E1, s.E2, s.E3 = s.E0/n, s.E1/n, s.E2/n, s.E3/n
+	q := [4]float64{s.E0, s.E1, s.E2, s.E3}
+	var j ekf7Matrix // (I - qq')/n for the quaternion, I for the biases
+	for a := 0; a < 4; a++ {
+		for b := 0; b < 4; b++ {
+			j[a][b] = -q[a] * q[b] / n
+		}
+		j[a][a] += 1 / n
+	}
+	for a := 4; a < ekf7N; a++ {
+		j[a][a] = 1
+	}
+	var t ekf7Matrix
+	for a := 0; a < ekf7N; a++ {
+		for b := 0; b < ekf7N; b++ {
+			for c := 0; c < ekf7N; c++ {
+				t[a][b] += j[a][c] * s.p[c][b]
+			}
+		}
+	}
+	for a := 0; a < ekf7N; a++ {
+		for b := 0; b < ekf7N; b++ {
+			var v float64
+			for c := 0; c < ekf7N; c++ {
+				v += t[a][c] * j[b][c]
+			}
+			s.p[a][b] = v
+		}
+	}
+	s.calcRotationMatrices()
+	s.syncCovariance()
+}
+
+// resetAttitude sets the covariance of E from the initial tilt uncertainty and the heading uncertainty
+// sigmaHeading, Rad, forgetting its correlations with the biases.
+func (s *EKF7State) resetAttitude(sigmaHeading float64) {
+	xi := s.xi()
+	v := [3]float64{DegToRad(ekfInitTilt), DegToRad(ekfInitTilt), sigmaHeading}
+	for i := 0; i < 4; i++ {
+		for j := 0; j < ekf7N; j++ {
+			s.p[i][j], s.p[j][i] = 0, 0
+		}
+	}
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			for k := 0; k < 3; k++ {
+				s.p[i][j] += xi[i][k] * v[k] * v[k] * xi[j][k] / 4
+			}
+		}
+	}
+	s.syncCovariance()
+}
+
+// referenceMag turns the heading so that the magnetometer reading m, aircraft frame, points to magnetic north
+// and takes its direction as the reference field.
+func (s *EKF7State) referenceMag(m1, m2, m3 float64) {
+	h1, h2, h3 := s.RotateBodyToEarth(m1, m2, m3)
+	roll, pitch, heading := FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+	_, _, heading = Regularize(0, 0, heading-math.Atan2(h1, h2))
+	s.E0, s.E1, s.E2, s.E3 = ToQuaternion(roll, pitch, heading)
+	s.calcRotationMatrices()
+	hh := math.Sqrt(h1*h1 + h2*h2 + h3*h3)
+	s.by, s.bz = math.Hypot(h1, h2)/hh, h3/hh
+	s.headingMag = heading
+	s.magValid = true
+	s.resetAttitude(s.magNoise)
+}
+
+func (s *EKF7State) syncCovariance() {
+	for i := 0; i < ekf7N; i++ {
+		for j := 0; j < i; j++ {
+			v := (s.p[i][j] + s.p[j][i]) / 2
+			s.p[i][j], s.p[j][i] = v, v
+		}
+	}
+	for i := 0; i < ekf7N; i++ {
+		for j := 0; j < ekf7N; j++ {
+			s.M.Set(i, j, s.p[i][j])
+		}
+	}
+}
+
+// RollPitchHeading returns the current attitude values, in radians.
+// The heading is invalid until the magnetometer has given it.
+func (s *EKF7State) RollPitchHeading() (roll float64, pitch float64, heading float64) {
+	roll, pitch, heading = s.State.RollPitchHeading()
+	if !s.magValid {
+		heading = Invalid
+	}
+	return
+}
+
+// MagHeading returns the tilt-compensated magnetic heading in degrees, Invalid without a magnetometer.
+func (s *EKF7State) MagHeading() (hdg float64) {
+	if !s.magValid {
+		return Invalid
+	}
+	return s.State.MagHeading()
+}
+
+// RollPitchHeadingUncertainty returns the standard deviations of the attitude values, in radians,
+// from the covariance of E.
+func (s *EKF7State) RollPitchHeadingUncertainty() (droll float64, dpitch float64, dheading float64) {
+	// Jacobian of roll, pitch and heading with respect to E, by central differences
+	const d = 1e-6
+	var j [3][4]float64
+	for k := 0; k < 4; k++ {
+		q := [4]float64{s.E0, s.E1, s.E2, s.E3}
+		q[k] += d
+		rp, pp, hp := FromQuaternion(q[0], q[1], q[2], q[3])
+		q[k] -= 2 * d
+		rm, pm, hm := FromQuaternion(q[0], q[1], q[2], q[3])
+		j[0][k] = AngleDiff(rp, rm) / (2 * d)
+		j[1][k] = (pp - pm) / (2 * d)
+		j[2][k] = AngleDiff(hp, hm) / (2 * d)
+	}
+	var v [3]float64
+	for i := 0; i < 3; i++ {
+		for k := 0; k < 4; k++ {
+			for l := 0; l < 4; l++ {
+				v[i] += j[i][k] * s.p[k][l] * j[i][l]
+			}
+		}
+	}
+	return math.Sqrt(v[0]), math.Sqrt(v[1]), math.Sqrt(v[2])
+}
+
+// CalcRollPitchHeadingUncertainty returns the standard deviations of the attitude values, in degrees.
+func (s *EKF7State) CalcRollPitchHeadingUncertainty() (droll float64, dpitch float64, dheading float64) {
+	droll, dpitch, dheading = s.RollPitchHeadingUncertainty()
+	return RadToDeg(droll), RadToDeg(dpitch), RadToDeg(dheading)
+}
+
+// CalcGyroBias returns the estimated gyro biases, °/s, sensor frame.
+func (s *EKF7State) CalcGyroBias() (b1, b2, b3 float64) {
+	return s.D1, s.D2, s.D3
+}
+
+// Covariance returns a copy of the 7x7 covariance of the state: the quaternion E, then the gyro biases, °/s.
+func (s *EKF7State) Covariance() *Matrix {
+	return s.M.Copy()
+}
+
+// Valid returns whether the current state is a valid estimate: the filter has been initialized,
+// its outputs and covariance are finite and its roll and pitch are known to within ekfMaxTilt.
+func (s *EKF7State) Valid() (ok bool) {
+	if !s.State.Valid() {
+		return false
+	}
+	for i := 0; i < ekf7N; i++ {
+		if v := s.p[i][i]; !(v >= 0) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	droll, dpitch, _ := s.RollPitchHeadingUncertainty()
+	return droll < DegToRad(ekfMaxTilt) && dpitch < DegToRad(ekfMaxTilt)
+}
+
+// SetMaxDT sets the interval, in seconds, between measurements above which the algorithm re-initializes.
+func (s *EKF7State) SetMaxDT(maxDT float64) {
+	s.maxDT = maxDT
+}
+
+// Describe returns "ekf7" with the current maxDT and noise settings.
+func (s *EKF7State) Describe() ProviderInfo {
+	return ProviderInfo{Name: "ekf7", Params: map[string]float64{
+		"maxDT":         s.maxDT,
+		"gyroNoise":     RadToDeg(s.gyroNoise),
+		"gyroBiasNoise": s.biasNoise,
+		"gravityNoise":  s.gravityNoise,
+		"magNoise":      RadToDeg(s.magNoise),
+	}}
+}
+
+// SetConfig lets the user alter the noise settings: gyroNoise (°/√s), gyroBiasNoise (°/s/√s),
+// gravityNoise (G) and magNoise (°).  Missing or non-positive values are left unchanged.
+func (s *EKF7State) SetConfig(configMap map[string]float64) {
+	get := func(k string, v float64) float64 {
+		if c, ok := configMap[k]; ok && c > 0 {
+			return c
+		}
+		return v
+	}
+	s.gyroNoise = DegToRad(get("gyroNoise", RadToDeg(s.gyroNoise)))
+	s.biasNoise = get("gyroBiasNoise", s.biasNoise)
+	s.gravityNoise = get("gravityNoise", s.gravityNoise)
+	s.magNoise = DegToRad(get("magNoise", RadToDeg(s.magNoise)))
+}
+
+// GetLogMap returns a map providing current state and measurement values for analysis.
+// It is only kept up to date by Compute from the first call to GetLogMap on.
+func (s *EKF7State) GetLogMap() (p map[string]interface{}) {
+	s.logMapUsed = true
+	return s.logMap
+}
+
+func (s *EKF7State) updateLogMap(m *Measurement, p map[string]interface{}) {
+	s.State.updateLogMap(m, p)
+	droll, dpitch, dheading := s.CalcRollPitchHeadingUncertainty()
+	p["RollSigma"] = droll
+	p["PitchSigma"] = dpitch
+	p["HeadingSigma"] = dheading
+	p["magValid"] = 0.0
+	if s.magValid {
+		p["magValid"] = 1.0
+	}
+}
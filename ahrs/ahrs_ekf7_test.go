@@ -0,0 +1,126 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+// staticPath holds the attitude roll, pitch and heading (rad) without moving.
+func staticPath(roll, pitch, heading float64) flightPath {
+	return func(t float64) (float64, float64, float64, float64, float64, float64) {
+		return roll, pitch, heading, 0, 0, 0
+	}
+}
+
+func TestEKF7PredictDirection(t *testing.T) {
+	path := staticPath(20*Deg, 10*Deg, 30*Deg)
+	m := withMagnetometer(simMeasurements(path, 0, 0, 0.02), path)[0]
+	s := NewEKF7AHRS()
+	s.E0, s.E1, s.E2, s.E3 = ToQuaternion(20*Deg, 10*Deg, 30*Deg)
+	mm := math.Sqrt(20*20 + 45*45)
+
+	for _, c := range []struct {
+		name string
+		v, z [3]float64
+	}{
+		{"gravity", [3]float64{0, 0, 1}, [3]float64{m.A1, m.A2, m.A3}},
+		{"magnetic field", [3]float64{0, 20 / mm, -45 / mm}, [3]float64{m.M1 / mm, m.M2 / mm, m.M3 / mm}},
+	} {
+		p, h := s.predictDirection(c.v)
+		for i := range p {
+			if math.Abs(p[i]-c.z[i]) > 1e-9 {
+				t.Errorf("%s component %d predicted %f, measured %f", c.name, i, p[i], c.z[i])
+			}
+		}
+		// The Jacobian matches central differences.
+		const d = 1e-6
+		for j := 0; j < 4; j++ {
+			e := []*float64{&s.E0, &s.E1, &s.E2, &s.E3}
+			*e[j] += d
+			pp, _ := s.predictDirection(c.v)
+			*e[j] -= 2 * d
+			pm, _ := s.predictDirection(c.v)
+			*e[j] += d
+			for i := range p {
+				if n := (pp[i] - pm[i]) / (2 * d); math.Abs(n-h[i][j]) > 1e-6 {
+					t.Errorf("%s Jacobian [%d][%d] is %f, numerically %f", c.name, i, j, h[i][j], n)
+				}
+			}
+		}
+	}
+}
+
+func TestEKF7GyroBias(t *testing.T) {
+	path := staticPath(10*Deg, 5*Deg, 30*Deg)
+	ms := withMagnetometer(withSensorErrors(simMeasurements(path, 0, 300, 0.02)), path)
+	s := NewEKF7AHRS()
+	for _, m := range ms {
+		s.Compute(m)
+	}
+
+	b1, b2, b3 := s.CalcGyroBias()
+	t.Logf("Estimated gyro bias %.3f, %.3f, %.3f °/s, injected %v", b1, b2, b3, gyroBias)
+	for i, b := range [3]float64{b1, b2, b3} {
+		if math.Abs(b-gyroBias[i]) > 0.05 {
+			t.Errorf("gyro bias %d estimated as %f °/s, expected %f", i+1, b, gyroBias[i])
+		}
+	}
+	roll, pitch, heading := s.CalcRollPitchHeading()
+	for _, c := range [][2]float64{{roll, 10}, {pitch, 5}, {heading, 30}} {
+		if e := angleErr(c[0], c[1]); e > 1 {
+			t.Errorf("attitude off by %f° with an estimated bias", e)
+		}
+	}
+	if !s.Valid() {
+		t.Error("not valid after a static run")
+	}
+}
+
+func TestEKF7CovarianceShrinks(t *testing.T) {
+	path := staticPath(10*Deg, 5*Deg, 30*Deg)
+	ms := withMagnetometer(simMeasurements(path, 0, 120, 0.02), path)
+	s := NewEKF7AHRS()
+	s.Compute(ms[0])
+	p0 := s.Covariance()
+
+	// Every ten seconds of consistent measurements leave the state less uncertain than before.
+	last := math.Inf(1)
+	for i, m := range ms[1:] {
+		s.Compute(m)
+		if (i+1)%500 != 0 {
+			continue
+		}
+		if tr := s.CalcCovarianceTrace(); !(tr < last) {
+			t.Errorf("covariance trace grew to %g at %.0f s, from %g", tr, m.T, last)
+		} else {
+			last = tr
+		}
+	}
+
+	p := s.Covariance()
+	if r, c := p.GetSize(); r != 7 || c != 7 {
+		t.Fatalf("expected a 7x7 covariance, got %dx%d", r, c)
+	}
+	for i := 4; i < 7; i++ {
+		if v, v0 := p.Get(i, i), p0.Get(i, i); v > v0/100 {
+			t.Errorf("gyro bias %d variance only fell from %g to %g", i-3, v0, v)
+		}
+	}
+	for i := 0; i < 7; i++ {
+		if p.Get(i, i) < 0 {
+			t.Errorf("negative variance %g for state %d", p.Get(i, i), i)
+		}
+		for j := 0; j < i; j++ {
+			if p.Get(i, j) != p.Get(j, i) {
+				t.Errorf("covariance isn't symmetric at %d, %d", i, j)
+			}
+		}
+	}
+	droll, dpitch, dheading := s.CalcRollPitchHeadingUncertainty()
+	t.Logf("Uncertainty after 2 minutes: roll %.3f°, pitch %.3f°, heading %.3f°", droll, dpitch, dheading)
+	if droll > 0.5 || dpitch > 0.5 || dheading > 1 {
+		t.Errorf("attitude still uncertain by %f°, %f°, %f°", droll, dpitch, dheading)
+	}
+}
+
+var _ AHRSProvider = (*EKF7State)(nil)
@@ -0,0 +1,270 @@
+package ahrs
+
+import (
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// gyroBias is the bias added to the gyro by withSensorErrors, °/s.
+var gyroBias = [3]float64{0.5, -0.3, 0.4}
+
+// withSensorErrors adds gyroBias and white noise to the gyro and accelerometer readings in ms.
+func withSensorErrors(ms []*Measurement) []*Measurement {
+	rng := rand.New(rand.NewSource(1))
+	for _, m := range ms {
+		m.B1 += gyroBias[0] + 0.1*rng.NormFloat64()
+		m.B2 += gyroBias[1] + 0.1*rng.NormFloat64()
+		m.B3 += gyroBias[2] + 0.1*rng.NormFloat64()
+		m.A1 += 0.02 * rng.NormFloat64()
+		m.A2 += 0.02 * rng.NormFloat64()
+		m.A3 += 0.02 * rng.NormFloat64()
+	}
+	return ms
+}
+
+// outageErrors returns the RMS roll and pitch errors in degrees of p while the GPS is out in sc,
+// and its RMS roll, pitch and heading errors otherwise, after the first 5 s.
+func outageErrors(sc scenario, p fuzzable, ms []*Measurement) (outage [2]float64, gps [3]float64) {
+	var nOutage, nGPS float64
+	for _, m := range ms {
+		p.Compute(m)
+		if m.T < 5 {
+			continue
+		}
+		roll, pitch, heading := p.GetState().CalcRollPitchHeading()
+		r, pp, h, _, _, _ := sc.path(m.T)
+		if sc.inOutage(m.T) {
+			outage[0] += math.Pow(angleErr(roll, r/Deg), 2)
+			outage[1] += math.Pow(angleErr(pitch, pp/Deg), 2)
+			nOutage++
+			continue
+		}
+		gps[0] += math.Pow(angleErr(roll, r/Deg), 2)
+		gps[1] += math.Pow(angleErr(pitch, pp/Deg), 2)
+		gps[2] += math.Pow(angleErr(heading, h/Deg), 2)
+		nGPS++
+	}
+	for i := range outage {
+		outage[i] = math.Sqrt(outage[i] / nOutage)
+	}
+	for i := range gps {
+		gps[i] = math.Sqrt(gps[i] / nGPS)
+	}
+	return
+}
+
+func TestEKFNominal(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+	simple := func(*Measurement) attitudeFilter { return NewSimpleAHRS() }
+	ekf := func(*Measurement) attitudeFilter { return NewEKFAHRS() }
+	for _, sc := range scenarios {
+		es, ee := runScenario(sc, 50, 5, simple), runScenario(sc, 50, 5, ekf)
+		t.Logf("%s: Simple roll %.2f°, pitch %.2f°, heading %.2f°; EKF roll %.2f°, pitch %.2f°, heading %.2f°",
+			sc.name, es.roll, es.pitch, es.heading, ee.roll, ee.pitch, ee.heading)
+		if ee.roll > es.roll+0.01 || ee.pitch > es.pitch+0.01 || ee.heading > es.heading+0.01 {
+			t.Errorf("%s: EKF is less accurate than Simple", sc.name)
+		}
+	}
+}
+
+func TestEKFGyroBias(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+	sc := scenarios[2]
+	if sc.outage[1] == 0 {
+		t.Fatal("expected the third scenario to have a GPS outage")
+	}
+
+	simple := NewSimpleAHRS()
+	so, sg := outageErrors(sc, simple, withSensorErrors(sc.measurements(50)))
+	ekf := NewEKFAHRS()
+	eo, eg := outageErrors(sc, ekf, withSensorErrors(sc.measurements(50)))
+	t.Logf("Simple: roll %.2f°, pitch %.2f°, heading %.2f° with GPS; roll %.2f°, pitch %.2f° without",
+		sg[0], sg[1], sg[2], so[0], so[1])
+	t.Logf("EKF:    roll %.2f°, pitch %.2f°, heading %.2f° with GPS; roll %.2f°, pitch %.2f° without",
+		eg[0], eg[1], eg[2], eo[0], eo[1])
+
+	for i, name := range []string{"roll", "pitch", "heading"} {
+		if eg[i] > sg[i] {
+			t.Errorf("EKF %s error %.2f° with GPS is worse than Simple's %.2f°", name, eg[i], sg[i])
+		}
+	}
+	if eo[0] > 1 || eo[1] > 1 || eo[0] > so[0]/4 {
+		t.Errorf("expected the EKF to hold roll and pitch within 1° through the GPS outage, got %.2f° and %.2f°",
+			eo[0], eo[1])
+	}
+	for i, d := range [3]float64{ekf.D1, ekf.D2, ekf.D3} {
+		if math.Abs(d-gyroBias[i]) > 0.1 {
+			t.Errorf("gyro bias %d estimated as %f°/s, actually %f°/s", i+1, d, gyroBias[i])
+		}
+	}
+}
+
+func TestEKFUncertainty(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+	s := NewEKFAHRS()
+	if s.Valid() {
+		t.Error("an uninitialized EKFState shouldn't be valid")
+	}
+
+	sc := scenarios[2]
+	var before, during [3]float64
+	for _, m := range withSensorErrors(sc.measurements(50)) {
+		s.Compute(m)
+		if !s.Valid() {
+			t.Fatalf("EKFState became invalid at %.2f s", m.T)
+		}
+		switch m.T {
+		case sc.outage[0] - 1:
+			before[0], before[1], before[2] = s.CalcRollPitchHeadingUncertainty()
+		case sc.outage[1] - 1:
+			during[0], during[1], during[2] = s.CalcRollPitchHeadingUncertainty()
+		}
+	}
+	t.Logf("uncertainty before the outage: %.2f°, %.2f°, %.2f°; at its end: %.2f°, %.2f°, %.2f°",
+		before[0], before[1], before[2], during[0], during[1], during[2])
+	for i := range before {
+		if !(before[i] > 0 && before[i] < 2) {
+			t.Errorf("expected an uncertainty between 0 and 2° with GPS, got %f°", before[i])
+		}
+	}
+	if during[2] <= before[2] {
+		t.Errorf("expected the heading uncertainty to grow without GPS, but it went from %f° to %f°",
+			before[2], during[2])
+	}
+	if tr := s.CalcCovarianceTrace(); !(tr > 0) {
+		t.Errorf("expected a positive covariance trace, got %f", tr)
+	}
+
+	// A covariance gone bad makes the estimate invalid.
+	s.p[0][0] = math.NaN()
+	if s.Valid() {
+		t.Error("EKFState with a NaN covariance should be invalid")
+	}
+}
+
+func TestEKFDeadReckonOnly(t *testing.T) {
+	const (
+		roll  = -15 * Deg
+		pitch = 10 * Deg
+	)
+	// The aircraft sits still and level, then is tilted after 5 s, while the GPS reports a steep turn.
+	tilted := func(t float64) (float64, float64, float64, float64, float64, float64) {
+		if t < 5 {
+			return 0, 0, 0, 0, 0, 0
+		}
+		return roll, pitch, 0, 0, 0, 0
+	}
+	gps := turnPath(150, 0, 0, G/150)
+
+	s := NewEKFAHRS()
+	s.SetDeadReckonOnly(true)
+	for i := 0; i <= 1000; i++ {
+		m := simMeasurement(tilted, float64(i)*0.02, 0.02)
+		_, _, _, m.W1, m.W2, m.W3 = gps(m.T)
+		m.TW = m.T
+		s.Compute(m)
+	}
+
+	r, p, h := s.RollPitchHeading()
+	if e := angleErr(r/Deg, roll/Deg); e > 0.5 {
+		t.Errorf("roll was %f°, expected %f°", r/Deg, roll/Deg)
+	}
+	if e := angleErr(p/Deg, pitch/Deg); e > 0.5 {
+		t.Errorf("pitch was %f°, expected %f°", p/Deg, pitch/Deg)
+	}
+	if h != Invalid || s.RateOfTurn() != Invalid {
+		t.Error("heading and rate of turn should be invalid without GPS")
+	}
+	if s.gs != 0 || s.tW != 0 || s.vValid {
+		t.Error("GPS data was used in dead-reckoning mode")
+	}
+}
+
+var (
+	_ AHRSProvider       = (*EKFState)(nil)
+	_ PredictingProvider = (*EKFState)(nil)
+)
+
+func TestEKFBiasCovariance(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+	s := NewEKFAHRS()
+	ms := withSensorErrors(simMeasurements(sTurnPath(100, 15*Deg, 30), 0, 120, 0.02))
+	biasVar := func(c *Matrix) float64 { return c.Get(3, 3) + c.Get(4, 4) + c.Get(5, 5) }
+	var v0, vLast float64
+	for _, m := range ms {
+		s.Compute(m)
+		c := s.Covariance()
+		v := biasVar(c)
+		if v0 == 0 {
+			v0, vLast = v, v
+		}
+		// With consistent measurements the bias uncertainty only shrinks, apart from its random walk.
+		if v > vLast+3*ekfGyroBiasNoiseDefault*ekfGyroBiasNoiseDefault*0.02 {
+			t.Fatalf("gyro bias variance grew from %g to %g at %.2f s", vLast, v, m.T)
+		}
+		vLast = v
+		for i := 0; i < ekfN; i++ {
+			for j := 0; j < i; j++ {
+				if c.Get(i, j) != c.Get(j, i) {
+					t.Fatalf("covariance isn't symmetric at %.2f s", m.T)
+				}
+			}
+		}
+	}
+	t.Logf("gyro bias variance went from %g to %g", v0, vLast)
+	if vLast > v0/100 {
+		t.Errorf("expected the gyro bias variance to shrink a hundredfold, it went from %g to %g", v0, vLast)
+	}
+
+	var b [3]float64
+	b[0], b[1], b[2] = s.CalcGyroBias()
+	for i := range b {
+		if math.Abs(b[i]-gyroBias[i]) > 0.1 {
+			t.Errorf("gyro bias %d estimated as %f°/s, actually %f°/s", i+1, b[i], gyroBias[i])
+		}
+	}
+
+	// The covariance returned is a copy.
+	s.Covariance().Set(0, 0, -1)
+	if s.p[0][0] < 0 {
+		t.Error("Covariance should return a copy")
+	}
+}
+
+func TestEKFCrabAngle(t *testing.T) {
+	// Nose held on 030° while a crosswind from the left sets the track 15° right of it.
+	const hdg, crab = 30 * Deg, -15 * Deg
+	path := func(t float64) (float64, float64, float64, float64, float64, float64) {
+		return 0, 0, hdg, 100 * math.Sin(hdg-crab), 100 * math.Cos(hdg-crab), 0
+	}
+	s := NewEKFAHRS()
+	ms := withMagnetometer(simMeasurements(path, 0, 60, 0.05), path)
+	for _, m := range ms {
+		s.Compute(m)
+	}
+	if c := s.CalcCrabAngle(); math.Abs(c-crab/Deg) > 0.5 {
+		t.Errorf("crab angle %.2f°, expected %.2f°", c, crab/Deg)
+	}
+
+	d := NewEKFAHRS()
+	d.SetDeclination(-12)
+	for _, m := range withDeclinedMagnetometer(simMeasurements(path, 0, 60, 0.05), path, -12*Deg) {
+		d.Compute(m)
+	}
+	if c := d.CalcCrabAngle(); math.Abs(c-crab/Deg) > 0.5 {
+		t.Errorf("crab angle %.2f° with 12° W of declination, expected %.2f°", c, crab/Deg)
+	}
+
+	m := simMeasurement(path, 60.05, 0.05)
+	s.Compute(m)
+	if c := s.CalcCrabAngle(); c != Invalid {
+		t.Errorf("crab angle %.2f° without a magnetometer, expected Invalid", c)
+	}
+}
@@ -0,0 +1,251 @@
+/*
+The Hybrid AHRS algorithm runs two other algorithms side by side on the same measurements, one aided by the GPS
+(by default the Simple algorithm) and one using the IMU and magnetometer only (by default Mahony's filter),
+and reports a blend of their attitudes.  Each has its failure mode: the first needs the GPS, the second a clean
+magnetometer and no sustained acceleration.
+
+The weight of the GPS-aided solution moves towards 1 while the GPS is good and towards 0 during an outage, with
+separate time constants, and the two attitudes are interpolated along the rotation between them.
+The GPS-aided solution isn't trusted once the GPS has gone, nor straight away when it comes back, so the blend
+follows the IMU-only attitude corrected by the rotation to the GPS-aided one, which is tracked with the GPS
+time constant while the GPS is good and held otherwise.  The reported attitude so never steps, whatever the
+solutions do.  The correction also aligns the IMU-only heading, so an outage starts from the right heading
+even without a magnetometer.
+*/
+package ahrs
+
+import "math"
+
+const (
+	hybridGPSTauDefault = 5.0 // Time constant for moving to the GPS-aided solution, s
+	hybridIMUTauDefault = 2.0 // Time constant for moving to the IMU-only solution, s
+)
+
+// HybridMode identifies which of a HybridState's solutions dominates its output.
+type HybridMode int
+
+const (
+	HybridIMU HybridMode = iota // IMU-only solution
+	HybridGPS                   // GPS-aided solution
+)
+
+func (m HybridMode) String() string {
+	if m == HybridGPS {
+		return "GPS"
+	}
+	return "IMU"
+}
+
+// HybridState is an AHRSProvider blending a GPS-aided and an IMU-only AHRSProvider.
+type HybridState struct {
+	State
+	gps, imu       AHRSProvider // GPS-aided and IMU-only solutions
+	w              float64      // Weight of the GPS-aided solution
+	mode           HybridMode
+	gpsTau, imuTau float64 // Time constants for moving to the GPS-aided and IMU-only solutions, s
+	c0, c1, c2, c3 float64 // Rotation from the IMU-only to the GPS-aided attitude, earth frame
+	headingOffset  float64 // Added to the IMU-only heading to align it with the GPS-aided one, Rad
+	headingValid   bool    // Whether either solution has given a heading
+	onMode         func(mode HybridMode)
+	logMapUsed     bool // Whether GetLogMap has been called, so logMap must be kept current
+}
+
+// NewHybridAHRS returns a new Hybrid AHRS object blending the GPS-aided provider gps and the IMU-only provider imu,
+// e.g. NewSimpleAHRS() and NewMahonyAHRS().  They must not be used directly afterwards.
+func NewHybridAHRS(gps, imu AHRSProvider) (s *HybridState) {
+	s = &HybridState{gps: gps, imu: imu, gpsTau: hybridGPSTauDefault, imuTau: hybridIMUTauDefault, c0: 1}
+	s.needsInitialization = true
+	s.aNorm = 1
+	s.E0 = 1
+	s.F0 = 1 // Initial guess is that it's oriented pointing forward and level
+	s.calcRotationMatrices()
+	s.logMap = make(map[string]interface{})
+	s.updateLogMap(&noMeasurement, s.logMap)
+	return
+}
+
+// Compute runs both solutions' computations and blends their attitudes.
+func (s *HybridState) Compute(m *Measurement) {
+	m = m.inKnots(&s.mKnots)
+	if !m.plausible() {
+		return // Ignore corrupt readings rather than let them poison the state
+	}
+	s.gps.Compute(m)
+	s.imu.Compute(m)
+
+	gpsOK := m.WValid && s.gps.Valid()
+	if _, _, h := s.gps.RollPitchHeading(); h == Invalid {
+		gpsOK = false
+	}
+	target := 0.0
+	if (gpsOK || !s.imu.Valid()) && s.gps.Valid() {
+		target = 1
+	}
+
+	dt := m.T - s.T
+	k := 1.0 // Fraction of the way to move the correction towards the GPS-aided solution
+	if s.needsInitialization || dt < 0 {
+		s.needsInitialization = false
+		s.w = target
+		s.mode = s.dominant()
+	} else {
+		tau := s.imuTau
+		if target > s.w {
+			tau = s.gpsTau
+		}
+		s.w += (target - s.w) * (1 - math.Exp(-dt/tau))
+		k = 1 - math.Exp(-dt/s.gpsTau)
+	}
+	s.T = m.T
+	s.blend(gpsOK, k)
+
+	if mode := s.dominant(); mode != s.mode {
+		s.mode = mode
+		if s.onMode != nil {
+			s.onMode(mode)
+		}
+	}
+	if s.logMapUsed {
+		s.updateLogMap(m, s.logMap)
+	}
+}
+
+func (s *HybridState) dominant() HybridMode {
+	if s.w >= 0.5 {
+		return HybridGPS
+	}
+	return HybridIMU
+}
+
+// blend sets the state's outputs to the weighted blend of the two solutions, first moving the correction
+// a fraction k of the way to the GPS-aided solution if gpsOK.
+func (s *HybridState) blend(gpsOK bool, k float64) {
+	g, i := s.gps.GetState(), s.imu.GetState()
+	_, _, gpsHeading := s.gps.RollPitchHeading()
+	_, _, imuHeading := s.imu.RollPitchHeading()
+	s.headingValid = s.headingValid || gpsHeading != Invalid || imuHeading != Invalid
+
+	if gpsOK {
+		_, _, gh := FromQuaternion(g.E0, g.E1, g.E2, g.E3)
+		_, _, ih := FromQuaternion(i.E0, i.E1, i.E2, i.E3)
+		s.headingOffset += k * AngleDiff(gh, ih+s.headingOffset)
+	}
+	// Turning clockwise by the offset is a rotation about the earth's up axis by minus the offset.
+	o0, o3 := math.Cos(s.headingOffset/2), -math.Sin(s.headingOffset/2)
+	i0, i1, i2, i3 := quaternionProduct(o0, 0, 0, o3, i.E0, i.E1, i.E2, i.E3)
+	if gpsOK {
+		t0, t1, t2, t3 := quaternionProduct(g.E0, g.E1, g.E2, g.E3, i0, -i1, -i2, -i3)
+		s.c0, s.c1, s.c2, s.c3 = QuaternionSlerp(s.c0, s.c1, s.c2, s.c3, t0, t1, t2, t3, k)
+	}
+	g0, g1, g2, g3 := quaternionProduct(s.c0, s.c1, s.c2, s.c3, i0, i1, i2, i3)
+	s.E0, s.E1, s.E2, s.E3 = QuaternionSlerp(i0, i1, i2, i3, g0, g1, g2, g3, s.w)
+	s.calcRotationMatrices()
+	s.roll, s.pitch, s.heading = FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+
+	s.headingMag = i.headingMag + s.w*AngleDiff(g.headingMag, i.headingMag)
+	s.slipSkid = i.slipSkid + s.w*(g.slipSkid-i.slipSkid)
+	s.turnRate = i.turnRate + s.w*(g.turnRate-i.turnRate)
+	s.gLoad = i.gLoad + s.w*(g.gLoad-i.gLoad)
+}
+
+// quaternionProduct returns the quaternion product a*b.
+func quaternionProduct(a0, a1, a2, a3, b0, b1, b2, b3 float64) (q0, q1, q2, q3 float64) {
+	q0 = a0*b0 - a1*b1 - a2*b2 - a3*b3
+	q1 = a0*b1 + a1*b0 + a2*b3 - a3*b2
+	q2 = a0*b2 - a1*b3 + a2*b0 + a3*b1
+	q3 = a0*b3 + a1*b2 - a2*b1 + a3*b0
+	return
+}
+
+// RollPitchHeading returns the current attitude values, in radians.
+// The heading is invalid until one of the solutions has given it.
+func (s *HybridState) RollPitchHeading() (roll float64, pitch float64, heading float64) {
+	roll, pitch, heading = s.State.RollPitchHeading()
+	if !s.headingValid {
+		heading = Invalid
+	}
+	return
+}
+
+// GetMode returns which solution dominates the output.
+func (s *HybridState) GetMode() HybridMode {
+	return s.mode
+}
+
+// GetGPSWeight returns the weight, from 0 to 1, of the GPS-aided solution in the output.
+func (s *HybridState) GetGPSWeight() float64 {
+	return s.w
+}
+
+// SetCallback sets a function to be called from Compute whenever the dominant solution changes.
+func (s *HybridState) SetCallback(f func(mode HybridMode)) {
+	s.onMode = f
+}
+
+// Valid returns whether the blended state is valid, which needs at least one of the solutions to be.
+func (s *HybridState) Valid() bool {
+	return s.State.Valid() && (s.gps.Valid() || s.imu.Valid())
+}
+
+// Reset restarts both solutions and the blend from scratch.
+func (s *HybridState) Reset() {
+	s.gps.Reset()
+	s.imu.Reset()
+	s.c0, s.c1, s.c2, s.c3 = 1, 0, 0, 0
+	s.headingOffset, s.headingValid = 0, false
+	s.State.Reset()
+}
+
+// SetSensorQuaternion changes the sensor quaternion F of both solutions.
+func (s *HybridState) SetSensorQuaternion(f *[4]float64) {
+	s.gps.SetSensorQuaternion(f)
+	s.imu.SetSensorQuaternion(f)
+	s.State.SetSensorQuaternion(f)
+}
+
+// SetCalibrations sets the calibrations of both solutions.
+func (s *HybridState) SetCalibrations(c, d, k, l *[3]float64) {
+	s.gps.SetCalibrations(c, d, k, l)
+	s.imu.SetCalibrations(c, d, k, l)
+	s.State.SetCalibrations(c, d, k, l)
+}
+
+// Describe returns "hybrid" with the current gpsTau and imuTau along with the params of the GPS-aided
+// and IMU-only solutions, as SetConfig takes them all.
+func (s *HybridState) Describe() ProviderInfo {
+	p := make(map[string]float64)
+	for _, d := range []ProviderInfo{s.imu.Describe(), s.gps.Describe()} {
+		for k, v := range d.Params {
+			p[k] = v
+		}
+	}
+	p["gpsTau"], p["imuTau"] = s.gpsTau, s.imuTau
+	return ProviderInfo{Name: "hybrid", Params: p}
+}
+
+// SetConfig lets the user alter the time constants gpsTau and imuTau, s, for moving to the GPS-aided
+// and the IMU-only solution; a missing or non-positive value is left unchanged.
+// configMap is passed on to both solutions too.
+func (s *HybridState) SetConfig(configMap map[string]float64) {
+	if v, ok := configMap["gpsTau"]; ok && v > 0 {
+		s.gpsTau = v
+	}
+	if v, ok := configMap["imuTau"]; ok && v > 0 {
+		s.imuTau = v
+	}
+	s.gps.SetConfig(configMap)
+	s.imu.SetConfig(configMap)
+}
+
+// GetLogMap returns a map providing current state and measurement values for analysis.
+// It is only kept up to date by Compute from the first call to GetLogMap on.
+func (s *HybridState) GetLogMap() (p map[string]interface{}) {
+	s.logMapUsed = true
+	return s.logMap
+}
+
+func (s *HybridState) updateLogMap(m *Measurement, p map[string]interface{}) {
+	s.State.updateLogMap(m, p)
+	p["GPSWeight"] = s.w
+	p["HeadingOffset"] = RadToDeg(s.headingOffset)
+}
@@ -0,0 +1,61 @@
+package ahrs
+
+import (
+	"io/ioutil"
+	"log"
+	"math"
+	"testing"
+)
+
+func TestHybridContinuity(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+
+	// Gentle S-turns with the GPS dropping out for 15 s, 3 s and 20 s.
+	sc := scenario{path: sTurnPath(100, 0.5, 60), duration: 130}
+	outage := func(t float64) bool { return (t >= 20 && t < 35) || (t >= 50 && t < 53) || (t >= 80 && t < 100) }
+	ms := withMagnetometer(sc.measurements(50), sc.path)
+	for _, m := range ms {
+		if outage(m.T) {
+			m.W1, m.W2, m.W3, m.WValid = 0, 0, 0, false
+		}
+	}
+
+	s := NewHybridAHRS(NewSimpleAHRS(), NewMahonyAHRS())
+	var modes []HybridMode
+	s.SetCallback(func(mode HybridMode) { modes = append(modes, mode) })
+	const maxJump = 0.5 // °, between samples 0.02 s apart
+	var r0, p0, h0 float64
+	for i, m := range ms {
+		s.Compute(m)
+		r, p, h := s.CalcRollPitchHeading()
+		if i > 0 {
+			if d := math.Max(angleErr(r, r0), math.Max(angleErr(p, p0), angleErr(h, h0))); d > maxJump {
+				t.Errorf("attitude jumped by %.2f° at %.2f s, GPS weight %.2f", d, m.T, s.GetGPSWeight())
+			}
+		}
+		r0, p0, h0 = r, p, h
+		at := func(t float64) bool { return math.Abs(m.T-t) < 0.01 }
+		if mode := s.GetMode(); (at(30) || at(95)) && mode != HybridIMU || (at(45) || at(125)) && mode != HybridGPS {
+			t.Errorf("%s solution dominating at %.2f s", mode, m.T)
+		}
+	}
+
+	want := []HybridMode{HybridIMU, HybridGPS, HybridIMU, HybridGPS, HybridIMU, HybridGPS}
+	if len(modes) != len(want) {
+		t.Fatalf("expected mode changes %v, got %v", want, modes)
+	}
+	for i := range want {
+		if modes[i] != want[i] {
+			t.Fatalf("expected mode changes %v, got %v", want, modes)
+		}
+	}
+
+	r, p, h := s.CalcRollPitchHeading()
+	rr, pp, hh, _, _, _ := sc.path(ms[len(ms)-1].T)
+	if angleErr(r, rr/Deg) > 2 || angleErr(p, pp/Deg) > 2 || angleErr(h, hh/Deg) > 2 {
+		t.Errorf("attitude %.2f°, %.2f°, %.2f°, expected %.2f°, %.2f°, %.2f°", r, p, h, rr/Deg, pp/Deg, hh/Deg)
+	}
+}
+
+var _ AHRSProvider = (*HybridState)(nil)
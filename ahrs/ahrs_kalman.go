@@ -3,20 +3,53 @@
 package ahrs
 
 import (
-	"github.com/skelterjohn/go.matrix"
+	"fmt"
 	"log"
 	"math"
 )
 
+// kalmanGateTimeoutDefault is the default time, s, for which the gate may reject a channel continuously
+// before Update escalates.
+const kalmanGateTimeoutDefault = 5.0
+
+// kalmanVibrationMaxDefault is the default largest factor by which vibration may increase the
+// accelerometer sigma.
+const kalmanVibrationMaxDefault = 10.0
+
+// kalmanMaxCondition is the largest condition number of the innovation covariance, scaled to a unit diagonal,
+// for which Update applies its correction.
+const kalmanMaxCondition = 1e12
+
 type KalmanState struct {
 	State
+	y              *Matrix // Innovation of the last Update: measurement minus predicted measurement
+	innovationHook func(y, ss *Matrix)
+	dt             float64 // Interval of the last Predict, s
+	gyroNoise      float64 // Gyro noise density, °/s/√Hz, or 0 to use the measurement's variance accumulators
+	accelNoise     float64 // Accelerometer noise density, G/√Hz, or 0 likewise
+	gpsNoise       float64 // GPS velocity sigma, kt, or 0 likewise
+	rB, rA, rW     float64 // Variances used for the gyro, accelerometer and GPS by the last Update
+	vibrationGain  float64 // Increase in the accelerometer sigma per G of vibration, or 0 not to adapt it
+	vibrationMax   float64 // Largest factor by which vibration may increase the accelerometer sigma
+	m0             *Matrix // Covariance at initialization, restored if M loses positive-definiteness
+	onReset        func(t float64)
+	layout         KalmanLayout
+	idx            []int // Indices in the full state of the states estimated, or nil for all
+	blockUpdate    bool    // Whether to update with all measurements at once rather than one channel at a time
+	gate           float64 // Largest normalized innovation squared accepted for a channel, or 0 for no gating
+	rejected       []int   // Channels rejected by the gate in the last Update
+	gateTimeout    float64 // Time, s, for which a channel may be rejected continuously before escalating
+	gateStats      []gateStats
+	onGateTimeout  func(channel int, t float64)
+	mPrev          *Matrix // Covariance before the last sequential update, restored if it is skipped
+
+	conditioningSkipCount int // Number of Updates skipped for an ill-conditioned innovation covariance
 }
 
+// CalcRollPitchHeadingUncertainty returns the standard deviations of the attitude values, in degrees.
 func (s *KalmanState) CalcRollPitchHeadingUncertainty() (droll float64, dpitch float64, dheading float64) {
-	droll, dpitch, dheading = VarFromQuaternion(s.E0, s.E1, s.E2, s.E3,
-		math.Sqrt(s.M.Get(6, 6)), math.Sqrt(s.M.Get(7, 7)),
-		math.Sqrt(s.M.Get(8, 8)), math.Sqrt(s.M.Get(9, 9)))
-	return
+	droll, dpitch, dheading = s.RollPitchHeadingUncertainty()
+	return RadToDeg(droll), RadToDeg(dpitch), RadToDeg(dheading)
 }
 
 // GetState returns the Kalman state of the system
@@ -24,82 +57,325 @@ func (s *KalmanState) GetState() *State {
 	return &s.State
 }
 
+// CalcInnovation returns the innovation from the last Update, the measurement minus the measurement predicted
+// by PredictMeasurement, in Measurement order U, W, A, B, M.  Channels without a valid measurement are 0.
+// A large innovation signals a fault or a maneuver that the model doesn't capture.
+// It returns nil before the first Update.
+func (s *KalmanState) CalcInnovation() (y []float64) {
+	if s.y == nil {
+		return nil
+	}
+	y = make([]float64, s.y.Rows())
+	for i := range y {
+		y[i] = s.y.Get(i, 0)
+	}
+	return
+}
+
+// SetInnovationHook sets a function to be called by each Update with the innovation y and its covariance ss,
+// for analysing the filter's consistency, e.g. with a NISChecker.  Channels without a valid measurement
+// have a variance of at least Big.  f must not modify or retain y or ss.
+func (s *KalmanState) SetInnovationHook(f func(y, ss *Matrix)) {
+	s.innovationHook = f
+}
+
 // GetStateMap returns the state information for analysis
 func (s *KalmanState) GetStateMap() (dat *map[string]float64) {
 	return
 }
 
+// KalmanLayout chooses the blocks of the Kalman filter's state that are estimated.  The airspeed U,
+// acceleration Z, attitude E and rotation rate H are always estimated; a block that isn't is held at its
+// initial value (wind and biases 0, the sensor level and forward), with no covariance at all, so that the
+// filter does less work and the block can't absorb errors.
+type KalmanLayout struct {
+	Mag               bool // Earth magnetic field N and magnetometer bias L; without them the magnetometer isn't used
+	Wind              bool // Wind V
+	AccelBias         bool // Accelerometer bias C
+	SensorOrientation bool // Sensor quaternion F
+	GyroBias          bool // Gyro bias D
+}
+
+// FullKalmanLayout estimates the whole state, as InitializeKalman does.
+var FullKalmanLayout = KalmanLayout{Mag: true, Wind: true, AccelBias: true, SensorOrientation: true, GyroBias: true}
+
+// indices returns the indices in the full state of the states estimated with layout l, or nil for all of them.
+func (l KalmanLayout) indices() (idx []int) {
+	if l == FullKalmanLayout {
+		return nil
+	}
+	add := func(on bool, from, to int) {
+		for i := from; on && i < to; i++ {
+			idx = append(idx, i)
+		}
+	}
+	add(true, 0, 13) // U, Z, E, H
+	add(l.Mag, 13, 16)
+	add(l.Wind, 16, 19)
+	add(l.AccelBias, 19, 22)
+	add(l.SensorOrientation, 22, 26)
+	add(l.GyroBias, 26, 29)
+	add(l.Mag, 29, 32)
+	return idx
+}
+
+// KalmanSigmas holds the initial standard deviations of the blocks of the Kalman filter's state.
+// A block left zero keeps its default, which may depend on the first measurement; a block that is set
+// must be positive throughout.
+type KalmanSigmas struct {
+	Airspeed          [3]float64 // U, kt (50, 5, 5, or 14 along with the GPS)
+	Accel             [3]float64 // Z, G (0.4, 0.2, 0.5)
+	Attitude          [3]float64 // Roll, pitch and heading, ° (0.5, or 0.1 when known, for each component of E)
+	RotationRate      [3]float64 // H, °/s (2, 2, 2)
+	MagField          [3]float64 // N, µT (65, 65, 65)
+	Wind              [3]float64 // V, kt (10, 10, 2, or √10 horizontally along with the GPS)
+	AccelBias         [3]float64 // C, G (0.02, 0.02, 0.02)
+	SensorOrientation [4]float64 // F (0.002, 0.002, 0.002, 0.002)
+	GyroBias          [3]float64 // D, °/s (0.1, 0.1, 0.1)
+	MagBias           [3]float64 // L, µT (10, 10, 10)
+}
+
+// KalmanNoise holds the process noise densities of the blocks of the Kalman filter's state: the standard
+// deviation each grows by as a random walk over one second, its variance growing in proportion to the
+// actual interval of each Predict however irregular the measurements.  A block left nil is unchanged, from
+// its default at the start; a block that is set must be non-negative and finite throughout, and a block
+// set to zero is held, its uncertainty not growing at all.
+type KalmanNoise struct {
+	Airspeed          *[3]float64 // U, kt/√s (1, 0.1, 0.1)
+	Accel             *[3]float64 // Z, G/√s (0.2, 0.1, 0.2)
+	Attitude          *[4]float64 // E, 1/√s (0.02, 0.02, 0.02, 0.02)
+	RotationRate      *[3]float64 // H, °/s/√s (1, 1, 1)
+	MagField          *[3]float64 // N, µT/√s (100, 100, 100)
+	Wind              *[3]float64 // V, kt/√s (5, 5, 5 per √hour)
+	AccelBias         *[3]float64 // C, G/√s (0.01, 0.01, 0.01 per √hour)
+	SensorOrientation *[4]float64 // F, 1/√s (0.0001, 0.0001, 0.0001, 0.0001 per √hour)
+	GyroBias          *[3]float64 // D, °/s/√s (0.1, 0.1, 0.1 per √hour)
+	MagBias           *[3]float64 // L, µT/√s (0.1, 0.1, 0.1 per √hour)
+}
+
+// noiseBlock is a block of KalmanNoise, starting at index i of the full state.
+type noiseBlock struct {
+	name string
+	i    int
+	v    []float64 // The densities, or nil if the block isn't set
+}
+
+// blocks returns the blocks of c in the order of the state.
+func (c KalmanNoise) blocks() []noiseBlock {
+	v3 := func(p *[3]float64) []float64 {
+		if p == nil {
+			return nil
+		}
+		return p[:]
+	}
+	v4 := func(p *[4]float64) []float64 {
+		if p == nil {
+			return nil
+		}
+		return p[:]
+	}
+	return []noiseBlock{
+		{"airspeed", 0, v3(c.Airspeed)},
+		{"acceleration", 3, v3(c.Accel)},
+		{"attitude", 6, v4(c.Attitude)},
+		{"rotation rate", 10, v3(c.RotationRate)},
+		{"magnetic field", 13, v3(c.MagField)},
+		{"wind", 16, v3(c.Wind)},
+		{"accelerometer bias", 19, v3(c.AccelBias)},
+		{"sensor orientation", 22, v4(c.SensorOrientation)},
+		{"gyro bias", 26, v3(c.GyroBias)},
+		{"magnetometer bias", 29, v3(c.MagBias)},
+	}
+}
+
+// KalmanInit configures how InitializeKalmanWithConfig starts the Kalman filter.
+type KalmanInit struct {
+	Layout   *KalmanLayout // As for InitializeKalmanWithLayout; by default FullKalmanLayout
+	Sigmas   KalmanSigmas
+	Noise    KalmanNoise // As for SetProcessNoiseDensities; the setters of the process noise can change it later
+	Attitude *[3]float64 // Initial roll, pitch and heading, rad, e.g. from a stored State; by default the GPS track
+}
+
+// checkBlock appends a problem to problems if the block v of the kind of parameter is set and not all positive.
+func checkBlock(problems []string, kind, name string, v []float64) []string {
+	set, ok := false, true
+	for _, x := range v {
+		set = set || x != 0
+		ok = ok && x > 0 && !math.IsInf(x, 0)
+	}
+	if set && !ok {
+		problems = append(problems, fmt.Sprintf("%s %s must be positive and finite, got %v", name, kind, v))
+	}
+	return problems
+}
+
+// validate returns a *ConfigError listing the blocks of c that are set and not all positive, or nil.
+func (c KalmanSigmas) validate() error {
+	var problems []string
+	check := func(name string, v []float64) {
+		problems = checkBlock(problems, "sigmas", "initial "+name, v)
+	}
+	check("airspeed", c.Airspeed[:])
+	check("acceleration", c.Accel[:])
+	check("attitude", c.Attitude[:])
+	check("rotation rate", c.RotationRate[:])
+	check("magnetic field", c.MagField[:])
+	check("wind", c.Wind[:])
+	check("accelerometer bias", c.AccelBias[:])
+	check("sensor orientation", c.SensorOrientation[:])
+	check("gyro bias", c.GyroBias[:])
+	check("magnetometer bias", c.MagBias[:])
+	if len(problems) > 0 {
+		return &ConfigError{problems}
+	}
+	return nil
+}
+
+// validate returns a *ConfigError listing the blocks of c that are set and not all non-negative, or nil.
+func (c KalmanNoise) validate() error {
+	var problems []string
+	for _, b := range c.blocks() {
+		for _, x := range b.v {
+			if !(x >= 0) || math.IsInf(x, 0) {
+				problems = append(problems, fmt.Sprintf("process noise %s must be non-negative and finite, got %v", b.name, b.v))
+				break
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return &ConfigError{problems}
+	}
+	return nil
+}
+
 // Initialize the state at the start of the Kalman filter, based on current measurements
 func InitializeKalman(m *Measurement) (s *KalmanState) {
+	return InitializeKalmanWithLayout(m, FullKalmanLayout)
+}
+
+// InitializeKalmanWithLayout is InitializeKalman estimating only the blocks of the state chosen by layout.
+// The covariance M and process noise N then hold just those states, in the order of the full state.
+func InitializeKalmanWithLayout(m *Measurement, layout KalmanLayout) (s *KalmanState) {
+	s, _ = InitializeKalmanWithConfig(m, KalmanInit{Layout: &layout})
+	return
+}
+
+// InitializeKalmanWithConfig is InitializeKalman with the layout, initial uncertainties, process noise and,
+// optionally, initial attitude given by c.  It returns a *ConfigError if any sigmas or noise densities are
+// out of range.
+func InitializeKalmanWithConfig(m *Measurement, c KalmanInit) (s *KalmanState, err error) {
+	if err = c.Sigmas.validate(); err != nil {
+		return nil, err
+	}
+	if err = c.Noise.validate(); err != nil {
+		return nil, err
+	}
 	s = new(KalmanState)
-	s.init(m)
+	s.gateTimeout = kalmanGateTimeoutDefault
+	s.vibrationMax = kalmanVibrationMaxDefault
+	s.layout = FullKalmanLayout
+	if c.Layout != nil {
+		s.layout = *c.Layout
+	}
+	s.idx = s.layout.indices()
+	s.init(m, c)
 	return
 }
 
-func (s *KalmanState) init(m *Measurement) {
+// InitialCovariance returns a copy of the covariance the filter was initialized with,
+// which it also returns to when reset.
+func (s *KalmanState) InitialCovariance() *Matrix {
+	return s.m0.Copy()
+}
+
+// orDefault returns v, or def if v is all zero.
+func orDefault(v, def []float64) []float64 {
+	for _, x := range v {
+		if x != 0 {
+			return v
+		}
+	}
+	return def
+}
+
+func (s *KalmanState) init(m *Measurement, c KalmanInit) {
 	// Diagonal matrix of initial state uncertainties, will be squared into covariance below
 	// Specifics here aren't too important--it will change very quickly
-	s.M = matrix.Diagonal([]float64{
-		50, 5, 5,                   // U*3
-		0.4, 0.2, 0.5,              // Z*3
-		0.5, 0.5, 0.5, 0.5,         // E*4
-		2, 2, 2,                    // H*3
-		65, 65, 65,                 // N*3
-		10, 10, 2,                  // V*3
-		0.02, 0.02, 0.02,           // C*3
-		0.002, 0.002, 0.002, 0.002, // F*4
-		0.1, 0.1, 0.1,              // D*4
-		10, 10, 10,                 // L*4
-	})
-	s.M = matrix.Product(s.M, s.M)
-
-	// Diagonal matrix of state process uncertainties per s, will be squared into covariance below
+	sig := c.Sigmas
+	var d []float64
+	d = append(d, orDefault(sig.Airspeed[:], []float64{50, 5, 5})...)
+	d = append(d, orDefault(sig.Accel[:], []float64{0.4, 0.2, 0.5})...)
+	d = append(d, 0.5, 0.5, 0.5, 0.5) // E*4, from sig.Attitude below
+	d = append(d, orDefault(sig.RotationRate[:], []float64{2, 2, 2})...)
+	d = append(d, orDefault(sig.MagField[:], []float64{65, 65, 65})...)
+	d = append(d, orDefault(sig.Wind[:], []float64{10, 10, 2})...)
+	d = append(d, orDefault(sig.AccelBias[:], []float64{0.02, 0.02, 0.02})...)
+	d = append(d, orDefault(sig.SensorOrientation[:], []float64{0.002, 0.002, 0.002, 0.002})...)
+	d = append(d, orDefault(sig.GyroBias[:], []float64{0.1, 0.1, 0.1})...)
+	d = append(d, orDefault(sig.MagBias[:], []float64{10, 10, 10})...)
+	s.M = diagonal(d)
+	s.M = product(s.M, s.M)
+
+	// Diagonal matrix of state process uncertainties per √s, will be squared into covariance per s below
 	// Tuning these is more important
 	tt := math.Sqrt(60.0*60.0) // One-hour time constant for drift of biases V, C, F, D, L
-	s.N = matrix.Diagonal([]float64{
-		1, 0.1, 0.1,                                // U*3
-		0.2, 0.1, 0.2,                              // Z*3
-		0.02, 0.02, 0.02, 0.02,                     // E*4
-		1, 1, 1,                                    // H*3
-		100, 100, 100,                              // N*3
-		5/tt, 5/tt, 5/tt,                           // V*3
-		0.01/tt, 0.01/tt, 0.01/tt,                  // C*3
-		0.0001/tt, 0.0001/tt, 0.0001/tt, 0.0001/tt, // F*4
-		0.1/tt, 0.1/tt, 0.1/tt,                     // D*3
-		0.1/tt, 0.1/tt, 0.1/tt,                     // L*3
+	s.N = diagonal([]float64{
+		1, 0.1, 0.1, // U
+		0.2, 0.1, 0.2, // Z
+		0.02, 0.02, 0.02, 0.02, // E
+		1, 1, 1, // H
+		100, 100, 100, // N
+		5 / tt, 5 / tt, 5 / tt, // V
+		0.01 / tt, 0.01 / tt, 0.01 / tt, // C
+		0.0001 / tt, 0.0001 / tt, 0.0001 / tt, 0.0001 / tt, // F
+		0.1 / tt, 0.1 / tt, 0.1 / tt, // D
+		0.1 / tt, 0.1 / tt, 0.1 / tt, // L
 	})
-	s.N = matrix.Product(s.N, s.N)
+	s.N = product(s.N, s.N)
 
 	//TODO westphae: for now just treat the case !m.UValid; if we have U, we can do a lot more!
 
 	// Best guess at initial airspeed is initial groundspeed
 	if m.WValid {
 		s.U1 = math.Hypot(m.W1, m.W2)
-		s.M.Set(0, 0, 14*14) // Our estimate of airspeed is better
-		s.M.Set(16, 16, 10)  // Matching uncertainty of windspeed
-		s.M.Set(17, 17, 10)  // Matching uncertainty of windspeed
+		if sig.Airspeed == [3]float64{} {
+			s.M.Set(0, 0, 14*14) // Our estimate of airspeed is better
+		}
+		if sig.Wind == [3]float64{} {
+			s.M.Set(16, 16, 10) // Matching uncertainty of windspeed
+			s.M.Set(17, 17, 10) // Matching uncertainty of windspeed
+		}
 	}
 
-	// Best guess at initial heading is initial track
-	if m.WValid && s.U1 > 5 {
+	// Best guess at initial heading is initial track, unless we were given the attitude
+	known := true
+	if c.Attitude != nil {
+		s.E0, s.E1, s.E2, s.E3 = ToQuaternion(c.Attitude[0], c.Attitude[1], c.Attitude[2])
+	} else if m.WValid && s.U1 > 5 {
 		// Simplified half-angle formulae
 		s.E0, s.E3 = math.Sqrt((s.U1 + m.W1) / (2 * s.U1)), math.Sqrt((s.U1 - m.W1) / (2 * s.U1))
 		if m.W2 < 0 {
 			s.E3 *= -1
 		}
+	} else { // If no groundspeed available then no idea which direction we're pointing
+		s.E0 = 1 // assume east
+		known = false
+	}
+	if known && sig.Attitude == [3]float64{} {
 		s.M.Set(6, 6, 0.1*0.1) // Our estimate of orientation is better
 		s.M.Set(7, 7, 0.1*0.1)
 		s.M.Set(8, 8, 0.1*0.1)
 		s.M.Set(9, 9, 0.1*0.1)
-	} else { // If no groundspeed available then no idea which direction we're pointing
-		s.E0 = 1 // assume east
 	}
 
 	s.F0 = 1 // Initial guess is that it's oriented pointing forward and level
 
 	s.normalize()
+	if sig.Attitude != [3]float64{} {
+		s.setAttitudeCovariance(DegToRad(sig.Attitude[0]), DegToRad(sig.Attitude[1]), DegToRad(sig.Attitude[2]))
+	}
 
-	if m.MValid { //TODO westphae: could do more here to get a better Fn since we know N points north
+	if m.MValid && s.layout.Mag { //TODO westphae: could do more here to get a better Fn since we know N points north
 		s.N1 = m.M1*s.e11 + m.M2*s.e12 + m.M3*s.e13
 		s.N2 = m.M1*s.e21 + m.M2*s.e22 + m.M3*s.e23
 		s.N3 = m.M1*s.e31 + m.M2*s.e32 + m.M3*s.e33
@@ -111,19 +387,89 @@ func (s *KalmanState) init(m *Measurement) {
 		s.M.Set(30, 30, Big)
 		s.M.Set(31, 31, Big)
 	}
+	if s.idx != nil {
+		s.M = submatrix(s.M, s.idx, s.idx)
+		s.N = submatrix(s.N, s.idx, s.idx)
+	}
+	s.m0 = s.M.Copy()
+	s.SetProcessNoiseDensities(c.Noise) // Already validated
 
 	return
 }
 
+// setAttitudeCovariance sets the covariance of E to that of roll, pitch and heading errors with
+// standard deviations droll, dpitch and dheading, rad, about the current attitude.  A little variance
+// along E itself, which normalizing removes anyway, keeps M positive-definite.
+func (s *KalmanState) setAttitudeCovariance(droll, dpitch, dheading float64) {
+	roll, pitch, heading := FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+	dq := toQuaternionDerivatives(roll, pitch, heading)
+	v := [3]float64{droll * droll, dpitch * dpitch, dheading * dheading}
+	e := [4]float64{s.E0, s.E1, s.E2, s.E3}
+	vn := math.Min(v[0], math.Min(v[1], v[2])) / 4
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			x := vn * e[i] * e[j]
+			for k := 0; k < 3; k++ {
+				x += v[k] * dq[k][i] * dq[k][j]
+			}
+			s.M.Set(6+i, 6+j, x)
+		}
+	}
+}
+
+// inflateAttitude widens the covariance of E about the saturated gyro axes, whose rates may have been off
+// by gyroSaturationRate over the interval dt, s.  The error adds up over the saturation.
+func (s *KalmanState) inflateAttitude(axes [3]bool, dt float64) {
+	for j, saturated := range axes {
+		if !saturated {
+			continue
+		}
+		var d [3]float64
+		d[j] = 1
+		a1, a2, a3 := s.rotateByF(d[0], d[1], d[2], false)
+		// Change in E per rad of rotation about the aircraft axis a: E*(0, a)/2, of length 1/2
+		u := [4]float64{
+			(-s.E1*a1 - s.E2*a2 - s.E3*a3) / 2,
+			(s.E0*a1 + s.E2*a3 - s.E3*a2) / 2,
+			(s.E0*a2 + s.E3*a1 - s.E1*a3) / 2,
+			(s.E0*a3 + s.E1*a2 - s.E2*a1) / 2,
+		}
+		var v float64 // Variance of the rotation about the axis
+		for a := 0; a < 4; a++ {
+			for b := 0; b < 4; b++ {
+				v += 16 * u[a] * s.M.Get(6+a, 6+b) * u[b]
+			}
+		}
+		sd := math.Sqrt(v) + DegToRad(gyroSaturationRate)*dt
+		for a := 0; a < 4; a++ {
+			for b := 0; b < 4; b++ {
+				s.M.Set(6+a, 6+b, s.M.Get(6+a, 6+b)+(sd*sd-v)*u[a]*u[b])
+			}
+		}
+	}
+}
+
 // Compute runs first the prediction and then the update phases of the Kalman filter
 func (s *KalmanState) Compute(m *Measurement) {
+	m = m.inKnots(&s.mKnots)
+	if !m.plausible() {
+		return // Ignore corrupt readings rather than let them poison the state
+	}
+	if !s.checkAccelClip(m) {
+		s.checkVibration(m.A1, m.A2, m.A3, m.T, m.SValid)
+	}
+	s.updateGyroTemp(m, s.D1, s.D2, s.D3)
+	dt := m.T - s.T
 	s.Predict(m.T)
+	if axes, saturated := s.checkGyroSaturation(m); saturated {
+		s.inflateAttitude(axes, dt)
+	}
 	s.Update(m)
 }
 
 // Valid applies some heuristics to detect whether the computed state is valid or not
 func (s *KalmanState) Valid() (ok bool) {
-	ok = true
+	ok = s.finite()
 
 	if s.U1 < -5 {
 		log.Println("AHRS got negative airspeed, restarting")
@@ -137,40 +483,47 @@ func (s *KalmanState) Valid() (ok bool) {
 		ok = false
 	}
 
-	roll, pitch, heading := s.CalcRollPitchHeading()
-	droll, dpitch, dheading := s.CalcRollPitchHeadingUncertainty()
-	if droll > 2.5*Deg || dpitch > 2.5*Deg {
+	roll, pitch, heading := s.RollPitchHeading()
+	droll, dpitch, dheading := s.RollPitchHeadingUncertainty()
+	if droll > DegToRad(2.5) || dpitch > DegToRad(2.5) {
 		log.Printf("AHRS too uncertain: roll %5.1f +/- %3.1f, pitch %4.1f +/- %3.1f, heading %5.1f +/- %3.1f\n",
-			roll/Deg, droll/Deg, pitch/Deg, dpitch/Deg, heading/Deg, dheading/Deg)
+			RadToDeg(roll), RadToDeg(droll), RadToDeg(pitch), RadToDeg(dpitch), RadToDeg(heading), RadToDeg(dheading))
 		ok = false
 	}
 
 	return ok
 }
 
-// Predict performs the prediction phase of the Kalman filter
+// Predict performs the prediction phase of the Kalman filter up to time t.
+// The process noise N is per second and is scaled by the actual interval, however irregular.
 func (s *KalmanState) Predict(t float64) {
 	f := s.calcJacobianState(t)
+	if s.idx != nil {
+		f = submatrix(f, s.idx, s.idx)
+	}
 	dt := t - s.T
 
 	s.U1 += dt*s.Z1*G
 	s.U2 += dt*s.Z2*G
 	s.U3 += dt*s.Z3*G
 
-	s.E0 += 0.5*dt*(-s.H1*s.E1 - s.H2*s.E2 - s.H3*s.E3)*Deg
-	s.E1 += 0.5*dt*(+s.H1*s.E0 + s.H2*s.E3 - s.H3*s.E2)*Deg
-	s.E2 += 0.5*dt*(-s.H1*s.E3 + s.H2*s.E0 + s.H3*s.E1)*Deg
-	s.E3 += 0.5*dt*(+s.H1*s.E2 - s.H2*s.E1 + s.H3*s.E0)*Deg
+	s.E0 += DegToRad(0.5*dt*(-s.H1*s.E1 - s.H2*s.E2 - s.H3*s.E3))
+	s.E1 += DegToRad(0.5*dt*(+s.H1*s.E0 + s.H2*s.E3 - s.H3*s.E2))
+	s.E2 += DegToRad(0.5*dt*(-s.H1*s.E3 + s.H2*s.E0 + s.H3*s.E1))
+	s.E3 += DegToRad(0.5*dt*(+s.H1*s.E2 - s.H2*s.E1 + s.H3*s.E0))
 	s.normalize()
 
 	// All other state vectors are unchanged
 
 	s.T = t
+	s.dt = dt
 
-	s.M = matrix.Sum(matrix.Product(f, matrix.Product(s.M, f.Transpose())), matrix.Scaled(s.N, dt))
+	s.M = sum(product(f, product(s.M, f.Transpose())), scaled(s.N, dt))
 }
 
-// Update applies the Kalman filter corrections given the measurements
+// Update applies the Kalman filter corrections given the measurements.
+// If the innovation covariance is too ill-conditioned to trust the correction, the state and its covariance
+// are left as predicted and ConditioningSkipCount is incremented.
 func (s *KalmanState) Update(m *Measurement) {
 	z := s.PredictMeasurement()
 
@@ -182,7 +535,7 @@ func (s *KalmanState) Update(m *Measurement) {
 		m.WValid = true
 	}
 
-	y := matrix.Zeros(15, 1)
+	y := NewMatrix(15, 1)
 	y.Set( 0, 0, m.U1 - z.U1)
 	y.Set( 1, 0, m.U2 - z.U2)
 	y.Set( 2, 0, m.U3 - z.U3)
@@ -200,6 +553,10 @@ func (s *KalmanState) Update(m *Measurement) {
 	y.Set(14, 0, m.M3 - z.M3)
 
 	h := s.calcJacobianMeasurement()
+	if s.idx != nil {
+		h = submatrix(h, nil, s.idx)
+	}
+	n := s.M.Rows()
 
 	var v float64
 	// U, W, A, B, M
@@ -222,6 +579,10 @@ func (s *KalmanState) Update(m *Measurement) {
 		m.M.Set(4, 4, v)
 		_, _, v = m.Accums[5](m.W3)
 		m.M.Set(5, 5, v)
+		if s.gpsNoise > 0 {
+			s.setNoise(m.M, 3, s.gpsNoise*s.gpsNoise)
+		}
+		s.rW = (m.M.Get(3, 3) + m.M.Get(4, 4) + m.M.Get(5, 5)) / 3
 	} else {
 		y.Set(3, 0, 0)
 		y.Set(4, 0, 0)
@@ -244,6 +605,28 @@ func (s *KalmanState) Update(m *Measurement) {
 		m.M.Set(10, 10, v)
 		_, _, v = m.Accums[11](m.B3)
 		m.M.Set(11, 11, v)
+		// A noise density spreads its variance over the bandwidth of one sample interval.
+		if s.accelNoise > 0 && s.dt > 0 {
+			s.setNoise(m.M, 6, s.accelNoise*s.accelNoise/s.dt)
+		}
+		if s.gyroNoise > 0 && s.dt > 0 {
+			s.setNoise(m.M, 9, s.gyroNoise*s.gyroNoise/s.dt)
+		}
+		if s.vibrationGain > 0 {
+			k := math.Min(1+s.vibrationGain*s.CalcVibration(), s.vibrationMax)
+			for i := 6; i < 9; i++ {
+				m.M.Set(i, i, k*k*m.M.Get(i, i))
+			}
+		}
+		s.rA = (m.M.Get(6, 6) + m.M.Get(7, 7) + m.M.Get(8, 8)) / 3
+		s.rB = (m.M.Get(9, 9) + m.M.Get(10, 10) + m.M.Get(11, 11)) / 3
+		if s.accelClip.clipped {
+			// A clipped accelerometer reading is left out.
+			for i := 6; i < 9; i++ {
+				y.Set(i, 0, 0)
+				m.M.Set(i, i, Big)
+			}
+		}
 	} else {
 		y.Set( 6, 0, 0)
 		y.Set( 7, 0, 0)
@@ -259,7 +642,7 @@ func (s *KalmanState) Update(m *Measurement) {
 		m.M.Set(11, 11, Big)
 	}
 
-	if m.MValid {
+	if m.MValid && s.layout.Mag {
 		_, _, v = m.Accums[12](m.M1)
 		m.M.Set(12, 12, v)
 		_, _, v = m.Accums[13](m.M2)
@@ -275,15 +658,58 @@ func (s *KalmanState) Update(m *Measurement) {
 		m.M.Set(14, 14, Big)
 	}
 
-	ss := matrix.Sum(matrix.Product(h, matrix.Product(s.M, h.Transpose())), m.M)
+	s.y = y
+
+	var su *Matrix
+	if s.blockUpdate {
+		ss := sum(product(h, product(s.M, h.Transpose())), m.M)
+		if s.innovationHook != nil {
+			s.innovationHook(y, ss)
+		}
 
-	m2, err := ss.Inverse()
-	if err != nil {
-		log.Println("AHRS: Can't invert Kalman gain matrix")
-		return
+		m2, err := ss.Inverse()
+		if err != nil {
+			log.Println("AHRS: Can't invert Kalman gain matrix")
+			s.conditioningSkipCount++
+			return
+		}
+		if c := scaledCondition(ss, m2); !(c <= kalmanMaxCondition) {
+			log.Printf("AHRS: Kalman innovation covariance is ill-conditioned (%g) at %f, skipping the update\n", c, m.T)
+			s.conditioningSkipCount++
+			su = NewMatrix(n, 1)
+		} else {
+			kk := product(s.M, product(h.Transpose(), m2))
+			su = product(kk, y)
+
+			// Joseph form, (I-KH) M (I-KH)ᵀ + K R Kᵀ, which rounding can't make indefinite as easily as (I-KH) M
+			ikh := difference(eye(n), product(kk, h))
+			s.M = sum(product(ikh, product(s.M, ikh.Transpose())), product(kk, product(m.M, kk.Transpose())))
+		}
+	} else {
+		if s.innovationHook != nil {
+			s.innovationHook(y, sum(product(h, product(s.M, h.Transpose())), m.M))
+		}
+		if s.mPrev == nil {
+			s.mPrev = NewMatrix(n, n)
+		}
+		copy(s.mPrev.elements, s.M.elements)
+		var ok bool
+		if su, ok = s.sequentialUpdate(y, h, m.M); !ok {
+			log.Printf("AHRS: Kalman innovation covariance is ill-conditioned at %f, skipping the update\n", m.T)
+			s.M, s.mPrev = s.mPrev, s.M
+			s.conditioningSkipCount++
+			su = NewMatrix(n, 1)
+		} else {
+			s.trackRejections(m.M)
+		}
+	}
+	if s.idx != nil { // Map the correction back onto the full state
+		full := NewMatrix(32, 1)
+		for i, j := range s.idx {
+			full.elements[j] = su.elements[i]
+		}
+		su = full
 	}
-	kk := matrix.Product(s.M, matrix.Product(h.Transpose(), m2))
-	su := matrix.Product(kk, y)
 	s.U1 += su.Get( 0, 0)
 	s.U2 += su.Get( 1, 0)
 	s.U3 += su.Get( 2, 0)
@@ -317,10 +743,373 @@ func (s *KalmanState) Update(m *Measurement) {
 	s.L2 += su.Get(30, 0)
 	s.L3 += su.Get(31, 0)
 	s.T = m.T
-	s.M = matrix.Product(matrix.Difference(matrix.Eye(32), matrix.Product(kk, h)), s.M)
+
+	s.M.Symmetrize()
+	if _, err := s.M.Cholesky(); err != nil {
+		log.Printf("AHRS: Kalman covariance isn't positive-definite at %f, resetting it\n", s.T)
+		if s.m0 != nil {
+			s.M = s.m0.Copy()
+		}
+		if s.onReset != nil {
+			s.onReset(s.T)
+		}
+	}
 	s.normalize()
 }
 
+// sequentialUpdate updates the covariance M with each channel of the innovation y in turn, for a diagonal
+// measurement noise r, and returns the correction to the state.  This needs no matrix inversion.
+// Channels without a valid measurement, with a variance of Big, are skipped, and so are those whose
+// normalized innovation squared exceeds the gate, if set.
+// The variance of each channel's innovation, given the channels before it, is a pivot of the factorization
+// of the innovation covariance: if it is less than 1/kalmanMaxCondition of the channel's variance alone, so
+// that the channel's measurement is almost determined by the others, it returns false, leaving M part-updated.
+func (s *KalmanState) sequentialUpdate(y, h, r *Matrix) (su *Matrix, ok bool) {
+	n := s.M.rows
+	su = NewMatrix(n, 1)
+	dx, p := su.elements, s.M.elements
+	pht, kal := make([]float64, n), make([]float64, n)
+	s.rejected = s.rejected[:0]
+
+	// Variance of each channel's innovation before any are processed
+	d := make([]float64, y.rows)
+	for i := range d {
+		hi := h.elements[i*n : (i+1)*n]
+		d[i] = r.Get(i, i)
+		for j, hj := range hi {
+			if hj == 0 {
+				continue
+			}
+			for k, hk := range hi {
+				d[i] += hj * p[j*n+k] * hk
+			}
+		}
+	}
+
+	for i := 0; i < y.rows; i++ {
+		ri := r.Get(i, i)
+		if ri >= Big {
+			continue
+		}
+		hi := h.elements[i*n : (i+1)*n]
+
+		// Innovation after the corrections from the channels already processed, and its variance
+		yi := y.elements[i]
+		for j, v := range hi {
+			yi -= v * dx[j]
+		}
+		si := ri
+		for j := 0; j < n; j++ {
+			var v float64
+			for k, hk := range hi {
+				if hk != 0 {
+					v += p[j*n+k] * hk
+				}
+			}
+			pht[j] = v
+			si += hi[j] * v
+		}
+		if !(si*kalmanMaxCondition >= d[i]) {
+			return su, false
+		}
+		if s.gate > 0 && yi*yi > s.gate*si {
+			s.rejected = append(s.rejected, i)
+			continue
+		}
+
+		// K = M hᵀ / s, and the Joseph form (I - K h) M (I - K h)ᵀ + K r Kᵀ, which unlike its reduction
+		// M - K s Kᵀ keeps M symmetric and positive despite rounding: first (I - K h) M = M - K (M hᵀ)ᵀ,
+		for j := 0; j < n; j++ {
+			kal[j] = pht[j] / si
+			dx[j] += kal[j] * yi
+			for k := 0; k < n; k++ {
+				p[j*n+k] -= kal[j] * pht[k]
+			}
+		}
+		// then that times (I - K h)ᵀ, plus K r Kᵀ.
+		for j := 0; j < n; j++ {
+			var ah float64
+			for k, hk := range hi {
+				if hk != 0 {
+					ah += p[j*n+k] * hk
+				}
+			}
+			for k := 0; k < n; k++ {
+				p[j*n+k] += (ri*kal[j] - ah) * kal[k]
+			}
+		}
+		// The products are only symmetric up to rounding, which the next channel mustn't build on.
+		for j := 0; j < n; j++ {
+			for k := 0; k < j; k++ {
+				v := (p[j*n+k] + p[k*n+j]) / 2
+				p[j*n+k], p[k*n+j] = v, v
+			}
+		}
+	}
+	return su, true
+}
+
+// scaledCondition returns the condition number, in the 1-norm, of the symmetric matrix ss with inverse ssInv,
+// after scaling ss to a unit diagonal, so that channels measured to very different accuracies don't count as
+// ill-conditioned.
+func scaledCondition(ss, ssInv *Matrix) float64 {
+	n := ss.rows
+	var c, cInv float64
+	for j := 0; j < n; j++ {
+		var col, colInv float64
+		for i := 0; i < n; i++ {
+			f := math.Sqrt(ss.Get(i, i) * ss.Get(j, j))
+			col += math.Abs(ss.Get(i, j)) / f
+			colInv += math.Abs(ssInv.Get(i, j)) * f
+		}
+		c, cInv = math.Max(c, col), math.Max(cInv, colInv)
+	}
+	return c * cInv
+}
+
+// ConditioningSkipCount returns the number of Updates skipped because the innovation covariance was too
+// ill-conditioned for the correction to be trusted.
+func (s *KalmanState) ConditioningSkipCount() int {
+	return s.conditioningSkipCount
+}
+
+// SetBlockUpdate sets whether Update processes the measurements as one block, inverting their innovation
+// covariance, rather than one channel at a time.  The results agree for a diagonal measurement noise, as
+// used by Update, but the block update costs more and doesn't gate individual channels.
+func (s *KalmanState) SetBlockUpdate(block bool) {
+	s.blockUpdate = block
+}
+
+// SetGate sets the largest normalized innovation squared, y²/s, accepted for each channel of a measurement
+// by the sequential update: a chi-square threshold with one degree of freedom, e.g. 10.83 to reject 0.1% of
+// good readings.  0, the default, accepts all.
+func (s *KalmanState) SetGate(chi2 float64) {
+	s.gate = chi2
+}
+
+// RejectedChannels returns the channels, in Measurement order U, W, A, B, M, that the gate rejected
+// in the last Update.
+func (s *KalmanState) RejectedChannels() []int {
+	return append([]int(nil), s.rejected...)
+}
+
+// gateStats counts the rejections of one measurement channel by the gate.
+type gateStats struct {
+	count     int     // Number of rejections
+	rejecting bool    // Whether the channel was rejected the last time it was valid
+	since     float64 // Time of the first of the current run of rejections, s
+}
+
+// trackRejections updates the rejection counts after a sequential update with measurement noise r.
+// A channel rejected whenever valid for longer than the gate timeout means the filter has diverged from it,
+// or the sensor has failed: the covariance is reset to its initial values, so that the filter can
+// reconverge, and the gate timeout hook is called.
+func (s *KalmanState) trackRejections(r *Matrix) {
+	if s.gateStats == nil {
+		s.gateStats = make([]gateStats, r.rows)
+	}
+	rej := s.rejected
+	for i := range s.gateStats {
+		g := &s.gateStats[i]
+		if len(rej) > 0 && rej[0] == i {
+			rej = rej[1:]
+			g.count++
+			if !g.rejecting {
+				g.rejecting, g.since = true, s.T
+			}
+			continue
+		}
+		if r.Get(i, i) < Big {
+			g.rejecting = false
+		}
+	}
+	for i := range s.gateStats {
+		g := &s.gateStats[i]
+		if !g.rejecting || s.gateTimeout <= 0 || s.T-g.since <= s.gateTimeout {
+			continue
+		}
+		log.Printf("AHRS: Kalman gate has rejected channel %d since %f, resetting the covariance\n", i, g.since)
+		g.since = s.T
+		if s.m0 != nil {
+			s.M = s.m0.Copy()
+		}
+		if s.onGateTimeout != nil {
+			s.onGateTimeout(i, s.T)
+		}
+	}
+}
+
+// RejectionCounts returns the number of times the gate has rejected each channel, in Measurement order
+// U, W, A, B, M.
+func (s *KalmanState) RejectionCounts() []int {
+	counts := make([]int, len(s.gateStats))
+	for i, g := range s.gateStats {
+		counts[i] = g.count
+	}
+	return counts
+}
+
+// SetGateTimeout sets the time, s, for which the gate may reject a channel whenever it is valid before
+// Update escalates, resetting the covariance and calling the gate timeout hook.  The default is 5 s;
+// 0 never escalates.
+func (s *KalmanState) SetGateTimeout(timeout float64) {
+	if timeout >= 0 {
+		s.gateTimeout = timeout
+	}
+}
+
+// SetGateTimeoutHook sets a function to be called by Update with the channel and the time when the gate
+// has rejected that channel for longer than the gate timeout.
+func (s *KalmanState) SetGateTimeoutHook(f func(channel int, t float64)) {
+	s.onGateTimeout = f
+}
+
+// SetCovarianceResetHook sets a function to be called by Update with the time whenever the covariance M
+// has lost positive-definiteness and been reset to its initial values.
+func (s *KalmanState) SetCovarianceResetHook(f func(t float64)) {
+	s.onReset = f
+}
+
+// setNoise sets the variances of the three measurement channels starting at i to v.
+func (s *KalmanState) setNoise(r *Matrix, i int, v float64) {
+	for j := i; j < i+3; j++ {
+		r.Set(j, j, v)
+	}
+}
+
+// SetProcessNoiseDensities sets the process noise densities of the blocks of n that are set, as
+// KalmanInit.Noise does at the start, taking effect from the next Predict.  Blocks of the state that the
+// layout doesn't estimate are ignored.  Only the diagonal of N is set, so any cross terms given by
+// SetProcessNoiseMatrix are kept.  It returns a *ConfigError, changing nothing, if n is out of range.
+func (s *KalmanState) SetProcessNoiseDensities(n KalmanNoise) error {
+	if err := n.validate(); err != nil {
+		return err
+	}
+	for _, b := range n.blocks() {
+		for j, v := range b.v {
+			if k, ok := s.stateIndex(b.i + j); ok {
+				s.N.Set(k, k, v*v)
+			}
+		}
+	}
+	return nil
+}
+
+// stateIndex returns the index in the estimated state of index i of the full state, and whether
+// the layout estimates it.
+func (s *KalmanState) stateIndex(i int) (int, bool) {
+	if s.idx == nil {
+		return i, true
+	}
+	for k, j := range s.idx {
+		if j == i {
+			return k, true
+		}
+	}
+	return 0, false
+}
+
+// SetProcessNoise sets the process noise for the rotation rate H, as a random walk in °/s/√s,
+// and for the acceleration Z, in G/√s, on all three axes, as SetProcessNoiseDensities does for the
+// RotationRate and Accel blocks.  The defaults are 1 and 0.1 to 0.2.  A non-positive or non-finite value
+// is left unchanged; SetProcessNoiseDensities can set zero.
+func (s *KalmanState) SetProcessNoise(gyro, accel float64) {
+	var n KalmanNoise
+	if gyro > 0 && !math.IsInf(gyro, 0) {
+		n.RotationRate = &[3]float64{gyro, gyro, gyro}
+	}
+	if accel > 0 && !math.IsInf(accel, 0) {
+		n.Accel = &[3]float64{accel, accel, accel}
+	}
+	s.SetProcessNoiseDensities(n)
+}
+
+// ProcessNoise returns the process noise for H, °/s/√s, and for Z, G/√s, averaged over the three axes.
+func (s *KalmanState) ProcessNoise() (gyro, accel float64) {
+	return math.Sqrt((s.N.Get(10, 10) + s.N.Get(11, 11) + s.N.Get(12, 12)) / 3),
+		math.Sqrt((s.N.Get(3, 3) + s.N.Get(4, 4) + s.N.Get(5, 5)) / 3)
+}
+
+// SetProcessNoiseMatrix replaces the full process noise covariance per second, N, in the order of the
+// state, taking effect from the next Predict: 32x32, or smaller for the states of a KalmanLayout.
+// Whichever of it, SetProcessNoiseDensities and SetProcessNoise was called last sets each variance.
+// n must be symmetric with a non-negative, finite diagonal, so that it can't destabilize the covariance;
+// it is copied.
+func (s *KalmanState) SetProcessNoiseMatrix(n *Matrix) error {
+	k := s.N.Rows()
+	if n.Rows() != k || n.Cols() != k {
+		return fmt.Errorf("ahrs: process noise must be %dx%d, got %dx%d", k, k, n.Rows(), n.Cols())
+	}
+	for i := 0; i < k; i++ {
+		if v := n.Get(i, i); !(v >= 0) || math.IsInf(v, 0) {
+			return fmt.Errorf("ahrs: process noise variance %d is %g", i, v)
+		}
+		for j := 0; j < i; j++ {
+			if math.Abs(n.Get(i, j)-n.Get(j, i)) > Small*math.Max(1, math.Abs(n.Get(i, j))) {
+				return fmt.Errorf("ahrs: process noise isn't symmetric at (%d, %d)", i, j)
+			}
+		}
+	}
+	s.N = n.Copy()
+	return nil
+}
+
+// SetMeasurementNoise sets the measurement noise of the gyro as a density, °/s/√Hz, of the accelerometer,
+// G/√Hz, and of the GPS velocity as a sigma, kt, taking effect from the next Update.  The densities are
+// turned into variances by the interval between measurements.  A value of 0 returns to estimating that
+// noise from the measurements' variance accumulators, as by default; negative or non-finite values are
+// left unchanged.
+func (s *KalmanState) SetMeasurementNoise(gyro, accel, gps float64) {
+	set := func(p *float64, v float64) {
+		if v >= 0 && !math.IsInf(v, 0) {
+			*p = v
+		}
+	}
+	set(&s.gyroNoise, gyro)
+	set(&s.accelNoise, accel)
+	set(&s.gpsNoise, gps)
+}
+
+// Describe returns "kalman" with the settings of its setters, none of which Config has: the measurement
+// noise as set by SetMeasurementNoise, 0 where estimated, as gyroNoise, accelNoiseDensity and gpsNoise,
+// the gate, gateTimeout, vibrationGain and vibrationMax, and blockUpdate as 1 or 0.
+func (s *KalmanState) Describe() ProviderInfo {
+	block := 0.0
+	if s.blockUpdate {
+		block = 1
+	}
+	return ProviderInfo{Name: "kalman", Params: map[string]float64{
+		"gyroNoise":         s.gyroNoise,
+		"accelNoiseDensity": s.accelNoise,
+		"gpsNoise":          s.gpsNoise,
+		"gate":              s.gate,
+		"gateTimeout":       s.gateTimeout,
+		"vibrationGain":     s.vibrationGain,
+		"vibrationMax":      s.vibrationMax,
+		"blockUpdate":       block,
+	}}
+}
+
+// SetVibrationScaling makes Update multiply the accelerometer sigma by 1 + gain times the vibration,
+// G, as given by CalcVibration, up to max, so that the filter trusts the accelerometer less as the engine
+// shakes it.  A gain of 0, the default, keeps the accelerometer noise as set or estimated; max defaults
+// to 10 and must be at least 1.  Negative or non-finite values are left unchanged.
+func (s *KalmanState) SetVibrationScaling(gain, max float64) {
+	if gain >= 0 && !math.IsInf(gain, 0) {
+		s.vibrationGain = gain
+	}
+	if max >= 1 && !math.IsInf(max, 0) {
+		s.vibrationMax = max
+	}
+}
+
+// MeasurementNoise returns the measurement noise used by the last Update, whether set or estimated:
+// the gyro and accelerometer noise densities, °/s/√Hz and G/√Hz, and the GPS velocity sigma, kt,
+// averaged over the three axes.  A sensor that hasn't been valid yet gives 0.
+func (s *KalmanState) MeasurementNoise() (gyro, accel, gps float64) {
+	return math.Sqrt(s.rB * s.dt), math.Sqrt(s.rA * s.dt), math.Sqrt(s.rW)
+}
+
 func (s *KalmanState) PredictMeasurement() (m *Measurement) {
 	m = NewMeasurement()
 
@@ -339,9 +1128,9 @@ func (s *KalmanState) PredictMeasurement() (m *Measurement) {
 	h1 := s.H1*s.e11 + s.H2*s.e21 + s.H3*s.e31
 	h2 := s.H1*s.e12 + s.H2*s.e22 + s.H3*s.e32
 	h3 := s.H1*s.e13 + s.H2*s.e23 + s.H3*s.e33
-	a1 := -s.Z1 + (h3*s.U2 - h2*s.U3)*Deg/G - s.e31
-	a2 := -s.Z2 + (h1*s.U3 - h3*s.U1)*Deg/G - s.e32
-	a3 := -s.Z3 + (h2*s.U1 - h1*s.U2)*Deg/G - s.e33
+	a1 := -s.Z1 + DegToRad(h3*s.U2 - h2*s.U3)/G - s.e31
+	a2 := -s.Z2 + DegToRad(h1*s.U3 - h3*s.U1)/G - s.e32
+	a3 := -s.Z3 + DegToRad(h2*s.U1 - h1*s.U2)/G - s.e33
 
 	m.A1 = s.f11*a1 + s.f12*a2 + s.f13*a3 + s.C1
 	m.A2 = s.f21*a1 + s.f22*a2 + s.f23*a3 + s.C2
@@ -364,10 +1153,10 @@ func (s *KalmanState) PredictMeasurement() (m *Measurement) {
 	return
 }
 
-func (s *KalmanState) calcJacobianState(t float64) (jac *matrix.DenseMatrix) {
+func (s *KalmanState) calcJacobianState(t float64) (jac *Matrix) {
 	dt := t-s.T
 
-	jac = matrix.Eye(32)
+	jac = eye(32)
 	// U*3, Z*3, E*4, H*3, N*3,
 	// V*3, C*3, F*4, D*3, L*3
 
@@ -378,44 +1167,71 @@ func (s *KalmanState) calcJacobianState(t float64) (jac *matrix.DenseMatrix) {
 	//s.U3 += dt*s.Z3*G
 	jac.Set(2, 5, dt*G)                // U3/Z3
 
-	//s.E0 += 0.5*dt*(-s.H1*s.E1 - s.H2*s.E2 - s.H3*s.E3)*Deg
-	jac.Set(6,  7, -0.5*dt*s.H1*Deg)  // E0/E1
-	jac.Set(6,  8, -0.5*dt*s.H2*Deg)  // E0/E2
-	jac.Set(6,  9, -0.5*dt*s.H3*Deg)  // E0/E3
-	jac.Set(6, 10, -0.5*dt*s.E1*Deg)  // E0/H1
-	jac.Set(6, 11, -0.5*dt*s.E2*Deg)  // E0/H2
-	jac.Set(6, 12, -0.5*dt*s.E3*Deg)  // E0/H3
-
-	//s.E1 += 0.5*dt*(+s.H1*s.E0 + s.H2*s.E3 - s.H3*s.E2)*Deg
-	jac.Set(7,  6, +0.5*dt*s.H1*Deg)  // E1/E0
-	jac.Set(7,  8, -0.5*dt*s.H3*Deg)  // E1/E2
-	jac.Set(7,  9, +0.5*dt*s.H2*Deg)  // E1/E3
-	jac.Set(7, 10, +0.5*dt*s.E0*Deg)  // E1/H1
-	jac.Set(7, 11, +0.5*dt*s.E3*Deg)  // E1/H2
-	jac.Set(7, 12, -0.5*dt*s.E2*Deg)  // E1/H3
-
-	//s.E2 += 0.5*dt*(-s.H1*s.E3 + s.H2*s.E0 + s.H3*s.E1)*Deg
-	jac.Set(8,  6, +0.5*dt*s.H2*Deg)  // E2/E0
-	jac.Set(8,  7, +0.5*dt*s.H3*Deg)  // E2/E1
-	jac.Set(8,  9, -0.5*dt*s.H1*Deg)  // E2/E3
-	jac.Set(8, 10, -0.5*dt*s.E3*Deg)  // E2/H1
-	jac.Set(8, 11, +0.5*dt*s.E0*Deg)  // E2/H2
-	jac.Set(8, 12, +0.5*dt*s.E1*Deg)  // E2/H3
-
-	//s.E3 += 0.5*dt*(+s.H1*s.E2 - s.H2*s.E1 + s.H3*s.E0)*Deg
-	jac.Set(9,  6, +0.5*dt*s.H3*Deg)  // E3/E0
-	jac.Set(9,  7, -0.5*dt*s.H2*Deg)  // E3/E1
-	jac.Set(9,  8, +0.5*dt*s.H1*Deg)  // E3/E2
-	jac.Set(9, 10, +0.5*dt*s.E2*Deg)  // E3/H1
-	jac.Set(9, 11, -0.5*dt*s.E1*Deg)  // E3/H2
-	jac.Set(9, 12, +0.5*dt*s.E0*Deg)  // E3/H3
+	//s.E0 += DegToRad(0.5*dt*(-s.H1*s.E1 - s.H2*s.E2 - s.H3*s.E3))
+	jac.Set(6,  7, DegToRad(-0.5*dt*s.H1))  // E0/E1
+	jac.Set(6,  8, DegToRad(-0.5*dt*s.H2))  // E0/E2
+	jac.Set(6,  9, DegToRad(-0.5*dt*s.H3))  // E0/E3
+	jac.Set(6, 10, DegToRad(-0.5*dt*s.E1))  // E0/H1
+	jac.Set(6, 11, DegToRad(-0.5*dt*s.E2))  // E0/H2
+	jac.Set(6, 12, DegToRad(-0.5*dt*s.E3))  // E0/H3
+
+	//s.E1 += DegToRad(0.5*dt*(+s.H1*s.E0 + s.H2*s.E3 - s.H3*s.E2))
+	jac.Set(7,  6, DegToRad(+0.5*dt*s.H1))  // E1/E0
+	jac.Set(7,  8, DegToRad(-0.5*dt*s.H3))  // E1/E2
+	jac.Set(7,  9, DegToRad(+0.5*dt*s.H2))  // E1/E3
+	jac.Set(7, 10, DegToRad(+0.5*dt*s.E0))  // E1/H1
+	jac.Set(7, 11, DegToRad(+0.5*dt*s.E3))  // E1/H2
+	jac.Set(7, 12, DegToRad(-0.5*dt*s.E2))  // E1/H3
+
+	//s.E2 += DegToRad(0.5*dt*(-s.H1*s.E3 + s.H2*s.E0 + s.H3*s.E1))
+	jac.Set(8,  6, DegToRad(+0.5*dt*s.H2))  // E2/E0
+	jac.Set(8,  7, DegToRad(+0.5*dt*s.H3))  // E2/E1
+	jac.Set(8,  9, DegToRad(-0.5*dt*s.H1))  // E2/E3
+	jac.Set(8, 10, DegToRad(-0.5*dt*s.E3))  // E2/H1
+	jac.Set(8, 11, DegToRad(+0.5*dt*s.E0))  // E2/H2
+	jac.Set(8, 12, DegToRad(+0.5*dt*s.E1))  // E2/H3
+
+	//s.E3 += DegToRad(0.5*dt*(+s.H1*s.E2 - s.H2*s.E1 + s.H3*s.E0))
+	jac.Set(9,  6, DegToRad(+0.5*dt*s.H3))  // E3/E0
+	jac.Set(9,  7, DegToRad(-0.5*dt*s.H2))  // E3/E1
+	jac.Set(9,  8, DegToRad(+0.5*dt*s.H1))  // E3/E2
+	jac.Set(9, 10, DegToRad(+0.5*dt*s.E2))  // E3/H1
+	jac.Set(9, 11, DegToRad(-0.5*dt*s.E1))  // E3/H2
+	jac.Set(9, 12, DegToRad(+0.5*dt*s.E0))  // E3/H3
+
+	// Predict then normalizes E and F, which takes out the part of their changes along themselves
+	e := [4]float64{s.E0, s.E1, s.E2, s.E3}
+	var ep [4]float64 // E as predicted, before it is normalized
+	for i := range ep {
+		for j := range e {
+			ep[i] += jac.Get(6+i, 6+j) * e[j]
+		}
+	}
+	normalizeJacobian(jac, 6, ep)
+	normalizeJacobian(jac, 22, [4]float64{s.F0, s.F1, s.F2, s.F3})
 
 	return
 }
 
-func (s *KalmanState) calcJacobianMeasurement() (jac *matrix.DenseMatrix) {
+// normalizeJacobian turns jac, whose rows i to i+3 are the Jacobian of the quaternion q, into the
+// Jacobian of q normalized, premultiplying those rows by (I - q qᵀ/|q|²)/|q|.
+func normalizeJacobian(jac *Matrix, i int, q [4]float64) {
+	qq := q[0]*q[0] + q[1]*q[1] + q[2]*q[2] + q[3]*q[3]
+	n := math.Sqrt(qq)
+	for j := 0; j < jac.Cols(); j++ {
+		var qj float64
+		for k := range q {
+			qj += q[k] * jac.Get(i+k, j)
+		}
+		for k := range q {
+			jac.Set(i+k, j, (jac.Get(i+k, j)-q[k]*qj/qq)/n)
+		}
+	}
+}
+
+func (s *KalmanState) calcJacobianMeasurement() (jac *Matrix) {
 
-	jac = matrix.Zeros(15, 32)
+	jac = NewMatrix(15, 32)
 	// U*3, Z*3, E*4, H*3, N*3,
 	// V*3, C*3, F*4, D*3, L*3
 	// U*3, W*3, A*3, B*3, M*3
@@ -493,51 +1309,51 @@ func (s *KalmanState) calcJacobianMeasurement() (jac *matrix.DenseMatrix) {
 	h1 := s.H1*s.e11 + s.H2*s.e21 + s.H3*s.e31
 	h2 := s.H1*s.e12 + s.H2*s.e22 + s.H3*s.e32
 	h3 := s.H1*s.e13 + s.H2*s.e23 + s.H3*s.e33
-	a1 := -s.Z1 + (h3*s.U2 - h2*s.U3)*Deg/G - s.e31
-	a2 := -s.Z2 + (h1*s.U3 - h3*s.U1)*Deg/G - s.e32
-	a3 := -s.Z3 + (h2*s.U1 - h1*s.U2)*Deg/G - s.e33
+	a1 := -s.Z1 + DegToRad(h3*s.U2 - h2*s.U3)/G - s.e31
+	a2 := -s.Z2 + DegToRad(h1*s.U3 - h3*s.U1)/G - s.e32
+	a3 := -s.Z3 + DegToRad(h2*s.U1 - h1*s.U2)/G - s.e33
 
 	ae1 := s.f11*(a1+s.Z1) + s.f12*(a2+s.Z2) + s.f13*(a3+s.Z3)
 	af1 := s.f11*a1 + s.f12*a2 + s.f13*a3
-	jac.Set(6, 0, (s.f13*h2 - s.f12*h3)*Deg/G)                    // A1/U1
-	jac.Set(6, 1, (s.f11*h3 - s.f13*h1)*Deg/G)                    // A1/U2
-	jac.Set(6, 2, (s.f12*h1 - s.f11*h2)*Deg/G)                    // A1/U3
+	jac.Set(6, 0, DegToRad(s.f13*h2 - s.f12*h3)/G)                    // A1/U1
+	jac.Set(6, 1, DegToRad(s.f11*h3 - s.f13*h1)/G)                    // A1/U2
+	jac.Set(6, 2, DegToRad(s.f12*h1 - s.f11*h2)/G)                    // A1/U3
 	jac.Set(6, 3, -s.f11)                                         // A1/Z1
 	jac.Set(6, 4, -s.f12)                                         // A1/Z2
 	jac.Set(6, 5, -s.f13)                                         // A1/Z3
-	jac.Set(6, 6, 2*Deg/G*(                                       // A1/E0
+	jac.Set(6, 6, DegToRad(2)/G*(                                       // A1/E0
 		s.f11*(s.H1*( s.E2*s.U2 + s.E3*s.U3) + s.H2*(-s.E1*s.U2 - s.E0*s.U3) + s.H3*( s.E0*s.U2 - s.E1*s.U3)) +
 		s.f12*(s.H1*( s.E0*s.U3 - s.E2*s.U1) + s.H2*( s.E3*s.U3 + s.E1*s.U1) + s.H3*(-s.E2*s.U3 - s.E0*s.U1)) +
 		s.f13*(s.H1*(-s.E3*s.U1 - s.E0*s.U2) + s.H2*( s.E0*s.U1 - s.E3*s.U2) + s.H3*( s.E1*s.U1 + s.E2*s.U2)) ) -
 		2* ae1 *s.E0 -
 		2*(s.f11*(-s.E2) + s.f12*( s.E1) + s.f13*( s.E0)) )
-	jac.Set(6, 7, 2*Deg/G*(                                       // A1/E1
+	jac.Set(6, 7, DegToRad(2)/G*(                                       // A1/E1
 		s.f11*(s.H1*( s.E3*s.U2 - s.E2*s.U3) + s.H2*(-s.E0*s.U2 + s.E1*s.U3) + s.H3*(-s.E1*s.U2 - s.E0*s.U3)) +
 		s.f12*(s.H1*( s.E1*s.U3 - s.E3*s.U1) + s.H2*( s.E2*s.U3 + s.E0*s.U1) + s.H3*( s.E3*s.U3 + s.E1*s.U1)) +
 		s.f13*(s.H1*( s.E2*s.U1 - s.E1*s.U2) + s.H2*(-s.E1*s.U1 - s.E2*s.U2) + s.H3*( s.E0*s.U1 - s.E3*s.U2)) ) -
 		2* ae1 *s.E1 -
 		2*(s.f11*( s.E3) + s.f12*( s.E0) + s.f13*(-s.E1)) )
-	jac.Set(6, 8, 2*Deg/G*(                                       // A1/E2
+	jac.Set(6, 8, DegToRad(2)/G*(                                       // A1/E2
 		s.f11*(s.H1*( s.E0*s.U2 - s.E1*s.U3) + s.H2*( s.E3*s.U2 - s.E2*s.U3) + s.H3*(-s.E2*s.U2 - s.E3*s.U3)) +
 		s.f12*(s.H1*(-s.E2*s.U3 - s.E0*s.U1) + s.H2*( s.E1*s.U3 - s.E3*s.U1) + s.H3*(-s.E0*s.U3 + s.E2*s.U1)) +
 		s.f13*(s.H1*( s.E1*s.U1 + s.E2*s.U2) + s.H2*( s.E2*s.U1 - s.E1*s.U2) + s.H3*( s.E3*s.U1 + s.E0*s.U2)) ) -
 		2* ae1 *s.E2 -
 		2*(s.f11*(-s.E0) + s.f12*( s.E3) + s.f13*(-s.E2)) )
-	jac.Set(6, 9, 2*Deg/G*(                                       // A1/E3
+	jac.Set(6, 9, DegToRad(2)/G*(                                       // A1/E3
 		s.f11*(s.H1*( s.E1*s.U2 + s.E0*s.U3) + s.H2*( s.E2*s.U2 + s.E3*s.U3) + s.H3*( s.E3*s.U2 - s.E2*s.U3)) +
 		s.f12*(s.H1*(-s.E3*s.U3 - s.E1*s.U1) + s.H2*( s.E0*s.U3 - s.E2*s.U1) + s.H3*( s.E1*s.U3 - s.E3*s.U1)) +
 		s.f13*(s.H1*(-s.E0*s.U1 + s.E3*s.U2) + s.H2*(-s.E3*s.U1 - s.E0*s.U2) + s.H3*( s.E2*s.U1 - s.E1*s.U2)) ) -
 		2* ae1 *s.E3 -
 		2*(s.f11*( s.E1) + s.f12*( s.E2) + s.f13*( s.E3)) )
-	jac.Set(6, 10, Deg/G*(                                      // A1/H1
+	jac.Set(6, 10, DegToRad(1)/G*(                                      // A1/H1
 		s.f11*(s.U2*s.e13 - s.U3*s.e12) +
 		s.f12*(s.U3*s.e11 - s.U1*s.e13) +
 		s.f13*(s.U1*s.e12 - s.U2*s.e11) ))
-	jac.Set(6, 11, Deg/G*(                                      // A1/H2
+	jac.Set(6, 11, DegToRad(1)/G*(                                      // A1/H2
 		s.f11*(s.U2*s.e23 - s.U3*s.e22) +
 		s.f12*(s.U3*s.e21 - s.U1*s.e23) +
 		s.f13*(s.U1*s.e22 - s.U2*s.e21) ))
-	jac.Set(6, 12, Deg/G*(                                      // A1/H3
+	jac.Set(6, 12, DegToRad(1)/G*(                                      // A1/H3
 		s.f11*(s.U2*s.e33 - s.U3*s.e32) +
 		s.f12*(s.U3*s.e31 - s.U1*s.e33) +
 		s.f13*(s.U1*s.e32 - s.U2*s.e31) ))
@@ -557,45 +1373,45 @@ func (s *KalmanState) calcJacobianMeasurement() (jac *matrix.DenseMatrix) {
 
 	aa2 := s.f21*(a1+s.Z1) + s.f22*(a2+s.Z2) + s.f23*(a3+s.Z3)
 	af2 := s.f21*a1 + s.f22*a2 + s.f23*a3
-	jac.Set(7, 0, (h2*s.f23 - h3*s.f22)*Deg/G)                    // A2/U1
-	jac.Set(7, 1, (h3*s.f21 - h1*s.f23)*Deg/G)                    // A2/U2
-	jac.Set(7, 2, (h1*s.f22 - h2*s.f21)*Deg/G)                    // A2/U3
+	jac.Set(7, 0, DegToRad(h2*s.f23 - h3*s.f22)/G)                    // A2/U1
+	jac.Set(7, 1, DegToRad(h3*s.f21 - h1*s.f23)/G)                    // A2/U2
+	jac.Set(7, 2, DegToRad(h1*s.f22 - h2*s.f21)/G)                    // A2/U3
 	jac.Set(7, 3, -s.f21)                                         // A2/Z1
 	jac.Set(7, 4, -s.f22)                                         // A2/Z2
 	jac.Set(7, 5, -s.f23)                                         // A2/Z3
-	jac.Set(7, 6, 2*Deg/G*(                                       // A2/E0
+	jac.Set(7, 6, DegToRad(2)/G*(                                       // A2/E0
 		s.f21*(s.H1*( s.E2*s.U2 + s.E3*s.U3) + s.H2*(-s.E1*s.U2 - s.E0*s.U3) + s.H3*( s.E0*s.U2 - s.E1*s.U3)) +
 		s.f22*(s.H1*( s.E0*s.U3 - s.E2*s.U1) + s.H2*( s.E3*s.U3 + s.E1*s.U1) + s.H3*(-s.E2*s.U3 - s.E0*s.U1)) +
 		s.f23*(s.H1*(-s.E3*s.U1 - s.E0*s.U2) + s.H2*( s.E0*s.U1 - s.E3*s.U2) + s.H3*( s.E1*s.U1 + s.E2*s.U2)) ) -
 		2*aa2*s.E0 -
 		2*(s.f21*(-s.E2) + s.f22*( s.E1) + s.f23*( s.E0)) )
-	jac.Set(7, 7, 2*Deg/G*(                                       // A2/E1
+	jac.Set(7, 7, DegToRad(2)/G*(                                       // A2/E1
 		s.f21*(s.H1*( s.E3*s.U2 - s.E2*s.U3) + s.H2*(-s.E0*s.U2 + s.E1*s.U3) + s.H3*(-s.E1*s.U2 - s.E0*s.U3)) +
 		s.f22*(s.H1*( s.E1*s.U3 - s.E3*s.U1) + s.H2*( s.E2*s.U3 + s.E0*s.U1) + s.H3*( s.E3*s.U3 + s.E1*s.U1)) +
 		s.f23*(s.H1*( s.E2*s.U1 - s.E1*s.U2) + s.H2*(-s.E1*s.U1 - s.E2*s.U2) + s.H3*( s.E0*s.U1 - s.E3*s.U2)) ) -
 		2*aa2*s.E1 -
 		2*(s.f21*( s.E3) + s.f22*( s.E0) + s.f23*(-s.E1)) )
-	jac.Set(7, 8, 2*Deg/G*(                                       // A2/E2
+	jac.Set(7, 8, DegToRad(2)/G*(                                       // A2/E2
 		s.f21*(s.H1*( s.E0*s.U2 - s.E1*s.U3) + s.H2*( s.E3*s.U2 - s.E2*s.U3) + s.H3*(-s.E2*s.U2 - s.E3*s.U3)) +
 		s.f22*(s.H1*(-s.E2*s.U3 - s.E0*s.U1) + s.H2*( s.E1*s.U3 - s.E3*s.U1) + s.H3*(-s.E0*s.U3 + s.E2*s.U1)) +
 		s.f23*(s.H1*( s.E1*s.U1 + s.E2*s.U2) + s.H2*( s.E2*s.U1 - s.E1*s.U2) + s.H3*( s.E3*s.U1 + s.E0*s.U2)) ) -
 		2*aa2*s.E2 -
 		2*(s.f21*(-s.E0) + s.f22*( s.E3) + s.f23*(-s.E2)) )
-	jac.Set(7, 9, 2*Deg/G*(                                       // A2/E3
+	jac.Set(7, 9, DegToRad(2)/G*(                                       // A2/E3
 		s.f21*(s.H1*( s.E1*s.U2 + s.E0*s.U3) + s.H2*( s.E2*s.U2 + s.E3*s.U3) + s.H3*( s.E3*s.U2 - s.E2*s.U3)) +
 		s.f22*(s.H1*(-s.E3*s.U3 - s.E1*s.U1) + s.H2*( s.E0*s.U3 - s.E2*s.U1) + s.H3*( s.E1*s.U3 - s.E3*s.U1)) +
 		s.f23*(s.H1*(-s.E0*s.U1 + s.E3*s.U2) + s.H2*(-s.E3*s.U1 - s.E0*s.U2) + s.H3*( s.E2*s.U1 - s.E1*s.U2)) ) -
 		2*aa2*s.E3 -
 		2*(s.f21*( s.E1) + s.f22*( s.E2) + s.f23*( s.E3)) )
-	jac.Set(7, 10, Deg/G*(                                      // A2/H1
+	jac.Set(7, 10, DegToRad(1)/G*(                                      // A2/H1
 		s.f21*(s.U2*s.e13 - s.U3*s.e12) +
 		s.f22*(s.U3*s.e11 - s.U1*s.e13) +
 		s.f23*(s.U1*s.e12 - s.U2*s.e11) ))
-	jac.Set(7, 11, Deg/G*(                                      // A2/H2
+	jac.Set(7, 11, DegToRad(1)/G*(                                      // A2/H2
 		s.f21*(s.U2*s.e23 - s.U3*s.e22) +
 		s.f22*(s.U3*s.e21 - s.U1*s.e23) +
 		s.f23*(s.U1*s.e22 - s.U2*s.e21) ))
-	jac.Set(7, 12, Deg/G*(                                      // A2/H3
+	jac.Set(7, 12, DegToRad(1)/G*(                                      // A2/H3
 		s.f21*(s.U2*s.e33 - s.U3*s.e32) +
 		s.f22*(s.U3*s.e31 - s.U1*s.e33) +
 		s.f23*(s.U1*s.e32 - s.U2*s.e31) ))
@@ -615,45 +1431,45 @@ func (s *KalmanState) calcJacobianMeasurement() (jac *matrix.DenseMatrix) {
 
 	aa3 := s.f31*(a1+s.Z1) + s.f32*(a2+s.Z2) + s.f33*(a3+s.Z3)
 	af3 := s.f31*a1 + s.f32*a2 + s.f33*a3
-	jac.Set(8, 0, (h2*s.f33 - h3*s.f32)*Deg/G)                    // A3/U1
-	jac.Set(8, 1, (h3*s.f31 - h1*s.f33)*Deg/G)                    // A3/U2
-	jac.Set(8, 2, (h1*s.f32 - h2*s.f31)*Deg/G)                    // A3/U3
+	jac.Set(8, 0, DegToRad(h2*s.f33 - h3*s.f32)/G)                    // A3/U1
+	jac.Set(8, 1, DegToRad(h3*s.f31 - h1*s.f33)/G)                    // A3/U2
+	jac.Set(8, 2, DegToRad(h1*s.f32 - h2*s.f31)/G)                    // A3/U3
 	jac.Set(8, 3, -s.f31)                                         // A3/Z1
 	jac.Set(8, 4, -s.f32)                                         // A3/Z2
 	jac.Set(8, 5, -s.f33)                                         // A3/Z3
-	jac.Set(8, 6, 2*Deg/G*(                                       // A3/E0
+	jac.Set(8, 6, DegToRad(2)/G*(                                       // A3/E0
 		s.f31*(s.H1*( s.E2*s.U2 + s.E3*s.U3) + s.H2*(-s.E1*s.U2 - s.E0*s.U3) + s.H3*( s.E0*s.U2 - s.E1*s.U3)) +
 		s.f32*(s.H1*( s.E0*s.U3 - s.E2*s.U1) + s.H2*( s.E3*s.U3 + s.E1*s.U1) + s.H3*(-s.E2*s.U3 - s.E0*s.U1)) +
 		s.f33*(s.H1*(-s.E3*s.U1 - s.E0*s.U2) + s.H2*( s.E0*s.U1 - s.E3*s.U2) + s.H3*( s.E1*s.U1 + s.E2*s.U2)) ) -
 		2*aa3*s.E0 -
 		2*(s.f31*(-s.E2) + s.f32*( s.E1) + s.f33*( s.E0)) )
-	jac.Set(8, 7, 2*Deg/G*(                                       // A3/E1
+	jac.Set(8, 7, DegToRad(2)/G*(                                       // A3/E1
 		s.f31*(s.H1*( s.E3*s.U2 - s.E2*s.U3) + s.H2*(-s.E0*s.U2 + s.E1*s.U3) + s.H3*(-s.E1*s.U2 - s.E0*s.U3)) +
 		s.f32*(s.H1*( s.E1*s.U3 - s.E3*s.U1) + s.H2*( s.E2*s.U3 + s.E0*s.U1) + s.H3*( s.E3*s.U3 + s.E1*s.U1)) +
 		s.f33*(s.H1*( s.E2*s.U1 - s.E1*s.U2) + s.H2*(-s.E1*s.U1 - s.E2*s.U2) + s.H3*( s.E0*s.U1 - s.E3*s.U2)) ) -
 		2*aa3*s.E1 -
 		2*(s.f31*( s.E3) + s.f32*( s.E0) + s.f33*(-s.E1)) )
-	jac.Set(8, 8, 2*Deg/G*(                                       // A3/E2
+	jac.Set(8, 8, DegToRad(2)/G*(                                       // A3/E2
 		s.f31*(s.H1*( s.E0*s.U2 - s.E1*s.U3) + s.H2*( s.E3*s.U2 - s.E2*s.U3) + s.H3*(-s.E2*s.U2 - s.E3*s.U3)) +
 		s.f32*(s.H1*(-s.E2*s.U3 - s.E0*s.U1) + s.H2*( s.E1*s.U3 - s.E3*s.U1) + s.H3*(-s.E0*s.U3 + s.E2*s.U1)) +
 		s.f33*(s.H1*( s.E1*s.U1 + s.E2*s.U2) + s.H2*( s.E2*s.U1 - s.E1*s.U2) + s.H3*( s.E3*s.U1 + s.E0*s.U2)) ) -
 		2*aa3*s.E2 -
 		2*(s.f31*(-s.E0) + s.f32*( s.E3) + s.f33*(-s.E2)) )
-	jac.Set(8, 9, 2*Deg/G*(                                       // A3/E3
+	jac.Set(8, 9, DegToRad(2)/G*(                                       // A3/E3
 		s.f31*(s.H1*( s.E1*s.U2 + s.E0*s.U3) + s.H2*( s.E2*s.U2 + s.E3*s.U3) + s.H3*( s.E3*s.U2 - s.E2*s.U3)) +
 		s.f32*(s.H1*(-s.E3*s.U3 - s.E1*s.U1) + s.H2*( s.E0*s.U3 - s.E2*s.U1) + s.H3*( s.E1*s.U3 - s.E3*s.U1)) +
 		s.f33*(s.H1*(-s.E0*s.U1 + s.E3*s.U2) + s.H2*(-s.E3*s.U1 - s.E0*s.U2) + s.H3*( s.E2*s.U1 - s.E1*s.U2)) ) -
 		2*aa3*s.E3 -
 		2*(s.f31*( s.E1) + s.f32*( s.E2) + s.f33*( s.E3)) )
-	jac.Set(8, 10, Deg/G*(                                      // A3/H1
+	jac.Set(8, 10, DegToRad(1)/G*(                                      // A3/H1
 		s.f31*(s.U2*s.e13 - s.U3*s.e12) +
 		s.f32*(s.U3*s.e11 - s.U1*s.e13) +
 		s.f33*(s.U1*s.e12 - s.U2*s.e11) ))
-	jac.Set(8, 11, Deg/G*(                                      // A3/H2
+	jac.Set(8, 11, DegToRad(1)/G*(                                      // A3/H2
 		s.f31*(s.U2*s.e23 - s.U3*s.e22) +
 		s.f32*(s.U3*s.e21 - s.U1*s.e23) +
 		s.f33*(s.U1*s.e22 - s.U2*s.e21) ))
-	jac.Set(8, 12, Deg/G*(                                      // A3/H3
+	jac.Set(8, 12, DegToRad(1)/G*(                                      // A3/H3
 		s.f31*(s.U2*s.e33 - s.U3*s.e32) +
 		s.f32*(s.U3*s.e31 - s.U1*s.e33) +
 		s.f33*(s.U1*s.e32 - s.U2*s.e31) ))
@@ -672,7 +1488,6 @@ func (s *KalmanState) calcJacobianMeasurement() (jac *matrix.DenseMatrix) {
 		2*af3*s.F3)
 
 	b1 := s.f11*h1 + s.f12*h2 + s.f13*h3
-	bf1 := b1 + s.D1
 	jac.Set(9, 6,                                                 // B1/E0
 		2*( s.E0*s.H1 + s.E3*s.H2 - s.E2*s.H3)*s.f11 +
 		2*(-s.E3*s.H1 + s.E0*s.H2 + s.E1*s.H3)*s.f12 +
@@ -697,17 +1512,16 @@ func (s *KalmanState) calcJacobianMeasurement() (jac *matrix.DenseMatrix) {
 	jac.Set(9, 11, s.e21*s.f11 + s.e22*s.f12 + s.e23*s.f13 )      // B1/H2
 	jac.Set(9, 12, s.e31*s.f11 + s.e32*s.f12 + s.e33*s.f13 )      // B1/H3
 	jac.Set(9, 22, 2*( h1*s.F0 - h2*s.F3 + h3*s.F2) -             // B1/F0
-		2*bf1*s.F0)
+		2*b1*s.F0)
 	jac.Set(9, 23, 2*( h1*s.F1 + h2*s.F2 + h3*s.F3) -             // B1/F1
-		2*bf1*s.F1)
+		2*b1*s.F1)
 	jac.Set(9, 24, 2*(-h1*s.F2 + h2*s.F1 + h3*s.F0) -             // B1/F2
-		2*bf1*s.F2)
+		2*b1*s.F2)
 	jac.Set(9, 25, 2*(-h1*s.F3 - h2*s.F0 + h3*s.F1) -             // B1/F3
-		2*bf1*s.F3)
+		2*b1*s.F3)
 	jac.Set(9, 26, 1)                                             // B1/D1
 
 	b2 := s.f21*h1 + s.f22*h2 + s.f23*h3
-	bf2 := b2 + s.D2
 	jac.Set(10, 6,                                                // B2/E0
 		2*( s.E0*s.H1 + s.E3*s.H2 - s.E2*s.H3)*s.f21 +
 		2*(-s.E3*s.H1 + s.E0*s.H2 + s.E1*s.H3)*s.f22 +
@@ -732,17 +1546,16 @@ func (s *KalmanState) calcJacobianMeasurement() (jac *matrix.DenseMatrix) {
 	jac.Set(10, 11, s.e21*s.f21 + s.e22*s.f22 + s.e23*s.f23 )     // B2/H2
 	jac.Set(10, 12, s.e31*s.f21 + s.e32*s.f22 + s.e33*s.f23 )     // B2/H3
 	jac.Set(10, 22, 2*( h1*s.F3 + h2*s.F0 - h3*s.F1) -            // B2/F0
-		2*bf2*s.F0)
+		2*b2*s.F0)
 	jac.Set(10, 23, 2*( h1*s.F2 - h2*s.F1 - h3*s.F0) -            // B2/F1
-		2*bf2*s.F1)
+		2*b2*s.F1)
 	jac.Set(10, 24, 2*( h1*s.F1 + h2*s.F2 + h3*s.F3) -            // B2/F2
-		2*bf2*s.F2)
+		2*b2*s.F2)
 	jac.Set(10, 25, 2*( h1*s.F0 - h2*s.F3 + h3*s.F2) -            // B2/F3
-		2*bf2*s.F3)
+		2*b2*s.F3)
 	jac.Set(10, 27, 1)                                            // B2/D2
 
 	b3 := s.f31*h1 + s.f32*h2 + s.f33*h3
-	bf3 := b3 + s.D3
 	jac.Set(11, 6,                                                // B3/E0
 		2*( s.E0*s.H1 + s.E3*s.H2 - s.E2*s.H3)*s.f31 +
 		2*(-s.E3*s.H1 + s.E0*s.H2 + s.E1*s.H3)*s.f32 +
@@ -767,52 +1580,70 @@ func (s *KalmanState) calcJacobianMeasurement() (jac *matrix.DenseMatrix) {
 	jac.Set(11, 11, s.e21*s.f31 + s.e22*s.f32 + s.e23*s.f33 )     // B3/H2
 	jac.Set(11, 12, s.e31*s.f31 + s.e32*s.f32 + s.e33*s.f33 )     // B3/H3
 	jac.Set(11, 22, 2*(-h1*s.F2 + h2*s.F1 + h3*s.F0) -            // B3/F0
-		2*bf3*s.F0)
+		2*b3*s.F0)
 	jac.Set(11, 23, 2*( h1*s.F3 + h2*s.F0 - h3*s.F1) -            // B3/F1
-		2*bf3*s.F1)
+		2*b3*s.F1)
 	jac.Set(11, 24, 2*(-h1*s.F0 + h2*s.F3 - h3*s.F2) -            // B3/F2
-		2*bf3*s.F2)
+		2*b3*s.F2)
 	jac.Set(11, 25, 2*( h1*s.F1 + h2*s.F2 + h3*s.F3) -            // B3/F3
-		2*bf3*s.F3)
+		2*b3*s.F3)
 	jac.Set(11, 28, 1)                                            // B3/D3
 
-	//TODO westphae: fix these
-	/*
-	m1 :=  s.N1*s.e11 + s.N2*s.e21 + s.N3*s.e31 + s.L1
-	m2 :=  s.N1*s.e12 + s.N2*s.e22 + s.N3*s.e32 + s.L2
-	m3 :=  s.N1*s.e13 + s.N2*s.e23 + s.N3*s.e33 + s.L3
+	// M = F (Eᵀ N + L), with E and F normalized as in the B rows
+	e := [3][3]float64{{s.e11, s.e12, s.e13}, {s.e21, s.e22, s.e23}, {s.e31, s.e32, s.e33}}
+	f := [3][3]float64{{s.f11, s.f12, s.f13}, {s.f21, s.f22, s.f23}, {s.f31, s.f32, s.f33}}
+	n := [3]float64{s.N1, s.N2, s.N3}
+	de := rotationDerivatives(s.E0, s.E1, s.E2, s.E3)
+	df := rotationDerivatives(s.F0, s.F1, s.F2, s.F3)
+	var en, mm [3]float64 // Eᵀ N, and M without the sensor rotation
+	for c := 0; c < 3; c++ {
+		for k := 0; k < 3; k++ {
+			en[c] += n[k] * e[k][c]
+		}
+	}
+	mm = [3]float64{en[0] + s.L1, en[1] + s.L2, en[2] + s.L3}
+	for r := 0; r < 3; r++ {
+		var fen, mr float64 // F Eᵀ N and M
+		for c := 0; c < 3; c++ {
+			fen += f[r][c] * en[c]
+			mr += f[r][c] * mm[c]
+		}
+		for i, q := range [4]float64{s.E0, s.E1, s.E2, s.E3} {
+			v := -2 * q * fen
+			for c := 0; c < 3; c++ {
+				for k := 0; k < 3; k++ {
+					v += f[r][c] * n[k] * de[i][k][c]
+				}
+			}
+			jac.Set(12+r, 6+i, v) // M/E
+		}
+		for k := 0; k < 3; k++ {
+			var v float64
+			for c := 0; c < 3; c++ {
+				v += f[r][c] * e[k][c]
+			}
+			jac.Set(12+r, 13+k, v) // M/N
+			jac.Set(12+r, 29+k, f[r][k]) // M/L
+		}
+		for i, q := range [4]float64{s.F0, s.F1, s.F2, s.F3} {
+			v := -2 * q * mr
+			for c := 0; c < 3; c++ {
+				v += df[i][r][c] * mm[c]
+			}
+			jac.Set(12+r, 22+i, v) // M/F
+		}
+	}
 
-	m.M1 = s.f11*m1 + s.f21*m2 + s.f31*m3 + s.L1
-	jac.Set(12, 6, 2*(+s.E0*s.N1 - s.E3*s.N2 + s.E2*s.N3))         // M1/E0
-	jac.Set(12, 7, 2*(+s.E1*s.N1 + s.E2*s.N2 + s.E3*s.N3))         // M1/E1
-	jac.Set(12, 8, 2*(-s.E2*s.N1 + s.E1*s.N2 + s.E0*s.N3))         // M1/E2
-	jac.Set(12, 9, 2*(-s.E3*s.N1 - s.E0*s.N2 + s.E1*s.N3))         // M1/E3
-	jac.Set(12, 13, 2*(s.E1*s.E1+s.E0*s.E0-0.5))                   // M1/N1
-	jac.Set(12, 14, 2*(s.E1*s.E2-s.E0*s.E3))                       // M1/N2
-	jac.Set(12, 15, 2*(s.E1*s.E3+s.E0*s.E2))                       // M1/N3
-	jac.Set(12, 29, 1)                                             // M1/L1
-
-	m.M2 = s.f12*m1 + s.f22*m2 + s.f32*m3 + s.L2
-	jac.Set(13, 6,  2*(+s.E3*s.N1 + s.E0*s.N2 - s.E1*s.N3))        // M2/E0
-	jac.Set(13, 7,  2*(+s.E2*s.N1 - s.E1*s.N2 - s.E0*s.N3))        // M2/E1
-	jac.Set(13, 8,  2*(+s.E1*s.N1 + s.E2*s.N2 + s.E3*s.N3))        // M2/E2
-	jac.Set(13, 9,  2*(+s.E0*s.N1 - s.E3*s.N2 + s.E2*s.N3))        // M2/E3
-	jac.Set(13, 13, 2*(s.E2*s.E1 + s.E0*s.E3))                     // M2/N1
-	jac.Set(13, 14, 2*(s.E2*s.E2 + s.E0*s.E0 - 0.5))               // M2/N2
-	jac.Set(13, 15, 2*(s.E2*s.E3 - s.E0*s.E1))                     // M2/N3
-	jac.Set(13, 30, 1)                                             // M2/L2
-
-	m.M3 = s.f13*m1 + s.f23*m2 + s.f33*m3 + s.L3
-	jac.Set(14, 6,  2*(-s.E2*s.N1 + s.E1*s.N2 + s.E0*s.N3))        // M3/E0
-	jac.Set(14, 7,  2*(+s.E3*s.N1 + s.E0*s.N2 - s.E1*s.N3))        // M3/E1
-	jac.Set(14, 8,  2*(-s.E0*s.N1 + s.E3*s.N2 - s.E2*s.N3))        // M3/E2
-	jac.Set(14, 9,  2*(+s.E1*s.N1 + s.E2*s.N2 + s.E3*s.N3))        // M3/E3
-	jac.Set(14, 13, 2*(s.E3*s.E1 - s.E0*s.E2))                     // M3/N1
-	jac.Set(14, 14, 2*(s.E3*s.E2 + s.E0*s.E1))                     // M3/N2
-	jac.Set(14, 15, 2*(s.E3*s.E3 + s.E0*s.E0 - 0.5))               // M3/N3
-	jac.Set(14, 31, 1)                                             // M3/L3
-	*/
+	return
+}
 
+// rotationDerivatives returns the derivatives of the rotation matrix that calcRotationMatrices computes from
+// the quaternion q with respect to each of its components, d[i][j][k] being that of element jk by qi.
+func rotationDerivatives(q0, q1, q2, q3 float64) (d [4][3][3]float64) {
+	d[0] = [3][3]float64{{2 * q0, -2 * q3, 2 * q2}, {2 * q3, 2 * q0, -2 * q1}, {-2 * q2, 2 * q1, 2 * q0}}
+	d[1] = [3][3]float64{{2 * q1, 2 * q2, 2 * q3}, {2 * q2, -2 * q1, -2 * q0}, {2 * q3, 2 * q0, -2 * q1}}
+	d[2] = [3][3]float64{{-2 * q2, 2 * q1, 2 * q0}, {2 * q1, 2 * q2, 2 * q3}, {-2 * q0, 2 * q3, -2 * q2}}
+	d[3] = [3][3]float64{{-2 * q3, -2 * q0, 2 * q1}, {2 * q0, -2 * q3, 2 * q2}, {2 * q1, 2 * q2, 2 * q3}}
 	return
 }
 
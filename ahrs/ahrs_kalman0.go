@@ -16,8 +16,8 @@ E -> E + 0.5*E*H*dt
 H -> H
 D -> D
 
-s.E0 += -0.5*dt*s.E1*s.H1*Deg
-s.E1 += +0.5*dt*s.E0*s.H1*Deg
+s.E0 += DegToRad(-0.5*dt*s.E1*s.H1)
+s.E1 += DegToRad(+0.5*dt*s.E0*s.H1)
 
 s.H1 += 0
 s.D1 += 0
@@ -32,21 +32,19 @@ m.B1 = s.H1 + s.D1
 package ahrs
 
 import (
+	"fmt"
 	"log"
 	"math"
-
-	"fmt"
-	"github.com/skelterjohn/go.matrix"
 )
 
 type Kalman0State struct {
 	State
-	f     *matrix.DenseMatrix
+	f     *Matrix
 	z     *Measurement
-	y     *matrix.DenseMatrix
-	h     *matrix.DenseMatrix
-	ss    *matrix.DenseMatrix
-	kk    *matrix.DenseMatrix
+	y     *Matrix
+	h     *Matrix
+	ss    *Matrix
+	kk    *Matrix
 }
 
 // Initialize the state at the start of the Kalman filter, based on current measurements
@@ -57,14 +55,14 @@ func NewKalman0AHRS() (s *Kalman0State) {
 	s.E0 = 1 // Initial guess is East
 	s.F0 = 1 // Initial guess is that it's oriented pointing forward and level
 	s.normalize()
-	s.M = matrix.Zeros(32, 32)
-	s.N = matrix.Zeros(32, 32)
-	s.f = matrix.Eye(32)
+	s.M = NewMatrix(32, 32)
+	s.N = NewMatrix(32, 32)
+	s.f = eye(32)
 	s.z = NewMeasurement()
-	s.y = matrix.Zeros(15, 1)
-	s.h = matrix.Zeros(15, 32)
-	s.ss = matrix.Zeros(32, 15)
-	s.kk = matrix.Zeros(32, 15)
+	s.y = NewMatrix(15, 1)
+	s.h = NewMatrix(15, 32)
+	s.ss = NewMatrix(32, 15)
+	s.kk = NewMatrix(32, 15)
 	s.logMap = make(map[string]interface{})
 	s.updateLogMap(NewMeasurement(), s.logMap)
 
@@ -83,7 +81,7 @@ func (s *Kalman0State) init(m *Measurement) {
 
 	// Diagonal matrix of initial state uncertainties, will be squared into covariance below
 	// Specifics here aren't too important--it will change very quickly
-	s.M = matrix.Diagonal([]float64{
+	s.M = diagonal([]float64{
 		Big, Big, Big, // U*3
 		Big, Big, Big, // Z*3
 		1, 1, Big, Big, // E*4
@@ -95,12 +93,12 @@ func (s *Kalman0State) init(m *Measurement) {
 		2, Big, Big, // D*3
 		Big, Big, Big, // L*3
 	})
-	s.M = matrix.Product(s.M, s.M)
+	s.M = product(s.M, s.M)
 
 	// Diagonal matrix of state process uncertainties per s, will be squared into covariance below
 	// Tuning these is more important
 	tt := math.Sqrt(60.0 * 60.0) // One-hour time constant for drift of biases V, C, F, D, L
-	s.N = matrix.Diagonal([]float64{
+	s.N = diagonal([]float64{
 		Big, Big, Big, // U*3
 		Big, Big, Big, // Z*3
 		0.05, 0.05, Big, Big, // E*4
@@ -112,7 +110,7 @@ func (s *Kalman0State) init(m *Measurement) {
 		0.1 / tt, Big, Big, // D*3
 		Big, Big, Big, // L*3
 	})
-	s.N = matrix.Product(s.N, s.N)
+	s.N = product(s.N, s.N)
 
 	s.updateLogMap(m, s.logMap)
 
@@ -122,6 +120,10 @@ func (s *Kalman0State) init(m *Measurement) {
 
 // Compute runs first the prediction and then the update phases of the Kalman filter
 func (s *Kalman0State) Compute(m *Measurement) {
+	m = m.inKnots(&s.mKnots)
+	if !m.plausible() {
+		return // Ignore corrupt readings rather than let them poison the state
+	}
 	m.A1, m.A2, m.A3 = s.rotateByF(m.A1, m.A2, m.A3, false)
 	m.B1, m.B2, m.B3 = s.rotateByF(m.B1, m.B2, m.B3, false)
 
@@ -141,11 +143,11 @@ func (s *Kalman0State) predict(t float64) {
 	dt := t - s.T
 
 	// State vectors H and D are unchanged; only E evolves.
-	s.E0, s.E1, s.E2, s.E3 = QuaternionRotate(s.E0, s.E1, s.E2, s.E3, s.H1*dt*Deg, 0, 0)
+	s.E0, s.E1, s.E2, s.E3 = QuaternionRotate(s.E0, s.E1, s.E2, s.E3, DegToRad(s.H1*dt), 0, 0)
 	s.T = t
 
 	s.calcJacobianState(t)
-	s.M = matrix.Sum(matrix.Product(s.f, matrix.Product(s.M, s.f.Transpose())), matrix.Scaled(s.N, dt))
+	s.M = sum(product(s.f, product(s.M, s.f.Transpose())), scaled(s.N, dt))
 }
 
 // predictMeasurement returns the measurement expected given the current state.
@@ -177,7 +179,7 @@ func (s *Kalman0State) update(m *Measurement) {
 	_, _, v = m.Accums[9](m.B1)
 	m.M.Set(9, 9, v)
 
-	s.ss = matrix.Sum(matrix.Product(s.h, matrix.Product(s.M, s.h.Transpose())), m.M)
+	s.ss = sum(product(s.h, product(s.M, s.h.Transpose())), m.M)
 
 	m2, err := s.ss.Inverse()
 	if err != nil {
@@ -185,14 +187,14 @@ func (s *Kalman0State) update(m *Measurement) {
 		log.Printf("ss: %s\n", s.ss)
 		return
 	}
-	s.kk = matrix.Product(s.M, matrix.Product(s.h.Transpose(), m2))
-	su := matrix.Product(s.kk, s.y)
+	s.kk = product(s.M, product(s.h.Transpose(), m2))
+	su := product(s.kk, s.y)
 	s.E0 += su.Get(6, 0)
 	s.E1 += su.Get(7, 0)
 	s.H1 += su.Get(10, 0)
 	s.D1 += su.Get(26, 0)
 	s.T = m.T
-	s.M = matrix.Product(matrix.Difference(matrix.Eye(32), matrix.Product(s.kk, s.h)), s.M)
+	s.M = product(difference(eye(32), product(s.kk, s.h)), s.M)
 	s.normalize()
 }
 
@@ -202,13 +204,13 @@ func (s *Kalman0State) calcJacobianState(t float64) {
 	// U*3, Z*3, E*4, H*3, N*3,
 	// V*3, C*3, F*4, D*3, L*3
 
-	// s.E0 += -0.5*dt*s.E1*s.H1*Deg
-	s.f.Set(6, 7, -0.5*dt*s.H1*Deg) // E0/E1
-	s.f.Set(6, 10, -0.5*dt*s.E1*Deg) // E0/H1
+	// s.E0 += DegToRad(-0.5*dt*s.E1*s.H1)
+	s.f.Set(6, 7, DegToRad(-0.5*dt*s.H1)) // E0/E1
+	s.f.Set(6, 10, DegToRad(-0.5*dt*s.E1)) // E0/H1
 
-	//s.E1 += +0.5*dt*s.E0*s.H1*Deg
-	s.f.Set(7, 6, 0.5*dt*s.H1*Deg) // E1/E0
-	s.f.Set(7, 10, 0.5*dt*s.E0*Deg) // E1/H1
+	//s.E1 += DegToRad(+0.5*dt*s.E0*s.H1)
+	s.f.Set(7, 6, DegToRad(0.5*dt*s.H1)) // E1/E0
+	s.f.Set(7, 10, DegToRad(0.5*dt*s.E0)) // E1/H1
 
 	// H and D are unchanged.
 
@@ -246,10 +248,10 @@ func (s *Kalman0State) updateLogMap(m *Measurement, p map[string]interface{}) {
 
 	/*
 	rv, pv, hv := s.State.RollPitchHeadingUncertainty()
-	p["PitchVar"] = pv / Deg
+	p["PitchVar"] = RadToDeg(pv)
 	*/
 
-	for k, v := range map[string]*matrix.DenseMatrix {
+	for k, v := range map[string]*Matrix {
 		"M": s.M,   // M is the state uncertainty covariance matrix
 		"N": s.N,   // N is the process uncertainty covariance matrix
 		"f": s.f,   // f is the State Jacobian
@@ -0,0 +1,211 @@
+/*
+The Madgwick AHRS algorithm is Sebastian Madgwick's gradient-descent orientation filter, for IMU and
+magnetometer setups without a reliable GPS.  The gyro rates are integrated into the attitude quaternion E,
+which is at the same time pulled by a gradient-descent step towards the attitude in which gravity and, if
+available, the earth's magnetic field would appear as the accelerometer and magnetometer read them.
+The gain beta sets how hard: it should be about the gyro error, rad/s.
+
+Without a magnetometer (the IMU variant) the heading follows the gyro alone and drifts; with one (the MARG
+variant) it is held to magnetic north.  The GPS isn't used.
+*/
+package ahrs
+
+import (
+	"log"
+	"math"
+)
+
+const madgwickBetaDefault = 0.1 // Gradient-descent gain, rad/s
+
+// MadgwickState is an AHRSProvider using Madgwick's gradient-descent filter.
+type MadgwickState struct {
+	State
+	beta       float64 // Gradient-descent gain, rad/s
+	magValid   bool    // Whether the heading has been referenced to the magnetometer
+	maxDT      float64 // Above this time interval, s, re-initialize--too stale
+	logMapUsed bool    // Whether GetLogMap has been called, so logMap must be kept current
+}
+
+// NewMadgwickAHRS returns a new Madgwick AHRS object.
+func NewMadgwickAHRS() (s *MadgwickState) {
+	s = new(MadgwickState)
+	s.needsInitialization = true
+	s.aNorm = 1
+	s.E0 = 1
+	s.F0 = 1 // Initial guess is that it's oriented pointing forward and level
+	s.beta = madgwickBetaDefault
+	s.maxDT = maxDTDefault
+	s.calcRotationMatrices()
+	s.logMap = make(map[string]interface{})
+	s.updateLogMap(&noMeasurement, s.logMap)
+	return
+}
+
+func (s *MadgwickState) init(m *Measurement) {
+	s.State.init(m)
+
+	// Start from the accelerometer's gravity vector and, if there is one, the magnetometer.
+	s.roll, s.pitch = s.CalcAccelAttitude(m)
+	s.heading = 0
+	s.E0, s.E1, s.E2, s.E3 = ToQuaternion(s.roll, s.pitch, s.heading)
+	s.calcRotationMatrices()
+	s.magValid = false
+	if m1, m2, m3, ok := s.magnetometer(m); ok {
+		h1, h2, _ := s.RotateBodyToEarth(m1, m2, m3)
+		_, _, s.heading = Regularize(0, 0, -math.Atan2(h1, h2))
+		s.E0, s.E1, s.E2, s.E3 = ToQuaternion(s.roll, s.pitch, s.heading)
+		s.calcRotationMatrices()
+		s.headingMag = s.heading
+		s.magValid = true
+	}
+
+	if s.logMapUsed {
+		s.updateLogMap(m, s.logMap)
+	}
+}
+
+// Compute performs the Madgwick AHRS computations.
+func (s *MadgwickState) Compute(m *Measurement) {
+	m = m.inKnots(&s.mKnots)
+	if !m.plausible() || !m.SValid {
+		return // Ignore corrupt readings rather than let them poison the state
+	}
+	if s.needsInitialization {
+		s.init(m)
+		return
+	}
+	dt := m.T - s.T
+	if dt > s.maxDT || dt < 0 {
+		log.Printf("AHRS Info: Reinitializing at %f\n", m.T)
+		s.init(m)
+		return
+	}
+	if dt < minDT {
+		return
+	}
+
+	s.H1, s.H2, s.H3 = s.rotateByF(m.B1-s.D1, m.B2-s.D2, m.B3-s.D3, false)
+	a1, a2, a3 := s.rotateByF(m.A1, m.A2, m.A3, false)
+	a1, a2, a3 = a1/s.aNorm, a2/s.aNorm, a3/s.aNorm
+	m1, m2, m3, magOK := s.magnetometer(m)
+	rel := s.checkMag(s.H1, s.H2, s.H3, m1, m2, m3, dt, magOK)
+
+	// Rate of change of E from the gyro, 0.5*E*H
+	q0, q1, q2, q3 := s.E0, s.E1, s.E2, s.E3
+	w1, w2, w3 := DegToRad(s.H1), DegToRad(s.H2), DegToRad(s.H3)
+	d0 := 0.5 * (-q1*w1 - q2*w2 - q3*w3)
+	d1 := 0.5 * (q0*w1 - q3*w2 + q2*w3)
+	d2 := 0.5 * (q3*w1 + q0*w2 - q1*w3)
+	d3 := 0.5 * (-q2*w1 + q1*w2 + q0*w3)
+
+	// Gradient of the squared error between the measured and predicted directions of gravity and,
+	// in the MARG variant, the magnetic field
+	var g0, g1, g2, g3 float64     // Gravity
+	var gm0, gm1, gm2, gm3 float64 // Magnetic field
+	clipped := s.checkAccelClip(m) // A clipped accelerometer reading doesn't show gravity.
+	if aa := math.Sqrt(a1*a1 + a2*a2 + a3*a3); aa > Small && !clipped {
+		f1 := 2*(q1*q3-q0*q2) - a1/aa
+		f2 := 2*(q0*q1+q2*q3) - a2/aa
+		f3 := 1 - 2*(q1*q1+q2*q2) - a3/aa
+		g0 = -2*q2*f1 + 2*q1*f2
+		g1 = 2*q3*f1 + 2*q0*f2 - 4*q1*f3
+		g2 = -2*q0*f1 + 2*q3*f2 - 4*q2*f3
+		g3 = 2*q1*f1 + 2*q2*f2
+	}
+	if magOK {
+		mm := math.Sqrt(m1*m1 + m2*m2 + m3*m3)
+		m1, m2, m3 = m1/mm, m2/mm, m3/mm
+		// Reference field: the measured one in the earth frame, turned to point north
+		h1, h2, h3 := s.RotateBodyToEarth(m1, m2, m3)
+		by, bz := math.Hypot(h1, h2), h3
+		f1 := by*2*(q1*q2+q0*q3) + bz*2*(q1*q3-q0*q2) - m1
+		f2 := by*(1-2*(q1*q1+q3*q3)) + bz*2*(q0*q1+q2*q3) - m2
+		f3 := by*2*(q2*q3-q0*q1) + bz*(1-2*(q1*q1+q2*q2)) - m3
+		gm0 = (2*by*q3-2*bz*q2)*f1 + 2*bz*q1*f2 - 2*by*q1*f3
+		gm1 = (2*by*q2+2*bz*q3)*f1 + (-4*by*q1+2*bz*q0)*f2 + (-2*by*q0-4*bz*q1)*f3
+		gm2 = (2*by*q1-2*bz*q0)*f1 + 2*bz*q3*f2 + (2*by*q3-4*bz*q2)*f3
+		gm3 = (2*by*q0+2*bz*q1)*f1 + (-4*by*q3+2*bz*q2)*f2 + 2*by*q2*f3
+		s.magValid = true
+	}
+	g0, g1, g2, g3 = g0+gm0, g1+gm1, g2+gm2, g3+gm3
+	s.checkGyroSaturation(m)
+	if gg := math.Sqrt(g0*g0 + g1*g1 + g2*g2 + g3*g3); gg > Small {
+		// A disturbed magnetometer is down-weighted after normalizing, so that it is really held back.
+		beta := s.beta * s.saturationBoost(m.T)
+		d0 -= beta * (g0 - (1-rel)*gm0) / gg
+		d1 -= beta * (g1 - (1-rel)*gm1) / gg
+		d2 -= beta * (g2 - (1-rel)*gm2) / gg
+		d3 -= beta * (g3 - (1-rel)*gm3) / gg
+	}
+
+	s.E0, s.E1, s.E2, s.E3 = QuaternionNormalize(q0+d0*dt, q1+d1*dt, q2+d2*dt, q3+d3*dt)
+	s.calcRotationMatrices()
+
+	// Update the outputs from the new attitude
+	s.roll, s.pitch, s.heading = FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+	if magOK {
+		s.headingMag = s.heading
+	}
+	s.slipSkid += slowSmoothConst * (math.Atan2(-a2, a3) - s.slipSkid)
+	_, _, h3 := s.RotateBodyToEarth(w1, w2, w3)
+	s.turnRate += slowSmoothConst * (-h3 - s.turnRate) // Positive to the right
+	s.gLoad += slowSmoothConst * (a3 - s.gLoad)
+
+	if s.logMapUsed {
+		s.updateLogMap(m, s.logMap)
+	}
+
+	s.T = m.T
+}
+
+// RollPitchHeading returns the current attitude values, in radians.
+// The heading is invalid until the magnetometer has given it: the IMU variant only tracks changes in heading.
+func (s *MadgwickState) RollPitchHeading() (roll float64, pitch float64, heading float64) {
+	roll, pitch, heading = s.State.RollPitchHeading()
+	if !s.magValid {
+		heading = Invalid
+	}
+	return
+}
+
+// MagHeading returns the tilt-compensated magnetic heading in degrees, Invalid without a magnetometer.
+func (s *MadgwickState) MagHeading() (hdg float64) {
+	if !s.magValid {
+		return Invalid
+	}
+	return s.State.MagHeading()
+}
+
+// SetMaxDT sets the interval, in seconds, between measurements above which the algorithm re-initializes.
+func (s *MadgwickState) SetMaxDT(maxDT float64) {
+	s.maxDT = maxDT
+}
+
+// Describe returns "madgwick" with the current maxDT and beta.
+func (s *MadgwickState) Describe() ProviderInfo {
+	return ProviderInfo{Name: "madgwick", Params: map[string]float64{"maxDT": s.maxDT, "beta": s.beta}}
+}
+
+// SetConfig lets the user alter the gradient-descent gain beta, rad/s.
+// A missing or non-positive value is left unchanged.
+func (s *MadgwickState) SetConfig(configMap map[string]float64) {
+	if v, ok := configMap["beta"]; ok && v > 0 {
+		s.beta = v
+	}
+}
+
+// GetLogMap returns a map providing current state and measurement values for analysis.
+// It is only kept up to date by Compute from the first call to GetLogMap on.
+func (s *MadgwickState) GetLogMap() (p map[string]interface{}) {
+	s.logMapUsed = true
+	return s.logMap
+}
+
+func (s *MadgwickState) updateLogMap(m *Measurement, p map[string]interface{}) {
+	s.State.updateLogMap(m, p)
+	p["Beta"] = s.beta
+	p["magValid"] = 0.0
+	if s.magValid {
+		p["magValid"] = 1.0
+	}
+}
@@ -0,0 +1,153 @@
+package ahrs
+
+import (
+	"io/ioutil"
+	"log"
+	"math"
+	"testing"
+)
+
+// withMagnetometer adds to ms the readings of a magnetometer in an earth field of 20 µT north and 45 µT down,
+// at the attitudes given by path.
+func withMagnetometer(ms []*Measurement, path flightPath) []*Measurement {
+	return withDeclinedMagnetometer(ms, path, 0)
+}
+
+// withDeclinedMagnetometer is withMagnetometer with the field's horizontal component pointing declination
+// radians east of true north.
+func withDeclinedMagnetometer(ms []*Measurement, path flightPath, declination float64) []*Measurement {
+	s := new(State)
+	sd, cd := math.Sincos(declination)
+	for _, m := range ms {
+		roll, pitch, heading, _, _, _ := path(m.T)
+		s.E0, s.E1, s.E2, s.E3 = ToQuaternion(roll, pitch, heading)
+		m.M1, m.M2, m.M3 = s.RotateEarthToBody(20*sd, 20*cd, -45)
+		m.MValid = true
+	}
+	return ms
+}
+
+// tumble rotates in place about all three axes at once, reaching 40° of roll, 25° of pitch,
+// rates of 100°/s and every heading.
+func tumble(t float64) (roll, pitch, heading, w1, w2, w3 float64) {
+	return 40 * Deg * math.Sin(2.5*t), 25 * Deg * math.Sin(1.7*t+1), 3 * math.Sin(0.3*t), 0, 0, 0
+}
+
+// madgwickErrors returns the RMS roll, pitch and heading errors in degrees of s along path after the first
+// settle seconds, taking the heading from the quaternion even when s doesn't report it.
+func madgwickErrors(s *MadgwickState, path flightPath, settle float64, ms []*Measurement) (roll, pitch, heading float64) {
+	var n float64
+	for _, m := range ms {
+		s.Compute(m)
+		if m.T < settle {
+			continue
+		}
+		r, p, h := s.CalcRollPitchHeading()
+		rr, pp, hh, _, _, _ := path(m.T)
+		roll += math.Pow(angleErr(r, rr/Deg), 2)
+		pitch += math.Pow(angleErr(p, pp/Deg), 2)
+		heading += math.Pow(angleErr(h, hh/Deg), 2)
+		n++
+	}
+	return math.Sqrt(roll / n), math.Sqrt(pitch / n), math.Sqrt(heading / n)
+}
+
+func TestMadgwickRotationSequence(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		mag  bool
+	}{{"IMU", false}, {"MARG", true}} {
+		ms := simMeasurements(tumble, 0, 60, 0.005)
+		if c.mag {
+			ms = withMagnetometer(ms, tumble)
+		}
+		s := NewMadgwickAHRS()
+		roll, pitch, heading := madgwickErrors(s, tumble, 1, ms)
+		t.Logf("%s: roll %.3f°, pitch %.3f°, heading %.3f°", c.name, roll, pitch, heading)
+		if roll > 0.5 || pitch > 0.5 {
+			t.Errorf("%s: roll and pitch errors of %.3f° and %.3f° through the rotation sequence", c.name, roll, pitch)
+		}
+		if c.mag && heading > 0.5 {
+			t.Errorf("%s: heading error of %.3f° through the rotation sequence", c.name, heading)
+		}
+		if _, _, h := s.RollPitchHeading(); (h == Invalid) == c.mag {
+			t.Errorf("%s: expected the heading to be valid only with a magnetometer, got %f", c.name, h)
+		}
+	}
+}
+
+func TestMadgwickHeadingDrift(t *testing.T) {
+	const bias = 0.5 // °/s about the vertical
+	level := straightPath(0, 70*Deg)
+	for _, c := range []struct {
+		name string
+		mag  bool
+	}{{"IMU", false}, {"MARG", true}} {
+		ms := simMeasurements(level, 0, 120, 0.01)
+		if c.mag {
+			ms = withMagnetometer(ms, level)
+		}
+		for _, m := range ms {
+			m.B3 += bias
+		}
+		s := NewMadgwickAHRS()
+		s.Compute(ms[0])
+		_, _, h0 := s.CalcRollPitchHeading()
+		for _, m := range ms[1:] {
+			s.Compute(m)
+		}
+		roll, pitch, heading := s.CalcRollPitchHeading()
+		drift := angleErr(heading, h0)
+		t.Logf("%s: roll %.3f°, pitch %.3f°, heading %.2f° after 120 s, drifted %.2f°", c.name, roll, pitch, heading, drift)
+		if math.Abs(roll) > 0.5 || math.Abs(pitch) > 0.5 {
+			t.Errorf("%s: level aircraft has roll %f°, pitch %f°", c.name, roll, pitch)
+		}
+		if c.mag && (drift > 1 || angleErr(heading, 70) > 1) {
+			t.Errorf("%s: heading %.2f° with a magnetometer, should stay at 70°", c.name, heading)
+		}
+		if !c.mag && math.Abs(drift-bias*120) > 1 {
+			t.Errorf("%s: heading drifted %.2f° without a magnetometer, expected %.2f° from the gyro bias",
+				c.name, drift, bias*120)
+		}
+	}
+}
+
+func TestMadgwickConfig(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+	ms := withMagnetometer(simMeasurements(tumble, 0, 10, 0.005), tumble)
+
+	// Only positive gains are accepted.
+	fast, slow := NewMadgwickAHRS(), NewMadgwickAHRS()
+	fast.SetConfig(map[string]float64{"beta": 1})
+	slow.SetConfig(map[string]float64{"beta": -1})
+	if fast.beta != 1 || slow.beta != madgwickBetaDefault {
+		t.Errorf("expected beta 1 and %f, got %f and %f", madgwickBetaDefault, fast.beta, slow.beta)
+	}
+
+	// A gap longer than maxDT restarts the filter from the accelerometer and magnetometer.
+	s := NewMadgwickAHRS()
+	s.SetMaxDT(0.5)
+	s.SetSensorQuaternion(&[4]float64{0, 0, 0, 1}) // Mounted facing backwards
+	for i, m := range ms {
+		if i > 400 && i < 600 {
+			// Lose the attitude during the gap: only a restart recovers it at once.
+			s.E0, s.E1, s.E2, s.E3 = ToQuaternion(90*Deg, 0, 0)
+			continue
+		}
+		// Turn the readings into the sensor frame.
+		m.A1, m.A2, m.B1, m.B2, m.M1, m.M2 = -m.A1, -m.A2, -m.B1, -m.B2, -m.M1, -m.M2
+		s.Compute(m)
+		if r, _, _ := s.CalcRollPitchHeading(); i == 600 && angleErr(r, 40*math.Sin(2.5*m.T)) > 1 {
+			t.Errorf("expected the filter to restart after the gap, roll was %.2f°", r)
+		}
+	}
+	r, p, h := s.CalcRollPitchHeading()
+	rr, pp, hh, _, _, _ := tumble(ms[len(ms)-1].T)
+	if angleErr(r, rr/Deg) > 1 || angleErr(p, pp/Deg) > 1 || angleErr(h, hh/Deg) > 1 {
+		t.Errorf("attitude through a backwards sensor was %.2f°, %.2f°, %.2f°, expected %.2f°, %.2f°, %.2f°",
+			r, p, h, rr/Deg, pp/Deg, hh/Deg)
+	}
+}
+
+var _ AHRSProvider = (*MadgwickState)(nil)
@@ -0,0 +1,232 @@
+/*
+The Mahony AHRS algorithm is Robert Mahony's nonlinear complementary filter.  The gyro rates are integrated
+into the attitude quaternion E, corrected by proportional and integral feedback on the error between the
+directions of gravity and, if available, the earth's magnetic field that E predicts and those that the
+accelerometer and magnetometer measure.  The integral feedback learns the gyro biases.
+
+The accelerometer is only used as a reference while it reads close to 1 G, so a turn, vibration or a dropped-out
+sensor leaves the attitude to the bias-corrected gyro.  Without a magnetometer the heading drifts.
+The GPS isn't used.
+*/
+package ahrs
+
+import (
+	"log"
+	"math"
+)
+
+const (
+	mahonyKpDefault      = 1.0  // Proportional gain, rad/s per unit error
+	mahonyKiDefault      = 0.1  // Integral gain, rad/s² per unit error
+	mahonyMaxBias        = 10.0 // Largest gyro bias the integral may learn, °/s
+	mahonyAccelTolerance = 0.15 // The accelerometer isn't used once its magnitude is this far from 1 G
+)
+
+// MahonyState is an AHRSProvider using Mahony's complementary filter.
+type MahonyState struct {
+	State
+	kp, ki     float64 // Proportional and integral gains
+	b1, b2, b3 float64 // Gyro bias learned by the integral feedback, aircraft frame, °/s
+	magValid   bool    // Whether the heading has been referenced to the magnetometer
+	maxDT      float64 // Above this time interval, s, re-initialize--too stale
+	logMapUsed bool    // Whether GetLogMap has been called, so logMap must be kept current
+}
+
+// NewMahonyAHRS returns a new Mahony AHRS object.
+func NewMahonyAHRS() (s *MahonyState) {
+	s = new(MahonyState)
+	s.needsInitialization = true
+	s.aNorm = 1
+	s.E0 = 1
+	s.F0 = 1 // Initial guess is that it's oriented pointing forward and level
+	s.kp = mahonyKpDefault
+	s.ki = mahonyKiDefault
+	s.maxDT = maxDTDefault
+	s.calcRotationMatrices()
+	s.logMap = make(map[string]interface{})
+	s.updateLogMap(&noMeasurement, s.logMap)
+	return
+}
+
+// init restarts the attitude from the accelerometer and magnetometer, keeping the learned gyro bias.
+func (s *MahonyState) init(m *Measurement) {
+	s.State.init(m)
+
+	s.roll, s.pitch = s.CalcAccelAttitude(m)
+	s.heading = 0
+	s.E0, s.E1, s.E2, s.E3 = ToQuaternion(s.roll, s.pitch, s.heading)
+	s.calcRotationMatrices()
+	s.magValid = false
+	if m1, m2, m3, ok := s.magnetometer(m); ok {
+		h1, h2, _ := s.RotateBodyToEarth(m1, m2, m3)
+		_, _, s.heading = Regularize(0, 0, -math.Atan2(h1, h2))
+		s.E0, s.E1, s.E2, s.E3 = ToQuaternion(s.roll, s.pitch, s.heading)
+		s.calcRotationMatrices()
+		s.headingMag = s.heading
+		s.magValid = true
+	}
+
+	if s.logMapUsed {
+		s.updateLogMap(m, s.logMap)
+	}
+}
+
+// Reset restarts the algorithm from scratch, forgetting the learned gyro bias.
+func (s *MahonyState) Reset() {
+	s.b1, s.b2, s.b3 = 0, 0, 0
+	s.State.Reset()
+}
+
+// Compute performs the Mahony AHRS computations.
+func (s *MahonyState) Compute(m *Measurement) {
+	m = m.inKnots(&s.mKnots)
+	if !m.plausible() || !m.SValid {
+		return // Ignore corrupt readings rather than let them poison the state
+	}
+	if s.needsInitialization {
+		s.init(m)
+		return
+	}
+	dt := m.T - s.T
+	if dt > s.maxDT || dt < 0 {
+		log.Printf("AHRS Info: Reinitializing at %f\n", m.T)
+		s.init(m)
+		return
+	}
+	if dt < minDT {
+		return
+	}
+	d1, d2, d3 := s.CalcGyroBias()
+	s.updateGyroTemp(m, d1, d2, d3)
+
+	b1, b2, b3 := s.rotateByF(m.B1-s.D1, m.B2-s.D2, m.B3-s.D3, false)
+	a1, a2, a3 := s.rotateByF(m.A1, m.A2, m.A3, false)
+	a1, a2, a3 = a1/s.aNorm, a2/s.aNorm, a3/s.aNorm
+	m1, m2, m3, magOK := s.magnetometer(m)
+	rel := s.checkMag(b1-s.b1, b2-s.b2, b3-s.b3, m1, m2, m3, dt, magOK)
+
+	// Error between the measured and predicted directions of gravity and the magnetic field,
+	// as the rotation that would align them
+	q0, q1, q2, q3 := s.E0, s.E1, s.E2, s.E3
+	var e1, e2, e3 float64
+	clipped := s.checkAccelClip(m) // A clipped accelerometer reading doesn't show gravity.
+	if aa := math.Sqrt(a1*a1 + a2*a2 + a3*a3); math.Abs(aa-1) < mahonyAccelTolerance && !clipped {
+		v1, v2, v3 := 2*(q1*q3-q0*q2), 2*(q0*q1+q2*q3), 1-2*(q1*q1+q2*q2)
+		e1 += (a2*v3 - a3*v2) / aa
+		e2 += (a3*v1 - a1*v3) / aa
+		e3 += (a1*v2 - a2*v1) / aa
+	}
+	if magOK {
+		mm := math.Sqrt(m1*m1 + m2*m2 + m3*m3)
+		m1, m2, m3 = m1/mm, m2/mm, m3/mm
+		// Reference field: the measured one in the earth frame, turned to point north
+		h1, h2, h3 := s.RotateBodyToEarth(m1, m2, m3)
+		by, bz := math.Hypot(h1, h2), h3
+		w1 := by*2*(q1*q2+q0*q3) + bz*2*(q1*q3-q0*q2)
+		w2 := by*(1-2*(q1*q1+q3*q3)) + bz*2*(q0*q1+q2*q3)
+		w3 := by*2*(q2*q3-q0*q1) + bz*(1-2*(q1*q1+q2*q2))
+		e1 += rel * (m2*w3 - m3*w2) // A disturbed magnetometer is down-weighted
+		e2 += rel * (m3*w1 - m1*w3)
+		e3 += rel * (m1*w2 - m2*w1)
+		s.magValid = true
+	}
+
+	// Integral feedback learns the gyro bias, proportional feedback corrects the attitude.
+	clamp := func(b float64) float64 {
+		return math.Max(-mahonyMaxBias, math.Min(mahonyMaxBias, b))
+	}
+	s.b1 = clamp(s.b1 - RadToDeg(s.ki*e1*dt))
+	s.b2 = clamp(s.b2 - RadToDeg(s.ki*e2*dt))
+	s.b3 = clamp(s.b3 - RadToDeg(s.ki*e3*dt))
+	s.H1, s.H2, s.H3 = b1-s.b1, b2-s.b2, b3-s.b3
+	s.checkGyroSaturation(m)
+	kp := s.kp * s.saturationBoost(m.T)
+	w1 := DegToRad(s.H1) + kp*e1
+	w2 := DegToRad(s.H2) + kp*e2
+	w3 := DegToRad(s.H3) + kp*e3
+
+	s.E0, s.E1, s.E2, s.E3 = QuaternionRotate(q0, q1, q2, q3, w1*dt, w2*dt, w3*dt)
+	s.calcRotationMatrices()
+
+	// Update the outputs from the new attitude
+	s.roll, s.pitch, s.heading = FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+	if magOK {
+		s.headingMag = s.heading
+	}
+	s.slipSkid += slowSmoothConst * (math.Atan2(-a2, a3) - s.slipSkid)
+	_, _, h3 := s.RotateBodyToEarth(DegToRad(s.H1), DegToRad(s.H2), DegToRad(s.H3))
+	s.turnRate += slowSmoothConst * (-h3 - s.turnRate) // Positive to the right
+	s.gLoad += slowSmoothConst * (a3 - s.gLoad)
+
+	if s.logMapUsed {
+		s.updateLogMap(m, s.logMap)
+	}
+
+	s.T = m.T
+}
+
+// RollPitchHeading returns the current attitude values, in radians.
+// The heading is invalid until the magnetometer has given it.
+func (s *MahonyState) RollPitchHeading() (roll float64, pitch float64, heading float64) {
+	roll, pitch, heading = s.State.RollPitchHeading()
+	if !s.magValid {
+		heading = Invalid
+	}
+	return
+}
+
+// MagHeading returns the tilt-compensated magnetic heading in degrees, Invalid without a magnetometer.
+func (s *MahonyState) MagHeading() (hdg float64) {
+	if !s.magValid {
+		return Invalid
+	}
+	return s.State.MagHeading()
+}
+
+// CalcGyroBias returns the gyro biases, °/s, sensor frame: the calibrations plus the bias learned
+// by the integral feedback.
+func (s *MahonyState) CalcGyroBias() (b1, b2, b3 float64) {
+	b1, b2, b3 = s.rotateByF(s.b1, s.b2, s.b3, true)
+	return s.D1 + b1, s.D2 + b2, s.D3 + b3
+}
+
+// SetMaxDT sets the interval, in seconds, between measurements above which the algorithm re-initializes.
+func (s *MahonyState) SetMaxDT(maxDT float64) {
+	s.maxDT = maxDT
+}
+
+// Describe returns "mahony" with the current maxDT, kp and ki.
+func (s *MahonyState) Describe() ProviderInfo {
+	return ProviderInfo{Name: "mahony", Params: map[string]float64{"maxDT": s.maxDT, "kp": s.kp, "ki": s.ki}}
+}
+
+// SetConfig lets the user alter the proportional gain kp, rad/s, and the integral gain ki, rad/s².
+// A missing or out of range value (kp must be positive, ki may be 0 to learn no bias) is left unchanged.
+func (s *MahonyState) SetConfig(configMap map[string]float64) {
+	if v, ok := configMap["kp"]; ok && v > 0 {
+		s.kp = v
+	}
+	if v, ok := configMap["ki"]; ok && v >= 0 {
+		s.ki = v
+	}
+}
+
+// GetLogMap returns a map providing current state and measurement values for analysis.
+// It is only kept up to date by Compute from the first call to GetLogMap on.
+func (s *MahonyState) GetLogMap() (p map[string]interface{}) {
+	s.logMapUsed = true
+	return s.logMap
+}
+
+func (s *MahonyState) updateLogMap(m *Measurement, p map[string]interface{}) {
+	s.State.updateLogMap(m, p)
+	p["Kp"] = s.kp
+	p["Ki"] = s.ki
+	p["BiasLearned1"] = s.b1
+	p["BiasLearned2"] = s.b2
+	p["BiasLearned3"] = s.b3
+	p["magValid"] = 0.0
+	if s.magValid {
+		p["magValid"] = 1.0
+	}
+}
@@ -0,0 +1,89 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMahonyGyroBias(t *testing.T) {
+	bias := [3]float64{0.5, -0.3, 0.4} // °/s
+	ms := withMagnetometer(simMeasurements(tumble, 0, 120, 0.005), tumble)
+	for _, m := range ms {
+		m.B1, m.B2, m.B3 = m.B1+bias[0], m.B2+bias[1], m.B3+bias[2]
+	}
+	s := NewMahonyAHRS()
+	s.SetSensorQuaternion(&[4]float64{0, 0, 0, 1}) // Mounted facing backwards: the bias is in the sensor frame
+	for _, m := range ms {
+		m.A1, m.A2, m.B1, m.B2, m.M1, m.M2 = -m.A1, -m.A2, -m.B1, -m.B2, -m.M1, -m.M2
+		s.Compute(m)
+	}
+	b1, b2, b3 := s.CalcGyroBias()
+	t.Logf("learned gyro bias %.3f, %.3f, %.3f °/s", b1, b2, b3)
+	for i, b := range [3]float64{-b1, -b2, b3} {
+		if math.Abs(b-bias[i]) > 0.05 {
+			t.Errorf("gyro bias %d: learned %.3f °/s, expected %.3f °/s", i+1, b, bias[i])
+		}
+	}
+
+	r, p, h := s.CalcRollPitchHeading()
+	rr, pp, hh, _, _, _ := tumble(ms[len(ms)-1].T)
+	if angleErr(r, rr/Deg) > 0.5 || angleErr(p, pp/Deg) > 0.5 || angleErr(h, hh/Deg) > 0.5 {
+		t.Errorf("attitude %.2f°, %.2f°, %.2f°, expected %.2f°, %.2f°, %.2f°", r, p, h, rr/Deg, pp/Deg, hh/Deg)
+	}
+
+	s.Reset()
+	if b1, b2, b3 := s.CalcGyroBias(); b1 != 0 || b2 != 0 || b3 != 0 {
+		t.Errorf("expected Reset to forget the learned bias, got %f, %f, %f", b1, b2, b3)
+	}
+}
+
+func TestMahonyAccelInvalid(t *testing.T) {
+	level := straightPath(0, 70*Deg)
+	ms := simMeasurements(level, 0, 60, 0.01)
+	for _, m := range ms {
+		m.B1 += 0.5
+		if m.T >= 40 {
+			m.A1, m.A2, m.A3 = 0, 0, 0 // Accelerometer dropped out
+		}
+	}
+	s := NewMahonyAHRS()
+	s.SetConfig(map[string]float64{"ki": 0.3})
+	for _, m := range ms {
+		s.Compute(m)
+		if m.T < 40 {
+			continue
+		}
+		if r, p, _ := s.CalcRollPitchHeading(); math.Abs(r) > 2 || math.Abs(p) > 2 {
+			t.Fatalf("at %.2f s without an accelerometer: roll %.2f°, pitch %.2f°", m.T, r, p)
+		}
+	}
+	if b, _, _ := s.CalcGyroBias(); math.IsNaN(b) || math.Abs(b) > mahonyMaxBias {
+		t.Errorf("learned bias %f °/s", b)
+	}
+}
+
+func TestMahonyConfig(t *testing.T) {
+	s := NewMahonyAHRS()
+	s.SetConfig(map[string]float64{"kp": -1, "ki": -1})
+	if s.kp != mahonyKpDefault || s.ki != mahonyKiDefault {
+		t.Errorf("expected out of range gains to be ignored, got kp %f, ki %f", s.kp, s.ki)
+	}
+	s.SetConfig(map[string]float64{"kp": 2, "ki": 0})
+	if s.kp != 2 || s.ki != 0 {
+		t.Errorf("expected kp 2, ki 0, got %f, %f", s.kp, s.ki)
+	}
+
+	// The integral is clamped however large the bias.
+	ms := simMeasurements(straightPath(0, 0), 0, 60, 0.01)
+	s = NewMahonyAHRS()
+	s.SetConfig(map[string]float64{"ki": 1})
+	for _, m := range ms {
+		m.B1 += 30
+		s.Compute(m)
+	}
+	if b, _, _ := s.CalcGyroBias(); math.Abs(b-mahonyMaxBias) > Small {
+		t.Errorf("expected the learned bias to be clamped at %f °/s, got %f", mahonyMaxBias, b)
+	}
+}
+
+var _ AHRSProvider = (*MahonyState)(nil)
@@ -18,18 +18,38 @@ package ahrs
 import (
 	"log"
 	"math"
-
-	"github.com/skelterjohn/go.matrix"
 )
 
 const (
 	minDT                      = 1e-6 // Below this time interval, don't recalculate
-	maxDT                      = 10.0 // Above this time interval, re-initialize--too stale
-	minGS                      = 5.0  // Below this GS, don't use any GPS data
+	maxDTDefault               = 10.0 // Above this time interval, re-initialize--too stale
+	minGSDefault               = 5.0  // Below this GS, don't use any GPS data
+	minGSMarginDefault         = 1.0  // Once using GPS data, keep on until this far below minGS
 	fastSmoothConstDefault     = 0.7  // Sensible default for fast smoothing of AHRS values
 	slowSmoothConstDefault     = 0.1  // Sensible default for slow smoothing of AHRS values
 	verySlowSmoothConstDefault = 0.02 // Five-second smoothing mainly for groundspeed, to decide static mode
 	gpsWeightDefault           = 0.04 // Sensible default for weight of GPS-derived values in solution
+	accelWeightDefault         = 0.01 // Sensible default for weight of accelerometer-derived roll and pitch
+	accelGTolerance            = 0.02 // Accelerometer reference isn't used once its magnitude is this far from 1 G
+	maneuverRate               = 3.0  // Rotation rate, °/s, above which adaptive mode takes the aircraft to be maneuvering
+	maneuverRateFull           = 15.0 // Rotation rate, °/s, at which adaptive mode trusts the gyro the most
+	maneuverMaxReduction       = 0.9  // Fraction of the GPS weight adaptive mode takes off in a full maneuver
+	minTurnRateDenom           = 0.25 // Smallest gs²·dt, kt²·s, by which the turn rate divides the turn of the GPS velocity
+	blendTimeDefault           = 2.0  // Time, s, over which the reversion weight ramps when the GPS is taken up or dropped
+	taxiMinGS                  = 2.0  // Below this GS, Kts, the GPS track is too noisy to correct the heading in taxi mode
+	taxiHeadingTauDefault      = 5.0  // Time constant, s, of the taxi-mode reversion of the heading toward the GPS track
+	taxiMaxRate                = 2.0  // Largest correction of the heading, °/s, toward the GPS track in taxi mode
+	windMinSamples             = 30   // Number of wind triangles solved before CalcWind reports the wind
+	windMinSpread              = 30.0 // Range of ground track, °, the wind triangles must span before CalcWind reports the wind
+	rotorcraftAccelTau         = 5.0  // Time constant, s, of a rotorcraft's reversion toward the accelerometer in a hover
+	rotorcraftBiasTau          = 30.0 // Time constant, s, with which a hovering rotorcraft learns the gyro bias from the reversion
+	rotorcraftMaxBiasRate      = 2.0  // Largest reversion rate, °/s, from which a rotorcraft learns the gyro bias
+	aerobaticRollRateDefault   = 60.0 // Roll rate, °/s, above which aerobatic detection takes the aircraft to be maneuvering
+	aerobaticPitchRateDefault  = 25.0 // Pitch rate, °/s, above which aerobatic detection takes the aircraft to be maneuvering
+	aerobaticYawRateDefault    = 25.0 // Yaw rate, °/s, above which aerobatic detection takes the aircraft to be maneuvering
+	aerobaticSettle            = 1.0  // Time, s, the rates must stay below the thresholds before the references return
+	rotorcraftGTolerance       = 0.1  // A rotorcraft's accelerometer isn't used once its smoothed magnitude is this far from 1 G
+	rotorcraftMagTau           = 5.0  // Time constant, s, of a rotorcraft's reversion of the heading toward the magnetometer
 )
 
 var (
@@ -37,19 +57,64 @@ var (
 	slowSmoothConst     = slowSmoothConstDefault     // Decay constant for smoothing values reported to the user
 	verySlowSmoothConst = verySlowSmoothConstDefault // Decay constant for smoothing values reported to the user
 	gpsWeight           = gpsWeightDefault           // Weight given to GPS quaternion over gyro quaternion
+	accelWeight         = accelWeightDefault         // Weight given to accelerometer roll and pitch when level
 )
 
 type SimpleState struct {
 	State
 	tW                            float64 // Time of last GPS reading
+	tAiding                       float64 // Time of the latest measurement given to Compute or UpdateAiding, s
 	eGPS0, eGPS1, eGPS2, eGPS3    float64 // GPS-derived orientation quaternion
 	eGyr0, eGyr1, eGyr2, eGyr3    float64 // GPS-derived orientation quaternion
-	rollGPS, pitchGPS, headingGPS float64 // GPS/accel-based attitude, Rad
+	eOld0, eOld1, eOld2, eOld3    float64 // Orientation quaternion before the latest update
+	eRaw0, eRaw1, eRaw2, eRaw3    float64 // Orientation quaternion from the raw gyro rates alone since initialization
+	dtLast                        float64 // Time interval of the latest update, s
+	rollGPS, pitchGPS, headingGPS float64 // GPS/accel-based attitude, Rad; the heading is really the ground track
 	rollGyr, pitchGyr, headingGyr float64 // Gyro-based attitude, Rad
+	rollAcc, pitchAcc             float64 // Accelerometer-based attitude, Rad
+	wAcc                          float64 // Current weight of the accelerometer-based attitude
 	w1, w2, w3, gs                float64 // Groundspeed & ROC, Kts
 	smoothW1, smoothW2, smoothGS  float64 // Smoothed groundspeed used to determine if stationary
 	staticMode                    bool    // For low groundspeed or invalid GPS
+	magValid                      bool    // Whether the latest measurement had a magnetometer reading
+	crab                          float64 // Angle of the nose right of the ground track, Rad (smoothed)
+	windE, windN                  float64 // Wind velocity (toward which it blows), east and north, Kts (smoothed)
+	nWind                         int     // Number of wind triangles solved since initialization
+	windTrack0                    float64 // Ground track of the first wind triangle, Rad
+	windTrackLo, windTrackHi      float64 // Range of ground track of the wind triangles about windTrack0, Rad
 	headingValid                  bool    // Whether to slew quickly to correct heading
+	aerobaticMode                 bool    // Take roll from the gyro alone, for inverted or aerobatic flight
+	aerobaticDetect               bool    // Suspend the references while the body rates show an aerobatic maneuver
+	aerobaticUntil                float64 // Time, s, until which the references are suspended after a maneuver
+	inAerobatics                  bool    // Whether the references are suspended for a maneuver
+	deadReckonOnly                bool    // Ignore the GPS entirely, taking roll and pitch from the accelerometer
+	quaternionMode                bool    // Revert toward an external AHRS's quaternion when the measurement has one
+	adaptiveK                     bool    // Trust the gyro more while maneuvering, reverting more slowly toward the GPS
+	maneuver                      float64 // Maneuver level for adaptiveK, 0 in steady flight to 1 in a full maneuver
+	rk4                           bool    // Propagate the attitude by RK4 between successive gyro samples
+	bPrev1, bPrev2, bPrev3        float64 // Previous gyro rates for rk4, aircraft frame, °/s
+	bOld1, bOld2, bOld3           float64 // Gyro rates before bPrev for rk4, aircraft frame, °/s
+	dtPrev                        float64 // Interval from bOld to bPrev, s
+	nPrev                         int     // Number of gyro samples held in bPrev and bOld since the last initialization
+	gyro1, gyro2, gyro3           float64 // Latest gyro rates from UpdateGyro, sensor frame, °/s
+	gyroValid                     bool    // Whether UpdateGyro has given rates since the last initialization
+	minGS                         float64 // Below this smoothed GS, Kts, don't use any GPS data
+	minGSMargin                   float64 // Hysteresis, Kts, below minGS for leaving GPS mode
+	blendTime                     float64 // Time, s, over which the reversion weight ramps after entering or leaving GPS mode
+	blend                         float64 // Progress of the ramp since entering or leaving GPS mode, 0 to 1
+	taxiTau                       float64 // Time constant, s, of taxi mode's heading reversion; 0 for no taxi mode
+	taxiHeading                   bool    // Whether taxi mode has taken the heading from the GPS track since initialization
+	rotorcraft                    bool    // Aid with the accelerometer and magnetometer, the GPS only adding its acceleration
+	magHeading                    bool    // Whether a rotorcraft has taken the heading from the magnetometer since initialization
+	maxDT                         float64 // Above this time interval, s, re-initialize--too stale
+	turnRateTau                   float64 // Time constant, s, of the turn rate filter; 0 for slowSmoothConst per update
+	gpsOffset                     float64 // Time by which the GPS fixes lag the IMU clock, s; negative if they lead
+	seeded                        bool    // Whether SetAttitude has seeded the attitude, held until the GPS gives the heading
+	seedRoll, seedPitch, seedHdg  float64 // Attitude seeded by SetAttitude, Rad
+	logMapUsed                    bool    // Whether GetLogMap has been called, so logMap must be kept current
+
+	gpsAlign       *gpsAligner // GPS fixes timed on the IMU clock, only allocated once gpsOffset is set
+	aerobaticRates [3]float64  // Roll, pitch and yaw rates, °/s, above which aerobatic detection sees a maneuver
 }
 
 //NewSimpleAHRS returns a new Simple AHRS object.
@@ -58,20 +123,39 @@ func NewSimpleAHRS() (s *SimpleState) {
 	s = new(SimpleState)
 	s.needsInitialization = true
 	s.aNorm = 1
+	s.E0 = 1
 	s.F0 = 1 // Initial guess is that it's oriented pointing forward and level
-	s.M = matrix.Zeros(32, 32)
-	s.N = matrix.Zeros(32, 32)
+	s.minGS = minGSDefault
+	s.minGSMargin = minGSMarginDefault
+	s.blendTime = blendTimeDefault
+	s.taxiTau = taxiHeadingTauDefault
+	s.aerobaticRates = [3]float64{aerobaticRollRateDefault, aerobaticPitchRateDefault, aerobaticYawRateDefault}
+	s.maxDT = maxDTDefault
+	s.calcRotationMatrices()
+	// The Simple algorithm has no covariance, so M and N are left nil.
 	s.logMap = make(map[string]interface{})
-	s.updateLogMap(NewMeasurement(), s.logMap)
+	s.updateLogMap(&noMeasurement, s.logMap)
 	return
 }
 
 func (s *SimpleState) init(m *Measurement) {
 	s.State.init(m)
 
+	s.tAiding = m.T
 	s.headingValid = false
-	s.tW = m.TW
-	if m.WValid {
+	s.blend = 1
+	s.taxiHeading = false
+	s.magHeading = false
+	s.inAerobatics, s.aerobaticUntil = false, 0
+	s.windE, s.windN, s.nWind = 0, 0, 0
+	s.windTrack0, s.windTrackLo, s.windTrackHi = 0, 0, 0
+	s.nPrev = 0
+	s.gyroValid = false
+	if s.gpsAlign != nil {
+		*s.gpsAlign = gpsAligner{}
+	}
+	if s.gpsValid(m) {
+		s.tW = m.TW
 		s.gs = math.Hypot(m.W1, m.W2)
 		s.smoothW1 = s.smoothW1 + verySlowSmoothConst*(m.W1-s.smoothW1)
 		s.smoothW2 = s.smoothW2 + verySlowSmoothConst*(m.W2-s.smoothW2)
@@ -89,7 +173,7 @@ func (s *SimpleState) init(m *Measurement) {
 		s.w3 = 0
 	}
 
-	if s.smoothGS > minGS {
+	if s.smoothGS > s.minGS && !s.rotorcraft {
 		s.heading = math.Atan2(m.W1, m.W2)
 		for s.heading < 0 {
 			s.heading += 2 * Pi
@@ -97,54 +181,132 @@ func (s *SimpleState) init(m *Measurement) {
 		for s.heading >= 2*Pi {
 			s.heading -= 2 * Pi
 		}
+		s.seeded = false
+	} else if s.seeded {
+		s.roll, s.pitch, s.heading = s.seedRoll, s.seedPitch, s.seedHdg
 	}
 
 	s.eGPS0, s.eGPS1, s.eGPS2, s.eGPS3 = ToQuaternion(s.roll, s.pitch, s.heading)
 	s.eGyr0, s.eGyr1, s.eGyr2, s.eGyr3 = ToQuaternion(s.roll, s.pitch, s.heading)
 
 	s.E0, s.E1, s.E2, s.E3 = s.eGPS0, s.eGPS1, s.eGPS2, s.eGPS3
+	s.eRaw0, s.eRaw1, s.eRaw2, s.eRaw3 = s.E0, s.E1, s.E2, s.E3
 
-	s.updateLogMap(m, s.logMap)
+	if s.logMapUsed {
+		s.updateLogMap(m, s.logMap)
+	}
 }
 
 // Compute performs the AHRSSimple AHRS computations.
+// Once initialized it makes no heap allocations, unless GetLogMap has been called or it is logging an error.
 func (s *SimpleState) Compute(m *Measurement) {
+	m = m.inKnots(&s.mKnots)
+	if !m.plausible() {
+		return // Ignore corrupt readings rather than let them poison the state
+	}
 	if s.needsInitialization {
 		s.init(m)
 		return
 	}
 	dt := m.T - s.T
-	dtw := m.TW - s.tW
+	// Given through UpdateAiding, the gyro has already carried the attitude up to m.T, so dt is 0 and the
+	// references revert it over the time since the previous aiding measurement instead.
+	dtAiding := m.T - s.tAiding
+	wValid := s.gpsValid(m)
+	mw1, mw2, mw3, mtw := m.W1, m.W2, m.W3, m.TW
+	if wValid && s.gpsAlign != nil {
+		// Take the GPS velocity at the time of the IMU readings.
+		s.gpsAlign.add(m.TW-s.gpsOffset, m.W1, m.W2, m.W3)
+		mw1, mw2, mw3 = s.gpsAlign.at(m.T)
+		mtw = m.T
+	}
+	var dtw float64
+	if wValid {
+		dtw = mtw - s.tW
+	}
 
-	if dt > maxDT || dtw > maxDT {
+	if dt > s.maxDT || dt < 0 || dtw > s.maxDT {
 		log.Printf("AHRS Info: Reinitializing at %f\n", m.T)
 		s.init(m)
 		return
 	}
 
+	s.checkGyroSaturation(m)
+	boost := s.saturationBoost(m.T)
+
 	// Rotate measurements from sensor frame to aircraft frame
 	a1, a2, a3 := s.rotateByF(-m.A1, -m.A2, -m.A3, false)
 	b1, b2, b3 := s.rotateByF(m.B1-s.D1, m.B2-s.D2, m.B3-s.D3, false)
-	m1, m2, _ := s.rotateByF(s.K1*m.M1+s.L1, s.K2*m.M2+s.L2, s.K3*m.M3+s.L3, false)
+	m1, m2, m3 := s.rotateByF(s.K1*m.M1+s.L1, s.K2*m.M2+s.L2, s.K3*m.M3+s.L3, false)
+
+	// Integrate the raw gyro rates alone, with no corrections, for comparison with the fused attitude.
+	g1, g2, g3 := s.rotateByF(m.B1, m.B2, m.B3, false)
+	s.eRaw0, s.eRaw1, s.eRaw2, s.eRaw3 = QuaternionRotate(s.eRaw0, s.eRaw1, s.eRaw2, s.eRaw3,
+		DegToRad(g1*dt), DegToRad(g2*dt), DegToRad(g3*dt))
 
-	// Update estimates of current gyro  and accel rates
-	s.Z1 += fastSmoothConst * (a1/s.aNorm - s.Z1)
-	s.Z2 += fastSmoothConst * (a2/s.aNorm - s.Z2)
-	s.Z3 += fastSmoothConst * (a3/s.aNorm - s.Z3)
+	// A clipped accelerometer reading is left out of the references, leaving the gyro to carry the attitude.
+	clipped := s.checkAccelClip(m)
+	if !clipped {
+		s.checkVibration(a1/s.aNorm, a2/s.aNorm, a3/s.aNorm, m.T, m.SValid)
+
+		// Update estimates of current gyro  and accel rates
+		s.Z1 += fastSmoothConst * (a1/s.aNorm - s.Z1)
+		s.Z2 += fastSmoothConst * (a2/s.aNorm - s.Z2)
+		s.Z3 += fastSmoothConst * (a3/s.aNorm - s.Z3)
+	}
 	s.H1 += fastSmoothConst * (b1 - s.H1)
 	s.H2 += fastSmoothConst * (b2 - s.H2)
 	s.H3 += fastSmoothConst * (b3 - s.H3)
 
-	if m.WValid && dtw > minDT {
-		s.gs = math.Hypot(m.W1, m.W2)
-		s.smoothW1 = s.smoothW1 + verySlowSmoothConst*(m.W1-s.smoothW1)
-		s.smoothW2 = s.smoothW2 + verySlowSmoothConst*(m.W2-s.smoothW2)
+	if wValid && dtw > minDT {
+		s.gs = math.Hypot(mw1, mw2)
+		s.smoothW1 = s.smoothW1 + verySlowSmoothConst*(mw1-s.smoothW1)
+		s.smoothW2 = s.smoothW2 + verySlowSmoothConst*(mw2-s.smoothW2)
 		s.smoothGS = math.Hypot(s.smoothW1, s.smoothW2)
 	}
 
+	// An external AHRS's attitude takes the place of the GPS and accelerometer references.
+	if s.quaternionMode && m.QValid {
+		s.fuseQuaternion(m, b1, b2, b3, dt, boost)
+		s.T, s.tAiding = m.T, m.T
+		if wValid {
+			s.tW, s.w1, s.w2, s.w3 = mtw, mw1, mw2, mw3
+		}
+		return
+	}
+
 	ae := [3]float64{0, 0, -1} // Acceleration due to gravity in earth frame
 	ve := [3]float64{0, 1, 0}  // Groundspeed in earth frame (default for desktop mode)
-	s.staticMode = !(m.WValid && (s.smoothGS > minGS))
+	// Enter GPS mode above minGS but only leave it below minGS less the margin, so as not to chatter.
+	minGS := s.minGS
+	if !s.staticMode && s.headingValid {
+		minGS -= s.minGSMargin
+	}
+	wasStatic := s.staticMode
+	s.staticMode = !(wValid && (s.smoothGS > minGS))
+	if s.staticMode != wasStatic && s.headingValid {
+		// Start the reference from the fused attitude and ramp the reversion weight up from 0 again,
+		// so the attitude doesn't lurch toward a reference that disagrees with it.
+		s.blend = 0
+		s.eGPS0, s.eGPS1, s.eGPS2, s.eGPS3 = s.E0, s.E1, s.E2, s.E3
+	}
+	if s.blendTime > 0 {
+		s.blend = math.Min(1, s.blend+dtAiding/s.blendTime)
+	} else {
+		s.blend = 1
+	}
+	if s.aerobaticDetect && s.detectAerobatics(m.T) {
+		// Mid-maneuver the references are meaningless, so follow the gyro alone, ramping them back in after.
+		s.blend = 0
+		s.eGPS0, s.eGPS1, s.eGPS2, s.eGPS3 = s.E0, s.E1, s.E2, s.E3
+	}
+	// Taxiing too slowly for GPS mode, the track still gives the heading, though not the roll or pitch.
+	taxi := s.staticMode && wValid && dtw > minDT && s.taxiTau > 0 && s.gs >= taxiMinGS && !s.rotorcraft
+	if s.deadReckonOnly || s.seeded || s.headingValid || s.taxiHeading || s.rotorcraft {
+		// Hold the current heading, so that only roll and pitch are taken from the accelerometer.  Once the
+		// GPS has given a heading it is held after the GPS is lost too, rather than reverting toward north.
+		ve = [3]float64{math.Sin(s.heading), math.Cos(s.heading), 0}
+	}
 	if !s.staticMode {
 		if !s.headingValid {
 			s.init(m)
@@ -155,25 +317,27 @@ func (s *SimpleState) Compute(m *Measurement) {
 			log.Printf("No GPS update at %f\n", m.T)
 			return
 		}
-		ve = [3]float64{m.W1, m.W2, m.W3} // Instantaneous groundspeed in earth frame
+		if !s.rotorcraft {
+			ve = [3]float64{mw1, mw2, mw3} // Instantaneous groundspeed in earth frame
+		}
 		// Instantaneous acceleration in earth frame based on change in GPS groundspeed
-		ae[0] -= (m.W1 - s.w1) / dtw / G
-		ae[1] -= (m.W2 - s.w2) / dtw / G
-		ae[2] -= (m.W3 - s.w3) / dtw / G
+		ae[0] -= (mw1 - s.w1) / dtw / G
+		ae[1] -= (mw2 - s.w2) / dtw / G
+		ae[2] -= (mw3 - s.w3) / dtw / G
 	}
 
-	ha, err := MakeUnitVector([3]float64{s.Z1, s.Z2, s.Z3})
+	ha, err := unitVector([3]float64{s.Z1, s.Z2, s.Z3})
 	if err != nil {
 		log.Println("AHRS Error: IMU-measured acceleration was zero")
 		return
 	}
 
-	he, _ := MakeUnitVector(ae)
-	se, _ := MakeUnitVector(ve)
+	he, _ := unitVector(ae)
+	se, _ := unitVector(ve)
 
 	// Left-multiplying a vector in the aircraft frame by rotmat will put it into the earth frame.
 	// rotmat maps the current IMU acceleration to the GPS-acceleration and the x-axis to the GPS-velocity.
-	rotmat, err := MakeHardSoftRotationMatrix(*ha, [3]float64{1, 0, 0}, *he, *se)
+	rotmat, err := hardSoftRotationMatrix(ha, [3]float64{1, 0, 0}, he, se)
 	if err != nil {
 		log.Printf("AHRS Error: %s\n", err)
 		return
@@ -181,37 +345,114 @@ func (s *SimpleState) Compute(m *Measurement) {
 
 	// This orientation quaternion EGPS rotates from aircraft frame to earth frame at the current time,
 	// as estimated using GPS and accelerometer.
-	e0, e1, e2, e3 := RotationMatrixToQuaternion(*rotmat)
+	e0, e1, e2, e3 := RotationMatrixToQuaternion(rotmat)
 	e0, e1, e2, e3 = QuaternionSign(e0, e1, e2, e3, s.eGPS0, s.eGPS1, s.eGPS2, s.eGPS3)
+	k := fastSmoothConst * s.blend // Slewed from the fused attitude toward the fresh reference during a ramp
 	s.eGPS0, s.eGPS1, s.eGPS2, s.eGPS3 = QuaternionNormalize(
-		s.eGPS0+fastSmoothConst*(e0-s.eGPS0),
-		s.eGPS1+fastSmoothConst*(e1-s.eGPS1),
-		s.eGPS2+fastSmoothConst*(e2-s.eGPS2),
-		s.eGPS3+fastSmoothConst*(e3-s.eGPS3),
+		s.eGPS0+k*(e0-s.eGPS0),
+		s.eGPS1+k*(e1-s.eGPS1),
+		s.eGPS2+k*(e2-s.eGPS2),
+		s.eGPS3+k*(e3-s.eGPS3),
 	)
 
 	// By rotating the orientation quaternion at the last time step, s.E, by the measured gyro rates,
 	// we get another estimate of the current orientation quaternion using the gyro.
-	s.eGyr0, s.eGyr1, s.eGyr2, s.eGyr3 = QuaternionRotate(s.E0, s.E1, s.E2, s.E3, s.H1*dt*Deg, s.H2*dt*Deg, s.H3*dt*Deg)
+	s.eGyr0, s.eGyr1, s.eGyr2, s.eGyr3 = s.propagate(b1, b2, b3, dt)
 
 	// Now fuse the GPS/Accelerometer and Gyro estimates, smooth the result and normalize.
 	s.eGPS0, s.eGPS1, s.eGPS2, s.eGPS3 = QuaternionSign(s.eGPS0, s.eGPS1, s.eGPS2, s.eGPS3,
 		s.eGyr0, s.eGyr1, s.eGyr2, s.eGyr3)
-	de0 := s.eGPS0 - s.eGyr0
-	de1 := s.eGPS1 - s.eGyr1
-	de2 := s.eGPS2 - s.eGyr2
-	de3 := s.eGPS3 - s.eGyr3
+	r0, r1, r2, r3 := s.eGPS0, s.eGPS1, s.eGPS2, s.eGPS3
+	if s.aerobaticMode {
+		// The GPS/accel roll assumes upright, coordinated flight, so only revert pitch and heading.
+		rollGyr, _, _ := FromQuaternion(s.eGyr0, s.eGyr1, s.eGyr2, s.eGyr3)
+		_, pitchGPS, headingGPS := FromQuaternion(r0, r1, r2, r3)
+		r0, r1, r2, r3 = ToQuaternion(rollGyr, pitchGPS, headingGPS)
+		r0, r1, r2, r3 = QuaternionSign(r0, r1, r2, r3, s.eGyr0, s.eGyr1, s.eGyr2, s.eGyr3)
+	}
+	if dt > 0 {
+		s.eOld0, s.eOld1, s.eOld2, s.eOld3 = s.E0, s.E1, s.E2, s.E3
+		s.dtLast = dt
+	}
+	de0 := r0 - s.eGyr0
+	de1 := r1 - s.eGyr1
+	de2 := r2 - s.eGyr2
+	de3 := r3 - s.eGyr3
+	gw := math.Min(1, gpsWeight*boost) * s.blend
+	if s.adaptiveK {
+		gw *= 1 - maneuverMaxReduction*s.updateManeuver()
+	}
+	if s.rotorcraft && s.staticMode {
+		// A hover's only reference is the accelerometer, trusted slowly and only while it reads a steady 1 G.
+		aa := math.Sqrt(s.Z1*s.Z1 + s.Z2*s.Z2 + s.Z3*s.Z3)
+		gw = math.Min(1, (1-math.Exp(-dtAiding/rotorcraftAccelTau))*boost) *
+			math.Max(0, 1-math.Abs(aa-1)/rotorcraftGTolerance) * s.vibMon.weight() * s.blend
+	}
+	if clipped {
+		gw = 0
+	}
 	s.E0, s.E1, s.E2, s.E3 = QuaternionNormalize(
-		s.eGyr0+gpsWeight*de0*(0.5+de0*de0),
-		s.eGyr1+gpsWeight*de1*(0.5+de1*de1),
-		s.eGyr2+gpsWeight*de2*(0.5+de2*de2),
-		s.eGyr3+gpsWeight*de3*(0.5+de3*de3),
+		s.eGyr0+gw*de0*(0.5+de0*de0),
+		s.eGyr1+gw*de1*(0.5+de1*de1),
+		s.eGyr2+gw*de2*(0.5+de2*de2),
+		s.eGyr3+gw*de3*(0.5+de3*de3),
 	)
 
+	// Pull roll and pitch gently toward the accelerometer's level reference.  This is only trustworthy
+	// when the accelerometer reads close to 1 G, as the aircraft can't then be accelerating much.
 	s.roll, s.pitch, s.heading = FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+	s.rollAcc, s.pitchAcc = s.CalcAccelAttitude(m)
+	s.wAcc = 0
+	if !s.aerobaticMode && !s.inAerobatics && !clipped {
+		aa := math.Sqrt(m.A1*m.A1+m.A2*m.A2+m.A3*m.A3) / s.aNorm
+		s.wAcc = accelWeight * math.Max(0, 1-math.Abs(aa-1)/accelGTolerance) * s.vibMon.weight()
+		s.wAcc = math.Min(1, s.wAcc*boost)
+	}
+	if s.wAcc > 0 {
+		s.roll += s.wAcc * AngleDiff(s.rollAcc, s.roll)
+		s.pitch += s.wAcc * (s.pitchAcc - s.pitch)
+		e0, e1, e2, e3 := ToQuaternion(s.roll, s.pitch, s.heading)
+		s.E0, s.E1, s.E2, s.E3 = QuaternionSign(e0, e1, e2, e3, s.E0, s.E1, s.E2, s.E3)
+	}
+	if taxi {
+		s.revertToTrack(mw1, mw2, dtAiding)
+	}
+	if s.rotorcraft && m.MValid {
+		s.revertToMag(m1, m2, m3, dtAiding)
+	}
+	if s.rotorcraft && s.staticMode && !clipped {
+		s.learnGyroBias(dtAiding)
+	}
+
 	s.rollGPS, s.pitchGPS, s.headingGPS = FromQuaternion(s.eGPS0, s.eGPS1, s.eGPS2, s.eGPS3)
 	s.rollGyr, s.pitchGyr, s.headingGyr = FromQuaternion(s.eGyr0, s.eGyr1, s.eGyr2, s.eGyr3)
 
+	// Update Crab Angle: seen from the attitude, whose heading follows the track, true north is off by the crab
+	s.magValid = m.MValid
+	if m.MValid && !s.staticMode {
+		me1, me2, _ := s.RotateBodyToEarth(m1, m2, m3)
+		crab := s.declination - math.Atan2(me1, me2)
+		// Kept within (-π, π], so it can't wind up however long the crab keeps turning one way.
+		s.crab = math.Remainder(s.crab+slowSmoothConst*AngleDiff(crab, s.crab), 2*Pi)
+	}
+
+	// Update Wind: the GPS velocity less the airspeed, turned from the track to the nose by the crab
+	if m.UValid && m.MValid && wValid && !s.staticMode && dtw > minDT {
+		u1, u2, _ := s.RotateBodyToEarth(m.U1, m.U2, m.U3)
+		sc, cc := math.Sincos(s.crab)
+		u1, u2 = u1*cc+u2*sc, u2*cc-u1*sc
+		track := math.Atan2(mw1, mw2)
+		if s.nWind == 0 {
+			s.windTrack0 = track
+		}
+		dtr := AngleDiff(track, s.windTrack0)
+		s.windTrackLo, s.windTrackHi = math.Min(s.windTrackLo, dtr), math.Max(s.windTrackHi, dtr)
+		s.nWind++
+		k := math.Max(slowSmoothConst, 1/float64(s.nWind)) // A running mean until it is long enough to smooth
+		s.windE += k * (mw1 - u1 - s.windE)
+		s.windN += k * (mw2 - u2 - s.windN)
+	}
+
 	// Update Magnetic Heading
 	dhM := AngleDiff(math.Atan2(m1, m2), s.headingMag)
 	s.headingMag += slowSmoothConst * dhM
@@ -225,32 +466,262 @@ func (s *SimpleState) Compute(m *Measurement) {
 	// Update Slip/Skid
 	s.slipSkid += slowSmoothConst * (math.Atan2(a2, -a3) - s.slipSkid)
 
-	// Update Rate of Turn
-	if s.gs > 0 && dtw > 0 {
-		s.turnRate += slowSmoothConst * ((m.W2*(m.W1-s.w1)-m.W1*(m.W2-s.w2))/(s.gs*s.gs)/dtw - s.turnRate)
+	// Update Rate of Turn, holding it below MinGS, where the GPS is only still in use through the hysteresis
+	if wValid && s.gs >= s.minGS && dtw > 0 {
+		k := slowSmoothConst
+		if s.turnRateTau > 0 {
+			k = 1 - math.Exp(-dtw/s.turnRateTau)
+		}
+		// Slow, or over a very short interval, the change in track is mostly GPS noise.
+		r := (mw2*(mw1-s.w1) - mw1*(mw2-s.w2)) / math.Max(s.gs*s.gs*dtw, minTurnRateDenom)
+		if !math.IsNaN(r) && !math.IsInf(r, 0) {
+			s.turnRate += k * (r - s.turnRate)
+		}
 	}
 
 	// Update GLoad
 	s.gLoad += slowSmoothConst * (-a3/s.aNorm - s.gLoad)
 
-	s.updateLogMap(m, s.logMap)
+	if s.logMapUsed {
+		s.updateLogMap(m, s.logMap)
+	}
 
-	s.T = m.T
-	s.tW = m.TW
-	s.w1 = m.W1
-	s.w2 = m.W2
-	s.w3 = m.W3
+	s.T, s.tAiding = m.T, m.T
+	if wValid {
+		s.tW = mtw
+		s.w1 = mw1
+		s.w2 = mw2
+		s.w3 = mw3
+	}
 }
 
-// RollPitchHeading returns the current attitude values as estimated by the Kalman algorithm.
+// revertToTrack turns the heading gently toward the GPS track w1, w2 over dt for taxi mode, no faster than
+// taxiMaxRate.  A track more than 90° off the heading is taken to be the aircraft backing up, which
+// doesn't correct the heading, unless the heading hasn't been found yet, when it is taken from the track at once.
+func (s *SimpleState) revertToTrack(w1, w2, dt float64) {
+	dh := AngleDiff(math.Atan2(w1, w2), s.heading)
+	switch {
+	case !s.headingValid && !s.seeded && !s.taxiHeading:
+		s.taxiHeading = true
+	case math.Abs(dh) > Pi/2:
+		return
+	default:
+		maxDH := DegToRad(taxiMaxRate) * dt
+		dh = math.Max(-maxDH, math.Min(maxDH, dh*(1-math.Exp(-dt/s.taxiTau))))
+	}
+	s.turnHeading(dh)
+}
+
+// revertToMag turns the heading toward the magnetic heading from the magnetometer reading m1, m2, m3 in the
+// aircraft frame, at once if the heading hasn't been found yet, else with the time constant rotorcraftMagTau.
+func (s *SimpleState) revertToMag(m1, m2, m3, dt float64) {
+	// Seen from the attitude, north is off by the heading error.
+	me1, me2, _ := s.RotateBodyToEarth(m1, m2, m3)
+	dh := -math.Atan2(me1, me2)
+	if s.headingValid || s.seeded || s.magHeading {
+		dh *= 1 - math.Exp(-dt/rotorcraftMagTau)
+	}
+	s.magHeading = true
+	s.turnHeading(dh)
+}
+
+// learnGyroBias takes the rate at which the references have reverted the gyro-propagated attitude over dt
+// to be the part of the gyro bias not yet corrected, and moves the bias estimate D toward it with the time
+// constant rotorcraftBiasTau.  A fast reversion, as when the heading is first found, isn't from the bias.
+func (s *SimpleState) learnGyroBias(dt float64) {
+	c1, c2, c3 := QuaternionRates(s.eGyr0, s.eGyr1, s.eGyr2, s.eGyr3, s.E0, s.E1, s.E2, s.E3, dt)
+	if math.Sqrt(c1*c1+c2*c2+c3*c3) > rotorcraftMaxBiasRate {
+		return
+	}
+	// The gyro read the reversion rate too low, so the bias was taken that much too high.
+	d1, d2, d3 := s.rotateByF(c1, c2, c3, true)
+	k := 1 - math.Exp(-dt/rotorcraftBiasTau)
+	s.D1 -= k * d1
+	s.D2 -= k * d2
+	s.D3 -= k * d3
+}
+
+// turnHeading turns the heading by dh, holding the roll and pitch.
+func (s *SimpleState) turnHeading(dh float64) {
+	s.roll, s.pitch, s.heading = Regularize(s.roll, s.pitch, s.heading+dh)
+	e0, e1, e2, e3 := ToQuaternion(s.roll, s.pitch, s.heading)
+	s.E0, s.E1, s.E2, s.E3 = QuaternionSign(e0, e1, e2, e3, s.E0, s.E1, s.E2, s.E3)
+	s.calcRotationMatrices()
+}
+
+// fuseQuaternion rotates the attitude by the gyro rates over dt and reverts it toward the quaternion of m
+// along the shorter rotation between them, by the GPS weight sped up by boost.
+func (s *SimpleState) fuseQuaternion(m *Measurement, b1, b2, b3, dt, boost float64) {
+	s.eGyr0, s.eGyr1, s.eGyr2, s.eGyr3 = s.propagate(b1, b2, b3, dt)
+	q0, q1, q2, q3 := QuaternionNormalize(m.Q0, m.Q1, m.Q2, m.Q3)
+	s.eGPS0, s.eGPS1, s.eGPS2, s.eGPS3 = QuaternionSign(q0, q1, q2, q3, s.eGyr0, s.eGyr1, s.eGyr2, s.eGyr3)
+	if dt > 0 {
+		s.eOld0, s.eOld1, s.eOld2, s.eOld3 = s.E0, s.E1, s.E2, s.E3
+		s.dtLast = dt
+	}
+	s.E0, s.E1, s.E2, s.E3 = QuaternionSlerp(s.eGyr0, s.eGyr1, s.eGyr2, s.eGyr3,
+		s.eGPS0, s.eGPS1, s.eGPS2, s.eGPS3, math.Min(1, gpsWeight*boost))
+	s.staticMode = false // The external AHRS gives the heading
+	s.wAcc = 0
+
+	s.roll, s.pitch, s.heading = FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+	s.rollGPS, s.pitchGPS, s.headingGPS = FromQuaternion(s.eGPS0, s.eGPS1, s.eGPS2, s.eGPS3)
+	s.rollGyr, s.pitchGyr, s.headingGyr = FromQuaternion(s.eGyr0, s.eGyr1, s.eGyr2, s.eGyr3)
+	_, _, h3 := s.RotateBodyToEarth(DegToRad(s.H1), DegToRad(s.H2), DegToRad(s.H3))
+	s.turnRate += slowSmoothConst * (-h3 - s.turnRate) // Positive to the right
+
+	if s.logMapUsed {
+		s.updateLogMap(m, s.logMap)
+	}
+}
+
+// propagate returns the attitude s.E rotated by the gyro over dt.  By default it is rotated by the smoothed
+// rates H; with RK4 set it is integrated through the current gyro rates b1, b2, b3, °/s, and the previous two,
+// interpolating them quadratically across the interval.
+func (s *SimpleState) propagate(b1, b2, b3, dt float64) (e0, e1, e2, e3 float64) {
+	if dt <= 0 {
+		return s.E0, s.E1, s.E2, s.E3 // Nothing to propagate, as for aiding at the time of the latest gyro rates
+	}
+	if !s.rk4 {
+		return QuaternionRotate(s.E0, s.E1, s.E2, s.E3, DegToRad(s.H1*dt), DegToRad(s.H2*dt), DegToRad(s.H3*dt))
+	}
+	if s.nPrev == 0 {
+		s.bPrev1, s.bPrev2, s.bPrev3 = b1, b2, b3
+	}
+	// Rates at the middle of the interval, linear until there are three samples to fit a parabola through.
+	l0, l1, l2 := 0.0, 0.5, 0.5
+	if s.nPrev > 1 {
+		h0 := s.dtPrev
+		l0, l1, l2 = -dt*dt/(4*h0*(h0+dt)), (h0+dt/2)/(2*h0), (h0+dt/2)/(2*(h0+dt))
+	}
+	e0, e1, e2, e3 = quaternionRK4(s.E0, s.E1, s.E2, s.E3,
+		DegToRad(s.bPrev1), DegToRad(s.bPrev2), DegToRad(s.bPrev3),
+		DegToRad(l0*s.bOld1+l1*s.bPrev1+l2*b1), DegToRad(l0*s.bOld2+l1*s.bPrev2+l2*b2),
+		DegToRad(l0*s.bOld3+l1*s.bPrev3+l2*b3),
+		DegToRad(b1), DegToRad(b2), DegToRad(b3), dt)
+	s.bOld1, s.bOld2, s.bOld3 = s.bPrev1, s.bPrev2, s.bPrev3
+	s.bPrev1, s.bPrev2, s.bPrev3 = b1, b2, b3
+	s.dtPrev = dt
+	if s.nPrev < 2 {
+		s.nPrev++
+	}
+	return
+}
+
+// UpdateGyro propagates the attitude by the gyro rates b1, b2, b3, °/s, sensor frame, read at time t, s,
+// for a gyro read faster than the other sensors, whose readings are then given to UpdateAiding.
+// It does nothing until UpdateAiding or Compute has initialized the attitude, or if t isn't after the
+// latest update; after a gap of more than MaxDT it waits for UpdateAiding to reinitialize.
+func (s *SimpleState) UpdateGyro(b1, b2, b3, t float64) {
+	dt := t - s.T
+	if s.needsInitialization || dt <= 0 || dt > s.maxDT {
+		return
+	}
+	s.gyro1, s.gyro2, s.gyro3, s.gyroValid = b1, b2, b3, true
+	s.checkGyroRates(b1, b2, b3, t)
+	h1, h2, h3 := s.rotateByF(b1-s.D1, b2-s.D2, b3-s.D3, false)
+	s.H1 += fastSmoothConst * (h1 - s.H1)
+	s.H2 += fastSmoothConst * (h2 - s.H2)
+	s.H3 += fastSmoothConst * (h3 - s.H3)
+	g1, g2, g3 := s.rotateByF(b1, b2, b3, false)
+	s.eRaw0, s.eRaw1, s.eRaw2, s.eRaw3 = QuaternionRotate(s.eRaw0, s.eRaw1, s.eRaw2, s.eRaw3,
+		DegToRad(g1*dt), DegToRad(g2*dt), DegToRad(g3*dt))
+	s.eOld0, s.eOld1, s.eOld2, s.eOld3 = s.E0, s.E1, s.E2, s.E3
+	s.dtLast = dt
+	s.E0, s.E1, s.E2, s.E3 = s.propagate(h1, h2, h3, dt)
+	s.roll, s.pitch, s.heading = FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+	s.T = t
+}
+
+// UpdateAiding corrects the attitude propagated by UpdateGyro with the accelerometer, GPS and magnetometer
+// readings in m, as Compute does, taking the gyro rates as the latest given to UpdateGyro rather than
+// those in m.  A measurement timed before the latest gyro rates is taken as arriving with them.
+func (s *SimpleState) UpdateAiding(m *Measurement) {
+	mm := *m
+	if s.gyroValid {
+		mm.B1, mm.B2, mm.B3 = s.gyro1, s.gyro2, s.gyro3
+	}
+	if !s.needsInitialization && mm.T < s.T {
+		mm.T = s.T
+	}
+	t, dtLast := s.T, s.dtLast
+	var b1, b2, b3 float64
+	if !s.needsInitialization && dtLast > 0 {
+		b1, b2, b3 = QuaternionRates(s.eOld0, s.eOld1, s.eOld2, s.eOld3, s.E0, s.E1, s.E2, s.E3, dtLast)
+	}
+	s.Compute(&mm)
+	if mm.T == t && s.dtLast == dtLast && dtLast > 0 {
+		// The references corrected the attitude with no gyro interval of their own, so keep the latest gyro
+		// rotation, ending at the corrected attitude, for PredictMeasurement.
+		s.eOld0, s.eOld1, s.eOld2, s.eOld3 = QuaternionRotate(s.E0, s.E1, s.E2, s.E3,
+			DegToRad(-b1*dtLast), DegToRad(-b2*dtLast), DegToRad(-b3*dtLast))
+	}
+}
+
+// RollPitchHeading returns the current attitude values, in radians.
+// The heading follows the GPS velocity, so with a crosswind it is the ground track; see CalcCrabAngle.
 func (s *SimpleState) RollPitchHeading() (roll float64, pitch float64, heading float64) {
 	roll, pitch, heading = s.State.RollPitchHeading()
-	if s.staticMode {
+	if s.staticMode && !(s.rotorcraft && s.magHeading) {
 		heading = Invalid
 	}
 	return
 }
 
+// CalcCrabAngle returns the angle in degrees between the ground track and the heading from the magnetometer,
+// turned to true by the declination given to SetDeclination, positive when the nose points right of the
+// track, as into a crosswind from the right.  The heading the Simple algorithm reports is taken from the GPS
+// velocity, so it is really the track, and only the magnetometer shows where the nose points.  It is Invalid
+// without both the GPS and the magnetometer.
+func (s *SimpleState) CalcCrabAngle() float64 {
+	if s.staticMode || !s.magValid {
+		return Invalid
+	}
+	return RadToDeg(s.crab)
+}
+
+// CalcWind returns the speed, Kts, and the direction from which the wind blows, ° true, from the wind
+// triangle of the airspeed along the nose and the GPS velocity.  The nose is found from the track by the crab
+// angle seen by the magnetometer, so valid is only true once enough wind triangles have been solved
+// with valid airspeed, GPS and magnetometer readings while in GPS mode, over a spread of ground tracks
+// wide enough that an error in the airspeed or crab doesn't pass for wind.  See SetDeclination.
+func (s *SimpleState) CalcWind() (windSpeed, windDir float64, valid bool) {
+	if s.nWind < windMinSamples || s.windTrackHi-s.windTrackLo < DegToRad(windMinSpread) {
+		return Invalid, Invalid, false
+	}
+	windDir = RadToDeg(math.Atan2(-s.windE, -s.windN))
+	if windDir < 0 {
+		windDir += 360
+	}
+	return math.Hypot(s.windE, s.windN), windDir, true
+}
+
+// CalcGyroOnlyAttitude returns the roll, pitch and heading in degrees from integrating the raw gyro rates alone,
+// with no bias correction and no reference, since the attitude was last initialized.  Its divergence from
+// CalcRollPitchHeading shows the drift that the references are correcting.
+func (s *SimpleState) CalcGyroOnlyAttitude() (roll, pitch, heading float64) {
+	roll, pitch, heading = FromQuaternion(s.eRaw0, s.eRaw1, s.eRaw2, s.eRaw3)
+	return RadToDeg(roll), RadToDeg(pitch), RadToDeg(heading)
+}
+
+// CalcTrack returns the ground track of the GPS velocity in degrees, which is also the heading the Simple
+// algorithm reports.  It is Invalid below MinGS.
+func (s *SimpleState) CalcTrack() float64 {
+	if s.staticMode {
+		return Invalid
+	}
+	return trackFromVelocity(s.w1, s.w2)
+}
+
+// CalcAttitude returns a compact copy of the attitude, with the rate of turn as RateOfTurn, Invalid without the
+// GPS, and the rate of climb of the GPS velocity.
+func (s *SimpleState) CalcAttitude() Attitude {
+	a := s.Attitude()
+	a.TurnRate = s.RateOfTurn()
+	a.ROC = MSToFPM(KnotsToMS(s.w3))
+	return a
+}
+
 // RateOfTurn returns the turn rate in degrees per second.
 func (s *SimpleState) RateOfTurn() (turnRate float64) {
 	if s.staticMode {
@@ -259,6 +730,246 @@ func (s *SimpleState) RateOfTurn() (turnRate float64) {
 	return s.State.RateOfTurn()
 }
 
+// CalcCovarianceTrace always returns NaN, since the Simple algorithm doesn't track a covariance.
+func (s *SimpleState) CalcCovarianceTrace() float64 {
+	return math.NaN()
+}
+
+// PredictMeasurement returns the measurement that the current state implies:
+// gyro rates from the latest change in attitude, accelerometer from gravity plus the centripetal
+// acceleration of a coordinated turn at the current bank and groundspeed, and GPS velocity from the
+// groundspeed, heading and vertical speed.  The GPS velocity is only valid when the GPS is in use.
+// The Simple algorithm doesn't model airspeed or the earth's magnetic field, so U and M are invalid.
+func (s *SimpleState) PredictMeasurement() (m *Measurement) {
+	m = NewMeasurement()
+	m.T = s.T
+	if s.needsInitialization {
+		return
+	}
+
+	// Body rotation from the previous attitude to the current one
+	b1, b2, b3 := QuaternionRates(s.eOld0, s.eOld1, s.eOld2, s.eOld3, s.E0, s.E1, s.E2, s.E3, s.dtLast)
+	m.B1, m.B2, m.B3 = s.rotateByF(b1, b2, b3, true)
+	m.B1 += s.D1
+	m.B2 += s.D2
+	m.B3 += s.D3
+
+	// Specific force in earth frame: 1G upwards plus the centripetal acceleration of a coordinated turn.
+	roll, _, heading := FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+	var f1, f2 float64
+	if !s.staticMode && s.gs > 0 {
+		tr := G * math.Tan(roll) / s.gs // rad/s
+		f1 = s.gs * tr * math.Cos(heading) / G
+		f2 = -s.gs * tr * math.Sin(heading) / G
+	}
+	r := QuaternionToRotationMatrix(s.E0, s.E1, s.E2, s.E3)
+	a1 := r[0][0]*f1 + r[1][0]*f2 + r[2][0]
+	a2 := r[0][1]*f1 + r[1][1]*f2 + r[2][1]
+	a3 := r[0][2]*f1 + r[1][2]*f2 + r[2][2]
+	m.A1, m.A2, m.A3 = s.rotateByF(a1*s.aNorm, a2*s.aNorm, a3*s.aNorm, true)
+	m.SValid = true
+
+	if !s.staticMode {
+		m.W1 = s.gs * math.Sin(heading)
+		m.W2 = s.gs * math.Cos(heading)
+		m.W3 = s.w3
+		m.TW = s.T
+		m.WValid = true
+	}
+	return
+}
+
+// SetAttitude seeds the attitude with a known roll, pitch and heading, in radians, e.g. a heading from
+// a surveyed compass rose during initialization on the ground, without waiting for the sensors to converge.
+// The GPS-derived attitude is reset to match, and the heading is held until the GPS track takes over.
+// If the algorithm hasn't been initialized yet, the seed is applied when it is.
+func (s *SimpleState) SetAttitude(roll, pitch, heading float64) {
+	s.seedRoll, s.seedPitch, s.seedHdg = Regularize(roll, pitch, heading)
+	s.seeded = true
+	if s.needsInitialization {
+		return
+	}
+	s.roll, s.pitch, s.heading = s.seedRoll, s.seedPitch, s.seedHdg
+	s.E0, s.E1, s.E2, s.E3 = ToQuaternion(s.roll, s.pitch, s.heading)
+	s.eGPS0, s.eGPS1, s.eGPS2, s.eGPS3 = s.E0, s.E1, s.E2, s.E3
+	s.eGyr0, s.eGyr1, s.eGyr2, s.eGyr3 = s.E0, s.E1, s.E2, s.E3
+	s.eOld0, s.eOld1, s.eOld2, s.eOld3 = s.E0, s.E1, s.E2, s.E3
+	s.rollGPS, s.pitchGPS, s.headingGPS = s.roll, s.pitch, s.heading
+	s.rollGyr, s.pitchGyr, s.headingGyr = s.roll, s.pitch, s.heading
+	s.calcRotationMatrices()
+}
+
+// SetAerobaticMode sets whether the roll is taken from gyro integration alone.
+// The GPS/accelerometer-derived roll is meaningless in inverted or aerobatic flight,
+// so in this mode only the pitch and heading are reverted toward the GPS-derived values.
+func (s *SimpleState) SetAerobaticMode(aerobatic bool) {
+	s.aerobaticMode = aerobatic
+}
+
+// SetAerobaticDetection sets whether the references are suspended while the gyro shows an aerobatic
+// maneuver, as a loop or an aileron roll, through which the attitude follows the gyro alone.  A maneuver is
+// taken to be in progress while the roll, pitch or yaw rate exceeds its threshold, set by SetAerobaticRates,
+// and for a second after; the references are then ramped back in over the blend time.  It is off by default.
+func (s *SimpleState) SetAerobaticDetection(detect bool) {
+	s.aerobaticDetect = detect
+	s.inAerobatics, s.aerobaticUntil = false, 0
+}
+
+// SetAerobaticRates sets the roll, pitch and yaw rates, °/s, above which aerobatic detection takes the
+// aircraft to be maneuvering, 60, 25 and 25°/s by default, well above the rates of a brisk steep turn.
+// A non-positive rate leaves its axis out of the detection.
+func (s *SimpleState) SetAerobaticRates(roll, pitch, yaw float64) {
+	s.aerobaticRates = [3]float64{roll, pitch, yaw}
+}
+
+// detectAerobatics returns whether the references are to be suspended at time t for a maneuver,
+// from the smoothed gyro rates.
+func (s *SimpleState) detectAerobatics(t float64) bool {
+	for i, h := range [3]float64{s.H1, s.H2, s.H3} {
+		if r := s.aerobaticRates[i]; r > 0 && math.Abs(h) > r {
+			s.aerobaticUntil = t + aerobaticSettle
+		}
+	}
+	s.inAerobatics = t < s.aerobaticUntil
+	return s.inAerobatics
+}
+
+// SetDeadReckonOnly sets whether the GPS is ignored entirely, for bench testing or aircraft without a GPS.
+// In this mode the W fields of the measurement are never read: roll and pitch are taken from the
+// accelerometer's gravity vector rather than from the GPS-derived acceleration, the heading is held
+// by the gyro alone, and heading and rate of turn are reported as invalid.
+func (s *SimpleState) SetDeadReckonOnly(deadReckonOnly bool) {
+	s.deadReckonOnly = deadReckonOnly
+}
+
+// SetVehicleType sets the kind of aircraft, which sets how the gyro is aided, FixedWing by default.
+// A Rotorcraft can hover with no groundspeed, so its roll and pitch are reverted slowly toward the
+// accelerometer whenever it reads a steady 1 G and its heading toward the magnetometer, the GPS only adding
+// the acceleration it measures while translating, as the track needn't follow the nose.
+func (s *SimpleState) SetVehicleType(v VehicleType) {
+	s.rotorcraft = v == Rotorcraft
+	s.magHeading = false
+}
+
+// SetQuaternionMode sets whether to take the attitude from an external AHRS: whenever a measurement
+// has a valid quaternion Q, the gyro-propagated attitude is reverted toward it, at the rate it would
+// otherwise be reverted toward the GPS and accelerometer, which are then left out.
+// The other outputs are only kept up to date from the measurements without a quaternion.
+func (s *SimpleState) SetQuaternionMode(quaternionMode bool) {
+	s.quaternionMode = quaternionMode
+}
+
+// SetRK4 sets whether the attitude is propagated by fourth-order Runge-Kutta integration of the raw gyro rates,
+// interpolated quadratically through the latest three samples, rather than by a single rotation by the smoothed rates.
+// This follows high-dynamics motion more closely, in particular coning, where the rate vector itself rotates
+// within a sample interval.  It is off by default.
+func (s *SimpleState) SetRK4(rk4 bool) {
+	s.rk4 = rk4
+	s.nPrev = 0
+}
+
+// SetAdaptiveK sets whether the weight given to the GPS is adapted to the flight: while the gyro or the
+// turn rate shows the aircraft maneuvering, the gyro is trusted more and the attitude is reverted more slowly
+// toward the GPS/accelerometer reference, which lags the maneuver; in steady flight the weight relaxes back
+// to its base value.
+func (s *SimpleState) SetAdaptiveK(adaptive bool) {
+	s.adaptiveK = adaptive
+	s.maneuver = 0
+}
+
+// updateManeuver updates and returns the maneuver level for adaptiveK from the larger of the gyro rotation rate
+// and the rate of turn.  It rises at once with the rate and relaxes slowly once the maneuver is over.
+func (s *SimpleState) updateManeuver() float64 {
+	rate := math.Max(math.Sqrt(s.H1*s.H1+s.H2*s.H2+s.H3*s.H3), math.Abs(RadToDeg(s.turnRate)))
+	level := math.Min(1, math.Max(0, (rate-maneuverRate)/(maneuverRateFull-maneuverRate)))
+	if level > s.maneuver {
+		s.maneuver = level
+	} else {
+		s.maneuver += slowSmoothConst * (level - s.maneuver)
+	}
+	return s.maneuver
+}
+
+// gpsValid returns whether the GPS part of m is to be used.
+func (s *SimpleState) gpsValid(m *Measurement) bool {
+	return m.WValid && !s.deadReckonOnly
+}
+
+// GetLogMap returns a map providing current state and measurement values for analysis.
+// Filling the map is costly, so it is only kept up to date by Compute from the first call to GetLogMap on.
+func (s *SimpleState) GetLogMap() (p map[string]interface{}) {
+	s.logMapUsed = true
+	return s.logMap
+}
+
+// SetMinGS sets the smoothed groundspeed, in Kts, below which GPS data isn't used.
+// A glider can usefully lower it; a jet may want it higher.
+func (s *SimpleState) SetMinGS(minGS float64) {
+	s.minGS = minGS
+}
+
+// SetMinGSMargin sets the hysteresis, in Kts, on the smoothed groundspeed for using GPS data: the GPS is
+// taken up above MinGS but only dropped again below MinGS less margin, 1 kt by default.
+// A negative margin is taken as 0.
+func (s *SimpleState) SetMinGSMargin(margin float64) {
+	s.minGSMargin = math.Max(margin, 0)
+}
+
+// SetBlendTime sets the time, in seconds, over which the weight reverting the attitude toward its reference
+// ramps from 0 up to its configured value when the GPS is taken up or dropped, 2 s by default, so that
+// the attitude doesn't lurch when the GPS and the held attitude disagree.  A non-positive time switches at once.
+func (s *SimpleState) SetBlendTime(blendTime float64) {
+	s.blendTime = math.Max(blendTime, 0)
+}
+
+// SetTaxiHeadingTimeConstant sets the time constant, in seconds, with which taxi mode reverts the heading
+// toward the GPS track, 5 s by default.  Taxi mode takes over from the gyro alone between 2 kt and MinGS,
+// leaving the roll and pitch to the accelerometer.  A non-positive tau turns taxi mode off.
+func (s *SimpleState) SetTaxiHeadingTimeConstant(tau float64) {
+	s.taxiTau = math.Max(tau, 0)
+}
+
+// SetMaxDT sets the interval, in seconds, between measurements above which the algorithm re-initializes.
+func (s *SimpleState) SetMaxDT(maxDT float64) {
+	s.maxDT = maxDT
+}
+
+// SetTurnRateTimeConstant sets the time constant, in seconds, of the low-pass filter on the rate of turn,
+// longer for a smoother reading on a bumpy day and shorter for a responsive aircraft.  The blend weight is
+// worked out from the interval between GPS updates.  A non-positive tau restores the fixed weight slowSmoothConst.
+func (s *SimpleState) SetTurnRateTimeConstant(tau float64) {
+	s.turnRateTau = math.Max(tau, 0)
+}
+
+// Describe returns "simple" with the current minGS, maxDT and GPS time offset and the smoothing constants
+// and weights set by SetConfig.
+func (s *SimpleState) Describe() ProviderInfo {
+	return ProviderInfo{Name: "simple", Params: map[string]float64{
+		"minGS":               s.minGS,
+		"maxDT":               s.maxDT,
+		"blendTime":           s.blendTime,
+		"taxiHeadingTau":      s.taxiTau,
+		"fastSmoothConst":     fastSmoothConst,
+		"slowSmoothConst":     slowSmoothConst,
+		"verySlowSmoothConst": verySlowSmoothConst,
+		"gpsWeight":           gpsWeight,
+		"accelWeight":         accelWeight,
+		"gpsOffset":           s.gpsOffset,
+	}}
+}
+
+// SetGPSTimeOffset sets the time, s, by which the GPS fixes lag the IMU clock, negative if they lead,
+// e.g. the latency of the GPS receiver.  Each fix is then taken to describe the velocity at its time TW
+// less dt, and the GPS velocity used at the time of the IMU readings is interpolated between the fixes
+// either side, or extrapolated from the latest ones when there isn't a later one yet.
+func (s *SimpleState) SetGPSTimeOffset(dt float64) {
+	s.gpsOffset = dt
+	s.gpsAlign = nil
+	if dt != 0 {
+		s.gpsAlign = new(gpsAligner)
+	}
+}
+
 // SetConfig lets the user alter some of the configuration settings.
 func (s *SimpleState) SetConfig(configMap map[string]float64) {
 	if v, ok := configMap["fastSmoothConst"]; ok {
@@ -273,6 +984,9 @@ func (s *SimpleState) SetConfig(configMap map[string]float64) {
 	if v, ok := configMap["gpsWeight"]; ok {
 		gpsWeight = v
 	}
+	if v, ok := configMap["accelWeight"]; ok {
+		accelWeight = v
+	}
 	if fastSmoothConst == 0 || slowSmoothConst == 0 || verySlowSmoothConst == 0 {
 		// This doesn't make sense, means user hasn't set correctly.
 		// Set sensible defaults.
@@ -280,18 +994,22 @@ func (s *SimpleState) SetConfig(configMap map[string]float64) {
 		slowSmoothConst = slowSmoothConstDefault
 		verySlowSmoothConst = verySlowSmoothConstDefault
 		gpsWeight = gpsWeightDefault
+		accelWeight = accelWeightDefault
 	}
 }
 
 func (s *SimpleState) updateLogMap(m *Measurement, p map[string]interface{}) {
 	s.State.updateLogMap(m, s.logMap)
 	var simpleLogMap = map[string]func(s *SimpleState, m *Measurement) float64{
-		"RollGPS":           func(s *SimpleState, m *Measurement) float64 { return s.rollGPS / Deg },
-		"PitchGPS":          func(s *SimpleState, m *Measurement) float64 { return s.pitchGPS / Deg },
-		"HeadingGPS":        func(s *SimpleState, m *Measurement) float64 { return s.headingGPS / Deg },
-		"RollGyr":           func(s *SimpleState, m *Measurement) float64 { return s.rollGyr / Deg },
-		"PitchGyr":          func(s *SimpleState, m *Measurement) float64 { return s.pitchGyr / Deg },
-		"HeadingGyr":        func(s *SimpleState, m *Measurement) float64 { return s.headingGyr / Deg },
+		"RollGPS":           func(s *SimpleState, m *Measurement) float64 { return RadToDeg(s.rollGPS) },
+		"PitchGPS":          func(s *SimpleState, m *Measurement) float64 { return RadToDeg(s.pitchGPS) },
+		"HeadingGPS":        func(s *SimpleState, m *Measurement) float64 { return RadToDeg(s.headingGPS) },
+		"RollGyr":           func(s *SimpleState, m *Measurement) float64 { return RadToDeg(s.rollGyr) },
+		"PitchGyr":          func(s *SimpleState, m *Measurement) float64 { return RadToDeg(s.pitchGyr) },
+		"HeadingGyr":        func(s *SimpleState, m *Measurement) float64 { return RadToDeg(s.headingGyr) },
+		"RollAcc":           func(s *SimpleState, m *Measurement) float64 { return RadToDeg(s.rollAcc) },
+		"PitchAcc":          func(s *SimpleState, m *Measurement) float64 { return RadToDeg(s.pitchAcc) },
+		"AccelWeight":       func(s *SimpleState, m *Measurement) float64 { return s.wAcc },
 		"GroundSpeed":       func(s *SimpleState, m *Measurement) float64 { return s.gs },
 		"SmoothW1":          func(s *SimpleState, m *Measurement) float64 { return s.smoothW1 },
 		"SmoothW2":          func(s *SimpleState, m *Measurement) float64 { return s.smoothW2 },
@@ -320,6 +1038,18 @@ func (s *SimpleState) updateLogMap(m *Measurement, p map[string]interface{}) {
 			}
 			return 0
 		},
+		"aerobaticMode": func(s *SimpleState, m *Measurement) float64 {
+			if s.aerobaticMode {
+				return 1
+			}
+			return 0
+		},
+		"deadReckonOnly": func(s *SimpleState, m *Measurement) float64 {
+			if s.deadReckonOnly {
+				return 1
+			}
+			return 0
+		},
 	}
 
 	for k := range simpleLogMap {
@@ -0,0 +1,1192 @@
+package ahrs
+
+import (
+	"math"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+// rollPath flies straight and level north at 100 kt, then from time t0 rolls through 360° at rate rr (rad/s).
+func rollPath(t0, rr float64) flightPath {
+	return func(t float64) (float64, float64, float64, float64, float64, float64) {
+		var roll float64
+		if t > t0 && t < t0+2*Pi/rr {
+			roll = rr * (t - t0)
+		}
+		return roll, 0, 0, 0, 100, 0
+	}
+}
+
+// maxRollErr runs a positive-G 360° roll through s, returning the largest error in the fused roll
+// and the largest change in the fused roll between two consecutive samples, both in degrees.
+func maxRollErr(s *SimpleState) (maxErr, maxStep float64) {
+	const (
+		dt = 0.05
+		rr = 90 * Deg
+	)
+	path := rollPath(10, rr)
+	ms := simMeasurements(path, 0, 16, dt)
+	var lastRoll float64
+	for i, m := range ms {
+		// In a positive-G roll the accelerometer keeps pointing toward the floor of the aircraft.
+		m.A1, m.A2, m.A3 = 0, 0, 1
+		s.Compute(m)
+		roll, _, _ := s.CalcRollPitchHeading()
+		trueRoll, _, _, _, _, _ := path(m.T)
+		maxErr = math.Max(maxErr, angleErr(roll, trueRoll/Deg))
+		if i > 0 {
+			maxStep = math.Max(maxStep, angleErr(roll, lastRoll))
+		}
+		lastRoll = roll
+	}
+	return
+}
+
+func TestSimpleAerobaticMode(t *testing.T) {
+	normalErr, _ := maxRollErr(NewSimpleAHRS())
+
+	s := NewSimpleAHRS()
+	s.SetAerobaticMode(true)
+	aeroErr, aeroStep := maxRollErr(s)
+
+	t.Logf("Max roll error during 360° roll: %4.1f° normal, %4.1f° aerobatic", normalErr, aeroErr)
+	if aeroErr > 5 {
+		t.Errorf("aerobatic mode roll error was %4.1f°, should follow the gyro", aeroErr)
+	}
+	if normalErr < 4*aeroErr {
+		t.Errorf("expected normal mode to be dragged back toward upright, error was only %4.1f°", normalErr)
+	}
+	// 90°/s at 20 Hz is 4.5° per step; the roll must follow continuously.
+	if aeroStep > 5 {
+		t.Errorf("aerobatic roll jumped by %4.1f° in one step", aeroStep)
+	}
+}
+
+func TestNewSimpleAHRSAllocations(t *testing.T) {
+	s := NewSimpleAHRS()
+	if s.M != nil || s.N != nil {
+		t.Error("SimpleState shouldn't allocate covariance matrices")
+	}
+	if tr := s.CalcCovarianceTrace(); !math.IsNaN(tr) {
+		t.Errorf("expected NaN covariance trace, got %f", tr)
+	}
+
+	// Two 32x32 matrices of float64 alone would be 16 kB; what remains is mostly the log map,
+	// each of whose entries is an allocation.
+	const maxBytes, maxAllocs = 2 * 32 * 32 * 8, 24
+	var before, after runtime.MemStats
+	const n = 100
+	runtime.ReadMemStats(&before)
+	for i := 0; i < n; i++ {
+		NewSimpleAHRS()
+	}
+	runtime.ReadMemStats(&after)
+	if b := (after.TotalAlloc - before.TotalAlloc) / n; b > maxBytes {
+		t.Errorf("NewSimpleAHRS allocated %d bytes, expected no more than %d", b, maxBytes)
+	}
+	if allocs := testing.AllocsPerRun(n, func() { NewSimpleAHRS() }); allocs > maxAllocs {
+		t.Errorf("NewSimpleAHRS made %.0f allocations, expected no more than %d", allocs, maxAllocs)
+	}
+}
+
+func BenchmarkNewSimpleAHRS(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NewSimpleAHRS()
+	}
+}
+
+func TestSimpleMinGS(t *testing.T) {
+	// 4 kt east is below the default minimum groundspeed of 5 kt.
+	ms := simMeasurements(straightPath(4, 90*Deg), 0, 20, 0.05)
+	run := func(s *SimpleState) (heading float64) {
+		for _, m := range ms {
+			s.Compute(m)
+		}
+		_, _, heading = s.RollPitchHeading()
+		return
+	}
+
+	if hdg := run(NewSimpleAHRS()); hdg != Invalid {
+		t.Errorf("expected GPS to be ignored at 4 kt by default, got heading %f°", hdg/Deg)
+	}
+
+	s := NewSimpleAHRS()
+	s.SetMinGS(3)
+	hdg := run(s)
+	if hdg == Invalid {
+		t.Fatal("expected GPS to be used at 4 kt with MinGS lowered to 3 kt")
+	}
+	if e := angleErr(hdg/Deg, 90); e > 1 {
+		t.Errorf("expected GPS-derived heading of 90°, got %f°", hdg/Deg)
+	}
+}
+
+// gpsModeFlips flies s east with a noisy groundspeed alternating between MinGS ± 0.5 kt and returns how often
+// it switches between using the GPS and not, once the smoothed groundspeed has settled.
+func gpsModeFlips(s *SimpleState) (flips int) {
+	ms := simMeasurements(straightPath(minGSDefault, 90*Deg), 0, 200, 0.1)
+	var static bool
+	for i, m := range ms {
+		m.W1 += 0.5 * float64(1-2*(i%2))
+		s.Compute(m)
+		_, _, hdg := s.RollPitchHeading()
+		if m.T > 100 && (hdg == Invalid) != static {
+			flips++
+		}
+		static = hdg == Invalid
+	}
+	return
+}
+
+func TestSimpleMinGSHysteresis(t *testing.T) {
+	s := NewSimpleAHRS()
+	s.SetMinGSMargin(0)
+	chatter := gpsModeFlips(s)
+	flips := gpsModeFlips(NewSimpleAHRS())
+	t.Logf("GPS mode flips over 100 s: %d without hysteresis, %d with", chatter, flips)
+	if chatter < 100 {
+		t.Errorf("expected the mode to chatter without hysteresis, only %d flips", chatter)
+	}
+	if flips > 1 {
+		t.Errorf("expected hysteresis to hold the mode, got %d flips", flips)
+	}
+}
+
+func TestSimpleMinGSSweep(t *testing.T) {
+	// Accelerating slowly from 2 to 10 kt east and back, through MinGS both ways, with GPS noise
+	rng := rand.New(rand.NewSource(1))
+	path := func(t float64) (float64, float64, float64, float64, float64, float64) {
+		return 0, 0, 90 * Deg, 2 + 8*(1-math.Abs(t-200)/200), 0, 0
+	}
+	s := NewSimpleAHRS()
+	var maxTilt, maxHdg, tr float64
+	var static bool
+	flips, held := 0, 0
+	for i, m := range simMeasurements(path, 0, 400, 0.1) {
+		m.W1 += 0.1 * rng.NormFloat64()
+		m.W2 += 0.1 * rng.NormFloat64()
+		s.Compute(m)
+		if i < 2 {
+			static = true
+			continue
+		}
+		roll, pitch, hdg := s.RollPitchHeading()
+		if (hdg == Invalid) != static {
+			flips++
+		}
+		static = hdg == Invalid
+		maxTilt = math.Max(maxTilt, math.Max(math.Abs(roll), math.Abs(pitch))/Deg)
+		if !static {
+			maxHdg = math.Max(maxHdg, angleErr(hdg/Deg, 90))
+			// Kept in GPS mode below MinGS by the hysteresis, the turn rate isn't updated from the noisy track.
+			if s.gs < minGSDefault {
+				if r := s.RateOfTurn(); r != tr {
+					t.Errorf("turn rate changed from %.2f to %.2f°/s at %.2f kt", tr, r, s.gs)
+				}
+				held++
+			}
+			tr = s.RateOfTurn()
+		}
+	}
+	if flips != 2 {
+		t.Errorf("GPS mode changed %d times, expected once each way", flips)
+	}
+	if held == 0 {
+		t.Error("never in GPS mode below MinGS")
+	}
+	if maxTilt > 0.3 || maxHdg > 1 {
+		t.Errorf("roll or pitch reached %.2f° and heading was off by %.2f°", maxTilt, maxHdg)
+	}
+}
+
+func TestSimpleGPSTimeOffset(t *testing.T) {
+	const lag = 0.5
+	path := sTurnPath(100, 30*Deg, 30)
+	run := func(offset float64) (e float64) {
+		ms := simMeasurements(path, 0, 60, 0.05)
+		for _, m := range ms {
+			// The GPS fix describes the velocity lag seconds earlier than it is stamped.
+			_, _, _, m.W1, m.W2, m.W3 = path(m.T - lag)
+		}
+		s := NewSimpleAHRS()
+		s.SetGPSTimeOffset(offset)
+		var n float64
+		for _, m := range ms {
+			s.Compute(m)
+			if m.T < 10 {
+				continue
+			}
+			_, _, heading := s.CalcRollPitchHeading()
+			_, _, hh, _, _, _ := path(m.T)
+			e += math.Pow(angleErr(heading, hh/Deg), 2)
+			n++
+		}
+		return math.Sqrt(e / n)
+	}
+	lagging, aligned := run(0), run(lag)
+	t.Logf("RMS heading error %.2f° with the GPS lagging %.1f s, %.2f° aligned", lagging, lag, aligned)
+	if aligned > lagging/3 {
+		t.Errorf("aligning the GPS to the IMU clock left an RMS heading error of %.2f°, against %.2f° without",
+			aligned, lagging)
+	}
+}
+
+// representativeMeasurements returns a minute of a turning flight as seen by real hardware:
+// IMU samples at 50 Hz but GPS fixes only once a second, interpolated in between.
+func representativeMeasurements() []*Measurement {
+	ms := simMeasurements(turnPath(100, 0, 10, 3*Deg), 0, 60, 0.02)
+	for i, m := range ms {
+		g0, j := ms[i-i%50], i-i%50+50
+		if j >= len(ms) {
+			j = len(ms) - 1
+		}
+		g1 := ms[j]
+		if g1.T == g0.T {
+			continue
+		}
+		f := (m.T - g0.T) / (g1.T - g0.T)
+		m.W1, m.W2, m.W3 = g0.W1+f*(g1.W1-g0.W1), g0.W2+f*(g1.W2-g0.W2), g0.W3+f*(g1.W3-g0.W3)
+	}
+	return ms
+}
+
+func TestSimpleComputeAllocations(t *testing.T) {
+	ms := representativeMeasurements()
+	s := NewSimpleAHRS()
+	i := 0
+	compute := func() {
+		s.Compute(ms[i])
+		i++
+	}
+	for i < 600 { // Get past initialization and into a steady turn
+		compute()
+	}
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	// testing.AllocsPerRun rounds down, which would hide an allocation made on only some calls.
+	n := len(ms) - i
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i < len(ms) {
+		compute()
+	}
+	runtime.ReadMemStats(&after)
+	if allocs := after.Mallocs - before.Mallocs; allocs > 0 {
+		t.Errorf("SimpleState.Compute made %d allocations in %d calls, should make none", allocs, n)
+	}
+
+	if !testing.Short() {
+		t.Logf("BenchmarkSimpleUpdate: %s", testing.Benchmark(BenchmarkSimpleUpdate))
+	}
+}
+
+func TestSimpleLogMap(t *testing.T) {
+	ms := representativeMeasurements()
+	s := NewSimpleAHRS()
+	p := s.GetLogMap()
+	for _, m := range ms[:100] {
+		s.Compute(m)
+	}
+	if tm := p["T"].(float64); tm != ms[99].T {
+		t.Errorf("log map wasn't kept up to date: T is %f, expected %f", tm, ms[99].T)
+	}
+}
+
+// BenchmarkSimpleUpdate measures the steady-state cost of SimpleState.Compute on representative measurements.
+func BenchmarkSimpleUpdate(b *testing.B) {
+	ms := representativeMeasurements()
+	s := NewSimpleAHRS()
+	for _, m := range ms[:600] {
+		s.Compute(m)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		j := 600 + i%(len(ms)-600)
+		if j == 600 && i > 0 { // Start the turn over without a time jump backwards
+			b.StopTimer()
+			s = NewSimpleAHRS()
+			for _, m := range ms[:600] {
+				s.Compute(m)
+			}
+			b.StartTimer()
+		}
+		s.Compute(ms[j])
+	}
+}
+
+func TestSimpleQuaternionNorm(t *testing.T) {
+	if testing.Short() {
+		t.Skip("long run skipped in short mode")
+	}
+	// A 3°/s turn comes back to the same place every 120 s, so the measurements can be repeated.
+	const period = 120.0
+	ms := simMeasurements(turnPath(100, 0, 0, 3*Deg), 0, period-0.02, 0.02)
+	s := NewSimpleAHRS()
+	var m Measurement
+	var maxErr float64
+	for i := 0; i < 1000000; i++ { // Over 5 hours at 50 Hz
+		m = *ms[i%len(ms)]
+		dt := float64(i/len(ms)) * period
+		m.T += dt
+		m.TW += dt
+		s.Compute(&m)
+		maxErr = math.Max(maxErr, math.Abs(s.CalcQuaternionNorm()-1))
+	}
+	t.Logf("Largest deviation of quaternion norm from 1: %g", maxErr)
+	if maxErr > 1e-9 {
+		t.Errorf("quaternion norm drifted by %g from 1", maxErr)
+	}
+}
+
+func TestSimpleDeadReckonOnly(t *testing.T) {
+	const (
+		roll  = -15 * Deg
+		pitch = 10 * Deg
+	)
+	// The aircraft sits still and level, then is tilted after 5 s.
+	tilted := func(t float64) (float64, float64, float64, float64, float64, float64) {
+		if t < 5 {
+			return 0, 0, 0, 0, 0, 0
+		}
+		return roll, pitch, 0, 0, 0, 0
+	}
+	// A steep turn at 150 kt: GPS data that would drag roll well away from the accelerometer's.
+	gps := turnPath(150, 0, 0, G/150)
+
+	s := NewSimpleAHRS()
+	s.SetDeadReckonOnly(true)
+	for i := 0; i <= 1000; i++ { // 20 s at 50 Hz
+		m := simMeasurement(tilted, float64(i)*0.02, 0.02)
+		_, _, _, m.W1, m.W2, m.W3 = gps(m.T)
+		m.TW = m.T
+		m.B1, m.B2, m.B3 = 0, 0, 0 // Only the accelerometer shows the tilt
+		s.Compute(m)
+	}
+
+	r, p, h := s.RollPitchHeading()
+	if e := angleErr(r/Deg, roll/Deg); e > 0.5 {
+		t.Errorf("roll was %f°, expected the accelerometer's %f°", r/Deg, roll/Deg)
+	}
+	if e := angleErr(p/Deg, pitch/Deg); e > 0.5 {
+		t.Errorf("pitch was %f°, expected the accelerometer's %f°", p/Deg, pitch/Deg)
+	}
+	if h != Invalid || s.RateOfTurn() != Invalid {
+		t.Error("heading and rate of turn should be invalid without GPS")
+	}
+	if s.gs != 0 || s.tW != 0 || s.w1 != 0 || s.w2 != 0 {
+		t.Error("GPS data was used in dead-reckoning mode")
+	}
+}
+
+// pullUpPath flies straight and level north at groundspeed gs (kt) until time t0, then pulls up
+// at 2 G until the pitch reaches pitch1 (rad), then climbs straight ahead.
+func pullUpPath(gs, t0, pitch1 float64) flightPath {
+	q := G / gs // Pitch rate for 2 G, rad/s, ignoring the small effect of the pitch itself
+	return func(t float64) (float64, float64, float64, float64, float64, float64) {
+		pitch := math.Min(math.Max(q*(t-t0), 0), pitch1)
+		return 0, pitch, 0, 0, gs * math.Cos(pitch), gs * math.Sin(pitch)
+	}
+}
+
+func TestSimpleAccelReferenceLevel(t *testing.T) {
+	// Slow flight: level at 60 kt but with the nose 8° up, which the GPS alone can't tell.
+	const pitch = 8 * Deg
+	path := func(float64) (float64, float64, float64, float64, float64, float64) {
+		return 0, pitch, 0, 0, 60, 0
+	}
+	s := NewSimpleAHRS()
+	var wAcc float64
+	for _, m := range simMeasurements(path, 0, 30, 0.02) {
+		s.Compute(m)
+		wAcc = s.wAcc
+	}
+	if wAcc == 0 {
+		t.Error("the accelerometer reference should be used in unaccelerated flight")
+	}
+	if _, p, _ := s.RollPitchHeading(); math.Abs(p-pitch) > 0.1*Deg {
+		t.Errorf("pitch was %f°, expected convergence to the accelerometer's %f°", p/Deg, pitch/Deg)
+	}
+}
+
+func TestSimpleAccelReferencePullUp(t *testing.T) {
+	const t0 = 10
+	path := pullUpPath(100, t0, 20*Deg)
+	s := NewSimpleAHRS()
+	var maxErr, maxAccErr float64
+	for _, m := range simMeasurements(path, 0, 20, 0.02) {
+		s.Compute(m)
+		_, truePitch, _, _, _, _ := path(m.T)
+		if m.T <= t0 || truePitch >= 20*Deg {
+			continue
+		}
+		if s.wAcc != 0 {
+			t.Fatalf("the accelerometer reference was given weight %f at %f s during a 2 G pull-up", s.wAcc, m.T)
+		}
+		_, pAcc := s.CalcAccelAttitude(m)
+		maxAccErr = math.Max(maxAccErr, math.Abs(pAcc-truePitch)/Deg)
+		_, p, _ := s.RollPitchHeading()
+		maxErr = math.Max(maxErr, math.Abs(p-truePitch)/Deg)
+	}
+	// The accelerometer alone shows only about half the true pitch during the pull-up.
+	t.Logf("Max pitch error during the pull-up: %4.1f° fused, %4.1f° accelerometer", maxErr, maxAccErr)
+	if maxAccErr < 5 {
+		t.Errorf("expected the accelerometer reference to be misleading, but it was only off by %f°", maxAccErr)
+	}
+	if maxErr > 2 {
+		t.Errorf("pitch was off by up to %f° during the pull-up", maxErr)
+	}
+}
+
+// turnRateResponse flies into a 3°/s turn at t = 20 s with noisy GPS velocity and returns the time, s,
+// the rate of turn takes to reach 63% of the true rate and its standard deviation, °/s, once settled.
+func turnRateResponse(tau float64) (lag, sd float64) {
+	const tr = 3 * Deg
+	rng := rand.New(rand.NewSource(1))
+	s := NewSimpleAHRS()
+	s.SetTurnRateTimeConstant(tau)
+	var n, sum, sum2 float64
+	for _, m := range simMeasurements(turnPath(100, 0, 20, tr), 0, 80, 0.1) {
+		m.W1 += 0.2 * rng.NormFloat64()
+		m.W2 += 0.2 * rng.NormFloat64()
+		s.Compute(m)
+		r := s.RateOfTurn()
+		if lag == 0 && m.T > 20 && r > 0.63*tr/Deg {
+			lag = m.T - 20
+		}
+		if m.T > 50 {
+			n, sum, sum2 = n+1, sum+r, sum2+r*r
+		}
+	}
+	return lag, math.Sqrt(sum2/n - sum*sum/n/n)
+}
+
+func TestSimpleTurnRateTimeConstant(t *testing.T) {
+	fastLag, fastSD := turnRateResponse(0.5)
+	slowLag, slowSD := turnRateResponse(5)
+	t.Logf("tau 0.5 s: lag %.1f s, sd %.3f°/s; tau 5 s: lag %.1f s, sd %.3f°/s", fastLag, fastSD, slowLag, slowSD)
+	if fastLag == 0 || slowLag == 0 {
+		t.Fatal("rate of turn never followed the turn")
+	}
+	if math.Abs(slowLag-5) > 1 || slowLag < 3*fastLag {
+		t.Errorf("expected a lag close to tau with tau 5 s and much shorter with 0.5 s")
+	}
+	if slowSD > fastSD/2 {
+		t.Errorf("expected the longer time constant to smooth the rate of turn")
+	}
+}
+
+func TestSimpleSetAttitude(t *testing.T) {
+	// Sitting on the ground, GPS valid but stationary
+	ms := simMeasurements(straightPath(0, 0), 0, 60, 0.05)
+	for _, before := range []bool{true, false} {
+		s := NewSimpleAHRS()
+		if before {
+			s.SetAttitude(0, 0, 270*Deg)
+		}
+		for i, m := range ms {
+			s.Compute(m)
+			if i == 0 && !before {
+				s.SetAttitude(0, 0, 270*Deg)
+				if _, _, hdg := s.CalcRollPitchHeading(); math.Abs(hdg-270) > 1e-6 {
+					t.Fatalf("expected the seeded heading of 270°, got %f°", hdg)
+				}
+			}
+		}
+		roll, pitch, hdg := s.CalcRollPitchHeading()
+		if angleErr(hdg, 270) > 0.1 || math.Abs(roll) > 0.1 || math.Abs(pitch) > 0.1 {
+			t.Errorf("seeded before the first Compute %t: expected level at 270° after a minute, got %f°, %f°, %f°",
+				before, roll, pitch, hdg)
+		}
+	}
+
+	// Once moving, the GPS track takes over.
+	s := NewSimpleAHRS()
+	s.SetAttitude(0, 0, 270*Deg)
+	for _, m := range simMeasurements(straightPath(100, 90*Deg), 0, 20, 0.05) {
+		s.Compute(m)
+	}
+	if _, _, hdg := s.CalcRollPitchHeading(); angleErr(hdg, 90) > 1 {
+		t.Errorf("expected the GPS track of 90° to take over, got %f°", hdg)
+	}
+}
+
+func TestCalcTrack(t *testing.T) {
+	// Crabbing 15° into a wind from the right, and 5° across north
+	for _, c := range []struct{ hdg, crab float64 }{{30, 15}, {3, 5}} {
+		track := math.Mod(c.hdg-c.crab+360, 360)
+		path := func(t float64) (float64, float64, float64, float64, float64, float64) {
+			return 0, 0, c.hdg * Deg, 100 * math.Sin(track*Deg), 100 * math.Cos(track*Deg), 0
+		}
+		ms := withMagnetometer(simMeasurements(path, 0, 60, 0.05), path)
+		s, e := NewSimpleAHRS(), NewEKFAHRS()
+		for _, m := range ms {
+			s.Compute(m)
+			e.Compute(m)
+		}
+		if tr := s.CalcTrack(); angleErr(tr, track) > 1e-6 {
+			t.Errorf("Simple track %.2f°, expected %.2f°", tr, track)
+		}
+		if tr := e.CalcTrack(); angleErr(tr, track) > 1e-6 {
+			t.Errorf("EKF track %.2f°, expected %.2f°", tr, track)
+		}
+		if crab := s.CalcCrabAngle(); math.Abs(crab-c.crab) > 0.5 {
+			t.Errorf("Simple crab angle %.2f° heading %.0f°, expected %.0f°", crab, c.hdg, c.crab)
+		}
+		if crab := e.CalcCrabAngle(); math.Abs(crab-c.crab) > 0.5 {
+			t.Errorf("EKF crab angle %.2f° heading %.0f°, expected %.0f°", crab, c.hdg, c.crab)
+		}
+	}
+
+	s := NewSimpleAHRS()
+	for _, m := range simMeasurements(straightPath(2, 0), 0, 1, 0.05) {
+		s.Compute(m)
+	}
+	if tr := s.CalcTrack(); tr != Invalid {
+		t.Errorf("track %.2f° below MinGS, expected Invalid", tr)
+	}
+}
+
+func TestSimpleCrabAngle(t *testing.T) {
+	// Nose held on 030° while a crosswind from the right sets the track 10° left of it.
+	const hdg, crab = 30 * Deg, 10 * Deg
+	path := func(t float64) (float64, float64, float64, float64, float64, float64) {
+		return 0, 0, hdg, 100 * math.Sin(hdg-crab), 100 * math.Cos(hdg-crab), 0
+	}
+	s := NewSimpleAHRS()
+	ms := withMagnetometer(simMeasurements(path, 0, 60, 0.05), path)
+	for _, m := range ms {
+		s.Compute(m)
+	}
+	if c := s.CalcCrabAngle(); math.Abs(c-crab/Deg) > 0.5 {
+		t.Errorf("crab angle %.2f°, expected %.2f°", c, crab/Deg)
+	}
+	if _, _, h := s.RollPitchHeading(); angleErr(h/Deg, (hdg-crab)/Deg) > 0.5 {
+		t.Errorf("heading %.2f°, expected the track %.2f°", h/Deg, (hdg-crab)/Deg)
+	}
+
+	// With 10° of declination, the magnetometer alone would put the nose 10° left of where it is.
+	d := NewSimpleAHRS()
+	d.SetDeclination(10)
+	for _, m := range withDeclinedMagnetometer(simMeasurements(path, 0, 60, 0.05), path, 10*Deg) {
+		d.Compute(m)
+	}
+	if c := d.CalcCrabAngle(); math.Abs(c-crab/Deg) > 0.5 {
+		t.Errorf("crab angle %.2f° with 10° of declination, expected %.2f°", c, crab/Deg)
+	}
+
+	m := simMeasurement(path, 60.05, 0.05)
+	s.Compute(m)
+	if c := s.CalcCrabAngle(); c != Invalid {
+		t.Errorf("crab angle %.2f° without a magnetometer, expected Invalid", c)
+	}
+}
+
+func TestSimpleQuaternionMode(t *testing.T) {
+	// Sitting level on the ground, while an external AHRS reports another, constant attitude.
+	q0, q1, q2, q3 := ToQuaternion(20*Deg, 5*Deg, 120*Deg)
+	ms := simMeasurements(straightPath(0, 0), 0, 30, 0.05)
+	for _, m := range ms {
+		m.Q0, m.Q1, m.Q2, m.Q3, m.QValid = q0, q1, q2, q3, true
+	}
+	s := NewSimpleAHRS()
+	s.SetQuaternionMode(true)
+	for _, m := range ms {
+		s.Compute(m)
+	}
+	roll, pitch, hdg := s.CalcRollPitchHeading()
+	if angleErr(roll, 20) > 0.1 || angleErr(pitch, 5) > 0.1 || angleErr(hdg, 120) > 0.1 {
+		t.Errorf("expected the external attitude 20°, 5°, 120°, got %f°, %f°, %f°", roll, pitch, hdg)
+	}
+	if _, _, h := s.RollPitchHeading(); h == Invalid {
+		t.Error("heading invalid though the external AHRS gives it")
+	}
+
+	// Without the mode, the quaternion is ignored.
+	s = NewSimpleAHRS()
+	for _, m := range ms {
+		s.Compute(m)
+	}
+	if roll, pitch, _ := s.CalcRollPitchHeading(); math.Abs(roll) > 0.1 || math.Abs(pitch) > 0.1 {
+		t.Errorf("expected level from the accelerometer, got %f°, %f°", roll, pitch)
+	}
+}
+
+func TestSimpleAdaptiveK(t *testing.T) {
+	// A step into a 10°/s turn with a noisy GPS, whose differenced acceleration makes a poor reference.
+	path := turnPath(100, 0, 30, 10*Deg)
+	ms := simMeasurements(path, 0, 60, 0.05)
+	rng := rand.New(rand.NewSource(1))
+	for _, m := range ms {
+		m.W1 += rng.NormFloat64()
+		m.W2 += rng.NormFloat64()
+		m.B1 += 0.1 * rng.NormFloat64()
+		m.B2 += 0.1 * rng.NormFloat64()
+		m.B3 += 0.1 * rng.NormFloat64()
+	}
+	headingErr := func(adaptive bool) float64 {
+		s := NewSimpleAHRS()
+		s.SetAdaptiveK(adaptive)
+		var e float64
+		var n int
+		for _, m := range ms {
+			s.Compute(m)
+			if m.T > 30 {
+				_, _, hdg, _, _, _ := path(m.T)
+				_, _, h := s.CalcRollPitchHeading()
+				e += math.Pow(angleErr(h, hdg/Deg), 2)
+				n++
+			}
+		}
+		return math.Sqrt(e / float64(n))
+	}
+	fixed, adaptive := headingErr(false), headingErr(true)
+	t.Logf("RMS heading error in the turn: %.3f° fixed, %.3f° adaptive", fixed, adaptive)
+	if adaptive >= fixed {
+		t.Errorf("expected adaptive K to reduce the heading error below %.3f°, got %.3f°", fixed, adaptive)
+	}
+}
+
+// coningAttitude returns the attitude of classic coning motion at time t: the aircraft's nose-up axis
+// sweeps a cone of half-angle a (rad) around the vertical at w (rad/s).
+func coningAttitude(a, w, t float64) (e0, e1, e2, e3 float64) {
+	return math.Cos(a / 2), math.Sin(a/2) * math.Cos(w*t), math.Sin(a/2) * math.Sin(w*t), 0
+}
+
+// coningRates returns the attitude of coning at time t, as from coningAttitude, and the body rates,
+// °/s, a gyro reads at that instant: sinusoidal on the first two axes and 90° out of phase.
+func coningRates(a, w, t float64) (e0, e1, e2, e3, b1, b2, b3 float64) {
+	e0, e1, e2, e3 = coningAttitude(a, w, t)
+	// Body rates 2 conj(e) e'
+	const h = 1e-6
+	p0, p1, p2, p3 := coningAttitude(a, w, t+h)
+	n0, n1, n2, n3 := coningAttitude(a, w, t-h)
+	d0, d1, d2, d3 := (p0-n0)/(2*h), (p1-n1)/(2*h), (p2-n2)/(2*h), (p3-n3)/(2*h)
+	b1 = RadToDeg(2 * (e0*d1 - e1*d0 - e2*d3 + e3*d2))
+	b2 = RadToDeg(2 * (e0*d2 + e1*d3 - e2*d0 - e3*d1))
+	b3 = RadToDeg(2 * (e0*d3 - e1*d2 + e2*d1 - e3*d0))
+	return
+}
+
+// quaternionAngle returns the angle, in degrees, of the rotation between the attitudes e and f.
+func quaternionAngle(e0, e1, e2, e3, f0, f1, f2, f3 float64) float64 {
+	return RadToDeg(2 * math.Acos(math.Min(1, math.Abs(e0*f0+e1*f1+e2*f2+e3*f3))))
+}
+
+// coningError returns the attitude error, in degrees, of s after 60 s of coning sampled at dt.
+func coningError(s *SimpleState, a, w, dt float64) float64 {
+	s.SetDeadReckonOnly(true)
+	var e0, e1, e2, e3 float64
+	for i := 0; i <= int(60/dt); i++ {
+		t := float64(i) * dt
+		m := NewMeasurement()
+		e0, e1, e2, e3, m.B1, m.B2, m.B3 = coningRates(a, w, t)
+		r := QuaternionToRotationMatrix(e0, e1, e2, e3)
+		m.A1, m.A2, m.A3 = r[2][0], r[2][1], r[2][2]
+		m.SValid, m.T = true, t
+		s.Compute(m)
+		if i == 0 {
+			s.E0, s.E1, s.E2, s.E3 = e0, e1, e2, e3
+		}
+	}
+	return quaternionAngle(s.E0, s.E1, s.E2, s.E3, e0, e1, e2, e3)
+}
+
+// coningSingleStepError returns the attitude error, in degrees, after 60 s of coning sampled at dt and
+// integrated by rotating through each raw gyro sample over the interval leading up to it, in one step.
+func coningSingleStepError(a, w, dt float64) float64 {
+	q0, q1, q2, q3, _, _, _ := coningRates(a, w, 0)
+	var e0, e1, e2, e3 float64
+	for i := 1; i <= int(60/dt); i++ {
+		var b1, b2, b3 float64
+		e0, e1, e2, e3, b1, b2, b3 = coningRates(a, w, float64(i)*dt)
+		q0, q1, q2, q3 = QuaternionRotate(q0, q1, q2, q3, DegToRad(b1*dt), DegToRad(b2*dt), DegToRad(b3*dt))
+	}
+	return quaternionAngle(q0, q1, q2, q3, e0, e1, e2, e3)
+}
+
+func TestSimpleRK4Coning(t *testing.T) {
+	// Without a GPS track the reference would hold the nose on a fixed heading, against the coning,
+	// so leave the gyro alone to carry the attitude, checked only by the accelerometer.
+	s := NewSimpleAHRS()
+	s.SetConfig(map[string]float64{"gpsWeight": 0})
+	defer s.SetConfig(map[string]float64{"gpsWeight": gpsWeightDefault})
+
+	// A 10° cone swept twice a second, sampled at 50 Hz.
+	const a, w, dt = 10 * Deg, 4 * Pi, 0.02
+	naive := coningError(s, a, w, dt)
+	single := coningSingleStepError(a, w, dt)
+	s = NewSimpleAHRS()
+	s.SetRK4(true)
+	rk4 := coningError(s, a, w, dt)
+	t.Logf("Attitude error after 60 s of coning: %.3f° through the smoothed rates, %.3f° through the raw rates "+
+		"in single steps, %.3f° RK4", naive, single, rk4)
+	// The fair comparison is with the same raw rates, rotated through in one step per sample.
+	if single < 1 {
+		t.Errorf("expected single-step integration to drift, but its error was only %.3f°", single)
+	}
+	if rk4 > single/10 {
+		t.Errorf("expected RK4 to cut the error of single steps, %.3f°, tenfold, but its error was %.3f°", single, rk4)
+	}
+
+	// Once the samples are held, RK4 must still make no allocations.
+	ms := representativeMeasurements()
+	for _, m := range ms[:10] {
+		s.Compute(m)
+	}
+	i := 10
+	if n := testing.AllocsPerRun(100, func() { s.Compute(ms[i]); i++ }); n > 0 {
+		t.Errorf("RK4 Compute made %.1f allocations", n)
+	}
+}
+
+func TestSimpleCalcAttitude(t *testing.T) {
+	// Climbing at 500 ft/min in a turn.
+	climb := MSToKnots(FPMToMS(500))
+	turn := turnPath(100, 0, 5, 3*Deg)
+	path := func(t float64) (float64, float64, float64, float64, float64, float64) {
+		roll, pitch, hdg, w1, w2, _ := turn(t)
+		return roll, pitch, hdg, w1, w2, climb
+	}
+	s := NewSimpleAHRS()
+	for _, m := range simMeasurements(path, 0, 30, 0.05) {
+		s.Compute(m)
+	}
+	a := s.CalcAttitude()
+	roll, pitch, heading := s.CalcRollPitchHeading()
+	if a.Roll != roll || a.Pitch != pitch || a.Heading != heading || a.TurnRate != s.RateOfTurn() ||
+		a.T != s.GetState().T {
+		t.Errorf("CalcAttitude gave %+v, expected %f, %f, %f, turning %f at %f",
+			a, roll, pitch, heading, s.RateOfTurn(), s.GetState().T)
+	}
+	if math.Abs(a.ROC-500) > 1e-6 {
+		t.Errorf("rate of climb %f ft/min, expected 500", a.ROC)
+	}
+}
+
+func TestSimpleGyroOnlyAttitude(t *testing.T) {
+	// A yaw gyro bias of 0.5°/s over two minutes straight and level
+	path := straightPath(100, 30*Deg)
+	s := NewSimpleAHRS()
+	for _, m := range simMeasurements(path, 0, 120, 0.05) {
+		m.B3 += 0.5
+		s.Compute(m)
+	}
+	_, _, heading := s.CalcRollPitchHeading()
+	_, _, headingGyr := s.CalcGyroOnlyAttitude()
+	if e := angleErr(heading, 30); e > 2 {
+		t.Errorf("fused heading %.1f°, expected 30°", heading)
+	}
+	if e := angleErr(headingGyr, 30); e < 50 {
+		t.Errorf("gyro-only heading %.1f°, expected it to drift about 60° from 30°", headingGyr)
+	}
+}
+
+func TestSimpleTurnRateGuard(t *testing.T) {
+	// Just above MinGS, a GPS fix arriving just after the last one with its track jumped by 10°
+	gs := minGSDefault + 1e-3
+	ms := simMeasurements(straightPath(gs, 0), 0, 60, 0.05)
+	s := NewSimpleAHRS()
+	for _, m := range ms {
+		s.Compute(m)
+	}
+	m := simMeasurement(straightPath(gs, 0), ms[len(ms)-1].T+minDT*1.01, minDT*1.01)
+	m.W1, m.W2 = gs*math.Sin(10*Deg), gs*math.Cos(10*Deg)
+	s.Compute(m)
+	if r := s.RateOfTurn(); math.IsNaN(r) || math.IsInf(r, 0) || math.Abs(r) > 360 {
+		t.Errorf("rate of turn %f°/s after a GPS fix %g s after the last", r, minDT*1.01)
+	}
+}
+
+func TestSimpleMultiRate(t *testing.T) {
+	// S-turns with the gyro read at 200 Hz and the other sensors at 20 Hz
+	path := sTurnPath(100, 30*Deg, 30)
+	rmsErr := func(s *SimpleState, e *float64, n *int, tt float64) {
+		if tt < 5 {
+			return
+		}
+		roll, pitch, heading := s.CalcRollPitchHeading()
+		r, p, h, _, _, _ := path(tt)
+		*e += math.Pow(angleErr(roll, r/Deg), 2) + math.Pow(angleErr(pitch, p/Deg), 2) +
+			math.Pow(angleErr(heading, h/Deg), 2)
+		*n += 3
+	}
+
+	combined := NewSimpleAHRS()
+	var eCombined float64
+	var nCombined int
+	for _, m := range simMeasurements(path, 0, 60, 0.05) {
+		combined.Compute(m)
+		rmsErr(combined, &eCombined, &nCombined, m.T)
+	}
+
+	multi := NewSimpleAHRS()
+	var eMulti float64
+	var nMulti int
+	for k := 0; k <= 12000; k++ {
+		tt := float64(k) * 0.005
+		if k > 0 {
+			g := simMeasurement(path, tt, 0.005)
+			multi.UpdateGyro(g.B1, g.B2, g.B3, tt)
+		}
+		if k%10 == 0 {
+			multi.UpdateAiding(simMeasurement(path, tt, 0.05))
+			rmsErr(multi, &eMulti, &nMulti, tt)
+		}
+	}
+
+	eCombined, eMulti = math.Sqrt(eCombined/float64(nCombined)), math.Sqrt(eMulti/float64(nMulti))
+	if math.Abs(multi.T-60) > 1e-9 || eMulti > eCombined+0.2 || eMulti > 1 {
+		t.Errorf("RMS attitude error %.3f° from 200 Hz gyro and 20 Hz aiding at %f s, %.3f° from 20 Hz measurements",
+			eMulti, multi.T, eCombined)
+	}
+}
+
+func TestSimpleMultiRateHover(t *testing.T) {
+	// The hover of TestSimpleRotorcraftHover with the gyro read at 100 Hz and the other sensors at 10 Hz
+	hover := func(t float64) (float64, float64, float64, float64, float64, float64) {
+		return 2 * Deg * math.Sin(0.5*t), 1.5 * Deg * math.Sin(0.3*t+1), 60*Deg + 10*Deg*math.Sin(0.05*t), 0, 0, 0
+	}
+	ms := withSensorErrors(withMagnetometer(simMeasurements(hover, 0, 600, 0.01), hover))
+
+	s := NewSimpleAHRS()
+	s.SetVehicleType(Rotorcraft)
+	var maxRP, maxH, maxB float64
+	for k, m := range ms {
+		if k > 0 {
+			s.UpdateGyro(m.B1, m.B2, m.B3, m.T)
+		}
+		if k%10 != 0 {
+			continue
+		}
+		s.UpdateAiding(m)
+		if m.T < 60 { // Learning the gyro bias
+			continue
+		}
+		roll, pitch, heading := s.CalcRollPitchHeading()
+		r, p, h, _, _, _ := hover(m.T)
+		maxRP = math.Max(maxRP, math.Max(angleErr(roll, r/Deg), angleErr(pitch, p/Deg)))
+		maxH = math.Max(maxH, angleErr(heading, h/Deg))
+		// The predicted gyro rates are those over the latest gyro interval, not undefined over none.
+		pm := s.PredictMeasurement()
+		maxB = math.Max(maxB, math.Max(math.Abs(pm.B1-m.B1), math.Max(math.Abs(pm.B2-m.B2), math.Abs(pm.B3-m.B3))))
+	}
+	if maxRP > 2 || maxH > 5 {
+		t.Errorf("roll or pitch up to %.2f° off and heading up to %.2f° off in a multi-rate hover", maxRP, maxH)
+	}
+	if d1, d2, d3 := s.D1-gyroBias[0], s.D2-gyroBias[1], s.D3-gyroBias[2]; math.Sqrt(d1*d1+d2*d2+d3*d3) > 0.05 {
+		t.Errorf("gyro bias learned as %.3f, %.3f, %.3f°/s at multiple rates, expected %v", s.D1, s.D2, s.D3, gyroBias)
+	}
+	if !(maxB < 1) {
+		t.Errorf("predicted gyro rates up to %.3f°/s off the measured ones after UpdateAiding", maxB)
+	}
+}
+
+func TestSimpleUpdateGyroSaturation(t *testing.T) {
+	s := NewSimpleAHRS()
+	s.SetGyroFullScale(250, 250, 250)
+	var tSat float64
+	s.SetGyroSaturationCallback(func(tt float64, axes [3]bool) { tSat = tt })
+	s.UpdateAiding(simMeasurement(staticPath(0, 0, 0), 0, 0.1))
+	s.UpdateGyro(0, 0, 260, 0.01)
+	if n, saturated := s.CalcGyroSaturations(); n != 1 || !saturated || tSat != 0.01 {
+		t.Errorf("%d saturations (now %t) reported at %f s from UpdateGyro, expected 1 at 0.01 s", n, saturated, tSat)
+	}
+	s.UpdateGyro(0, 0, 100, 0.02)
+	if n, saturated := s.CalcGyroSaturations(); n != 1 || saturated {
+		t.Errorf("%d saturations (now %t) after the gyro recovered", n, saturated)
+	}
+}
+
+func TestSimpleGPSBlend(t *testing.T) {
+	// A steady turn with the GPS lost from 40 s to 45 s: the references then disagree with the held attitude.
+	const slewLimit = 0.2 // Largest change in the attitude error from one sample to the next, °
+	path := turnPath(100, 0, 10, 3*Deg)
+	maxSlew := func(blendTime float64) (slew float64) {
+		s := NewSimpleAHRS()
+		s.SetBlendTime(blendTime)
+		var er, ep, eh float64
+		for _, m := range simMeasurements(path, 0, 60, 0.1) {
+			m.WValid = m.T < 40 || m.T >= 45
+			s.Compute(m)
+			roll, pitch, heading := s.CalcRollPitchHeading()
+			r, p, h, _, _, _ := path(m.T)
+			dr, dp, dh := roll-r/Deg, pitch-p/Deg, AngleDiff(heading*Deg, h)/Deg
+			// Over the second after the GPS drops out and after it comes back
+			if (m.T >= 40 && m.T < 41) || (m.T >= 45 && m.T < 46) {
+				slew = math.Max(slew, math.Max(math.Abs(dr-er), math.Max(math.Abs(dp-ep), math.Abs(dh-eh))))
+			}
+			er, ep, eh = dr, dp, dh
+		}
+		return slew
+	}
+
+	blended, switched := maxSlew(blendTimeDefault), maxSlew(0)
+	if blended > slewLimit || blended >= switched {
+		t.Errorf("attitude error changed by up to %.3f° between samples as the GPS dropped out and came back, "+
+			"%.3f° switching at once", blended, switched)
+	}
+}
+
+func TestSimpleGPSBlendMultiRate(t *testing.T) {
+	// The turn of TestSimpleGPSBlend with the gyro read at 200 Hz and the other sensors at 20 Hz, and the
+	// GPS lost from 40 s to 43 s: the blend ramps with the aiding measurements, not the zero gyro interval.
+	path := turnPath(100, 0, 10, 3*Deg)
+	s := NewSimpleAHRS()
+	minBlend, blendOut := 1.0, 0.0
+	for k := 0; k <= 12000; k++ {
+		tt := float64(k) * 0.005
+		if k > 0 {
+			g := simMeasurement(path, tt, 0.005)
+			s.UpdateGyro(g.B1, g.B2, g.B3, tt)
+		}
+		if k%10 != 0 {
+			continue
+		}
+		m := simMeasurement(path, tt, 0.05)
+		m.WValid = tt < 40 || tt >= 43
+		s.UpdateAiding(m)
+		if tt >= 40 {
+			minBlend = math.Min(minBlend, s.blend)
+		}
+		if tt < 43 {
+			blendOut = s.blend
+		}
+	}
+	if minBlend > 0.1 || blendOut != 1 || s.blend != 1 {
+		t.Errorf("blend fell to %.3f, was %.3f as the GPS came back and %.3f at the end, expected 0, 1 and 1",
+			minBlend, blendOut, s.blend)
+	}
+	roll, pitch, heading := s.CalcRollPitchHeading()
+	r, p, h, _, _, _ := path(60)
+	if e := math.Max(angleErr(roll, r/Deg), math.Max(angleErr(pitch, p/Deg), angleErr(heading, h/Deg))); e > 1 {
+		t.Errorf("attitude %.2f° off after the GPS came back", e)
+	}
+}
+
+func TestSimpleTaxiHeading(t *testing.T) {
+	// Five minutes of taxiing at 4 kt, weaving 90° either side of north, with a 0.5°/s yaw gyro bias
+	path := sTurnPath(4, 90*Deg, 120)
+	taxi := func(tau float64) (herr float64) {
+		s := NewSimpleAHRS()
+		s.SetTaxiHeadingTimeConstant(tau)
+		for _, m := range simMeasurements(path, 0, 300, 0.1) {
+			m.B3 += 0.5
+			s.Compute(m)
+		}
+		_, _, heading := s.CalcRollPitchHeading()
+		_, _, h, _, _, _ := path(300)
+		return angleErr(heading, h/Deg)
+	}
+	if herr := taxi(taxiHeadingTauDefault); herr > 3 {
+		t.Errorf("heading %.1f° off after a 5-minute taxi in taxi mode", herr)
+	}
+	if herr := taxi(0); herr < 20 {
+		t.Errorf("heading only %.1f° off after a 5-minute taxi on the gyro alone", herr)
+	}
+
+	// Backing out of a parking spot facing north doesn't swing the heading round to the track.
+	backUp := func(t float64) (float64, float64, float64, float64, float64, float64) {
+		return 0, 0, 0, 0, -3, 0
+	}
+	s := NewSimpleAHRS()
+	s.SetAttitude(0, 0, 0)
+	for _, m := range simMeasurements(backUp, 0, 30, 0.1) {
+		s.Compute(m)
+	}
+	if _, _, heading := s.CalcRollPitchHeading(); angleErr(heading, 0) > 1 {
+		t.Errorf("heading %.1f° backing up facing north", heading)
+	}
+}
+
+func TestSimpleCalcWind(t *testing.T) {
+	// A slow turn at 100 kt through the air in a 20 kt wind from 250°
+	const tas, ws, wd = 100, 20, 250 * Deg
+	we, wn := -ws*math.Sin(wd), -ws*math.Cos(wd)
+	tr := 1 * Deg
+	path := func(t float64) (float64, float64, float64, float64, float64, float64) {
+		h := tr * t
+		return math.Atan(tas * tr / G), 0, h, tas*math.Sin(h) + we, tas*math.Cos(h) + wn, 0
+	}
+	for _, declination := range []float64{0, 10, -15} {
+		s := NewSimpleAHRS()
+		s.SetDeclination(declination)
+		ms := withDeclinedMagnetometer(simMeasurements(path, 0, 120, 0.1), path, declination*Deg)
+		for i, m := range ms {
+			m.U1, m.UValid, m.TU = tas, true, m.T
+			s.Compute(m)
+			if _, _, valid := s.CalcWind(); i < windMinSamples && valid {
+				t.Errorf("wind valid after %d measurements", i+1)
+			}
+		}
+		speed, dir, valid := s.CalcWind()
+		if !valid || math.Abs(speed-ws) > 2 || angleErr(dir, wd/Deg) > 5 {
+			t.Errorf("wind %.1f kt from %.0f° (valid %t) with %.0f° of declination, expected %d kt from %.0f°",
+				speed, dir, valid, declination, ws, wd/Deg)
+		}
+	}
+
+	// Holding the track, an error in the airspeed or the crab would pass for wind, so it isn't reported.
+	straight := func(t float64) (float64, float64, float64, float64, float64, float64) {
+		return 0, 0, 0, we, tas + wn, 0
+	}
+	s := NewSimpleAHRS()
+	for _, m := range withMagnetometer(simMeasurements(straight, 0, 120, 0.1), straight) {
+		m.U1, m.UValid, m.TU = tas, true, m.T
+		s.Compute(m)
+	}
+	if speed, dir, valid := s.CalcWind(); valid {
+		t.Errorf("wind %.1f kt from %.0f° reported without turning", speed, dir)
+	}
+}
+
+func TestSimpleRotorcraftHover(t *testing.T) {
+	// Ten minutes hovering, rocking a little and yawing slowly about 60°, with gyro bias and noise
+	hover := func(t float64) (float64, float64, float64, float64, float64, float64) {
+		return 2 * Deg * math.Sin(0.5*t), 1.5 * Deg * math.Sin(0.3*t+1), 60*Deg + 10*Deg*math.Sin(0.05*t), 0, 0, 0
+	}
+	ms := withSensorErrors(withMagnetometer(simMeasurements(hover, 0, 600, 0.1), hover))
+
+	s := NewSimpleAHRS()
+	s.SetVehicleType(Rotorcraft)
+	var maxRP, maxH float64
+	for _, m := range ms {
+		s.Compute(m)
+		if m.T < 60 { // Learning the gyro bias
+			continue
+		}
+		roll, pitch, heading := s.CalcRollPitchHeading()
+		r, p, h, _, _, _ := hover(m.T)
+		maxRP = math.Max(maxRP, math.Max(angleErr(roll, r/Deg), angleErr(pitch, p/Deg)))
+		maxH = math.Max(maxH, angleErr(heading, h/Deg))
+	}
+	if maxRP > 2 || maxH > 5 {
+		t.Errorf("roll or pitch up to %.2f° off and heading up to %.2f° off in a hover", maxRP, maxH)
+	}
+	if d1, d2, d3 := s.D1-gyroBias[0], s.D2-gyroBias[1], s.D3-gyroBias[2]; math.Sqrt(d1*d1+d2*d2+d3*d3) > 0.05 {
+		t.Errorf("gyro bias learned as %.3f, %.3f, %.3f°/s, expected %v", s.D1, s.D2, s.D3, gyroBias)
+	}
+}
+
+func TestSimpleLongFlightHeading(t *testing.T) {
+	// Ten hours of a constant 3°/s yaw on the gyro alone, from a seeded attitude.
+	const rate, hours = 3 * Deg, 10
+	spin := func(t float64) (float64, float64, float64, float64, float64, float64) {
+		return 0, 0, math.Remainder(rate*t, 2*Pi), 0, 0, 0
+	}
+	s := NewSimpleAHRS()
+	s.SetAttitude(0, 0, 0)
+	var maxErr float64
+	for k := 0; k <= hours*36000; k++ {
+		m := simMeasurement(spin, float64(k)*0.1, 0.1)
+		m.WValid = false
+		s.Compute(m)
+		if k%600 != 0 {
+			continue
+		}
+		_, _, h, _, _, _ := spin(m.T)
+		_, _, heading := s.State.CalcRollPitchHeading()
+		_, _, raw := s.CalcGyroOnlyAttitude()
+		if heading < 0 || heading >= 360 || raw < 0 || raw >= 360 {
+			t.Fatalf("heading %f° or raw gyro heading %f° out of [0, 360) after %.0f s", heading, raw, m.T)
+		}
+		maxErr = math.Max(maxErr, math.Abs(AngleDiff(raw*Deg, h)/Deg))
+	}
+	if maxErr > 0.01 {
+		t.Errorf("raw gyro heading off by up to %g° over %d hours", maxErr, hours)
+	}
+
+	// The same turn circling at 100 kt, with the fused heading following the GPS track.
+	const gs = 100
+	bank := math.Atan(gs * rate / G)
+	circle := func(t float64) (float64, float64, float64, float64, float64, float64) {
+		h := math.Remainder(rate*t, 2*Pi)
+		return bank, 0, h, gs * math.Sin(h), gs * math.Cos(h), 0
+	}
+	s = NewSimpleAHRS()
+	var offset float64
+	maxErr = 0
+	for k := 0; k <= hours*36000; k++ {
+		m := simMeasurement(circle, float64(k)*0.1, 0.1)
+		s.Compute(m)
+		if k%600 != 0 || m.T < 60 {
+			continue
+		}
+		_, _, h, _, _, _ := circle(m.T)
+		_, _, heading := s.CalcRollPitchHeading()
+		if !(heading >= 0 && heading < 360) {
+			t.Fatalf("heading %f° out of [0, 360) after %.0f s", heading, m.T)
+		}
+		// The fused heading lags the turn by a constant amount, settled after the first minute.
+		e := AngleDiff(heading*Deg, h) / Deg
+		if m.T == 60 {
+			offset = e
+		}
+		maxErr = math.Max(maxErr, math.Abs(e-offset))
+	}
+	t.Logf("Fused heading within %.2g° of its lag of %.3f°", maxErr, -offset)
+	if !(maxErr <= 0.01) {
+		t.Errorf("fused heading drifted by up to %g° from its lag of %.3f° over %d hours", maxErr, -offset, hours)
+	}
+}
+
+func TestSimpleCrabBounded(t *testing.T) {
+	// A magnetic field turning steadily about the vertical keeps the crab turning one way.
+	const rate = 10 * Deg
+	ms := simMeasurements(straightPath(100, 0), 0, 3600, 0.1)
+	s := NewSimpleAHRS()
+	for _, m := range ms {
+		m.M1, m.M2, m.M3 = 20*math.Sin(rate*m.T), 20*math.Cos(rate*m.T), -45
+		m.MValid = true
+		s.Compute(m)
+		if math.Abs(s.crab) > Pi {
+			t.Fatalf("crab angle wound up to %f° after %.0f s", s.crab/Deg, m.T)
+		}
+	}
+}
+
+func TestSimpleAerobaticDetection(t *testing.T) {
+	// A 4-second aileron roll at 90°/s from straight and level flight
+	rollErr := func(s *SimpleState) float64 {
+		path := rollPath(10, 90*Deg)
+		for _, m := range simMeasurements(path, 0, 14.5, 0.05) {
+			m.A1, m.A2, m.A3 = 0, 0, 1 // Positive G throughout
+			s.Compute(m)
+		}
+		roll, pitch, heading := s.CalcRollPitchHeading()
+		return math.Max(angleErr(roll, 0), math.Max(angleErr(pitch, 0), angleErr(heading, 0)))
+	}
+	s := NewSimpleAHRS()
+	s.SetAerobaticDetection(true)
+	if on, off := rollErr(s), rollErr(NewSimpleAHRS()); on > 2 || off < 10 {
+		t.Errorf("attitude %.1f° off after the roll with aerobatic detection, %.1f° without", on, off)
+	}
+
+	// A brisk roll into a 45° bank turn at 100 kt, rolling at 30°/s, isn't a maneuver.
+	const gs, bank, rr = 100, 45 * Deg, 30 * Deg
+	t0, t1 := 10.0, 10+bank/rr
+	steep := func(t float64) (float64, float64, float64, float64, float64, float64) {
+		var roll, hdg float64
+		switch {
+		case t > t1:
+			roll = bank
+			hdg = -G/gs*math.Log(math.Cos(bank))/rr + G/gs*math.Tan(bank)*(t-t1)
+		case t > t0:
+			roll = rr * (t - t0)
+			hdg = -G / gs * math.Log(math.Cos(roll)) / rr
+		}
+		return roll, 0, hdg, gs * math.Sin(hdg), gs * math.Cos(hdg), 0
+	}
+	s = NewSimpleAHRS()
+	s.SetAerobaticDetection(true)
+	for _, m := range simMeasurements(steep, 0, 60, 0.05) {
+		s.Compute(m)
+		if s.inAerobatics {
+			t.Fatalf("aerobatics detected in a steep turn at %.2f s, rates %.1f, %.1f, %.1f°/s",
+				m.T, s.H1, s.H2, s.H3)
+		}
+	}
+}
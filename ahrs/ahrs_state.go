@@ -2,8 +2,6 @@ package ahrs
 
 import (
 	"math"
-
-	"github.com/skelterjohn/go.matrix"
 )
 
 // State holds the complete information describing the state of the aircraft.
@@ -14,7 +12,7 @@ type State struct {
 	U1, U2, U3     float64 // Vector for airspeed, aircraft frame, kt
 	Z1, Z2, Z3     float64 // Vector for rate of change of airspeed, aircraft frame, G
 	E0, E1, E2, E3 float64 // Quaternion rotating aircraft frame to earth frame
-	H1, H2, H3     float64 // Vector for gyro rates, earth frame, °/s
+	H1, H2, H3     float64 // Vector for gyro rates, aircraft frame, °/s
 	N1, N2, N3     float64 // Vector for earth's magnetic field, earth (inertial) frame, µT
 
 	V1, V2, V3     float64 // (Bias) Vector for windspeed, earth frame, kt
@@ -26,8 +24,9 @@ type State struct {
 
 	T float64 // Time when state last updated
 
-	M *matrix.DenseMatrix // Covariance matrix of state uncertainty, same order as above vars:
-	N *matrix.DenseMatrix // Covariance matrix of state noise per unit time
+	// M and N are only allocated by the providers that use them; they are nil otherwise.
+	M *Matrix // Covariance matrix of state uncertainty, same order as above vars:
+	N *Matrix // Covariance matrix of state noise per unit time
 	// U, Z, E, H, N,
 	// V, C, F, D, L
 
@@ -41,40 +40,105 @@ type State struct {
 
 	roll, pitch, heading float64                // Fused attitude, Rad
 	headingMag           float64                // Magnetic heading, Rad (smoothed)
+	declination          float64                // Magnetic declination, Rad east of true north
 	slipSkid             float64                // Slip/Skid Angle, Rad (smoothed)
 	gLoad                float64                // G Load, G vertical (smoothed)
 	turnRate             float64                // turn rate, Rad/s (smoothed)
 	needsInitialization  bool                   // Rather than computing, initialize
 	aNorm                float64                // Normalization constant by which to scale measured accelerations
 	logMap               map[string]interface{} // Map only for analysis/debugging
+	magMon               magMonitor             // Consistency of the magnetometer with the gyro
+	vibMon               vibrationMonitor       // Spread of the accelerometer magnitude
+	tempModel            GyroTempModel          // Gyro biases vs temperature
+	tempFit              gyroTempFit            // Learning of tempModel
+	gyroSat              gyroSaturation         // Gyro rates clipping at the sensor's full-scale range
+	accelClip            accelClipping          // Accelerometer readings clipping at the sensor's full-scale range
+	turnCoordinator      TurnCoordinator        // Configuration of CalcTurnCoordinator
+	mKnots               Measurement            // Copy of a measurement given in other units, converted to knots
 }
 
-// RollPitchHeading returns the current attitude values as estimated by the Kalman algorithm.
+// RollPitchHeading returns the current attitude values, in radians, from the attitude quaternion E.
+// CalcRollPitchHeading returns them in degrees.
 func (s *State) RollPitchHeading() (roll float64, pitch float64, heading float64) {
 	roll, pitch, heading = FromQuaternion(s.E0, s.E1, s.E2, s.E3)
 	return
 }
 
+// RollPitchHeadingUncertainty returns the standard deviations of the attitude values, in radians.
+// They are NaN if the state carries no covariance.
 func (s *State) RollPitchHeadingUncertainty() (droll float64, dpitch float64, dheading float64) {
+	if s.M == nil {
+		return math.NaN(), math.NaN(), math.NaN()
+	}
 	droll, dpitch, dheading = VarFromQuaternion(s.E0, s.E1, s.E2, s.E3,
 		math.Sqrt(s.M.Get(6, 6)), math.Sqrt(s.M.Get(7, 7)),
 		math.Sqrt(s.M.Get(8, 8)), math.Sqrt(s.M.Get(9, 9)))
 	return
 }
 
+// CalcCovarianceTrace returns the trace of the state covariance matrix M, a cheap scalar measure
+// of the filter's overall uncertainty that should settle down as a Kalman filter converges.
+// It returns NaN if the state carries no covariance.
+func (s *State) CalcCovarianceTrace() (tr float64) {
+	if s.M == nil {
+		return math.NaN()
+	}
+	r, c := s.M.GetSize()
+	for i := 0; i < r && i < c; i++ {
+		tr += s.M.Get(i, i)
+	}
+	return
+}
+
+// CalcQuaternionNorm returns the norm of the orientation quaternion E, which should always be 1.
+func (s *State) CalcQuaternionNorm() float64 {
+	return math.Sqrt(s.E0*s.E0 + s.E1*s.E1 + s.E2*s.E2 + s.E3*s.E3)
+}
+
 // MagHeading returns the magnetic heading in degrees.
 func (s *State) MagHeading() (hdg float64) {
-	return s.headingMag / Deg
+	return RadToDeg(s.headingMag)
 }
 
 // SlipSkid returns the slip/skid angle in degrees.
 func (s *State) SlipSkid() (slipSkid float64) {
-	return s.slipSkid / Deg
+	return RadToDeg(s.slipSkid)
 }
 
 // RateOfTurn returns the turn rate in degrees per second.
 func (s *State) RateOfTurn() (turnRate float64) {
-	return s.turnRate / Deg
+	return RadToDeg(s.turnRate)
+}
+
+// eulerRatePoleCos is the cosine of the pitch beyond which CalcEulerRates no longer gives the roll and heading
+// rates, which grow without bound toward the vertical.
+const eulerRatePoleCos = 0.01 // About 89.4°
+
+// CalcBodyRates returns the rotation rates of the aircraft, corrected for the gyro bias, in °/s about its own
+// axes: roll about the nose, positive right wing down; pitch about the wings, positive nose up; and yaw about
+// the top, positive nose right.
+func (s *State) CalcBodyRates() (p, q, r float64) {
+	return s.H1, -s.H2, -s.H3
+}
+
+// CalcEulerRates returns the rates of change, °/s, of the roll, pitch and heading, which differ from the
+// body rates once the aircraft banks or pitches: in a banked turn the heading rate is shared between the
+// pitch and yaw gyros.  Toward the vertical the roll and heading rates are undefined, so beyond about
+// 89.4° of pitch they are taken as at that pitch and ok is false.
+func (s *State) CalcEulerRates() (rollRate, pitchRate, headingRate float64, ok bool) {
+	p, q, r := s.CalcBodyRates()
+	roll, pitch, _ := s.RollPitchHeading()
+	sinPhi, cosPhi := math.Sincos(roll)
+	cosTheta := math.Cos(pitch)
+	ok = cosTheta >= eulerRatePoleCos
+	if !ok {
+		cosTheta = eulerRatePoleCos
+	}
+	tanTheta := math.Copysign(math.Sqrt(1-cosTheta*cosTheta), pitch) / cosTheta
+	rollRate = p + (q*sinPhi+r*cosPhi)*tanTheta
+	pitchRate = q*cosPhi - r*sinPhi
+	headingRate = (q*sinPhi + r*cosPhi) / cosTheta
+	return
 }
 
 // GLoad returns the current G load, in G's.
@@ -137,19 +201,40 @@ func (s *State) GetCalibrations() (c, d, k, l *[3]float64) {
 		&[3]float64{s.K1, s.K2, s.K3}, &[3]float64{s.L1, s.L2, s.L3}
 }
 
+// SetDeclination sets the magnetic declination, ° east of true north (negative west), by which the
+// providers turn the magnetometer's north to true north in finding the crab angle and the wind.
+// It is 0 by default, which leaves them off by the local declination.
+func (s *State) SetDeclination(declination float64) {
+	s.declination = DegToRad(declination)
+}
+
 // SetConfig lets the user alter some of the configuration settings.
 func (s *State) SetConfig(configMap map[string]float64) {
 	return
 }
 
 // Valid returns whether the current state is a valid estimate or if something went wrong in the calculation.
+// It is false until the algorithm has been initialized by a measurement.
 func (s *State) Valid() (ok bool) {
+	return !s.needsInitialization && s.finite()
+}
+
+// finite returns whether all the values reported to the user are finite numbers.
+func (s *State) finite() bool {
+	roll, pitch, heading := s.RollPitchHeading()
+	for _, v := range [...]float64{roll, pitch, heading, s.headingMag, s.slipSkid, s.turnRate, s.gLoad} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
 	return true
 }
 
 // init puts the algorithm into a known state, on startup or after a reset.
 func (s *State) init(m *Measurement) {
 	s.needsInitialization = false
+	s.magMon = magMonitor{}
+	s.vibMon = vibrationMonitor{}
 
 	s.K1, s.K2, s.K3 = 1, 1, 1
 	s.T = m.T
@@ -168,10 +253,8 @@ func (s *State) init(m *Measurement) {
 	// Initialize Magnetic Heading, Slip/Skid, Rate of Turn, and GLoad.
 	_, _, s.headingMag = Regularize(0, 0, math.Atan2(m1, m2))
 	s.slipSkid = math.Atan2(a2, -a3)
-	s.turnRate = b3 * Deg
+	s.turnRate = DegToRad(b3)
 	s.gLoad = -a3 / s.aNorm
-
-	s.updateLogMap(m, s.logMap)
 }
 
 // Reset restarts the algorithm from scratch.
@@ -192,9 +275,9 @@ func (s *State) GetLogMap() (p map[string]interface{}) {
 func (s *State) updateLogMap(m *Measurement, p map[string]interface{}) {
 	var logMap = map[string]func(s *State, m *Measurement) float64{
 		"Ta":      func(s *State, m *Measurement) float64 { return s.T },
-		"Roll":    func(s *State, m *Measurement) float64 { return s.roll / Deg },
-		"Pitch":   func(s *State, m *Measurement) float64 { return s.pitch / Deg },
-		"Heading": func(s *State, m *Measurement) float64 { return s.heading / Deg },
+		"Roll":    func(s *State, m *Measurement) float64 { return RadToDeg(s.roll) },
+		"Pitch":   func(s *State, m *Measurement) float64 { return RadToDeg(s.pitch) },
+		"Heading": func(s *State, m *Measurement) float64 { return RadToDeg(s.heading) },
 		"WValid": func(s *State, m *Measurement) float64 {
 			if m.WValid {
 				return 1
@@ -325,9 +408,112 @@ func (s *State) rotateByF(a1, a2, a3 float64, inverse bool) (z1, z2, z3 float64)
 	return
 }
 
-// RollPitchHeading returns the current roll, pitch and heading estimates
-// for the State, in degrees
+// RotateBodyToEarth rotates the aircraft-frame vector (x, y, z) into the earth frame using the attitude
+// quaternion E, in the same sense as the rest of the package: X_e = E*X_a*conj(E).
+func (s *State) RotateBodyToEarth(x, y, z float64) (float64, float64, float64) {
+	return quaternionRotateVector(s.E0, s.E1, s.E2, s.E3, x, y, z)
+}
+
+// RotateEarthToBody rotates the earth-frame vector (x, y, z) into the aircraft frame, the inverse of
+// RotateBodyToEarth.
+func (s *State) RotateEarthToBody(x, y, z float64) (float64, float64, float64) {
+	return quaternionRotateVector(s.E0, -s.E1, -s.E2, -s.E3, x, y, z)
+}
+
+// CalcRotationMatrix returns the direction cosine matrix r rotating aircraft-frame vectors into the earth
+// frame, X_e = r·X_a, built directly from the attitude quaternion E so that it has none of the Euler angles'
+// ambiguity at the pitch pole.  Its columns are the nose, left wing and top of the aircraft in the earth
+// frame's east, north and up, as described for ENU.
+func (s *State) CalcRotationMatrix() (r [3][3]float64) {
+	return *QuaternionToRotationMatrix(s.E0, s.E1, s.E2, s.E3)
+}
+
+// CalcQuaternion returns the attitude quaternion E normalized, scalar first.  It rotates the aircraft frame
+// into the earth frame, X_e = E*X_a*conj(E), so that it carries the same rotation as CalcRotationMatrix.
+func (s *State) CalcQuaternion() (w, x, y, z float64) {
+	return QuaternionNormalize(s.E0, s.E1, s.E2, s.E3)
+}
+
+// CalcQuaternionRate returns the rate of change of CalcQuaternion, per second, at the latest gyro rates H:
+// half the product of the quaternion and the rates, in rad/s, aircraft frame.  Stepping the quaternion
+// along it lets a client interpolate the attitude smoothly between updates.
+func (s *State) CalcQuaternionRate() (w, x, y, z float64) {
+	e0, e1, e2, e3 := s.CalcQuaternion()
+	w, x, y, z = quaternionProduct(e0, e1, e2, e3, 0, DegToRad(s.H1), DegToRad(s.H2), DegToRad(s.H3))
+	return w / 2, x / 2, y / 2, z / 2
+}
+
+// CalcInverseRotationMatrix returns the transpose of CalcRotationMatrix, rotating earth-frame vectors into
+// the aircraft frame.
+func (s *State) CalcInverseRotationMatrix() (r [3][3]float64) {
+	e := s.CalcRotationMatrix()
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			r[i][j] = e[j][i]
+		}
+	}
+	return
+}
+
+// quaternionRotateVector returns q*v*conj(q) for the unit quaternion q and vector v.
+func quaternionRotateVector(q0, q1, q2, q3, v1, v2, v3 float64) (r1, r2, r3 float64) {
+	// t = 2 q x v, r = v + q0 t + q x t
+	t1 := 2 * (q2*v3 - q3*v2)
+	t2 := 2 * (q3*v1 - q1*v3)
+	t3 := 2 * (q1*v2 - q2*v1)
+	r1 = v1 + q0*t1 + q2*t3 - q3*t2
+	r2 = v2 + q0*t2 + q3*t1 - q1*t3
+	r3 = v3 + q0*t3 + q1*t2 - q2*t1
+	return
+}
+
+// magnetometer returns the calibrated magnetometer reading in m, aircraft frame, and whether it is usable.
+func (s *State) magnetometer(m *Measurement) (m1, m2, m3 float64, ok bool) {
+	if !m.MValid {
+		return
+	}
+	m1, m2, m3 = s.rotateByF(s.K1*m.M1+s.L1, s.K2*m.M2+s.L2, s.K3*m.M3+s.L3, false)
+	return m1, m2, m3, m1*m1+m2*m2+m3*m3 > Small
+}
+
+// PredictMag returns the magnetometer reading, aircraft frame, µT, that the attitude implies in an earth field of
+// the given intensity, µT, pointing declination radians east of true north and inclination radians below the
+// horizon, as for the magnetometer part of PredictMeasurement.  The magnetometer's own calibration isn't applied.
+func (s *State) PredictMag(declination, inclination, intensity float64) (m1, m2, m3 float64) {
+	h := intensity * math.Cos(inclination)
+	return s.RotateEarthToBody(h*math.Sin(declination), h*math.Cos(declination), -intensity*math.Sin(inclination))
+}
+
+// CalcAccelAttitude returns the roll and pitch, in radians, that the accelerometer reading in m implies
+// if it is measuring only 1 G of gravity, that is if the aircraft isn't accelerating.
+func (s *State) CalcAccelAttitude(m *Measurement) (roll, pitch float64) {
+	a1, a2, a3 := s.rotateByF(m.A1, m.A2, m.A3, false)
+	return math.Atan2(a2, a3), math.Atan2(a1, math.Hypot(a2, a3))
+}
+
+// CalcRollPitchHeading returns the current roll, pitch and heading estimates for the State, in degrees,
+// for display.  RollPitchHeading returns them in radians.
 func (s *State) CalcRollPitchHeading() (roll float64, pitch float64, heading float64) {
 	roll, pitch, heading = FromQuaternion(s.E0, s.E1, s.E2, s.E3)
-	return roll / Deg, pitch / Deg, heading / Deg
+	return RadToDeg(roll), RadToDeg(pitch), RadToDeg(heading)
+}
+
+// Attitude returns a compact copy of the attitude of s, with the turn rate and the rate of climb of the
+// velocity through the air U, rotated into the earth frame, plus the wind V.
+func (s *State) Attitude() Attitude {
+	roll, pitch, heading := s.CalcRollPitchHeading()
+	_, _, w3 := s.RotateBodyToEarth(s.U1, s.U2, s.U3)
+	return Attitude{Roll: roll, Pitch: pitch, Heading: heading, TurnRate: s.RateOfTurn(),
+		ROC: MSToFPM(KnotsToMS(w3 + s.V3)), T: s.T}
+}
+
+// CalcAttitude returns Attitude; the providers that track the climb some other way override it.
+func (s *State) CalcAttitude() Attitude {
+	return s.Attitude()
+}
+
+// CalcGyroBias returns the gyro biases, °/s, sensor frame, that the algorithm subtracts from the gyro readings:
+// the calibrations, updated by those algorithms that estimate the biases.
+func (s *State) CalcGyroBias() (b1, b2, b3 float64) {
+	return s.D1, s.D2, s.D3
 }
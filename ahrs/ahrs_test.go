@@ -1,7 +1,7 @@
 package ahrs
 
 import (
-	"github.com/skelterjohn/go.matrix"
+	"io/ioutil"
 	"log"
 	"math"
 	"math/rand"
@@ -10,7 +10,7 @@ import (
 )
 
 func createRandomState() (s *KalmanState) {
-	s = &KalmanState{State{
+	s = &KalmanState{State: State{
 		U1: rand.Float64()*100 + 15,
 		U2: rand.Float64()*10 - 5,
 		U3: rand.Float64()*10 - 5,
@@ -46,8 +46,8 @@ func createRandomState() (s *KalmanState) {
 		L3: rand.Float64()*1 - 0.5,
 
 		T: 10,
-		M: matrix.Zeros(32, 32),
-		N: matrix.Zeros(32, 32),
+		M: NewMatrix(32, 32),
+		N: NewMatrix(32, 32),
 	}}
 
 	s.normalize()
@@ -112,40 +112,79 @@ func measMap(m *Measurement) map[int]*float64 {
 	}
 }
 
-func TestJacobianMeasurement(t *testing.T) {
-	for n := 0; n < 100; n++ {
-		rand.Seed(time.Now().Unix())
-		s := createRandomState()
-		smap := stateMap(s)
-
-		m := s.PredictMeasurement()
-		mmap := measMap(m)
-
-		h := s.calcJacobianMeasurement()
+// numericJacobianMeasurement differentiates PredictMeasurement by central differences, renormalizing
+// the quaternions after each step as Update does.
+func numericJacobianMeasurement(s *KalmanState) *Matrix {
+	const d = 1e-6
+	jac := NewMatrix(15, 32)
+	for i := 0; i < 32; i++ {
+		sp, sm := *s, *s
+		*(stateMap(&sp)[i]) += d
+		*(stateMap(&sm)[i]) -= d
+		sp.normalize()
+		sm.normalize()
+		mp, mm := measMap(sp.PredictMeasurement()), measMap(sm.PredictMeasurement())
+		for j := 0; j < 15; j++ {
+			jac.Set(j, i, (*(mp[j])-*(mm[j]))/(2*d))
+		}
+	}
+	return jac
+}
 
-		for i := 0; i < 32; i++ {
-			//TODO westphae: don't skip these after working out Jacobian for magnetometer
-			if (i >= 12 && i <= 14) || (i >= 29) {
-				continue
+// jacobianGrid returns random states swept over a grid of attitudes, airspeeds and turn rates.
+func jacobianGrid() (states []*KalmanState) {
+	rand.Seed(5)
+	for _, roll := range []float64{-60, 0, 30} {
+		for _, pitch := range []float64{-15, 0, 10} {
+			for _, heading := range []float64{0, 135, 270} {
+				for _, gs := range []float64{40, 150} {
+					for _, tr := range []float64{0, StandardRate} {
+						s := createRandomState()
+						s.E0, s.E1, s.E2, s.E3 = ToQuaternion(roll*Deg, pitch*Deg, heading*Deg)
+						s.U1, s.U2, s.U3 = gs, 0, 0
+						s.H1, s.H2, s.H3 = 0, 0, tr
+						s.normalize()
+						states = append(states, s)
+					}
+				}
 			}
-			*(smap[i]) += Small
-			s.calcRotationMatrices()
-			mm := s.PredictMeasurement()
-			*(smap[i]) -= Small
-			s.calcRotationMatrices()
-			mmmap := measMap(mm)
-			//TODO westphae: indices all the way up to 15 after working out Jacobian for magnetometer
-			for j := 0; j < 12; j++ {
-				dM := (*(mmmap[j]) - *(mmap[j])) / Small
-				if math.Abs(dM-h.Get(j, i)) > 1e-4 {
-					log.Printf("Error in index %2d,%2d: Calc %6f, Jacobian was %6f\n", j, i, dM, h.Get(j, i))
-					t.Fail()
+		}
+	}
+	for n := 0; n < 50; n++ {
+		s := createRandomState()
+		s.normalize()
+		states = append(states, s)
+	}
+	return
+}
+
+func TestJacobianMeasurement(t *testing.T) {
+	for n, s := range jacobianGrid() {
+		h, nh := s.calcJacobianMeasurement(), numericJacobianMeasurement(s)
+		for j := 0; j < 15; j++ {
+			for i := 0; i < 32; i++ {
+				if math.Abs(h.Get(j, i)-nh.Get(j, i)) > 1e-5*math.Max(1, math.Abs(nh.Get(j, i))) {
+					t.Errorf("state %d: element %2d,%2d is %g, numerically %g", n, j, i, h.Get(j, i), nh.Get(j, i))
 				}
 			}
 		}
 	}
 }
 
+func BenchmarkJacobianMeasurement(b *testing.B) {
+	s := jacobianGrid()[0]
+	b.Run("Analytic", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s.calcJacobianMeasurement()
+		}
+	})
+	b.Run("Numeric", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			numericJacobianMeasurement(s)
+		}
+	})
+}
+
 func TestJacobianState(t *testing.T) {
 	//TODO westphae: loop over 100, re-seed
 	for n := 0; n < 1; n++ {
@@ -167,15 +206,7 @@ func TestJacobianState(t *testing.T) {
 			}
 			ss := *s // Shallow copy
 			ssmap := stateMap(&ss)
-			*(ssmap[i]) += Small
-			if i >= 6 && i <= 9 {
-				r := math.Sqrt((1 - *(ssmap[i])**(ssmap[i])) / (1 - (*(ssmap[i])-Small)*(*(ssmap[i])-Small)))
-				for j := 6; j <= 9; j++ {
-					if j != i {
-						*(ssmap[j]) *= r
-					}
-				}
-			}
+			*(ssmap[i]) += Small // Predict renormalizes a quaternion knocked off the unit sphere, as does the Jacobian
 
 			ss.Predict(t1)
 
@@ -225,6 +256,50 @@ func TestAccumulator(t *testing.T) {
 	log.Printf("Success: n=%6.0f, m=%6f, v=%6f\n", n, m, v)
 }
 
+func TestRegularize(t *testing.T) {
+	for _, c := range []struct{ in, out [3]float64 }{
+		{[3]float64{0, 100, 0}, [3]float64{180, 80, 180}},
+		{[3]float64{0, -100, 0}, [3]float64{180, -80, 180}},
+		{[3]float64{30, 100, 90}, [3]float64{-150, 80, 270}},
+		{[3]float64{-30, -100, 300}, [3]float64{150, -80, 120}},
+		{[3]float64{0, 270, 0}, [3]float64{0, -90, 0}},
+		{[3]float64{0, 180, 0}, [3]float64{180, 0, 180}},
+		{[3]float64{20, 90, 45}, [3]float64{20, 90, 45}},
+		{[3]float64{-180, 0, 360}, [3]float64{180, 0, 0}},
+		{[3]float64{190, 0, -10}, [3]float64{-170, 0, 350}},
+		{[3]float64{720, 3600, -7200}, [3]float64{0, 0, 0}},
+	} {
+		roll, pitch, heading := Regularize(c.in[0]*Deg, c.in[1]*Deg, c.in[2]*Deg)
+		if math.Abs(roll/Deg-c.out[0]) > 1e-9 || math.Abs(pitch/Deg-c.out[1]) > 1e-9 ||
+			math.Abs(heading/Deg-c.out[2]) > 1e-9 {
+			t.Errorf("Regularize(%v) gave %.6f, %.6f, %.6f, expected %v", c.in, roll/Deg, pitch/Deg, heading/Deg, c.out)
+		}
+	}
+
+	if _, _, heading := Regularize(0, 0, -1e-17); heading != 0 {
+		t.Errorf("a tiny negative heading regularized to %g", heading)
+	}
+
+	// Any attitude comes out in range, describing the same rotation.
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		r0, p0, h0 := 20*(rng.Float64()-0.5), 20*(rng.Float64()-0.5), 20*(rng.Float64()-0.5)
+		roll, pitch, heading := Regularize(r0, p0, h0)
+		if roll <= -Pi || roll > Pi || pitch < -Pi/2 || pitch > Pi/2 || heading < 0 || heading >= 2*Pi {
+			t.Fatalf("Regularize(%g, %g, %g) gave %g, %g, %g, out of range", r0, p0, h0, roll, pitch, heading)
+		}
+		a := QuaternionToRotationMatrix(ToQuaternion(r0, p0, h0))
+		b := QuaternionToRotationMatrix(ToQuaternion(roll, pitch, heading))
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				if math.Abs(a[j][k]-b[j][k]) > 1e-9 {
+					t.Fatalf("Regularize(%g, %g, %g) gave %g, %g, %g, a different attitude", r0, p0, h0, roll, pitch, heading)
+				}
+			}
+		}
+	}
+}
+
 func TestMakeUnitVector(t *testing.T) {
 	var v, w *[3]float64
 
@@ -386,3 +461,993 @@ func TestMakeHardSoftRotationMatrix(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestCovarianceTrace(t *testing.T) {
+	// Ten minutes of S-turns with a magnetometer: after the first minute, while the observable states
+	// converge, the trace must stay below where it started and not grow over the rest of the flight.
+	path := sTurnPath(100, 30*Deg, 60)
+	ms := withMagnetometer(simMeasurements(path, 0, 600, 0.05), path)
+	s := InitializeKalman(ms[0])
+	tr0 := s.CalcCovarianceTrace()
+	var settled float64
+	for _, m := range ms[1:] {
+		s.Compute(m)
+		tr := s.CalcCovarianceTrace()
+		if !(tr < tr0) {
+			t.Fatalf("covariance trace %f at %.2f s isn't below the initial %f", tr, m.T, tr0)
+		}
+		switch {
+		case m.T < 60:
+		case m.T < 120:
+			settled = math.Max(settled, tr)
+		case tr > settled*1.001:
+			t.Fatalf("covariance trace grew to %f at %.2f s from at most %f in the second minute", tr, m.T, settled)
+		}
+	}
+
+	if tr := NewSimpleAHRS().CalcCovarianceTrace(); !math.IsNaN(tr) {
+		t.Errorf("SimpleState has no covariance, expected NaN trace, got %f", tr)
+	}
+}
+
+func TestCalcAccelAttitude(t *testing.T) {
+	s := NewSimpleAHRS()
+	for roll := -60.0; roll <= 60; roll += 15 {
+		for pitch := -30.0; pitch <= 30; pitch += 10 {
+			path := func(float64) (float64, float64, float64, float64, float64, float64) {
+				return roll * Deg, pitch * Deg, 40 * Deg, 0, 0, 0
+			}
+			r, p := s.CalcAccelAttitude(simMeasurement(path, 1, 0.1))
+			if math.Abs(r/Deg-roll) > 1e-9 || math.Abs(p/Deg-pitch) > 1e-9 {
+				t.Errorf("expected roll %f°, pitch %f°, got %f°, %f°", roll, pitch, r/Deg, p/Deg)
+			}
+		}
+	}
+}
+
+func TestRotateBodyToEarth(t *testing.T) {
+	s := NewSimpleAHRS()
+	for _, att := range [][3]float64{{0, 0, 0}, {30, 10, 40}, {-60, -25, 200}, {90, 0, 300}} {
+		s.E0, s.E1, s.E2, s.E3 = ToQuaternion(att[0]*Deg, att[1]*Deg, att[2]*Deg)
+		s.calcRotationMatrices()
+		path := func(float64) (float64, float64, float64, float64, float64, float64) {
+			return att[0] * Deg, att[1] * Deg, att[2] * Deg, 0, 0, 0
+		}
+		m := simMeasurement(path, 1, 0.1)
+		x, y, z := s.RotateBodyToEarth(G*m.A1, G*m.A2, G*m.A3)
+		if math.Abs(x) > 1e-9 || math.Abs(y) > 1e-9 || math.Abs(z-G) > 1e-9 {
+			t.Errorf("at attitude %v gravity rotated to (%f, %f, %f), expected (0, 0, %f)", att, x, y, z, G)
+		}
+
+		// The inverse and the rotation matrix agree.
+		a1, a2, a3 := s.RotateEarthToBody(3, -4, 5)
+		e1, e2, e3 := s.rotateByE(3, -4, 5, true)
+		if math.Abs(a1-e1) > 1e-9 || math.Abs(a2-e2) > 1e-9 || math.Abs(a3-e3) > 1e-9 {
+			t.Errorf("at attitude %v rotated to (%f, %f, %f), expected (%f, %f, %f)", att, a1, a2, a3, e1, e2, e3)
+		}
+		if b1, b2, b3 := s.RotateBodyToEarth(a1, a2, a3); math.Abs(b1-3) > 1e-9 || math.Abs(b2+4) > 1e-9 ||
+			math.Abs(b3-5) > 1e-9 {
+			t.Errorf("at attitude %v round trip gave (%f, %f, %f)", att, b1, b2, b3)
+		}
+	}
+}
+
+func TestPredictMag(t *testing.T) {
+	// 50 µT dipping 60°, declination 10° east; horizontal component 25 µT
+	const dec, inc, f = 10 * Deg, 60 * Deg, 50.0
+	s := new(State)
+	for _, c := range []struct {
+		heading    float64 // Level, °
+		m1, m2, m3 float64 // Nose, left wing, up, µT
+	}{
+		{0, 25 * math.Cos(dec), -25 * math.Sin(dec), -25 * math.Sqrt(3)},
+		{90, 25 * math.Sin(dec), 25 * math.Cos(dec), -25 * math.Sqrt(3)},
+		{10, 25, 0, -25 * math.Sqrt(3)},
+	} {
+		s.E0, s.E1, s.E2, s.E3 = ToQuaternion(0, 0, c.heading*Deg)
+		m1, m2, m3 := s.PredictMag(dec, inc, f)
+		if math.Abs(m1-c.m1) > 1e-9 || math.Abs(m2-c.m2) > 1e-9 || math.Abs(m3-c.m3) > 1e-9 {
+			t.Errorf("level on %.0f° predicted (%f, %f, %f) µT, expected (%f, %f, %f)",
+				c.heading, m1, m2, m3, c.m1, c.m2, c.m3)
+		}
+	}
+}
+
+func TestAttitudeUnits(t *testing.T) {
+	// A steady 3°/s turn at 100 kt, banked about 15.4°, on a heading of 90° after 30 s
+	path := turnPath(100, 0, 0, 3*Deg)
+	roll0, _, _, _, _, _ := path(30)
+	ms := simMeasurements(path, 0, 30, 0.05)
+
+	simple := NewSimpleAHRS()
+	for _, m := range ms {
+		simple.Compute(m)
+	}
+	// The Kalman filter, with its attitude set directly to the truth
+	kalman := InitializeKalmanWithLayout(ms[0], FullKalmanLayout)
+	kalman.E0, kalman.E1, kalman.E2, kalman.E3 = ToQuaternion(roll0, 0, 90*Deg)
+
+	for _, c := range []struct {
+		name string
+		s    AHRSProvider
+		tol  float64 // °
+	}{{"Simple", simple, 1}, {"Kalman", kalman, 1e-9}} {
+		roll, pitch, heading := c.s.RollPitchHeading()
+		if math.Abs(roll-roll0) > DegToRad(c.tol) || math.Abs(pitch) > DegToRad(c.tol) ||
+			math.Abs(heading-Pi/2) > DegToRad(c.tol) {
+			t.Errorf("%s: RollPitchHeading gave %f, %f, %f rad, expected %f, 0, %f",
+				c.name, roll, pitch, heading, roll0, Pi/2)
+		}
+		rollDeg, pitchDeg, headingDeg := c.s.GetState().CalcRollPitchHeading()
+		if math.Abs(rollDeg-roll0/Deg) > c.tol || math.Abs(pitchDeg) > c.tol || math.Abs(headingDeg-90) > c.tol {
+			t.Errorf("%s: CalcRollPitchHeading gave %f, %f, %f°, expected %f, 0, 90",
+				c.name, rollDeg, pitchDeg, headingDeg, roll0/Deg)
+		}
+	}
+
+	droll, dpitch, dheading := kalman.RollPitchHeadingUncertainty()
+	drollDeg, dpitchDeg, dheadingDeg := kalman.CalcRollPitchHeadingUncertainty()
+	if math.Abs(drollDeg-RadToDeg(droll)) > 1e-9 || math.Abs(dpitchDeg-RadToDeg(dpitch)) > 1e-9 ||
+		math.Abs(dheadingDeg-RadToDeg(dheading)) > 1e-9 {
+		t.Errorf("Kalman uncertainty %f, %f, %f° but %f, %f, %f rad",
+			drollDeg, dpitchDeg, dheadingDeg, droll, dpitch, dheading)
+	}
+}
+
+func TestCalcEulerRates(t *testing.T) {
+	// A level turn at 100 kt banked 30° to the right
+	tr := G * math.Tan(30*Deg) / 100
+	s := NewSimpleAHRS()
+	for _, m := range simMeasurements(turnPath(100, 0, 0, tr), 0, 30, 0.05) {
+		s.Compute(m)
+	}
+	rollRate, pitchRate, headingRate, ok := s.CalcEulerRates()
+	if !ok || math.Abs(headingRate-tr/Deg) > 0.02*tr/Deg || math.Abs(rollRate) > 0.1 || math.Abs(pitchRate) > 0.1 {
+		t.Errorf("Euler rates %f, %f, %f°/s (ok %t), expected 0, 0, %f", rollRate, pitchRate, headingRate, ok, tr/Deg)
+	}
+	// The yaw gyro only sees the part of the turn along the top of the aircraft.
+	if _, q, r := s.CalcBodyRates(); math.Abs(r-tr/Deg*math.Cos(30*Deg)) > 0.02*tr/Deg ||
+		math.Abs(q-tr/Deg*math.Sin(30*Deg)) > 0.02*tr/Deg {
+		t.Errorf("body pitch and yaw rates %f, %f°/s, expected %f, %f", q, r,
+			tr/Deg*math.Sin(30*Deg), tr/Deg*math.Cos(30*Deg))
+	}
+
+	// Straight up there is no heading rate to give.
+	s.E0, s.E1, s.E2, s.E3 = ToQuaternion(0, 90*Deg, 0)
+	if _, _, h, ok := s.CalcEulerRates(); ok || math.IsInf(h, 0) || math.IsNaN(h) {
+		t.Errorf("pitched up 90°, heading rate %f, ok %t", h, ok)
+	}
+}
+
+func TestCalcRotationMatrix(t *testing.T) {
+	s := new(State)
+	for roll := -180.0; roll < 180; roll += 30 {
+		for _, pitch := range []float64{-90, -89.99, -60, -10, 0, 25, 89.9, 89.999, 90} {
+			for hdg := 0.0; hdg < 360; hdg += 45 {
+				s.E0, s.E1, s.E2, s.E3 = ToQuaternion(roll*Deg, pitch*Deg, hdg*Deg)
+				r, ri := s.CalcRotationMatrix(), s.CalcInverseRotationMatrix()
+				att := [3]float64{roll, pitch, hdg}
+
+				// Orthonormal with determinant +1
+				for i := 0; i < 3; i++ {
+					for j := 0; j < 3; j++ {
+						var v, w float64
+						for k := 0; k < 3; k++ {
+							v += r[i][k] * r[j][k]
+							w += r[i][k] * ri[k][j]
+						}
+						if i == j {
+							v, w = v-1, w-1
+						}
+						if math.Abs(v) > 1e-12 || math.Abs(w) > 1e-12 {
+							t.Errorf("at attitude %v DCM·DCMᵀ or DCM·inverse is off the identity at %d, %d", att, i, j)
+						}
+					}
+				}
+				det := r[0][0]*(r[1][1]*r[2][2]-r[1][2]*r[2][1]) - r[0][1]*(r[1][0]*r[2][2]-r[1][2]*r[2][0]) +
+					r[0][2]*(r[1][0]*r[2][1]-r[1][1]*r[2][0])
+				if math.Abs(det-1) > 1e-12 {
+					t.Errorf("at attitude %v determinant %f", att, det)
+				}
+
+				// The nose points along the heading and pitch.
+				n1 := math.Sin(hdg*Deg) * math.Cos(pitch*Deg)
+				n2 := math.Cos(hdg*Deg) * math.Cos(pitch*Deg)
+				n3 := math.Sin(pitch * Deg)
+				if math.Abs(r[0][0]-n1) > 1e-9 || math.Abs(r[1][0]-n2) > 1e-9 || math.Abs(r[2][0]-n3) > 1e-9 {
+					t.Errorf("at attitude %v nose along (%f, %f, %f), expected (%f, %f, %f)",
+						att, r[0][0], r[1][0], r[2][0], n1, n2, n3)
+				}
+
+				x, y, z := s.RotateBodyToEarth(0.3, -0.5, 0.8)
+				if math.Abs(x-(0.3*r[0][0]-0.5*r[0][1]+0.8*r[0][2])) > 1e-12 ||
+					math.Abs(y-(0.3*r[1][0]-0.5*r[1][1]+0.8*r[1][2])) > 1e-12 ||
+					math.Abs(z-(0.3*r[2][0]-0.5*r[2][1]+0.8*r[2][2])) > 1e-12 {
+					t.Errorf("at attitude %v the DCM disagrees with RotateBodyToEarth", att)
+				}
+
+				// The Euler angles read back describe the same rotation, however ambiguous near the pole;
+				// at the pole itself roll and heading can't be told apart, which is why the DCM is wanted.
+				if math.Abs(pitch) == 90 {
+					continue
+				}
+				s2 := new(State)
+				s2.E0, s2.E1, s2.E2, s2.E3 = ToQuaternion(FromQuaternion(s.E0, s.E1, s.E2, s.E3))
+				r2 := s2.CalcRotationMatrix()
+				for i := 0; i < 3; i++ {
+					for j := 0; j < 3; j++ {
+						if math.Abs(r[i][j]-r2[i][j]) > 1e-6 {
+							t.Errorf("at attitude %v round trip through Euler angles changed the DCM at %d, %d: %f, %f",
+								att, i, j, r[i][j], r2[i][j])
+						}
+					}
+				}
+
+			}
+		}
+	}
+}
+
+func TestCalcQuaternion(t *testing.T) {
+	attitudes := [][3]float64{{0, 0, 0}, {30, 10, 40}, {-60, -25, 200}, {170, 80, 300}, {-120, -70, 10}}
+	ms := scenarios[0].measurements(50)
+	for _, pr := range providers {
+		p, ok := pr.new(ms[0]).(AHRSProvider)
+		if !ok {
+			continue
+		}
+		for _, m := range ms[:100] {
+			p.Compute(m)
+		}
+		s := p.GetState()
+		for _, att := range attitudes {
+			// An unnormalized E is scaled back onto the unit sphere.
+			e0, e1, e2, e3 := ToQuaternion(att[0]*Deg, att[1]*Deg, att[2]*Deg)
+			s.E0, s.E1, s.E2, s.E3 = 1.01*e0, 1.01*e1, 1.01*e2, 1.01*e3
+			q0, q1, q2, q3 := p.CalcQuaternion()
+			if math.Abs(q0-e0) > 1e-12 || math.Abs(q1-e1) > 1e-12 || math.Abs(q2-e2) > 1e-12 || math.Abs(q3-e3) > 1e-12 {
+				t.Errorf("%s: at attitude %v quaternion %f, %f, %f, %f, expected %f, %f, %f, %f",
+					pr.name, att, q0, q1, q2, q3, e0, e1, e2, e3)
+			}
+			s.E0, s.E1, s.E2, s.E3 = e0, e1, e2, e3
+
+			r := s.CalcRotationMatrix()
+			for j := 0; j < 3; j++ {
+				var v [3]float64
+				v[j] = 1
+				x, y, z := quaternionRotateVector(q0, q1, q2, q3, v[0], v[1], v[2])
+				if math.Abs(x-r[0][j]) > 1e-12 || math.Abs(y-r[1][j]) > 1e-12 || math.Abs(z-r[2][j]) > 1e-12 {
+					t.Errorf("%s: at attitude %v quaternion and DCM disagree on axis %d", pr.name, att, j+1)
+				}
+			}
+			roll, pitch, hdg := s.CalcRollPitchHeading()
+			if angleErr(roll, att[0]) > 1e-6 || angleErr(pitch, att[1]) > 1e-6 || angleErr(hdg, att[2]) > 1e-6 {
+				t.Errorf("%s: at attitude %v CalcRollPitchHeading gave %f, %f, %f", pr.name, att, roll, pitch, hdg)
+			}
+
+			// The rate agrees with rotating by the gyro rates over a short step.
+			const dt = 1e-6
+			s.H1, s.H2, s.H3 = 20, -5, 10
+			d0, d1, d2, d3 := p.CalcQuaternionRate()
+			r0, r1, r2, r3 := QuaternionRotate(q0, q1, q2, q3, DegToRad(s.H1*dt), DegToRad(s.H2*dt), DegToRad(s.H3*dt))
+			if math.Abs((r0-q0)/dt-d0) > 1e-4 || math.Abs((r1-q1)/dt-d1) > 1e-4 ||
+				math.Abs((r2-q2)/dt-d2) > 1e-4 || math.Abs((r3-q3)/dt-d3) > 1e-4 {
+				t.Errorf("%s: at attitude %v quaternion rate %f, %f, %f, %f, expected %f, %f, %f, %f", pr.name, att,
+					d0, d1, d2, d3, (r0-q0)/dt, (r1-q1)/dt, (r2-q2)/dt, (r3-q3)/dt)
+			}
+		}
+	}
+}
+
+func TestKalmanInnovation(t *testing.T) {
+	ms := kalmanScenario()
+	s := InitializeKalman(ms[0])
+	if s.CalcInnovation() != nil {
+		t.Error("expected no innovation before the first update")
+	}
+	var baseline float64
+	for _, m := range ms[1:80] {
+		s.Compute(m)
+		baseline = math.Max(baseline, math.Abs(s.CalcInnovation()[6]))
+	}
+
+	// A sudden 1G jolt forward that the model knows nothing about
+	m := ms[80]
+	m.A1 += 1
+	s.Compute(m)
+	y := s.CalcInnovation()
+	if len(y) != 15 {
+		t.Fatalf("expected 15 innovation values, got %d", len(y))
+	}
+	if y[6] < 0.9 || y[6] < 5*baseline {
+		t.Errorf("A1 innovation was %f for a 1G jolt, against %f in steady flight", y[6], baseline)
+	}
+}
+
+// kalmanScenario returns a canned set of measurements, with magnetometer, for a coordinated turn.
+func kalmanScenario() (ms []*Measurement) {
+	path := turnPath(100, 0, 2, 3*Deg)
+	ms = simMeasurements(path, 0, 6, 0.05)
+	for _, m := range ms {
+		roll, pitch, heading, _, _, _ := path(m.T)
+		r := QuaternionToRotationMatrix(ToQuaternion(roll, pitch, heading))
+		n := [3]float64{0, 20, -45} // Earth magnetic field, ENU
+		m.M1 = r[0][0]*n[0] + r[1][0]*n[1] + r[2][0]*n[2]
+		m.M2 = r[0][1]*n[0] + r[1][1]*n[1] + r[2][1]*n[2]
+		m.M3 = r[0][2]*n[0] + r[1][2]*n[1] + r[2][2]*n[2]
+		m.MValid = true
+	}
+	return
+}
+
+// kalmanFingerprint returns the 32 state values followed by the covariance trace and the sum of all
+// covariance elements, which together pin down the result of a filter run.
+func kalmanFingerprint(s *State) (fp []float64) {
+	sm := stateMap(&KalmanState{State: *s})
+	for i := 0; i < 32; i++ {
+		fp = append(fp, *sm[i])
+	}
+	var sum float64
+	for i := 0; i < 32; i++ {
+		for j := 0; j < 32; j++ {
+			sum += s.M.Get(i, j)
+		}
+	}
+	return append(fp, s.CalcCovarianceTrace(), sum)
+}
+
+// kalmanRuns runs the canned scenario through each of the Kalman filters.
+func kalmanRuns() map[string]*State {
+	runs := make(map[string]*State)
+
+	ms := kalmanScenario()
+	s := InitializeKalman(ms[0])
+	s.SetBlockUpdate(true) // The fingerprint was recorded with the block update
+	for _, m := range ms[1:] {
+		s.Compute(m)
+	}
+	runs["Kalman"] = &s.State
+
+	type filter interface {
+		Compute(m *Measurement)
+		GetState() *State
+	}
+	for name, p := range map[string]filter{"Kalman0": NewKalman0AHRS(), "Kalman1": NewKalman1AHRS()} {
+		for _, m := range kalmanScenario() {
+			p.Compute(m)
+		}
+		runs[name] = p.GetState()
+	}
+	return runs
+}
+
+// kalmanGolden holds the fingerprints of kalmanRuns, recorded before moving from go.matrix to Matrix;
+// that of Kalman was re-recorded when its magnetometer Jacobian was filled in, and the attitude of Kalman1
+// when QuaternionRotate was made exact.
+var kalmanGolden = map[string][]float64{
+	"Kalman": {
+		103.23840350747682, -0.18017791062946775, -1.2708929886065794, -0.0032146555669162018,
+		-0.021723255651768573, -0.2194064683770373, 0.7287429894598074, 0.26300190837367105,
+		0.2043985181309584, 0.5983183912356851, -1.9937435455253636, 0.4599734273024578,
+		-2.3076816836044722, -17.069333537950143, 24.146830433793063, -39.426341482312395,
+		0.396357508716351, -2.807417193150946, -0.7032798616495255, 0.0007666186687906743,
+		0.040063338894086906, 0.24815639782285032, 0.9999999426850678, -0.00032181455653500403,
+		0.0001051862240819925, -1.053968445767768e-06, -0.03715034145132798, -0.5549349899951368,
+		0.08748681939855026, -0.008836090061636522, 0.3021054436497378, -0.021709552738773563,
+		883.2161572426562, 381.30290800791084,
+	},
+	"Kalman0": {
+		0, 0, 0, 0,
+		0, 0, 0.99999999999999001, 1.4144670249382504e-07,
+		0, 0, -3.1439170047890699e-14, 0,
+		0, 0, 0, 0,
+		0, 0, 0, 0,
+		0, 0, 1, 0,
+		0, 0, -3.4932413027387041e-23, 0,
+		0, 0, 0, 0,
+		1.9600000000000033e+20, 1.9600000000000033e+20,
+	},
+	"Kalman1": {
+		0, 0, 0, 0,
+		0, 0, 0.8809497494401383, -0.003335053527481736,
+		-0.007375492292566934, -0.4731405906205561, -3.1439170047890699e-14, -0.79459191144997732,
+		-2.892857354633867, 0, 0, 0,
+		0, 0, 0, 0,
+		0, 0, 1, 0,
+		0, 0, -3.4932413027387041e-23, -8.8287989336279616e-10,
+		-3.2142859331469573e-09, 0, 0, 0,
+		1.5400000000000033e+20, 1.5400000000000033e+20,
+	},
+}
+
+func TestKalmanRegression(t *testing.T) {
+	for name, s := range kalmanRuns() {
+		fp := kalmanFingerprint(s)
+		for i, v := range kalmanGolden[name] {
+			if math.Abs(fp[i]-v) > 1e-9*math.Max(1, math.Abs(v)) {
+				t.Errorf("%s: fingerprint element %d is %g, expected %g", name, i, fp[i], v)
+			}
+		}
+	}
+}
+
+func BenchmarkKalmanCompute(b *testing.B) {
+	for _, block := range []bool{false, true} {
+		name := "Sequential"
+		if block {
+			name = "Block"
+		}
+		b.Run(name, func(b *testing.B) {
+			ms := kalmanScenario()
+			s := InitializeKalman(ms[0])
+			s.SetBlockUpdate(block)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m := *ms[1+i%(len(ms)-1)]
+				if i%(len(ms)-1) == 0 { // Start the scenario over without a time jump backwards
+					s = InitializeKalman(ms[0])
+					s.SetBlockUpdate(block)
+				}
+				s.Compute(&m)
+			}
+		})
+	}
+}
+
+func TestKalmanSequentialUpdate(t *testing.T) {
+	var runs [2]*KalmanState
+	for i, block := range []bool{false, true} {
+		ms := kalmanScenario()
+		s := InitializeKalman(ms[0])
+		s.SetBlockUpdate(block)
+		for _, m := range ms[1:] {
+			s.Compute(m)
+		}
+		runs[i] = s
+	}
+	seq, block := kalmanFingerprint(&runs[0].State), kalmanFingerprint(&runs[1].State)
+	for i := range seq {
+		if math.Abs(seq[i]-block[i]) > 1e-5*math.Max(1, math.Abs(block[i])) {
+			t.Errorf("fingerprint element %d is %g with the sequential update, %g with the block update",
+				i, seq[i], block[i])
+		}
+	}
+	if d := maxAbsDiff(runs[0].M, runs[1].M); d > 1e-5*runs[1].CalcCovarianceTrace() {
+		t.Errorf("covariances differ by up to %g", d)
+	}
+}
+
+func TestKalmanSequentialJoseph(t *testing.T) {
+	// Two states known to 1e5 measured to 1e-3: the update must leave them known to about 1e-3
+	// rather than have rounding cancel their variances to nothing, or below.
+	const big, r = 1e10, 1e-6
+	s := new(KalmanState)
+	s.M = NewMatrix(3, 3)
+	s.M.Set(0, 0, big)
+	s.M.Set(1, 1, big)
+	s.M.Set(0, 1, 1e-3*big)
+	s.M.Set(1, 0, 1e-3*big)
+	s.M.Set(2, 2, 1)
+	y, h, rr := NewMatrix(2, 1), NewMatrix(2, 3), NewMatrix(2, 2)
+	y.Set(0, 0, 1)
+	y.Set(1, 0, -1)
+	h.Set(0, 0, 1)
+	h.Set(1, 1, 1)
+	rr.Set(0, 0, r)
+	rr.Set(1, 1, r)
+	if _, ok := s.sequentialUpdate(y, h, rr); !ok {
+		t.Fatal("sequential update rejected as ill-conditioned")
+	}
+
+	for j := 0; j < 3; j++ {
+		for k := 0; k < j; k++ {
+			if d := math.Abs(s.M.Get(j, k) - s.M.Get(k, j)); d != 0 {
+				t.Errorf("covariance asymmetric by %g at (%d, %d)", d, j, k)
+			}
+		}
+	}
+	for j := 0; j < 2; j++ {
+		if v := s.M.Get(j, j); math.Abs(v-r) > 0.01*r {
+			t.Errorf("state %d has variance %g after the update, expected about %g", j, v, r)
+		}
+	}
+	if _, err := s.M.Cholesky(); err != nil {
+		t.Errorf("covariance isn't positive-definite after the update: %s", err)
+	}
+}
+
+func TestKalmanGate(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+	// run returns the state after the scenario with a wild GPS reading at sample n, if wild,
+	// and the channels rejected then.
+	const n = 40
+	run := func(gate float64, wild bool) (fp []float64, rejected []int) {
+		ms := kalmanScenario()
+		s := InitializeKalman(ms[0])
+		s.SetMeasurementNoise(0, 0, 1)
+		s.SetGate(gate)
+		for i, m := range ms[1 : n+2] {
+			if i+1 == n && wild {
+				m.W1 += 100
+			}
+			s.Compute(m)
+			if i+1 < n && len(s.RejectedChannels()) > 0 {
+				t.Fatalf("expected no channels rejected for consistent measurements, got %v at %.2f s",
+					s.RejectedChannels(), m.T)
+			}
+			if i+1 == n {
+				rejected = s.RejectedChannels()
+			}
+		}
+		return kalmanFingerprint(&s.State)[:32], rejected
+	}
+
+	clean, _ := run(10.83, false)
+	gated, rejected := run(10.83, true)
+	ungated, _ := run(0, true)
+	if len(rejected) != 1 || rejected[0] != 3 {
+		t.Errorf("expected only the W1 channel, 3, rejected, got %v", rejected)
+	}
+	// The rest of the measurement is still used, so the gated filter stays close to the clean one.
+	var dGated, dUngated float64
+	for i := range clean {
+		dGated = math.Max(dGated, math.Abs(gated[i]-clean[i]))
+		dUngated = math.Max(dUngated, math.Abs(ungated[i]-clean[i]))
+	}
+	t.Logf("state off by up to %g with gating, %g without", dGated, dUngated)
+	if dUngated < 100*dGated {
+		t.Errorf("expected gating to reject the wild reading: state off by up to %g with it, %g without",
+			dGated, dUngated)
+	}
+}
+
+// kalmanGPSConvergence starts the Kalman filter with its airspeed 20 kt out and returns the GPS velocity
+// innovation integrated over the flight, kt·s, as a measure of how slowly it converges.
+func kalmanGPSConvergence(gpsNoise float64) (area float64, s *KalmanState) {
+	const dt = 0.05
+	ms := simMeasurements(straightPath(100, 30*Deg), 0, 60, dt)
+	s = InitializeKalman(ms[0])
+	s.SetMeasurementNoise(0, 0, gpsNoise)
+	s.U1 += 20
+	for _, m := range ms[1:] {
+		s.Compute(m)
+		y := s.CalcInnovation()
+		area += math.Hypot(y[3], y[4]) * dt
+	}
+	return
+}
+
+func TestKalmanNoiseSettings(t *testing.T) {
+	last := 0.0
+	for _, sigma := range []float64{0.5, 1, 2, 4, 8} {
+		area, s := kalmanGPSConvergence(sigma)
+		t.Logf("GPS sigma %.1f kt: integrated GPS innovation %.2f kt·s", sigma, area)
+		if area <= last {
+			t.Errorf("expected more GPS noise to slow convergence, got %.2f kt·s at %.1f kt after %.2f", area, sigma, last)
+		}
+		last = area
+		if _, _, gps := s.MeasurementNoise(); math.Abs(gps-sigma) > Small {
+			t.Errorf("expected the effective GPS sigma to be %.1f kt, got %f", sigma, gps)
+		}
+	}
+
+	// Noise densities are turned into variances by the sample interval, and changing the process noise
+	// mid-flight leaves the covariance sound.
+	ms := kalmanScenario()
+	s := InitializeKalman(ms[0])
+	for i, m := range ms[1:] {
+		if i == len(ms)/2 {
+			s.SetMeasurementNoise(0.05, 0.01, -1)
+			s.SetProcessNoise(2, 0.3)
+		}
+		s.Compute(m)
+	}
+	gyro, accel, _ := s.MeasurementNoise()
+	if math.Abs(gyro-0.05) > Small || math.Abs(accel-0.01) > Small {
+		t.Errorf("expected the effective gyro and accel noise densities to be set, got %f, %f", gyro, accel)
+	}
+	if gyro, accel := s.ProcessNoise(); math.Abs(gyro-2) > Small || math.Abs(accel-0.3) > Small {
+		t.Errorf("expected the process noise to be set, got %f, %f", gyro, accel)
+	}
+	if !s.finite() {
+		t.Error("state isn't finite after changing the noise mid-flight")
+	}
+
+	n := s.N.Copy()
+	n.Set(0, 1, 1)
+	if err := s.SetProcessNoiseMatrix(n); err == nil {
+		t.Error("expected an asymmetric process noise to be rejected")
+	}
+	if err := s.SetProcessNoiseMatrix(NewMatrix(15, 15)); err == nil {
+		t.Error("expected a process noise of the wrong size to be rejected")
+	}
+	n.Set(1, 0, 1)
+	if err := s.SetProcessNoiseMatrix(n); err != nil || s.N.Get(1, 0) != 1 {
+		t.Errorf("expected a symmetric process noise to be accepted: %v", err)
+	}
+}
+
+func TestKalmanCovarianceLongRun(t *testing.T) {
+	if testing.Short() || raceEnabled {
+		t.Skip("long-duration test")
+	}
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+
+	const (
+		n  = 200000
+		dt = 0.01
+	)
+	path := sTurnPath(100, 30*Deg, 60)
+	rng := rand.New(rand.NewSource(1))
+	var s *KalmanState
+	var resets int
+	gps, mag := true, true
+	for i := 0; i < n; i++ {
+		m := simMeasurement(path, float64(i)*dt, dt)
+		roll, pitch, heading, _, _, _ := path(m.T)
+		r := QuaternionToRotationMatrix(ToQuaternion(roll, pitch, heading))
+		e := [3]float64{0, 20, -45} // Earth magnetic field, ENU
+		m.M1 = r[0][0]*e[0] + r[1][0]*e[1] + r[2][0]*e[2]
+		m.M2 = r[0][1]*e[0] + r[1][1]*e[1] + r[2][1]*e[2]
+		m.M3 = r[0][2]*e[0] + r[1][2]*e[1] + r[2][2]*e[2]
+		// Sensors drop out for a while now and then, the IMU for single samples.
+		if rng.Float64() < 0.002 {
+			gps = !gps
+		}
+		if rng.Float64() < 0.001 {
+			mag = !mag
+		}
+		m.WValid, m.MValid, m.SValid = gps, mag, rng.Float64() > 0.01
+		if s == nil {
+			s = InitializeKalman(m)
+			s.SetCovarianceResetHook(func(float64) { resets++ })
+			continue
+		}
+		s.Compute(m)
+
+		for j := 0; j < 32; j++ {
+			for k := 0; k < j; k++ {
+				if s.M.Get(j, k) != s.M.Get(k, j) {
+					t.Fatalf("covariance asymmetric at (%d, %d) after %d updates", j, k, i)
+				}
+			}
+		}
+		if _, err := s.M.Cholesky(); err != nil {
+			t.Fatalf("covariance lost positive-definiteness after %d updates: %s", i, err)
+		}
+	}
+	if resets > 0 {
+		t.Errorf("covariance was reset %d times", resets)
+	}
+}
+
+func TestKalmanCovarianceReset(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+	ms := kalmanScenario()
+	s := InitializeKalman(ms[0])
+	m0 := s.M.Copy()
+	var resetAt float64
+	s.SetCovarianceResetHook(func(t float64) { resetAt = t })
+	s.Compute(ms[1])
+	if resetAt != 0 {
+		t.Fatalf("unexpected covariance reset at %f s", resetAt)
+	}
+
+	// Corrupt the covariance beyond what the Joseph form can repair.
+	s.M = scaled(s.M, -1)
+	s.Compute(ms[2])
+	if resetAt != ms[2].T {
+		t.Errorf("expected a covariance reset at %f s, got %f", ms[2].T, resetAt)
+	}
+	if d := maxAbsDiff(s.M, m0); d != 0 {
+		t.Errorf("expected the covariance reset to its initial values, off by %g", d)
+	}
+}
+
+func TestKalmanIllConditioned(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+	for _, block := range []bool{false, true} {
+		ms := kalmanScenario()
+		s := InitializeKalman(ms[0])
+		s.SetBlockUpdate(block)
+		for _, m := range ms[1:10] {
+			s.Compute(m)
+		}
+		if n := s.ConditioningSkipCount(); n != 0 {
+			t.Fatalf("block %v: expected no updates skipped, got %d", block, n)
+		}
+
+		// Measurements without noise of a state whose errors are almost perfectly correlated
+		// make a near-singular innovation covariance.
+		s.SetMeasurementNoise(1e-12, 1e-12, 1e-12)
+		m := ms[10]
+		s.Predict(m.T)
+		v := make([]float64, 32)
+		for i := range v {
+			v[i] = math.Sqrt(s.M.Get(i, i))
+		}
+		for i := range v {
+			for j := range v {
+				s.M.Set(i, j, v[i]*v[j])
+			}
+			s.M.Set(i, i, s.M.Get(i, i)*(1+1e-13))
+		}
+		before := kalmanFingerprint(&s.State)
+		s.Update(m)
+		after := kalmanFingerprint(&s.State)
+
+		if n := s.ConditioningSkipCount(); n != 1 {
+			t.Errorf("block %v: expected the update to be skipped, skip count %d", block, n)
+		}
+		for i := range before {
+			if math.Abs(after[i]-before[i]) > 1e-12*math.Max(1, math.Abs(before[i])) {
+				t.Errorf("block %v: fingerprint element %d changed from %g to %g", block, i, before[i], after[i])
+			}
+		}
+	}
+}
+
+func TestKalmanGateSpikes(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+	// run returns the attitude through the scenario, with GPS spikes every second if spikes, and the filter.
+	run := func(gate float64, spikes bool) (att [][3]float64, s *KalmanState) {
+		ms := kalmanScenario()
+		s = InitializeKalman(ms[0])
+		s.SetMeasurementNoise(0, 0, 1)
+		s.SetGate(gate)
+		for i, m := range ms[1:] {
+			if spikes && i%20 == 10 {
+				m.W1 += 50
+			}
+			s.Compute(m)
+			var a [3]float64
+			a[0], a[1], a[2] = s.CalcRollPitchHeading()
+			att = append(att, a)
+		}
+		return att, s
+	}
+	// worst returns the largest difference between the attitudes a and b, °.
+	worst := func(a, b [][3]float64) (d float64) {
+		for i := range a {
+			for j := range a[i] {
+				d = math.Max(d, math.Abs(angleErr(a[i][j], b[i][j])))
+			}
+		}
+		return
+	}
+
+	clean, _ := run(10.83, false)
+	gated, s := run(10.83, true)
+	ungated, _ := run(0, true)
+	dGated, dUngated := worst(gated, clean), worst(ungated, clean)
+	t.Logf("spikes move the attitude by up to %.4f° gated, %.4f° ungated", dGated, dUngated)
+	if dGated > 0.1 || dUngated < 100*dGated {
+		t.Errorf("expected the gate to remove the spikes' effect: attitude moved by up to %.4f° gated, %.4f° ungated",
+			dGated, dUngated)
+	}
+	if n := s.RejectionCounts(); len(n) != 15 || n[3] != 6 {
+		t.Errorf("expected the 6 spikes counted as rejections of W1, channel 3, got %v", n)
+	}
+}
+
+func TestKalmanGateTimeout(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+	ms := kalmanScenario()
+	s := InitializeKalman(ms[0])
+	s.SetGate(10.83)
+	s.SetGateTimeout(1)
+	var channel = -1
+	var at float64
+	s.SetGateTimeoutHook(func(c int, t float64) {
+		if channel < 0 {
+			channel, at = c, t
+		}
+	})
+	const tStep = 2.0
+	for _, m := range ms[1:] {
+		if m.T >= tStep {
+			m.A1 += 3 // The accelerometer fails with a large bias
+		}
+		s.Compute(m)
+	}
+	t.Logf("rejections %v, escalated for channel %d at %.2f s", s.RejectionCounts(), channel, at)
+	if channel != 6 || at < tStep+1 || at > tStep+2 {
+		t.Errorf("expected the gate to escalate for A1, channel 6, about 1 s after %.1f s; got channel %d at %.2f s",
+			tStep, channel, at)
+	}
+}
+
+func TestKalmanLayout(t *testing.T) {
+	// The full state with the magnetometer ignored, as the filter does for readings that aren't valid.
+	msFull := kalmanScenario()
+	for _, m := range msFull {
+		m.MValid = false
+	}
+	full := InitializeKalman(msFull[0])
+	ms := kalmanScenario()
+	noMag := FullKalmanLayout
+	noMag.Mag = false
+	s := InitializeKalmanWithLayout(ms[0], noMag)
+	if n := s.M.Rows(); n != 26 {
+		t.Fatalf("expected a 26x26 covariance without the magnetometer, got %d", n)
+	}
+	for i := 1; i < len(ms); i++ {
+		full.Compute(msFull[i])
+		s.Compute(ms[i])
+		var a, b, da, db [3]float64
+		a[0], a[1], a[2] = full.CalcRollPitchHeading()
+		b[0], b[1], b[2] = s.CalcRollPitchHeading()
+		da[0], da[1], da[2] = full.CalcRollPitchHeadingUncertainty()
+		db[0], db[1], db[2] = s.CalcRollPitchHeadingUncertainty()
+		for j := range a {
+			if math.Abs(angleErr(a[j], b[j])) > 1e-9 || math.Abs(da[j]-db[j]) > 1e-9 {
+				t.Fatalf("at %.2f s the attitude is %v ± %v with the full state, %v ± %v without the magnetometer",
+					ms[i].T, a, da, b, db)
+			}
+		}
+	}
+
+	// The minimal layout still gives a usable attitude, and the disabled blocks stay put.
+	ms = kalmanScenario()
+	s = InitializeKalmanWithLayout(ms[0], KalmanLayout{})
+	if n := s.M.Rows(); n != 13 {
+		t.Fatalf("expected a 13x13 covariance for the minimal layout, got %d", n)
+	}
+	for _, m := range ms[1:] {
+		s.Compute(m)
+	}
+	if !s.finite() || s.V1 != 0 || s.C1 != 0 || s.D1 != 0 || s.L1 != 0 || s.N1 != 0 || s.F0 != 1 {
+		t.Errorf("disabled blocks changed: V1 %g, C1 %g, D1 %g, L1 %g, N1 %g, F0 %g", s.V1, s.C1, s.D1, s.L1, s.N1, s.F0)
+	}
+	if err := s.SetProcessNoiseMatrix(eye(32)); err == nil {
+		t.Error("expected a 32x32 process noise to be rejected for the minimal layout")
+	}
+	if err := s.SetProcessNoiseMatrix(eye(13)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKalmanInitialConfig(t *testing.T) {
+	m := simMeasurement(straightPath(100, 0), 0, 0.05)
+	for _, sig := range []KalmanSigmas{{Wind: [3]float64{10, -1, 2}}, {GyroBias: [3]float64{0.1, 0, 0.1}}} {
+		if _, err := InitializeKalmanWithConfig(m, KalmanInit{Sigmas: sig}); err == nil {
+			t.Errorf("expected sigmas %+v to be rejected", sig)
+		} else if _, ok := err.(*ConfigError); !ok {
+			t.Errorf("expected a *ConfigError, got %v", err)
+		}
+	}
+
+	// The sigmas and attitude given are applied, and the covariance applied is reported.
+	s, err := InitializeKalmanWithConfig(m, KalmanInit{
+		Sigmas:   KalmanSigmas{Airspeed: [3]float64{3, 2, 1}, Attitude: [3]float64{2, 2, 10}},
+		Attitude: &[3]float64{10 * Deg, -5 * Deg, 200 * Deg},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m0 := s.InitialCovariance(); m0.Get(0, 0) != 9 || m0.Get(2, 2) != 1 || maxAbsDiff(m0, s.M) != 0 {
+		t.Errorf("initial covariance doesn't match the sigmas: U variances %g, %g", m0.Get(0, 0), m0.Get(2, 2))
+	}
+	roll, pitch, heading := s.CalcRollPitchHeading()
+	if angleErr(roll, 10) > 1e-9 || angleErr(pitch, -5) > 1e-9 || angleErr(heading, 200) > 1e-9 {
+		t.Errorf("expected the attitude given, got %f, %f, %f", roll, pitch, heading)
+	}
+	if _, err := s.M.Cholesky(); err != nil {
+		t.Error("initial covariance isn't positive-definite:", err)
+	}
+	// Without a layout, the whole state is estimated.
+	if r, c := s.M.GetSize(); r != 32 || c != 32 {
+		t.Errorf("expected the full 32x32 covariance without a layout, got %dx%d", r, c)
+	}
+
+	// Starting 30° off the heading, a tight heading sigma keeps the filter from believing the GPS track,
+	// which alone fixes the heading with the minimal layout.
+	headingErr := func(sigma float64) float64 {
+		ms := simMeasurements(straightPath(100, 0), 0, 1.5, 0.05)
+		s, err := InitializeKalmanWithConfig(ms[0], KalmanInit{
+			Layout:   &KalmanLayout{},
+			Sigmas:   KalmanSigmas{Attitude: [3]float64{2, 2, sigma}},
+			Attitude: &[3]float64{0, 0, 30 * Deg},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range ms[1:] {
+			s.Compute(m)
+		}
+		_, _, heading := s.CalcRollPitchHeading()
+		return angleErr(heading, 0)
+	}
+	tight, loose := headingErr(1), headingErr(60)
+	if loose > 1 || tight < 10 {
+		t.Errorf("heading error after 1.5 s is %.1f° with a 1° sigma, %.1f° with a 60° sigma", tight, loose)
+	}
+}
+
+func TestKalmanProcessNoiseIrregular(t *testing.T) {
+	m := simMeasurement(straightPath(100, 0), 0, 0.05)
+	if _, err := InitializeKalmanWithConfig(m, KalmanInit{Noise: KalmanNoise{GyroBias: &[3]float64{1, -1, 1}}}); err == nil {
+		t.Error("expected a negative process noise to be rejected")
+	}
+
+	// Random-walk states grow by their density squared times the time elapsed, however it's divided up.
+	const wind, gyroBias = 0.5, 0.01
+	s, err := InitializeKalmanWithConfig(m, KalmanInit{
+		Noise: KalmanNoise{
+			Wind:     &[3]float64{wind, wind, wind},
+			GyroBias: &[3]float64{gyroBias, gyroBias, gyroBias},
+			MagBias:  &[3]float64{},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v0, d0, l0 := s.M.Get(16, 16), s.M.Get(26, 26), s.M.Get(29, 29)
+	tt := s.T
+	for _, dt := range []float64{0.01, 0.2, 0.05, 1, 0.003, 0.5, 0.1} {
+		tt += dt
+		s.Predict(tt)
+	}
+	elapsed := tt - m.T
+	if v := s.M.Get(16, 16) - v0; math.Abs(v-wind*wind*elapsed) > 1e-12 {
+		t.Errorf("wind variance grew by %g over %.3f s, expected %g", v, elapsed, wind*wind*elapsed)
+	}
+	if d := s.M.Get(26, 26) - d0; math.Abs(d-gyroBias*gyroBias*elapsed) > 1e-12 {
+		t.Errorf("gyro bias variance grew by %g over %.3f s, expected %g", d, elapsed, gyroBias*gyroBias*elapsed)
+	}
+	if l := s.M.Get(29, 29); l != l0 {
+		t.Errorf("magnetometer bias variance changed from %g to %g without process noise", l0, l)
+	}
+
+	// The setters replace the densities given at the start, each from its call on.
+	s.SetProcessNoise(2, 0)
+	if err := s.SetProcessNoiseDensities(KalmanNoise{Wind: &[3]float64{}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetProcessNoiseDensities(KalmanNoise{Wind: &[3]float64{1, math.NaN(), 1}}); err == nil {
+		t.Error("expected a NaN process noise to be rejected")
+	}
+	if h, v, d := s.N.Get(10, 10), s.N.Get(16, 16), s.N.Get(26, 26); h != 4 || v != 0 || d != gyroBias*gyroBias {
+		t.Errorf("process noise variances of H, V and D are %g, %g, %g, expected 4, 0 and %g", h, v, d, gyroBias*gyroBias)
+	}
+
+	// With the minimal layout, blocks that aren't estimated are ignored.
+	s, err = InitializeKalmanWithConfig(m, KalmanInit{Layout: &KalmanLayout{}, Noise: KalmanNoise{Wind: &[3]float64{1, 1, 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetProcessNoiseDensities(KalmanNoise{RotationRate: &[3]float64{3, 3, 3}, GyroBias: &[3]float64{1, 1, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := s.N.GetSize(); r != 13 || s.N.Get(12, 12) != 9 {
+		t.Errorf("minimal layout has %dx%d process noise, with H3 variance %g", r, r, s.N.Get(12, 12))
+	}
+}
+
+func BenchmarkKalmanLayout(b *testing.B) {
+	for _, l := range []struct {
+		name   string
+		layout KalmanLayout
+	}{{"Full", FullKalmanLayout}, {"Minimal", KalmanLayout{}}} {
+		b.Run(l.name, func(b *testing.B) {
+			ms := kalmanScenario()
+			s := InitializeKalmanWithLayout(ms[0], l.layout)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m := *ms[1+i%(len(ms)-1)]
+				if i%(len(ms)-1) == 0 { // Start the scenario over without a time jump backwards
+					s = InitializeKalmanWithLayout(ms[0], l.layout)
+				}
+				s.Compute(&m)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+/*
+The UKF AHRS algorithm is the EKF algorithm with its linearizations replaced by the unscented transform.
+It has the same state, error state, process and measurement models, noise settings and outputs;
+only the propagation of the covariance and the measurement updates differ.  Sigma points are spread about the
+error state according to its covariance and each is pushed through the full nonlinear model, so large attitude
+errors and fast rotations don't suffer from the EKF's first-order Jacobians.
+*/
+package ahrs
+
+import "math"
+
+const (
+	ukfSigmas = 2*ekfN + 1 // Number of sigma points
+	ukfAlpha  = 1.0        // Spread of the sigma points
+	ukfBeta   = 2.0        // Optimal for Gaussian errors
+	ukfKappa  = 0.0        // Secondary scaling
+
+	ukfLambda  = ukfAlpha*ukfAlpha*(ekfN+ukfKappa) - ekfN
+	ukfSpread  = ekfN + ukfLambda                             // Sigma points lie √ukfSpread standard deviations out
+	ukfWeight  = 1 / (2 * ukfSpread)                          // Mean and covariance weight of each outer sigma point
+	ukfWeight0 = ukfLambda / ukfSpread                        // Mean weight of the central sigma point
+	ukfWeightC = ukfWeight0 + 1 - ukfAlpha*ukfAlpha + ukfBeta // Covariance weight of the central sigma point
+)
+
+// UKFState is an AHRSProvider using an unscented Kalman filter.
+// It shares EKFState's models and configuration, so the two are interchangeable.
+type UKFState struct {
+	EKFState
+}
+
+// ukfNominal holds the part of an EKFState that the error state perturbs, along with the gyro rates.
+type ukfNominal struct {
+	e       [4]float64
+	d, v, h [3]float64
+}
+
+// ukfFilter holds the buffers for the sigma-point computations, allocated once with the UKFState.
+type ukfFilter struct {
+	l     ekfMatrix                // Cholesky factor of the covariance
+	sigma [ukfSigmas][ekfN]float64 // Sigma points of the error state
+	dy    [ukfSigmas]float64       // Innovation at each sigma point
+	nom   ukfNominal               // State about which the sigma points are spread
+	prop  ukfNominal               // Propagated central sigma point
+}
+
+// NewUKFAHRS returns a new UKF AHRS object.
+func NewUKFAHRS() (s *UKFState) {
+	s = &UKFState{EKFState: *NewEKFAHRS()}
+	s.ukf = new(ukfFilter)
+	return
+}
+
+// saveNominal stores the state's nominal values in n.
+func (s *EKFState) saveNominal(n *ukfNominal) {
+	n.e = [4]float64{s.E0, s.E1, s.E2, s.E3}
+	n.d = [3]float64{s.D1, s.D2, s.D3}
+	n.v = [3]float64{s.v1, s.v2, s.v3}
+	n.h = [3]float64{s.H1, s.H2, s.H3}
+}
+
+// restoreNominal sets the state to n perturbed by the error state dx, or to n itself if dx is nil.
+func (s *EKFState) restoreNominal(n *ukfNominal, dx *[ekfN]float64) {
+	s.E0, s.E1, s.E2, s.E3 = n.e[0], n.e[1], n.e[2], n.e[3]
+	s.D1, s.D2, s.D3 = n.d[0], n.d[1], n.d[2]
+	s.v1, s.v2, s.v3 = n.v[0], n.v[1], n.v[2]
+	s.H1, s.H2, s.H3 = n.h[0], n.h[1], n.h[2]
+	if dx != nil {
+		s.E0, s.E1, s.E2, s.E3 = rotationVectorTimes(dx[0], dx[1], dx[2], s.E0, s.E1, s.E2, s.E3)
+		s.D1 += dx[3]
+		s.D2 += dx[4]
+		s.D3 += dx[5]
+		s.v1 += dx[6]
+		s.v2 += dx[7]
+		s.v3 += dx[8]
+		// The gyro rates follow the biases.
+		d1, d2, d3 := s.rotateByF(dx[3], dx[4], dx[5], false)
+		s.H1 -= d1
+		s.H2 -= d2
+		s.H3 -= d3
+	}
+	s.calcRotationMatrices()
+}
+
+// rotationVectorTimes returns the quaternion e turned by the rotation vector r, in radians, in the earth frame.
+func rotationVectorTimes(r1, r2, r3, e0, e1, e2, e3 float64) (q0, q1, q2, q3 float64) {
+	rr := math.Sqrt(r1*r1 + r2*r2 + r3*r3)
+	c, k := 1.0, 0.5
+	if rr > Small {
+		c, k = math.Cos(rr/2), math.Sin(rr/2)/rr
+	}
+	r1, r2, r3 = r1*k, r2*k, r3*k
+	return QuaternionNormalize(
+		c*e0-r1*e1-r2*e2-r3*e3,
+		c*e1+r1*e0+r2*e3-r3*e2,
+		c*e2-r1*e3+r2*e0+r3*e1,
+		c*e3+r1*e2-r2*e1+r3*e0,
+	)
+}
+
+// rotationVectorBetween returns the rotation vector, in radians, in the earth frame that turns the
+// quaternion a into e.
+func rotationVectorBetween(a0, a1, a2, a3, e0, e1, e2, e3 float64) (r1, r2, r3 float64) {
+	// q = e*conj(a)
+	q0 := e0*a0 + e1*a1 + e2*a2 + e3*a3
+	q1 := -e0*a1 + e1*a0 - e2*a3 + e3*a2
+	q2 := -e0*a2 + e1*a3 + e2*a0 - e3*a1
+	q3 := -e0*a3 - e1*a2 + e2*a1 + e3*a0
+	if q0 < 0 {
+		q0, q1, q2, q3 = -q0, -q1, -q2, -q3
+	}
+	k := 2.0
+	if qq := math.Sqrt(q1*q1 + q2*q2 + q3*q3); qq > Small {
+		k = 2 * math.Atan2(qq, q0) / qq
+	}
+	return q1 * k, q2 * k, q3 * k
+}
+
+// sigmaPoints spreads the sigma points about the error state mean according to the covariance p.
+func (u *ukfFilter) sigmaPoints(p *ekfMatrix, mean *[ekfN]float64) {
+	// Cholesky factorization p = l*l', skipping any direction without positive variance
+	u.l = ekfMatrix{}
+	for j := 0; j < ekfN; j++ {
+		d := p[j][j]
+		for k := 0; k < j; k++ {
+			d -= u.l[j][k] * u.l[j][k]
+		}
+		if !(d > 0) {
+			continue
+		}
+		u.l[j][j] = math.Sqrt(d)
+		for i := j + 1; i < ekfN; i++ {
+			v := p[i][j]
+			for k := 0; k < j; k++ {
+				v -= u.l[i][k] * u.l[j][k]
+			}
+			u.l[i][j] = v / u.l[j][j]
+		}
+	}
+
+	c := math.Sqrt(ukfSpread)
+	u.sigma[0] = *mean
+	for k := 0; k < ekfN; k++ {
+		for i := 0; i < ekfN; i++ {
+			u.sigma[1+k][i] = mean[i] + c*u.l[i][k]
+			u.sigma[1+ekfN+k][i] = mean[i] - c*u.l[i][k]
+		}
+	}
+}
+
+// predict propagates each sigma point over the interval dt and takes the mean and covariance
+// of their errors from the propagated central one, which becomes the nominal state.
+func (u *ukfFilter) predict(s *EKFState, m *Measurement, dt float64) {
+	s.saveNominal(&u.nom)
+	u.sigmaPoints(&s.p, &s.dx)
+
+	s.propagate(m, dt)
+	s.saveNominal(&u.prop)
+	for j := 1; j < ukfSigmas; j++ {
+		x := &u.sigma[j]
+		s.restoreNominal(&u.nom, x)
+		s.propagate(m, dt)
+		x[0], x[1], x[2] = rotationVectorBetween(u.prop.e[0], u.prop.e[1], u.prop.e[2], u.prop.e[3],
+			s.E0, s.E1, s.E2, s.E3)
+		x[6], x[7], x[8] = s.v1-u.prop.v[0], s.v2-u.prop.v[1], s.v3-u.prop.v[2]
+	}
+	u.sigma[0] = [ekfN]float64{}
+	s.restoreNominal(&u.prop, nil)
+
+	s.dx = [ekfN]float64{}
+	for j := 1; j < ukfSigmas; j++ {
+		for i := 0; i < ekfN; i++ {
+			s.dx[i] += ukfWeight * u.sigma[j][i]
+		}
+	}
+	for i := 0; i < ekfN; i++ {
+		for k := 0; k <= i; k++ {
+			v := ukfWeightC * (u.sigma[0][i] - s.dx[i]) * (u.sigma[0][k] - s.dx[k])
+			for j := 1; j < ukfSigmas; j++ {
+				v += ukfWeight * (u.sigma[j][i] - s.dx[i]) * (u.sigma[j][k] - s.dx[k])
+			}
+			s.p[i][k] = v + s.N.Get(i, k)*dt
+			s.p[k][i] = s.p[i][k]
+		}
+	}
+}
+
+// update applies a scalar measurement with variance r, evaluating its innovation innov at each sigma point.
+func (u *ukfFilter) update(s *EKFState, innov func() float64, r float64) {
+	s.saveNominal(&u.nom)
+	u.sigmaPoints(&s.p, &s.dx)
+	for j := range u.sigma {
+		s.restoreNominal(&u.nom, &u.sigma[j])
+		u.dy[j] = innov()
+	}
+	s.restoreNominal(&u.nom, nil)
+
+	y := ukfWeight0 * u.dy[0]
+	for j := 1; j < ukfSigmas; j++ {
+		y += ukfWeight * u.dy[j]
+	}
+	ss := r + ukfWeightC*(u.dy[0]-y)*(u.dy[0]-y)
+	var py [ekfN]float64 // Covariance of the error state with the predicted measurement, the negative innovation
+	for j := 1; j < ukfSigmas; j++ {
+		ss += ukfWeight * (u.dy[j] - y) * (u.dy[j] - y)
+		for i := 0; i < ekfN; i++ {
+			py[i] -= ukfWeight * (u.sigma[j][i] - s.dx[i]) * (u.dy[j] - y)
+		}
+	}
+	for i := 0; i < ekfN; i++ {
+		k := py[i] / ss
+		s.dx[i] += k * y
+		for j := 0; j < ekfN; j++ {
+			s.p[i][j] -= k * py[j]
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package ahrs
+
+import (
+	"io/ioutil"
+	"log"
+	"math"
+	"runtime"
+	"testing"
+)
+
+// aerobatic reverses 60° banks at 100 kt every 6 s, rolling at up to 50°/s, and starts at full bank
+// so that the accelerometer gives the filters a 60° roll error to recover from.
+var aerobatic = scenario{name: "Aerobatic", path: sTurnPath(100, 0.63, 12), duration: 60}
+
+// consistencyStats holds the RMS roll and pitch errors in degrees of a filter along a scenario after
+// the first settle seconds, its largest roll error then, and its mean normalized estimation error squared
+// for roll and pitch, which averages 2 if its uncertainty matches its errors.
+type consistencyStats struct {
+	roll, pitch, maxRoll, nees float64
+}
+
+func runConsistency(sc scenario, s *EKFState, settle float64, ms []*Measurement) (c consistencyStats) {
+	var n float64
+	for _, m := range ms {
+		s.Compute(m)
+		if m.T < settle {
+			continue
+		}
+		roll, pitch, _ := s.CalcRollPitchHeading()
+		droll, dpitch, _ := s.CalcRollPitchHeadingUncertainty()
+		r, p, _, _, _, _ := sc.path(m.T)
+		er, ep := angleErr(roll, r/Deg), angleErr(pitch, p/Deg)
+		c.roll += er * er
+		c.pitch += ep * ep
+		c.maxRoll = math.Max(c.maxRoll, er)
+		c.nees += er*er/(droll*droll) + ep*ep/(dpitch*dpitch)
+		n++
+	}
+	c.roll, c.pitch, c.nees = math.Sqrt(c.roll/n), math.Sqrt(c.pitch/n), c.nees/n
+	return
+}
+
+func TestUKFAerobatic(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+	const settle = 5 // s
+	ekf := runConsistency(aerobatic, NewEKFAHRS(), settle, withSensorErrors(aerobatic.measurements(50)))
+	ukf := runConsistency(aerobatic, &NewUKFAHRS().EKFState, settle, withSensorErrors(aerobatic.measurements(50)))
+	for _, c := range []struct {
+		name string
+		c    consistencyStats
+	}{{"EKF", ekf}, {"UKF", ukf}} {
+		t.Logf("%s: roll %.2f°, pitch %.2f°, max roll %.2f°, NEES %.2f (2 if consistent)",
+			c.name, c.c.roll, c.c.pitch, c.c.maxRoll, c.c.nees)
+		if c.c.maxRoll > 5 {
+			t.Errorf("%s roll error reached %.2f° after recovering from the initial bank", c.name, c.c.maxRoll)
+		}
+		if c.c.nees > 6 {
+			t.Errorf("%s is overconfident: NEES %.2f for 2 degrees of freedom", c.name, c.c.nees)
+		}
+	}
+	if ukf.roll > 1.25*ekf.roll || ukf.pitch > 1.25*ekf.pitch {
+		t.Errorf("UKF roll and pitch errors %.2f° and %.2f° are much worse than the EKF's %.2f° and %.2f°",
+			ukf.roll, ukf.pitch, ekf.roll, ekf.pitch)
+	}
+}
+
+func TestUKFMatchesEKF(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+	// With small errors the models are close to linear, so the two filters should agree.
+	ekf, ukf := NewEKFAHRS(), NewUKFAHRS()
+	for _, m := range scenarios[1].measurements(50) {
+		mm := *m
+		ekf.Compute(m)
+		ukf.Compute(&mm)
+	}
+	er, ep, eh := ekf.CalcRollPitchHeading()
+	ur, up, uh := ukf.CalcRollPitchHeading()
+	if angleErr(er, ur) > 0.1 || angleErr(ep, up) > 0.1 || angleErr(eh, uh) > 0.1 {
+		t.Errorf("EKF attitude %.2f°, %.2f°, %.2f° differs from UKF attitude %.2f°, %.2f°, %.2f°",
+			er, ep, eh, ur, up, uh)
+	}
+	for i := 0; i < 3; i++ {
+		e, u := math.Sqrt(ekf.M.Get(i, i))/Deg, math.Sqrt(ukf.M.Get(i, i))/Deg
+		if math.Abs(e-u) > 0.2*e {
+			t.Errorf("EKF attitude uncertainty %d is %.3f°, UKF %.3f°", i, e, u)
+		}
+	}
+}
+
+func TestUKFAllocations(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+	ms := scenarios[2].measurements(50)
+	s := NewUKFAHRS()
+	i := 0
+	for i < 100 {
+		s.Compute(ms[i])
+		i++
+	}
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	n := len(ms) - i
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i < len(ms) {
+		s.Compute(ms[i])
+		i++
+	}
+	runtime.ReadMemStats(&after)
+	if allocs := after.Mallocs - before.Mallocs; allocs > 0 {
+		t.Errorf("UKFState.Compute made %d allocations in %d calls, should make none", allocs, n)
+	}
+}
+
+// BenchmarkEKFvsUKF compares the cost of the two filters on the aerobatic scenario.
+// The UKF pushes 19 sigma points through the models for each prediction and measurement,
+// costing about four times as much as the EKF.
+func BenchmarkEKFvsUKF(b *testing.B) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+	ms := aerobatic.measurements(50)
+	for _, c := range []struct {
+		name string
+		new  func() AHRSProvider
+	}{
+		{"EKF", func() AHRSProvider { return NewEKFAHRS() }},
+		{"UKF", func() AHRSProvider { return NewUKFAHRS() }},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			s := c.new()
+			m := new(Measurement)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				j := i % len(ms)
+				if j == 0 && i > 0 {
+					b.StopTimer()
+					s = c.new()
+					b.StartTimer()
+				}
+				*m = *ms[j]
+				s.Compute(m)
+			}
+		})
+	}
+}
+
+var (
+	_ AHRSProvider       = (*UKFState)(nil)
+	_ PredictingProvider = (*UKFState)(nil)
+)
@@ -0,0 +1,67 @@
+package ahrs
+
+import (
+	"math"
+	"math/bits"
+)
+
+// ARINC 429 labels, octal, of the attitude words, as for an AHRS.
+const (
+	ARINCLabelMagHeading = 0320
+	ARINCLabelPitch      = 0324
+	ARINCLabelRoll       = 0325
+)
+
+// ARINC 429 sign/status matrix of BNR words, bits 30-31.
+const (
+	ARINCFailureWarning = 0
+	ARINCNoComputedData = 1
+	ARINCFunctionalTest = 2
+	ARINCNormal         = 3
+)
+
+const (
+	arincDataBits = 18  // Data bits of a BNR word, 11-28, with the sign in bit 29
+	arincAngle    = 180 // Range, °, of the attitude words
+)
+
+// EncodeARINC429 returns the ARINC 429 BNR word for value on label, in the range ±scale, with all 18 data bits,
+// normal status and odd parity.  Bit 1 of the word is its least significant bit; the label, octal, is held in
+// bits 1-8 most significant bit first, in the order it is sent.  A value beyond the range is clamped to it.
+func EncodeARINC429(label int, value float64, scale float64) uint32 {
+	return encodeBNR(label, value, scale, arincDataBits, ARINCNormal)
+}
+
+// AttitudeToARINC returns the ARINC 429 words for the pitch, roll and heading of a, in that order, on their
+// standard labels, with 14 significant bits for pitch and roll and 15 for the heading.
+// The heading goes on the magnetic heading label, so it should be a magnetic heading.
+// An Invalid angle is sent as no computed data.
+func AttitudeToARINC(a Attitude) []uint32 {
+	return []uint32{
+		encodeARINCAngle(ARINCLabelPitch, a.Pitch, 14),
+		encodeARINCAngle(ARINCLabelRoll, a.Roll, 14),
+		encodeARINCAngle(ARINCLabelMagHeading, a.Heading, 15),
+	}
+}
+
+// encodeARINCAngle encodes the angle x, °, on label with sigBits significant bits, or as no computed data
+// if it is Invalid or not finite.
+func encodeARINCAngle(label int, x float64, sigBits uint) uint32 {
+	if x == Invalid || math.IsNaN(x) || math.IsInf(x, 0) {
+		return encodeBNR(label, 0, arincAngle, sigBits, ARINCNoComputedData)
+	}
+	return encodeBNR(label, math.Remainder(x, 360), arincAngle, sigBits, ARINCNormal)
+}
+
+// encodeBNR encodes value in the range ±scale as a two's complement fraction of scale in the sigBits most
+// significant data bits, with the sign/status matrix ssm and odd parity.
+func encodeBNR(label int, value, scale float64, sigBits uint, ssm uint32) uint32 {
+	full := float64(uint32(1) << sigBits)
+	n := math.Max(-full, math.Min(full-1, math.Round(value/scale*full)))
+	data := uint32(int32(n)) & (1<<(sigBits+1) - 1) // Sign and data
+	w := uint32(bits.Reverse8(uint8(label))) | data<<(28-sigBits) | ssm<<29
+	if bits.OnesCount32(w)%2 == 0 {
+		w |= 1 << 31
+	}
+	return w
+}
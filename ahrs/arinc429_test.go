@@ -0,0 +1,58 @@
+package ahrs
+
+import (
+	"math"
+	"math/bits"
+	"testing"
+)
+
+// decodeARINC429 returns the label, the value in the range ±scale and the sign/status matrix of the BNR word w,
+// and whether its parity is odd.
+func decodeARINC429(w uint32, scale float64) (label int, value float64, ssm uint32, parity bool) {
+	label = int(bits.Reverse8(uint8(w)))
+	data := int32(w<<3) >> 13 // Sign-extend bits 11-29
+	return label, float64(data) / (1 << arincDataBits) * scale, w >> 29 & 3, bits.OnesCount32(w)%2 == 1
+}
+
+func TestEncodeARINC429(t *testing.T) {
+	for _, x := range []float64{0, 1, -1, 12.345, -179.9, 179.99} {
+		w := EncodeARINC429(0324, x, 180)
+		label, v, ssm, parity := decodeARINC429(w, 180)
+		if label != 0324 || math.Abs(v-x) > 180.0/(1<<arincDataBits) || ssm != ARINCNormal || !parity {
+			t.Errorf("%f encoded as %#08x, decoded as label %o, %f, SSM %d, odd parity %t", x, w, label, v, ssm, parity)
+		}
+	}
+	// Label 0324 is sent 00101011 from bit 1.
+	if w := EncodeARINC429(0324, 0, 180); w&0xff != 0x2b {
+		t.Errorf("label 324 in bits 1-8 as %#02x, expected 0x2b", w&0xff)
+	}
+	// Out of range values are clamped.
+	if _, v, _, _ := decodeARINC429(EncodeARINC429(0324, 500, 180), 180); v < 179.99 || v >= 180 {
+		t.Errorf("500 clamped to %f", v)
+	}
+}
+
+func TestAttitudeToARINC(t *testing.T) {
+	a := Attitude{Roll: -23.456, Pitch: 7.89, Heading: 271.3}
+	ws := AttitudeToARINC(a)
+	for i, c := range []struct {
+		label int
+		want  float64
+		res   float64 // Resolution, °
+	}{
+		{ARINCLabelPitch, 7.89, 180.0 / (1 << 14)},
+		{ARINCLabelRoll, -23.456, 180.0 / (1 << 14)},
+		{ARINCLabelMagHeading, 271.3 - 360, 180.0 / (1 << 15)},
+	} {
+		label, v, ssm, parity := decodeARINC429(ws[i], 180)
+		if label != c.label || math.Abs(v-c.want) > c.res/2+1e-12 || ssm != ARINCNormal || !parity {
+			t.Errorf("word %d %#08x decoded as label %o, %f, SSM %d, odd parity %t, expected label %o, %f",
+				i, ws[i], label, v, ssm, parity, c.label, c.want)
+		}
+	}
+
+	a.Heading = Invalid
+	if _, _, ssm, _ := decodeARINC429(AttitudeToARINC(a)[2], 180); ssm != ARINCNoComputedData {
+		t.Errorf("invalid heading sent with SSM %d", ssm)
+	}
+}
@@ -0,0 +1,45 @@
+package ahrs
+
+// AttitudeInterpolator interpolates between the latest two attitudes of a provider, for a display that
+// renders faster than the provider updates.  It interpolates the quaternions rather than the Euler angles,
+// so the attitude turns smoothly at a constant rate, through north and at any bank.
+type AttitudeInterpolator struct {
+	ta, tb float64    // Times of the older and newer attitudes, s
+	a, b   [4]float64 // Older and newer attitude quaternions
+	n      int        // Number of attitudes held, up to 2
+}
+
+// Add records the current attitude of p, at the time of its latest measurement.
+func (ip *AttitudeInterpolator) Add(p AHRSProvider) {
+	e0, e1, e2, e3 := p.CalcQuaternion()
+	ip.AddQuaternion(p.GetState().T, e0, e1, e2, e3)
+}
+
+// AddQuaternion records the attitude quaternion e, rotating the aircraft frame to the earth frame, at time t.
+func (ip *AttitudeInterpolator) AddQuaternion(t, e0, e1, e2, e3 float64) {
+	ip.ta, ip.a = ip.tb, ip.b
+	ip.tb, ip.b = t, [4]float64{e0, e1, e2, e3}
+	if ip.n < 2 {
+		ip.n++
+	}
+}
+
+// QuaternionAt returns the attitude quaternion at time t, interpolated between the latest two attitudes.
+// Before the older one it returns that, and after the newer one that, rather than extrapolating.
+// It returns the identity quaternion until an attitude has been added.
+func (ip *AttitudeInterpolator) QuaternionAt(t float64) (e0, e1, e2, e3 float64) {
+	switch {
+	case ip.n == 0:
+		return 1, 0, 0, 0
+	case ip.n == 1 || ip.tb <= ip.ta:
+		return ip.b[0], ip.b[1], ip.b[2], ip.b[3]
+	}
+	return QuaternionSlerp(ip.a[0], ip.a[1], ip.a[2], ip.a[3], ip.b[0], ip.b[1], ip.b[2], ip.b[3],
+		(t-ip.ta)/(ip.tb-ip.ta))
+}
+
+// AttitudeAt returns the roll, pitch and heading in degrees at time t, as interpolated by QuaternionAt.
+func (ip *AttitudeInterpolator) AttitudeAt(t float64) (roll, pitch, heading float64) {
+	roll, pitch, heading = FromQuaternion(ip.QuaternionAt(t))
+	return RadToDeg(roll), RadToDeg(pitch), RadToDeg(heading)
+}
@@ -0,0 +1,65 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAttitudeInterpolator(t *testing.T) {
+	// Banked 30°, the heading swings 170° from 300° through north to 110° over a second.
+	a0, a1, a2, a3 := ToQuaternion(30*Deg, 0, 300*Deg)
+	b0, b1, b2, b3 := ToQuaternion(30*Deg, 0, 110*Deg)
+	for _, sign := range []float64{1, -1} {
+		var ip AttitudeInterpolator
+		ip.AddQuaternion(10, a0, a1, a2, a3)
+		ip.AddQuaternion(11, sign*b0, sign*b1, sign*b2, sign*b3)
+
+		// Constant angular velocity: each tenth of the way turns through the same angle, the short way.
+		p0, p1, p2, p3 := ip.QuaternionAt(10)
+		for i := 1; i <= 10; i++ {
+			q0, q1, q2, q3 := ip.QuaternionAt(10 + float64(i)/10)
+			if d := 2 * math.Acos(math.Min(1, math.Abs(p0*q0+p1*q1+p2*q2+p3*q3))) / Deg; math.Abs(d-17) > 1e-9 {
+				t.Errorf("sign %.0f: step %d turned through %f°, expected 17°", sign, i, d)
+			}
+			p0, p1, p2, p3 = q0, q1, q2, q3
+		}
+		roll, pitch, hdg := ip.AttitudeAt(10.5)
+		if angleErr(roll, 30) > 1e-9 || math.Abs(pitch) > 1e-9 || angleErr(hdg, 25) > 1e-9 {
+			t.Errorf("sign %.0f: halfway attitude %f°, %f°, %f°, expected 30°, 0°, 25°", sign, roll, pitch, hdg)
+		}
+
+		// Outside the two attitudes, the nearer is held rather than extrapolated.
+		if _, _, hdg := ip.AttitudeAt(9); angleErr(hdg, 300) > 1e-9 {
+			t.Errorf("sign %.0f: heading before the older attitude %f°, expected 300°", sign, hdg)
+		}
+		if _, _, hdg := ip.AttitudeAt(12); angleErr(hdg, 110) > 1e-9 {
+			t.Errorf("sign %.0f: heading after the newer attitude %f°, expected 110°", sign, hdg)
+		}
+	}
+
+	// Nearly identical attitudes don't divide by zero.
+	var ip AttitudeInterpolator
+	ip.AddQuaternion(0, a0, a1, a2, a3)
+	ip.AddQuaternion(0.1, a0, a1, a2, a3+1e-12)
+	if q0, q1, q2, q3 := ip.QuaternionAt(0.05); math.IsNaN(q0 + q1 + q2 + q3) {
+		t.Error("interpolating between identical attitudes gave NaN")
+	}
+}
+
+func TestAttitudeInterpolatorProvider(t *testing.T) {
+	var ip AttitudeInterpolator
+	if q0, _, _, _ := ip.QuaternionAt(0); q0 != 1 {
+		t.Errorf("expected the identity before any attitude, got q0 %f", q0)
+	}
+	s := NewSimpleAHRS()
+	for _, m := range simMeasurements(straightPath(100, 45*Deg), 0, 10, 0.05) {
+		s.Compute(m)
+		ip.Add(s)
+	}
+	roll, pitch, hdg := s.CalcRollPitchHeading()
+	if r, p, h := ip.AttitudeAt(s.GetState().T); angleErr(r, roll) > 1e-9 || angleErr(p, pitch) > 1e-9 ||
+		angleErr(h, hdg) > 1e-9 {
+		t.Errorf("interpolated attitude %f°, %f°, %f° at the latest update, expected %f°, %f°, %f°",
+			r, p, h, roll, pitch, hdg)
+	}
+}
@@ -0,0 +1,68 @@
+package ahrs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+	"text/tabwriter"
+)
+
+var benchmarkRates = []float64{10, 50, 100}
+
+// BenchmarkProviders times Compute for each provider on each scenario at each IMU rate.
+func BenchmarkProviders(b *testing.B) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard) // The Kalman providers are chatty
+	for _, p := range providers {
+		for _, sc := range scenarios {
+			for _, hz := range benchmarkRates {
+				b.Run(fmt.Sprintf("%s/%s/%.0fHz", p.name, sc.name, hz), func(b *testing.B) {
+					ms := sc.measurements(hz)
+					f := p.new(ms[0])
+					m := new(Measurement)
+					b.ReportAllocs()
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						j := i % len(ms)
+						if j == 0 && i > 0 { // Start the scenario over without a time jump backwards
+							b.StopTimer()
+							f = p.new(ms[0])
+							b.StartTimer()
+						}
+						*m = *ms[j] // Some providers modify the measurement
+						f.Compute(m)
+					}
+				})
+			}
+		}
+	}
+}
+
+// TestAttitudeErrorVsCPU tabulates the accuracy of each provider on each scenario against its CPU cost,
+// so that tuning tradeoffs are visible.  It only runs with -v, since the Kalman providers take a while.
+func TestAttitudeErrorVsCPU(t *testing.T) {
+	if testing.Short() || !testing.Verbose() {
+		t.Skip("provider comparison only runs with -v")
+	}
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard) // The Kalman providers are chatty
+
+	const (
+		hz     = 50
+		settle = 5 // s
+	)
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "Provider\tScenario\tRoll RMS °\tPitch RMS °\tHeading RMS °\tµs/Compute\t\n")
+	for _, p := range providers {
+		for _, sc := range scenarios {
+			e := runScenario(sc, hz, settle, p.new)
+			fmt.Fprintf(w, "%s\t%s\t%.2f\t%.2f\t%.2f\t%.1f\t\n", p.name, sc.name,
+				e.roll, e.pitch, e.heading, float64(e.perCompute.Nanoseconds())/1000)
+		}
+	}
+	w.Flush()
+	t.Logf("Attitude error vs CPU at %d Hz:\n%s", hz, buf.String())
+}
@@ -0,0 +1,152 @@
+package ahrs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// binaryRecord is the fixed layout of a Measurement in a binary log: a bitmask of the validity flags,
+// in the order of the Measurement's, with the record format in its top byte, followed by all its float64
+// fields, also in order, and the unit of W.
+type binaryRecord struct {
+	Valid          uint64
+	U1, U2, U3     float64
+	W1, W2, W3     float64
+	A1, A2, A3     float64
+	B1, B2, B3     float64
+	M1, M2, M3     float64
+	TW, TU, T      float64
+	Temp           float64
+	Q0, Q1, Q2, Q3 float64
+	WUnits         uint8
+}
+
+// binaryLogFormat is the format of the records written, kept in the top byte of their Valid.  The first
+// format, which left it 0, had no WUnits.
+const (
+	binaryLogFormat      = 2
+	binaryLogFormatShift = 56
+)
+
+const (
+	validU = 1 << iota
+	validW
+	validS
+	validM
+	validTemp
+	validQ
+)
+
+// BinaryLogRecordSize is the size in bytes of each record of a binary log: the validity bitmask,
+// 23 float64 fields and the unit of W.
+const BinaryLogRecordSize = 8 + 23*8 + 1
+
+// BinaryLogWriter appends Measurements to a compact binary log, for a host with little storage or processing
+// to spare.  Each record has the same size, BinaryLogRecordSize, so record i starts at byte i*BinaryLogRecordSize
+// and can be read directly.  All fields are written little-endian, the byte order of most microcontrollers.
+// Only the measured values, their validity and the unit of W are logged; the noise covariance and accumulators
+// are not.
+type BinaryLogWriter struct {
+	w   io.Writer
+	buf bytes.Buffer
+	n   int
+}
+
+// NewBinaryLogWriter returns a BinaryLogWriter appending to w, e.g. a file opened with os.O_APPEND.
+func NewBinaryLogWriter(w io.Writer) *BinaryLogWriter {
+	return &BinaryLogWriter{w: w}
+}
+
+// Append writes m as the next record of the log.
+func (l *BinaryLogWriter) Append(m *Measurement) error {
+	r := binaryRecord{
+		U1: m.U1, U2: m.U2, U3: m.U3,
+		W1: m.W1, W2: m.W2, W3: m.W3,
+		A1: m.A1, A2: m.A2, A3: m.A3,
+		B1: m.B1, B2: m.B2, B3: m.B3,
+		M1: m.M1, M2: m.M2, M3: m.M3,
+		TW: m.TW, TU: m.TU, T: m.T,
+		Temp: m.Temp,
+		Q0:   m.Q0, Q1: m.Q1, Q2: m.Q2, Q3: m.Q3,
+		WUnits: uint8(m.WUnits),
+		Valid:  binaryLogFormat << binaryLogFormatShift,
+	}
+	for _, f := range []struct {
+		valid bool
+		bit   uint64
+	}{{m.UValid, validU}, {m.WValid, validW}, {m.SValid, validS}, {m.MValid, validM},
+		{m.TempValid, validTemp}, {m.QValid, validQ}} {
+		if f.valid {
+			r.Valid |= f.bit
+		}
+	}
+
+	l.buf.Reset()
+	if err := binary.Write(&l.buf, binary.LittleEndian, &r); err != nil {
+		return fmt.Errorf("ahrs: encoding binary log record %d: %w", l.n, err)
+	}
+	if _, err := l.w.Write(l.buf.Bytes()); err != nil {
+		return fmt.Errorf("ahrs: writing binary log record %d: %w", l.n, err)
+	}
+	l.n++
+	return nil
+}
+
+// Len returns the number of records appended so far.
+func (l *BinaryLogWriter) Len() int {
+	return l.n
+}
+
+// BinaryLogReader reads the records of a binary log written by a BinaryLogWriter, in any order.
+type BinaryLogReader struct {
+	r   io.ReaderAt
+	n   int
+	buf []byte
+}
+
+// NewBinaryLogReader returns a BinaryLogReader for the size bytes of log r, e.g. an *os.File and its size.
+// It returns an error if size isn't a whole number of records, as for a log cut off mid-write.
+func NewBinaryLogReader(r io.ReaderAt, size int64) (*BinaryLogReader, error) {
+	if size%int64(BinaryLogRecordSize) != 0 {
+		return nil, fmt.Errorf("ahrs: binary log size %d isn't a multiple of the record size %d", size, BinaryLogRecordSize)
+	}
+	return &BinaryLogReader{r: r, n: int(size / int64(BinaryLogRecordSize)), buf: make([]byte, BinaryLogRecordSize)}, nil
+}
+
+// Len returns the number of records in the log.
+func (l *BinaryLogReader) Len() int {
+	return l.n
+}
+
+// Read returns a new Measurement, as from NewMeasurement, holding record i of the log.
+func (l *BinaryLogReader) Read(i int) (*Measurement, error) {
+	if i < 0 || i >= l.n {
+		return nil, fmt.Errorf("ahrs: binary log record %d out of range [0, %d)", i, l.n)
+	}
+	if _, err := l.r.ReadAt(l.buf, int64(i)*int64(BinaryLogRecordSize)); err != nil {
+		return nil, fmt.Errorf("ahrs: reading binary log record %d: %w", i, err)
+	}
+	var r binaryRecord
+	if err := binary.Read(bytes.NewReader(l.buf), binary.LittleEndian, &r); err != nil {
+		return nil, fmt.Errorf("ahrs: decoding binary log record %d: %w", i, err)
+	}
+	if f := r.Valid >> binaryLogFormatShift; f != binaryLogFormat {
+		return nil, fmt.Errorf("ahrs: binary log record %d has format %d, expected %d", i, f, binaryLogFormat)
+	}
+
+	m := NewMeasurement()
+	m.UValid, m.WValid, m.SValid, m.MValid = r.Valid&validU != 0, r.Valid&validW != 0, r.Valid&validS != 0, r.Valid&validM != 0
+	m.TempValid, m.QValid = r.Valid&validTemp != 0, r.Valid&validQ != 0
+	m.U1, m.U2, m.U3 = r.U1, r.U2, r.U3
+	m.W1, m.W2, m.W3 = r.W1, r.W2, r.W3
+	m.A1, m.A2, m.A3 = r.A1, r.A2, r.A3
+	m.B1, m.B2, m.B3 = r.B1, r.B2, r.B3
+	m.M1, m.M2, m.M3 = r.M1, r.M2, r.M3
+	m.TW, m.TU, m.T = r.TW, r.TU, r.T
+	m.Temp = r.Temp
+	m.Q0, m.Q1, m.Q2, m.Q3 = r.Q0, r.Q1, r.Q2, r.Q3
+	m.WUnits = SpeedUnit(r.WUnits)
+	return m, nil
+}
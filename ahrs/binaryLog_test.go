@@ -0,0 +1,76 @@
+package ahrs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestBinaryLog(t *testing.T) {
+	if n := binary.Size(binaryRecord{}); n != BinaryLogRecordSize {
+		t.Fatalf("records take %d bytes, BinaryLogRecordSize is %d", n, BinaryLogRecordSize)
+	}
+
+	var buf bytes.Buffer
+	w := NewBinaryLogWriter(&buf)
+	ms := simMeasurements(turnPath(100, 0, 10, 3*Deg), 0, 50, 0.05)[:1000]
+	for i, m := range ms {
+		m.Temp, m.TempValid = 20+float64(i)/100, true
+		m.MValid = i%2 == 0
+		if i%2 == 1 {
+			m.W1, m.W2, m.W3, m.WUnits = KnotsToMS(m.W1), KnotsToMS(m.W2), KnotsToMS(m.W3), MetersPerSecond
+		}
+		if err := w.Append(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.Len() != 1000 || buf.Len() != 1000*BinaryLogRecordSize {
+		t.Fatalf("expected 1000 records of %d bytes, got %d in %d bytes", BinaryLogRecordSize, w.Len(), buf.Len())
+	}
+
+	r, err := NewBinaryLogReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 1000 {
+		t.Errorf("expected 1000 records, got %d", r.Len())
+	}
+	m, err := r.Read(500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ms[500]
+	if m.T != want.T || m.W1 != want.W1 || m.A3 != want.A3 || m.B2 != want.B2 || m.Temp != want.Temp {
+		t.Errorf("record 500 read back as T %f, W1 %f, A3 %f, B2 %f, Temp %f, expected %f, %f, %f, %f, %f",
+			m.T, m.W1, m.A3, m.B2, m.Temp, want.T, want.W1, want.A3, want.B2, want.Temp)
+	}
+	if m.WValid != want.WValid || m.SValid != want.SValid || m.MValid != want.MValid || !m.TempValid || m.QValid {
+		t.Error("record 500 validity flags read back wrong")
+	}
+	if m.M == nil {
+		t.Error("expected the measurement read back to have a noise covariance")
+	}
+	if m, err := r.Read(501); err != nil {
+		t.Error(err)
+	} else if m.WUnits != MetersPerSecond || m.W2 != ms[501].W2 {
+		t.Errorf("record 501 in m/s read back with W2 %f in units %d, expected %f in m/s", m.W2, m.WUnits, ms[501].W2)
+	}
+
+	if _, err := r.Read(1000); err == nil {
+		t.Error("expected an error reading past the end of the log")
+	}
+	if _, err := NewBinaryLogReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()-1)); err == nil {
+		t.Error("expected an error for a log cut off mid-record")
+	}
+
+	// A record of the first format, without WUnits, is refused rather than read as knots.
+	old := buf.Bytes()[:BinaryLogRecordSize]
+	old[7] = 0
+	r, err = NewBinaryLogReader(bytes.NewReader(old), int64(len(old)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(0); err == nil {
+		t.Error("expected an error reading a record of an older format")
+	}
+}
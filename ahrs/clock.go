@@ -0,0 +1,57 @@
+package ahrs
+
+import "sync"
+
+// Clock gives the time, s, at which a Runner computes, in place of the timestamps of the measurements.
+type Clock interface {
+	Now() float64
+}
+
+// SimClock is a Clock for simulations and replays which only advances when told to.
+// A Runner given a SimClock computes exactly once per Tick, on the latest measurement it has received,
+// so that its cadence doesn't depend on wall time or on how the measurements arrive.
+type SimClock struct {
+	mu    sync.Mutex
+	t     float64
+	step  float64
+	ticks chan chan struct{} // To the Runner driven by the clock, if any; closed by it once it has computed
+	stop  chan struct{}      // The Runner's stop channel
+}
+
+// NewSimClock returns a SimClock starting at time t0, s, and advancing by step, s, on each Tick.
+func NewSimClock(t0, step float64) *SimClock {
+	return &SimClock{t: t0, step: step}
+}
+
+// Now returns the current time of the clock, s.
+func (c *SimClock) Now() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+// Tick advances the clock by its step.  If it drives a Runner, Tick returns once the Runner has computed
+// at the new time, or has been stopped.
+func (c *SimClock) Tick() {
+	c.mu.Lock()
+	c.t += c.step
+	ticks, stop := c.ticks, c.stop
+	c.mu.Unlock()
+	if ticks == nil {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case ticks <- done:
+		<-done
+	case <-stop:
+	}
+}
+
+// attach makes c drive a Runner, which receives its ticks from the returned channel until stop is closed.
+func (c *SimClock) attach(stop chan struct{}) <-chan chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ticks, c.stop = make(chan chan struct{}), stop
+	return c.ticks
+}
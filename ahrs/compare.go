@@ -0,0 +1,96 @@
+package ahrs
+
+import (
+	"math"
+	"time"
+)
+
+// ComparisonStats summarizes how a provider's attitude departed from the consensus of all the providers
+// run over the same measurements by CompareProviders.  The angles are in degrees.
+type ComparisonStats struct {
+	MaxRoll, MaxPitch, MaxHeading float64 // Largest departure from the consensus
+	RMSRoll, RMSPitch, RMSHeading float64 // RMS departure from the consensus
+	N                             int     // Number of measurements after which the provider was valid
+	NHeading                      int     // Number of those at which it also had a heading
+	ComputeTime                   time.Duration
+}
+
+// CompareProviders runs each of providers over ms and returns, keyed as providers, the stats of its
+// attitude against the consensus, the mean attitude of the providers valid after each measurement.
+// A heading reported as Invalid, as by a provider with no magnetometer or GPS, is left out of the heading
+// consensus and stats.  Each provider is given its own copy of each measurement, so ms are left as they were.
+// A provider that is never valid has no departures, with N 0.
+func CompareProviders(ms []*Measurement, providers map[string]AHRSProvider) map[string]ComparisonStats {
+	stats := make(map[string]ComparisonStats, len(providers))
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+		stats[name] = ComparisonStats{}
+	}
+
+	type attitude struct {
+		roll, pitch, heading float64
+		valid, headingValid  bool
+	}
+	att := make([]attitude, len(names))
+	for _, m := range ms {
+		var roll, pitch, sinH, cosH float64
+		var n int
+		for i, name := range names {
+			p, mm := providers[name], *m
+			st := stats[name]
+			t := time.Now()
+			p.Compute(&mm)
+			st.ComputeTime += time.Since(t)
+			stats[name] = st
+
+			a := &att[i]
+			a.roll, a.pitch, a.heading = p.RollPitchHeading()
+			a.valid = p.Valid() && a.roll != Invalid && a.pitch != Invalid
+			a.headingValid = a.valid && a.heading != Invalid
+			if a.valid {
+				roll, pitch = roll+a.roll, pitch+a.pitch
+				n++
+			}
+			if a.headingValid {
+				sinH, cosH = sinH+math.Sin(a.heading), cosH+math.Cos(a.heading)
+			}
+		}
+		if n == 0 {
+			continue
+		}
+		roll, pitch, heading := roll/float64(n), pitch/float64(n), math.Atan2(sinH, cosH)
+
+		for i, name := range names {
+			a := &att[i]
+			if !a.valid {
+				continue
+			}
+			dr := math.Abs(RadToDeg(a.roll - roll))
+			dp := math.Abs(RadToDeg(a.pitch - pitch))
+			st := stats[name]
+			st.MaxRoll, st.MaxPitch = math.Max(st.MaxRoll, dr), math.Max(st.MaxPitch, dp)
+			st.RMSRoll, st.RMSPitch = st.RMSRoll+dr*dr, st.RMSPitch+dp*dp
+			st.N++
+			if a.headingValid {
+				dh := math.Abs(RadToDeg(AngleDiff(a.heading, heading)))
+				st.MaxHeading = math.Max(st.MaxHeading, dh)
+				st.RMSHeading += dh * dh
+				st.NHeading++
+			}
+			stats[name] = st
+		}
+	}
+
+	for name, st := range stats {
+		if st.N > 0 {
+			st.RMSRoll = math.Sqrt(st.RMSRoll / float64(st.N))
+			st.RMSPitch = math.Sqrt(st.RMSPitch / float64(st.N))
+		}
+		if st.NHeading > 0 {
+			st.RMSHeading = math.Sqrt(st.RMSHeading / float64(st.NHeading))
+		}
+		stats[name] = st
+	}
+	return stats
+}
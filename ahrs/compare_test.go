@@ -0,0 +1,42 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCompareProviders(t *testing.T) {
+	path := sTurnPath(100, 30*Deg, 30)
+	ms := withMagnetometer(simMeasurements(path, 0, 60, 0.05), path)
+	t0 := ms[0].T
+	stats := CompareProviders(ms, map[string]AHRSProvider{
+		"simple": NewSimpleAHRS(),
+		"mahony": NewMahonyAHRS(),
+	})
+	if ms[0].T != t0 {
+		t.Errorf("measurements altered by the comparison")
+	}
+
+	for _, name := range []string{"simple", "mahony"} {
+		st, ok := stats[name]
+		if !ok {
+			t.Errorf("no stats for %s", name)
+			continue
+		}
+		if st.N == 0 || st.NHeading == 0 || st.ComputeTime <= 0 {
+			t.Errorf("%s: %d valid measurements in %v", name, st.N, st.ComputeTime)
+		}
+		for _, v := range []float64{st.MaxRoll, st.MaxPitch, st.MaxHeading, st.RMSRoll, st.RMSPitch, st.RMSHeading} {
+			if math.IsNaN(v) || math.IsInf(v, 0) || v < 0 {
+				t.Errorf("%s: stats %+v not finite", name, st)
+				break
+			}
+		}
+		if st.RMSRoll > st.MaxRoll || st.RMSPitch > st.MaxPitch || st.RMSHeading > st.MaxHeading {
+			t.Errorf("%s: RMS above the maximum in %+v", name, st)
+		}
+	}
+	if s, m := stats["simple"], stats["mahony"]; math.Abs(s.MaxRoll-m.MaxRoll) > 1e-9 {
+		t.Errorf("departures of two providers from their mean differ: %f° and %f°", s.MaxRoll, m.MaxRoll)
+	}
+}
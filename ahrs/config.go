@@ -0,0 +1,242 @@
+package ahrs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// Config carries the tunables of all the providers, for host applications that read them from a settings file.
+// Each is optional: a nil field keeps the provider's default, given below, and a provider ignores those it
+// doesn't have.  LoadConfig fills in the defaults explicitly.
+type Config struct {
+	MinGS *float64 `json:"minGS,omitempty"` // simple, ekf, ukf: groundspeed, kt, below which the GPS track isn't used (5)
+	MaxDT *float64 `json:"maxDT,omitempty"` // simple, ekf, ukf, ekf7, madgwick, mahony: gap, s, that restarts the algorithm (10)
+
+	// simple; these are shared by all SimpleStates, as with SetConfig.
+	FastSmoothConst     *float64 `json:"fastSmoothConst,omitempty"`     // (0.7)
+	SlowSmoothConst     *float64 `json:"slowSmoothConst,omitempty"`     // (0.1)
+	VerySlowSmoothConst *float64 `json:"verySlowSmoothConst,omitempty"` // (0.02)
+	GPSWeight           *float64 `json:"gpsWeight,omitempty"`           // (0.04)
+	AccelWeight         *float64 `json:"accelWeight,omitempty"`         // (0.01)
+	BlendTime           *float64 `json:"blendTime,omitempty"`           // ramp, s, on taking up or dropping the GPS, may be 0 (2)
+	TaxiHeadingTau      *float64 `json:"taxiHeadingTau,omitempty"`      // taxi mode, s, may be 0 for none (5)
+
+	// ekf and ukf, and those marked for ekf7 too
+	GyroNoise     *float64 `json:"gyroNoise,omitempty"`     // ekf7: °/√s (0.1)
+	GyroBiasNoise *float64 `json:"gyroBiasNoise,omitempty"` // ekf7: °/s/√s (0.002)
+	AccelNoise    *float64 `json:"accelNoise,omitempty"`    // kt/√s (1)
+	GPSNoise      *float64 `json:"gpsNoise,omitempty"`      // kt (2)
+	TrackNoise    *float64 `json:"trackNoise,omitempty"`    // ° (10)
+	GravityNoise  *float64 `json:"gravityNoise,omitempty"`  // ekf7: G (0.05)
+	MagNoise      *float64 `json:"magNoise,omitempty"`      // ekf7: ° (5)
+
+	Beta *float64 `json:"beta,omitempty"` // madgwick: gradient-descent gain, rad/s (0.1)
+
+	Kp *float64 `json:"kp,omitempty"` // mahony: proportional gain, rad/s (1)
+	Ki *float64 `json:"ki,omitempty"` // mahony: integral gain, rad/s², may be 0 to learn no gyro bias (0.1)
+
+	GPSTau *float64 `json:"gpsTau,omitempty"` // hybrid: time constant for moving to the GPS-aided solution, s (5)
+	IMUTau *float64 `json:"imuTau,omitempty"` // hybrid: time constant for moving to the IMU-only solution, s (2)
+
+	// simple: the kind of aircraft, which sets how the gyro is aided (fixedWing)
+	VehicleType VehicleType `json:"vehicleType,omitempty"`
+
+	// all: mounting of the sensor, as the sensor quaternion F (1, 0, 0, 0)
+	SensorQuaternion *[4]float64 `json:"sensorQuaternion,omitempty"`
+
+	strict bool // Whether Check rejects params the provider doesn't have, as for NewProvider
+}
+
+// VehicleType is the kind of aircraft, which sets how the Simple algorithm aids the gyro.
+type VehicleType int
+
+const (
+	FixedWing  VehicleType = iota // Aided by the GPS, whose track lines up with the nose in flight
+	Rotorcraft                    // Aided by the accelerometer and magnetometer in a hover and by the GPS when translating
+)
+
+var vehicleTypeNames = map[VehicleType]string{FixedWing: "fixedWing", Rotorcraft: "rotorcraft"}
+
+func (v VehicleType) String() string {
+	if name, ok := vehicleTypeNames[v]; ok {
+		return name
+	}
+	return fmt.Sprintf("VehicleType(%d)", int(v))
+}
+
+// MarshalText writes v by name, as in a settings file.
+func (v VehicleType) MarshalText() ([]byte, error) {
+	if _, ok := vehicleTypeNames[v]; !ok {
+		return nil, fmt.Errorf("ahrs: unknown vehicle type %d", int(v))
+	}
+	return []byte(v.String()), nil
+}
+
+// UnmarshalText reads a vehicle type by name, case-insensitively.
+func (v *VehicleType) UnmarshalText(text []byte) error {
+	for t, name := range vehicleTypeNames {
+		if strings.EqualFold(name, string(text)) {
+			*v = t
+			return nil
+		}
+	}
+	return fmt.Errorf("ahrs: unknown vehicle type %q", text)
+}
+
+// configFields maps the param names used by NewProvider and SetConfig to the fields of a Config,
+// with their defaults and the largest value that makes sense.
+var configFields = []struct {
+	name     string
+	def, max float64
+	field    func(c *Config) **float64
+}{
+	{"minGS", minGSDefault, math.Inf(1), func(c *Config) **float64 { return &c.MinGS }},
+	{"maxDT", maxDTDefault, math.Inf(1), func(c *Config) **float64 { return &c.MaxDT }},
+	{"fastSmoothConst", fastSmoothConstDefault, 1, func(c *Config) **float64 { return &c.FastSmoothConst }},
+	{"slowSmoothConst", slowSmoothConstDefault, 1, func(c *Config) **float64 { return &c.SlowSmoothConst }},
+	{"verySlowSmoothConst", verySlowSmoothConstDefault, 1, func(c *Config) **float64 { return &c.VerySlowSmoothConst }},
+	{"gpsWeight", gpsWeightDefault, 1, func(c *Config) **float64 { return &c.GPSWeight }},
+	{"accelWeight", accelWeightDefault, 1, func(c *Config) **float64 { return &c.AccelWeight }},
+	{"blendTime", blendTimeDefault, math.Inf(1), func(c *Config) **float64 { return &c.BlendTime }},
+	{"taxiHeadingTau", taxiHeadingTauDefault, math.Inf(1), func(c *Config) **float64 { return &c.TaxiHeadingTau }},
+	{"gyroNoise", ekfGyroNoiseDefault, math.Inf(1), func(c *Config) **float64 { return &c.GyroNoise }},
+	{"gyroBiasNoise", ekfGyroBiasNoiseDefault, math.Inf(1), func(c *Config) **float64 { return &c.GyroBiasNoise }},
+	{"accelNoise", ekfAccelNoiseDefault, math.Inf(1), func(c *Config) **float64 { return &c.AccelNoise }},
+	{"gpsNoise", ekfGPSNoiseDefault, math.Inf(1), func(c *Config) **float64 { return &c.GPSNoise }},
+	{"trackNoise", ekfTrackNoiseDefault, 180, func(c *Config) **float64 { return &c.TrackNoise }},
+	{"gravityNoise", ekfGravityNoiseDefault, math.Inf(1), func(c *Config) **float64 { return &c.GravityNoise }},
+	{"magNoise", ekfMagNoiseDefault, 180, func(c *Config) **float64 { return &c.MagNoise }},
+	{"beta", madgwickBetaDefault, math.Inf(1), func(c *Config) **float64 { return &c.Beta }},
+	{"kp", mahonyKpDefault, math.Inf(1), func(c *Config) **float64 { return &c.Kp }},
+	{"ki", mahonyKiDefault, math.Inf(1), func(c *Config) **float64 { return &c.Ki }},
+	{"gpsTau", hybridGPSTauDefault, math.Inf(1), func(c *Config) **float64 { return &c.GPSTau }},
+	{"imuTau", hybridIMUTauDefault, math.Inf(1), func(c *Config) **float64 { return &c.IMUTau }},
+}
+
+// zeroParams are the params that may be 0, which turns off what they tune.
+var zeroParams = []string{"ki", "blendTime", "taxiHeadingTau"}
+
+// ConfigError lists everything wrong with a Config.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "ahrs: invalid config: " + strings.Join(e.Problems, "; ")
+}
+
+// DefaultConfig returns a Config with every field set to its default.
+func DefaultConfig() Config {
+	var c Config
+	return c.WithDefaults()
+}
+
+// WithDefaults returns a copy of c with the fields that aren't set given their defaults.
+func (c Config) WithDefaults() Config {
+	d := Config{strict: c.strict, VehicleType: c.VehicleType}
+	for _, f := range configFields {
+		v := f.def
+		if p := *f.field(&c); p != nil {
+			v = *p
+		}
+		*f.field(&d) = &v
+	}
+	d.SensorQuaternion = &[4]float64{1, 0, 0, 0}
+	if c.SensorQuaternion != nil {
+		*d.SensorQuaternion = *c.SensorQuaternion
+	}
+	return d
+}
+
+// Params returns the fields of c that are set, keyed by their param names as used by SetConfig.
+func (c Config) Params() map[string]float64 {
+	p := make(map[string]float64)
+	for _, f := range configFields {
+		if v := *f.field(&c); v != nil {
+			p[f.name] = *v
+		}
+	}
+	return p
+}
+
+// Validate returns a *ConfigError listing all the problems with c, or nil.  Each value set must be finite,
+// positive (ki may be 0) and in range, the smoothing constants must get slower from fast to very slow,
+// and the sensor quaternion must be a unit quaternion.
+func (c Config) Validate() error {
+	var problems []string
+	for _, f := range configFields {
+		p := *f.field(&c)
+		if p == nil {
+			continue
+		}
+		switch v := *p; {
+		case math.IsNaN(v) || math.IsInf(v, 0):
+			problems = append(problems, fmt.Sprintf("%s must be finite, got %g", f.name, v))
+		case v < 0 || (v == 0 && !containsString(zeroParams, f.name)):
+			problems = append(problems, fmt.Sprintf("%s must be positive, got %g", f.name, v))
+		case v > f.max:
+			problems = append(problems, fmt.Sprintf("%s must be at most %g, got %g", f.name, f.max, v))
+		}
+	}
+
+	d := c.WithDefaults()
+	if *d.SlowSmoothConst > *d.FastSmoothConst {
+		problems = append(problems, fmt.Sprintf("slowSmoothConst %g must not exceed fastSmoothConst %g",
+			*d.SlowSmoothConst, *d.FastSmoothConst))
+	}
+	if *d.VerySlowSmoothConst > *d.SlowSmoothConst {
+		problems = append(problems, fmt.Sprintf("verySlowSmoothConst %g must not exceed slowSmoothConst %g",
+			*d.VerySlowSmoothConst, *d.SlowSmoothConst))
+	}
+	if c.VehicleType != FixedWing && c.VehicleType != Rotorcraft {
+		problems = append(problems, fmt.Sprintf("vehicleType %d is unknown", c.VehicleType))
+	}
+	if f := d.SensorQuaternion; math.Abs(f[0]*f[0]+f[1]*f[1]+f[2]*f[2]+f[3]*f[3]-1) > 1e-3 {
+		problems = append(problems, fmt.Sprintf("sensorQuaternion %v must have unit norm", *f))
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{problems}
+	}
+	return nil
+}
+
+// Check returns the params set in c that the provider called name has, among allowed.
+// Registered providers may use it to pick out their config.
+func (c Config) Check(name string, allowed ...string) (map[string]float64, error) {
+	p := c.Params()
+	for k := range p {
+		if containsString(allowed, k) {
+			continue
+		}
+		if c.strict {
+			return nil, fmt.Errorf("ahrs: provider %q has no param %q", name, k)
+		}
+		delete(p, k)
+	}
+	return p, nil
+}
+
+// LoadConfig reads a Config as JSON from r, fills in the defaults for the fields missing and validates it.
+// Unknown fields are rejected, so that a misspelt tunable doesn't silently keep its default.
+func LoadConfig(r io.Reader) (c Config, err error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&c); err != nil {
+		return Config{}, fmt.Errorf("ahrs: reading config: %w", err)
+	}
+	if err = c.Validate(); err != nil {
+		return Config{}, err
+	}
+	return c.WithDefaults(), nil
+}
+
+// SaveConfig writes c as JSON to w, with the defaults filled in, so the file records the effective configuration.
+func SaveConfig(w io.Writer, c Config) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c.WithDefaults())
+}
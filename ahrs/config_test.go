@@ -0,0 +1,124 @@
+package ahrs
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigPartial(t *testing.T) {
+	c, err := LoadConfig(strings.NewReader(`{"beta": 0.05, "kp": 2, "sensorQuaternion": [0, 1, 0, 0]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *c.Beta != 0.05 || *c.Kp != 2 || *c.SensorQuaternion != [4]float64{0, 1, 0, 0} {
+		t.Errorf("fields given weren't loaded: beta %g, kp %g, sensorQuaternion %v", *c.Beta, *c.Kp, *c.SensorQuaternion)
+	}
+	if *c.MaxDT != maxDTDefault || *c.Ki != mahonyKiDefault || *c.GPSNoise != ekfGPSNoiseDefault {
+		t.Errorf("missing fields didn't get their defaults: maxDT %g, ki %g, gpsNoise %g", *c.MaxDT, *c.Ki, *c.GPSNoise)
+	}
+
+	// A loaded config, with every field set, suits every provider.
+	m := NewMeasurement()
+	m.SValid, m.A3 = true, 1
+	for _, name := range Providers() {
+		p, err := NewAHRSProvider(name, c, m)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if f := p.GetState().F1; name != "kalman" && f != 1 {
+			t.Errorf("%s: sensor quaternion not applied, F1 = %g", name, f)
+		}
+	}
+	p, _ := NewAHRSProvider("hybrid", c, nil)
+	if kp := p.(*HybridState).imu.(*MahonyState).kp; kp != 2 {
+		t.Errorf("hybrid's IMU-only solution didn't get kp: %g", kp)
+	}
+}
+
+func TestLoadConfigUnknownField(t *testing.T) {
+	if _, err := LoadConfig(strings.NewReader(`{"beta": 0.05, "bta": 0.1}`)); err == nil ||
+		!strings.Contains(err.Error(), "bta") {
+		t.Errorf("expected a misspelt field to be rejected, got %v", err)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	_, err := LoadConfig(strings.NewReader(`{"beta": -1, "gpsWeight": 2, "fastSmoothConst": 0.05,
+		"sensorQuaternion": [1, 1, 0, 0]}`))
+	var ce *ConfigError
+	if !errors.As(err, &ce) {
+		t.Fatalf("expected a ConfigError, got %v", err)
+	}
+	// All the problems are reported at once.
+	for _, want := range []string{"beta", "gpsWeight", "slowSmoothConst", "sensorQuaternion"} {
+		found := false
+		for _, p := range ce.Problems {
+			found = found || strings.HasPrefix(p, want)
+		}
+		if !found {
+			t.Errorf("expected a problem with %s among %q", want, ce.Problems)
+		}
+	}
+	if len(ce.Problems) != 4 {
+		t.Errorf("expected 4 problems, got %q", ce.Problems)
+	}
+}
+
+func TestSaveConfigRoundTrip(t *testing.T) {
+	c, err := LoadConfig(strings.NewReader(`{"gyroNoise": 0.2, "imuTau": 3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b1, b2 bytes.Buffer
+	if err := SaveConfig(&b1, c); err != nil {
+		t.Fatal(err)
+	}
+	c2, err := LoadConfig(bytes.NewReader(b1.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveConfig(&b2, c2); err != nil {
+		t.Fatal(err)
+	}
+	if b1.String() != b2.String() {
+		t.Errorf("config changed on a round trip:\n%s\n%s", b1.String(), b2.String())
+	}
+
+	// The effective configuration is written out, including the defaults.
+	var b3 bytes.Buffer
+	if err := SaveConfig(&b3, Config{}); err != nil {
+		t.Fatal(err)
+	}
+	d, err := LoadConfig(&b3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Params()) != len(configFields) || *d.Beta != madgwickBetaDefault {
+		t.Errorf("defaults weren't written out: %v", d.Params())
+	}
+}
+
+func TestLoadConfigVehicleType(t *testing.T) {
+	c, err := LoadConfig(strings.NewReader(`{"vehicleType": "Rotorcraft"}`))
+	if err != nil || c.VehicleType != Rotorcraft {
+		t.Fatalf("vehicleType read as %v, %v", c.VehicleType, err)
+	}
+	var b bytes.Buffer
+	if err := SaveConfig(&b, c); err != nil || !strings.Contains(b.String(), `"vehicleType": "rotorcraft"`) {
+		t.Errorf("vehicleType not written by name, got %s, %v", b.String(), err)
+	}
+	p, err := NewAHRSProvider("simple", c, nil)
+	if err != nil || !p.(*SimpleState).rotorcraft {
+		t.Errorf("simple provider for a rotorcraft config not in rotorcraft mode: %v", err)
+	}
+
+	if _, err := LoadConfig(strings.NewReader(`{"vehicleType": "blimp"}`)); err == nil {
+		t.Errorf("unknown vehicle type accepted")
+	}
+	if err := (Config{VehicleType: 7}).Validate(); err == nil {
+		t.Errorf("unknown vehicle type %d accepted", 7)
+	}
+}
@@ -0,0 +1,68 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+// TestProviderConformance checks that each AHRSProvider honours the contract of the interface.
+// The original Kalman filter doesn't converge and keeps no log map, so only its accessors and Reset are checked.
+func TestProviderConformance(t *testing.T) {
+	sc := scenarios[0]
+	for _, pr := range providers {
+		ms := withMagnetometer(sc.measurements(50), sc.path)
+		p, ok := pr.new(ms[0]).(AHRSProvider)
+		if !ok {
+			continue
+		}
+
+		f := [4]float64{0, 0, 0, 1}
+		p.SetSensorQuaternion(&f)
+		if g := p.GetSensorQuaternion(); *g != f {
+			t.Errorf("%s: set sensor quaternion %v, got %v", pr.name, f, *g)
+		}
+		p.SetSensorQuaternion(&[4]float64{1, 0, 0, 0})
+
+		c, d, k, l := [3]float64{0, 0, 1.01}, [3]float64{0.1, -0.2, 0.3}, [3]float64{1, 1, 1}, [3]float64{0, 0, 0}
+		p.SetCalibrations(&c, &d, &k, &l)
+		if gc, gd, gk, gl := p.GetCalibrations(); *gc != c || *gd != d || *gk != k || *gl != l {
+			t.Errorf("%s: set calibrations %v %v %v %v, got %v %v %v %v", pr.name, c, d, k, l, *gc, *gd, *gk, *gl)
+		}
+		p.SetCalibrations(&[3]float64{0, 0, 1}, &[3]float64{}, nil, nil)
+		p.SetConfig(nil)
+
+		for _, m := range ms {
+			p.Compute(m)
+		}
+		if pr.name == "Kalman" {
+			if p.Reset(); p.Valid() {
+				t.Errorf("%s: valid after Reset", pr.name)
+			}
+			continue
+		}
+		if !p.Valid() {
+			t.Errorf("%s: not valid after %s", pr.name, sc.name)
+		}
+		roll, pitch, heading := p.RollPitchHeading()
+		for name, v := range map[string]float64{"roll": roll, "pitch": pitch, "heading": heading,
+			"mag heading": p.MagHeading(), "slip/skid": p.SlipSkid(), "rate of turn": p.RateOfTurn(), "G load": p.GLoad()} {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				t.Errorf("%s: %s is %f", pr.name, name, v)
+			}
+		}
+		if p.GetState() == nil || p.GetLogMap() == nil {
+			t.Errorf("%s: expected a state and a log map", pr.name)
+		}
+
+		p.Reset()
+		if p.Valid() {
+			t.Errorf("%s: valid after Reset", pr.name)
+		}
+		for _, m := range ms[:10] {
+			p.Compute(m)
+		}
+		if !p.Valid() {
+			t.Errorf("%s: not valid after restarting", pr.name)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package ahrs
+
+import "math"
+
+const deadbandDefault = 0.2 // Default dead-band of Deadband, °
+
+// Deadband wraps an AHRSProvider and reports a roll or pitch smaller than its threshold as exactly zero,
+// so that sensor noise doesn't make a display jitter in level flight.  Once snapped to zero an angle is
+// held there until it grows past half as much again as the threshold, so that it doesn't flicker at the
+// threshold.  The provider's own state is left alone.
+type Deadband struct {
+	AHRSProvider
+	threshold float64 // Roll and pitch, °, below which they're reported as zero
+	zero      [2]bool // Whether the roll and pitch are held at zero
+}
+
+// WithDeadband returns a Deadband wrapping p with a dead-band of threshold degrees, or 0.2° if it isn't positive.
+func WithDeadband(p AHRSProvider, threshold float64) *Deadband {
+	if threshold <= 0 {
+		threshold = deadbandDefault
+	}
+	return &Deadband{AHRSProvider: p, threshold: threshold}
+}
+
+// RollPitchHeading returns the provider's attitude in radians, with the roll and pitch in the dead-band zeroed.
+func (d *Deadband) RollPitchHeading() (roll float64, pitch float64, heading float64) {
+	roll, pitch, heading = d.AHRSProvider.RollPitchHeading()
+	return d.apply(0, roll), d.apply(1, pitch), heading
+}
+
+// CalcRollPitchHeading returns the provider's attitude in degrees, with the roll and pitch in the dead-band
+// zeroed.
+func (d *Deadband) CalcRollPitchHeading() (roll float64, pitch float64, heading float64) {
+	roll, pitch, heading = d.RollPitchHeading()
+	if heading != Invalid {
+		heading = RadToDeg(heading)
+	}
+	return RadToDeg(roll), RadToDeg(pitch), heading
+}
+
+// CalcAttitude returns the provider's Attitude with the roll and pitch in the dead-band zeroed.
+func (d *Deadband) CalcAttitude() Attitude {
+	a := d.AHRSProvider.CalcAttitude()
+	a.Roll, a.Pitch = RadToDeg(d.apply(0, DegToRad(a.Roll))), RadToDeg(d.apply(1, DegToRad(a.Pitch)))
+	return a
+}
+
+// CalcQuaternion returns the provider's attitude quaternion rebuilt with the roll and pitch in the dead-band
+// zeroed, keeping its heading and sign.
+func (d *Deadband) CalcQuaternion() (w, x, y, z float64) {
+	e0, e1, e2, e3 := d.AHRSProvider.CalcQuaternion()
+	roll, pitch, heading := FromQuaternion(e0, e1, e2, e3)
+	w, x, y, z = ToQuaternion(d.apply(0, roll), d.apply(1, pitch), heading)
+	return QuaternionSign(w, x, y, z, e0, e1, e2, e3)
+}
+
+// apply returns the angle x, rad, of axis i, or zero while it is in the dead-band.
+func (d *Deadband) apply(i int, x float64) float64 {
+	a := math.Abs(RadToDeg(x))
+	if d.zero[i] {
+		d.zero[i] = a <= 1.5*d.threshold
+	} else {
+		d.zero[i] = a < d.threshold
+	}
+	if d.zero[i] {
+		return 0
+	}
+	return x
+}
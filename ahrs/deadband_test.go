@@ -0,0 +1,62 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDeadband(t *testing.T) {
+	s := NewSimpleAHRS()
+	s.needsInitialization = false
+	d := WithDeadband(s, 0)
+	for _, c := range []struct {
+		roll, want float64 // °
+	}{
+		{0.1, 0},
+		{-0.15, 0},
+		{0.25, 0}, // Held at zero by the hysteresis
+		{0.5, 0.5},
+		{0.25, 0.25}, // Passed through on the way down
+		{-0.19, 0},
+		{-0.5, -0.5},
+	} {
+		s.E0, s.E1, s.E2, s.E3 = ToQuaternion(c.roll*Deg, c.roll*Deg, 90*Deg)
+		r, p, h := d.CalcRollPitchHeading()
+		if math.Abs(r-c.want) > 1e-9 || math.Abs(p-c.want) > 1e-9 || math.Abs(h-90) > 1e-9 {
+			t.Errorf("roll and pitch %.2f° reported as %f, %f° on %f°, expected %.2f°", c.roll, r, p, h, c.want)
+		}
+	}
+	// The provider's own state is left alone.
+	if r, _, _ := s.CalcRollPitchHeading(); math.Abs(r+0.5) > 1e-9 {
+		t.Errorf("provider's roll changed to %f°", r)
+	}
+}
+
+func TestDeadbandAttitudeAndQuaternion(t *testing.T) {
+	s := NewSimpleAHRS()
+	s.needsInitialization = false
+	d := WithDeadband(s, 0)
+	for _, c := range []struct {
+		roll, want float64 // °
+	}{
+		{0.1, 0},
+		{0.25, 0}, // Held at zero by the hysteresis
+		{0.5, 0.5},
+	} {
+		s.E0, s.E1, s.E2, s.E3 = ToQuaternion(c.roll*Deg, c.roll*Deg, 90*Deg)
+		s.calcRotationMatrices()
+		if a := d.CalcAttitude(); math.Abs(a.Roll-c.want) > 1e-9 || math.Abs(a.Pitch-c.want) > 1e-9 ||
+			math.Abs(a.Heading-90) > 1e-9 {
+			t.Errorf("roll and pitch %.2f° given as attitude %+v, expected %.2f°", c.roll, a, c.want)
+		}
+		w, x, y, z := d.CalcQuaternion()
+		r, p, h := FromQuaternion(w, x, y, z)
+		if math.Abs(r/Deg-c.want) > 1e-9 || math.Abs(p/Deg-c.want) > 1e-9 || math.Abs(h/Deg-90) > 1e-9 {
+			t.Errorf("roll and pitch %.2f° given as quaternion of %f, %f, %f°, expected %.2f°",
+				c.roll, r/Deg, p/Deg, h/Deg, c.want)
+		}
+		if w*s.E0+x*s.E1+y*s.E2+z*s.E3 < 0 {
+			t.Errorf("roll and pitch %.2f° given as a quaternion of the other sign from the provider's", c.roll)
+		}
+	}
+}
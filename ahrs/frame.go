@@ -0,0 +1,69 @@
+package ahrs
+
+import "math"
+
+// Frame is a coordinate convention for the earth and aircraft frames of a Measurement.
+type Frame int
+
+const (
+	// ENU is the convention used throughout this package, as in ROS: earth frame 1 east, 2 north, 3 up;
+	// aircraft frame 1 to the nose, 2 to the left wing, 3 up.
+	// The attitude quaternion E and CalcRotationMatrix rotate the aircraft frame into the earth frame;
+	// roll is positive right wing down, pitch positive nose up and heading clockwise from north.
+	ENU Frame = iota
+	// NED is the usual aviation convention: earth frame 1 north, 2 east, 3 down;
+	// aircraft frame 1 to the nose, 2 to the right wing, 3 down.
+	NED
+)
+
+// ConvertMeasurement converts the readings in m from the from convention to the to convention, in place.
+// Between ENU and NED the transform is its own inverse:
+//
+//	W1, W2, W3 (earth frame)      -> W2, W1, -W3
+//	U, A, B and M (aircraft frame) -> X1, -X2, -X3
+//	Q                              -> (0, 1, 1, 0)/√2 * Q * (0, 1, 0, 0)
+//
+// so, for example, a level accelerometer reads A3 = 1 in ENU and A3 = -1 in NED.
+// Only the readings are converted, so this is meant for raw measurements before they reach a provider;
+// the variance accumulators and noise covariance are left alone.
+func ConvertMeasurement(m *Measurement, from, to Frame) {
+	if from == to {
+		return
+	}
+	m.W1, m.W2, m.W3 = m.W2, m.W1, -m.W3
+	m.U2, m.U3 = -m.U2, -m.U3
+	m.A2, m.A3 = -m.A2, -m.A3
+	m.B2, m.B3 = -m.B2, -m.B3
+	m.M2, m.M3 = -m.M2, -m.M3
+	// Swap the earth axes by a half turn about east+north and flip the aircraft axes by a half turn about the nose.
+	q0, q1, q2, q3 := quaternionProduct(0, 1/math.Sqrt2, 1/math.Sqrt2, 0, m.Q0, m.Q1, m.Q2, m.Q3)
+	m.Q0, m.Q1, m.Q2, m.Q3 = quaternionProduct(q0, q1, q2, q3, 0, 1, 0, 0)
+}
+
+// SpeedUnit is the unit of a GPS velocity fed to GPSVelocity.
+type SpeedUnit int
+
+const (
+	Knots           SpeedUnit = iota // Knots, the unit of the package
+	MetersPerSecond                  // m/s, as from u-blox receivers
+)
+
+// GPSVelocity returns the GPS velocity v1, v2, v3, given in the frame and unit of the receiver, as the W1, W2, W3
+// of a Measurement: east, north and up, in knots.  So a receiver reporting north, east and down in m/s, as
+// u-blox's do, gives GPSVelocity(NED, MetersPerSecond, vn, ve, vd).  The providers' thresholds, such as MinGS,
+// are in knots whatever the receiver reports.
+func GPSVelocity(frame Frame, unit SpeedUnit, v1, v2, v3 float64) (w1, w2, w3 float64) {
+	w1, w2, w3 = v1, v2, v3
+	if frame == NED {
+		w1, w2, w3 = v2, v1, -v3
+	}
+	if unit == MetersPerSecond {
+		w1, w2, w3 = MSToKnots(w1), MSToKnots(w2), MSToKnots(w3)
+	}
+	return
+}
+
+// GPSVelocityNEDms returns the GPS velocity north, east and down in m/s as the W1, W2, W3 of a Measurement.
+func GPSVelocityNEDms(vn, ve, vd float64) (w1, w2, w3 float64) {
+	return GPSVelocity(NED, MetersPerSecond, vn, ve, vd)
+}
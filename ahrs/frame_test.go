@@ -0,0 +1,143 @@
+package ahrs
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestConvertMeasurementRoundTrip(t *testing.T) {
+	m := NewMeasurement()
+	for _, p := range []*float64{&m.U1, &m.U2, &m.U3, &m.W1, &m.W2, &m.W3, &m.A1, &m.A2, &m.A3,
+		&m.B1, &m.B2, &m.B3, &m.M1, &m.M2, &m.M3} {
+		*p = rand.NormFloat64()
+	}
+	orig := *m
+	ConvertMeasurement(m, NED, ENU)
+	if m.W1 == orig.W1 || m.A3 == orig.A3 {
+		t.Error("measurement wasn't converted")
+	}
+	ConvertMeasurement(m, ENU, NED)
+	if m.U1 != orig.U1 || m.U2 != orig.U2 || m.U3 != orig.U3 ||
+		m.W1 != orig.W1 || m.W2 != orig.W2 || m.W3 != orig.W3 ||
+		m.A1 != orig.A1 || m.A2 != orig.A2 || m.A3 != orig.A3 ||
+		m.B1 != orig.B1 || m.B2 != orig.B2 || m.B3 != orig.B3 ||
+		m.M1 != orig.M1 || m.M2 != orig.M2 || m.M3 != orig.M3 {
+		t.Errorf("NED->ENU->NED changed the measurement:\n%+v\n%+v", orig, *m)
+	}
+}
+
+func TestConvertMeasurementNED(t *testing.T) {
+	// Level, climbing north at 100 kt and 5 kt, turning right at 3°/s, as a NED stack reports it.
+	m := NewMeasurement()
+	m.W1, m.W2, m.W3 = 100, 0, -5
+	m.A3 = -1
+	m.B3 = 3
+	ConvertMeasurement(m, NED, ENU)
+	if m.W1 != 0 || m.W2 != 100 || m.W3 != 5 {
+		t.Errorf("expected ENU velocity 0, 100, 5, got %f, %f, %f", m.W1, m.W2, m.W3)
+	}
+	if m.A3 != 1 {
+		t.Errorf("expected a level accelerometer to read A3 = 1, got %f", m.A3)
+	}
+	// A right turn is a negative rotation about the up axis.
+	if m.B3 != -3 {
+		t.Errorf("expected B3 = -3°/s for a right turn, got %f", m.B3)
+	}
+	ConvertMeasurement(m, ENU, ENU)
+	if m.W2 != 100 {
+		t.Error("converting to the same frame should do nothing")
+	}
+}
+
+func TestConvertMeasurementQuaternion(t *testing.T) {
+	// Rotating a reading into the earth frame by Q must give the same vector in either convention.
+	m := NewMeasurement()
+	m.Q0, m.Q1, m.Q2, m.Q3 = ToQuaternion(30*Deg, -10*Deg, 250*Deg)
+	m.A1, m.A2, m.A3 = 0.2, -0.3, 0.9
+	e1, e2, e3 := quaternionRotateVector(m.Q0, m.Q1, m.Q2, m.Q3, m.A1, m.A2, m.A3)
+	ConvertMeasurement(m, ENU, NED)
+	n1, n2, n3 := quaternionRotateVector(m.Q0, m.Q1, m.Q2, m.Q3, m.A1, m.A2, m.A3)
+	if math.Abs(n1-e2) > 1e-12 || math.Abs(n2-e1) > 1e-12 || math.Abs(n3+e3) > 1e-12 {
+		t.Errorf("earth-frame vector %f, %f, %f in ENU became %f, %f, %f in NED", e1, e2, e3, n1, n2, n3)
+	}
+	if qq := m.Q0*m.Q0 + m.Q1*m.Q1 + m.Q2*m.Q2 + m.Q3*m.Q3; math.Abs(qq-1) > 1e-12 {
+		t.Errorf("converted quaternion has norm² %f", qq)
+	}
+}
+
+func TestGPSVelocityConventions(t *testing.T) {
+	// 4 m/s, under MinGS if mistaken for knots, on a track of 120° climbing at 1 m/s
+	const track = 120 * Deg
+	ve, vn, vu := 4*math.Sin(track), 4*math.Cos(track), 1.0
+	for _, c := range []struct {
+		name       string
+		frame      Frame
+		unit       SpeedUnit
+		v1, v2, v3 float64
+	}{
+		{"ENU kt", ENU, Knots, MSToKnots(ve), MSToKnots(vn), MSToKnots(vu)},
+		{"ENU m/s", ENU, MetersPerSecond, ve, vn, vu},
+		{"NED kt", NED, Knots, MSToKnots(vn), MSToKnots(ve), -MSToKnots(vu)},
+		{"NED m/s", NED, MetersPerSecond, vn, ve, -vu},
+	} {
+		w1, w2, w3 := GPSVelocity(c.frame, c.unit, c.v1, c.v2, c.v3)
+		if math.Abs(w1-MSToKnots(ve)) > 1e-12 || math.Abs(w2-MSToKnots(vn)) > 1e-12 ||
+			math.Abs(w3-MSToKnots(vu)) > 1e-12 {
+			t.Errorf("%s: velocity (%f, %f, %f) kt, expected (%f, %f, %f)", c.name, w1, w2, w3,
+				MSToKnots(ve), MSToKnots(vn), MSToKnots(vu))
+		}
+
+		s := NewSimpleAHRS()
+		for i := 0; i <= 1200; i++ {
+			m := NewMeasurement()
+			m.A3 = 1
+			m.W1, m.W2, m.W3 = GPSVelocity(c.frame, c.unit, c.v1, c.v2, c.v3)
+			m.WValid, m.SValid = true, true
+			m.T, m.TW = float64(i)*0.05, float64(i)*0.05
+			s.Compute(m)
+		}
+		if _, _, heading := s.CalcRollPitchHeading(); angleErr(heading, 120) > 1 {
+			t.Errorf("%s: heading %.1f°, expected 120°", c.name, heading)
+		}
+		if gs := math.Hypot(w1, w2); math.Abs(gs-MSToKnots(4)) > 1e-9 {
+			t.Errorf("%s: groundspeed %f kt, expected %f", c.name, gs, MSToKnots(4))
+		}
+	}
+
+	if w1, w2, w3 := GPSVelocityNEDms(vn, ve, -vu); w1 != MSToKnots(ve) || w2 != MSToKnots(vn) || w3 != MSToKnots(vu) {
+		t.Errorf("GPSVelocityNEDms gave (%f, %f, %f)", w1, w2, w3)
+	}
+}
+
+func TestMeasurementWUnits(t *testing.T) {
+	// A slow taxi turn at 4 m/s, which is under MinGS if mistaken for knots
+	for _, c := range []struct {
+		name string
+		p, q fuzzable
+	}{
+		{"Simple", NewSimpleAHRS(), NewSimpleAHRS()},
+		{"EKF", NewEKFAHRS(), NewEKFAHRS()},
+	} {
+		// The measurement in m/s is reused for every sample, as by a caller setting WUnits once.
+		mm := NewMeasurement()
+		mm.WUnits = MetersPerSecond
+		for _, m := range simMeasurements(turnPath(MSToKnots(4), 0, 10, 6*Deg), 0, 40, 0.05) {
+			mm.SValid, mm.WValid, mm.T, mm.TW = m.SValid, m.WValid, m.T, m.TW
+			mm.A1, mm.A2, mm.A3, mm.B1, mm.B2, mm.B3 = m.A1, m.A2, m.A3, m.B1, m.B2, m.B3
+			mm.W1, mm.W2, mm.W3 = KnotsToMS(m.W1), KnotsToMS(m.W2), KnotsToMS(m.W3)
+			given := *mm
+			c.p.Compute(m)
+			c.q.Compute(mm)
+			if mm.WUnits != MetersPerSecond || mm.W1 != given.W1 || mm.W2 != given.W2 || mm.W3 != given.W3 {
+				t.Fatalf("%s: measurement in m/s changed by Compute from %+v to %+v", c.name, given, *mm)
+			}
+		}
+		roll, pitch, heading := c.p.GetState().CalcRollPitchHeading()
+		rollQ, pitchQ, headingQ := c.q.GetState().CalcRollPitchHeading()
+		if math.Abs(roll-rollQ) > 1e-6 || math.Abs(pitch-pitchQ) > 1e-6 || angleErr(heading, headingQ) > 1e-6 {
+			t.Errorf("%s: attitude %f, %f, %f in knots but %f, %f, %f in m/s",
+				c.name, roll, pitch, heading, rollQ, pitchQ, headingQ)
+		}
+	}
+}
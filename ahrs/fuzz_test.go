@@ -0,0 +1,217 @@
+package ahrs
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"math"
+	"testing"
+)
+
+// measurementSize is the number of bytes decoded into each Measurement:
+// a byte of validity flags followed by the float64 fields U, W, A, B, M, T and TW.
+const measurementSize = 1 + 17*8
+
+// decodeMeasurements turns arbitrary bytes into a sequence of measurements, so the fuzzer can produce
+// any values at all, including NaN, Inf, time jumps, times going backwards and samples with no valid data.
+func decodeMeasurements(data []byte) (ms []*Measurement) {
+	for ; len(data) >= measurementSize; data = data[measurementSize:] {
+		m := NewMeasurement()
+		m.UValid, m.WValid, m.SValid, m.MValid = data[0]&1 != 0, data[0]&2 != 0, data[0]&4 != 0, data[0]&8 != 0
+		for i, f := range []*float64{&m.U1, &m.U2, &m.U3, &m.W1, &m.W2, &m.W3, &m.A1, &m.A2, &m.A3,
+			&m.B1, &m.B2, &m.B3, &m.M1, &m.M2, &m.M3, &m.T, &m.TW} {
+			*f = math.Float64frombits(binary.LittleEndian.Uint64(data[1+8*i:]))
+		}
+		ms = append(ms, m)
+	}
+	return
+}
+
+// encodeMeasurements is the inverse of decodeMeasurements, for building the seed corpus.
+func encodeMeasurements(ms []*Measurement) (data []byte) {
+	for _, m := range ms {
+		var b [measurementSize]byte
+		for i, v := range []bool{m.UValid, m.WValid, m.SValid, m.MValid} {
+			if v {
+				b[0] |= 1 << uint(i)
+			}
+		}
+		for i, f := range []float64{m.U1, m.U2, m.U3, m.W1, m.W2, m.W3, m.A1, m.A2, m.A3,
+			m.B1, m.B2, m.B3, m.M1, m.M2, m.M3, m.T, m.TW} {
+			binary.LittleEndian.PutUint64(b[1+8*i:], math.Float64bits(f))
+		}
+		data = append(data, b[:]...)
+	}
+	return
+}
+
+// fuzzSeeds are the starting points for the fuzzer: a little normal flight, and the cases that have been found
+// to break the providers.
+func fuzzSeeds() (seeds [][]byte) {
+	ms := kalmanScenario()[:20]
+	seeds = append(seeds, encodeMeasurements(ms))
+
+	for _, c := range fuzzRegressions {
+		seeds = append(seeds, encodeMeasurements(c.ms()))
+	}
+	return
+}
+
+// fuzzable is what the fuzz targets check on each provider.
+// Kalman0State and Kalman1State don't implement the whole AHRSProvider.
+type fuzzable interface {
+	attitudeFilter
+	RollPitchHeading() (float64, float64, float64)
+	MagHeading() float64
+	SlipSkid() float64
+	RateOfTurn() float64
+	GLoad() float64
+	Valid() bool
+}
+
+// fuzzOutputsOK checks that p either has finite outputs or knows that they're not valid.
+func fuzzOutputsOK(t *testing.T, p fuzzable, m *Measurement) {
+	roll, pitch, heading := p.RollPitchHeading()
+	for _, v := range []float64{roll, pitch, heading, p.MagHeading(), p.SlipSkid(), p.RateOfTurn(), p.GLoad()} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			if p.Valid() {
+				t.Fatalf("non-finite output but Valid() is true after measurement %+v", *m)
+			}
+			return
+		}
+	}
+}
+
+func fuzzProvider(f *testing.F, newProvider func(m *Measurement) attitudeFilter) {
+	for _, s := range fuzzSeeds() {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ms := decodeMeasurements(data)
+		if len(ms) == 0 {
+			return
+		}
+		defer log.SetOutput(log.Writer())
+		log.SetOutput(ioutil.Discard)
+		p := newProvider(ms[0])
+		for _, m := range ms {
+			p.Compute(m)
+			fuzzOutputsOK(t, p.(fuzzable), m)
+		}
+	})
+}
+
+func FuzzSimpleUpdate(f *testing.F) {
+	fuzzProvider(f, func(*Measurement) attitudeFilter { return NewSimpleAHRS() })
+}
+
+func FuzzKalmanUpdate(f *testing.F) {
+	fuzzProvider(f, func(m *Measurement) attitudeFilter { return InitializeKalman(m) })
+}
+
+func FuzzKalman0Update(f *testing.F) {
+	fuzzProvider(f, func(*Measurement) attitudeFilter { return NewKalman0AHRS() })
+}
+
+func FuzzKalman1Update(f *testing.F) {
+	fuzzProvider(f, func(*Measurement) attitudeFilter { return NewKalman1AHRS() })
+}
+
+func FuzzEKFUpdate(f *testing.F) {
+	fuzzProvider(f, func(*Measurement) attitudeFilter { return NewEKFAHRS() })
+}
+
+func FuzzUKFUpdate(f *testing.F) {
+	fuzzProvider(f, func(*Measurement) attitudeFilter { return NewUKFAHRS() })
+}
+
+func FuzzMadgwickUpdate(f *testing.F) {
+	fuzzProvider(f, func(*Measurement) attitudeFilter { return NewMadgwickAHRS() })
+}
+
+func FuzzMahonyUpdate(f *testing.F) {
+	fuzzProvider(f, func(*Measurement) attitudeFilter { return NewMahonyAHRS() })
+}
+
+func FuzzHybridUpdate(f *testing.F) {
+	fuzzProvider(f, func(*Measurement) attitudeFilter { return NewHybridAHRS(NewSimpleAHRS(), NewMahonyAHRS()) })
+}
+
+// fuzzRegression is a sequence of measurements found by fuzzing to break a provider.
+type fuzzRegression struct {
+	name string
+	ms   func() []*Measurement
+}
+
+// withBad returns a few level measurements, then bad, then a few more level measurements.
+func withBad(bad func(t float64) *Measurement) func() []*Measurement {
+	return func() (ms []*Measurement) {
+		for i := 0; i < 10; i++ {
+			ms = append(ms, levelMeasurement(float64(i)*0.1))
+		}
+		ms = append(ms, bad(1))
+		for i := 11; i < 20; i++ {
+			ms = append(ms, levelMeasurement(float64(i)*0.1))
+		}
+		return
+	}
+}
+
+var fuzzRegressions = []fuzzRegression{
+	// A gyro rate big enough to overflow the quaternion rotation
+	{"HugeGyroRate", withBad(func(t float64) (m *Measurement) {
+		m = levelMeasurement(t)
+		m.B3 = 8.55e270
+		return
+	})},
+	// NaN groundspeed went straight through math.Hypot into the attitude
+	{"NaNGroundspeed", withBad(func(t float64) (m *Measurement) {
+		m = levelMeasurement(t)
+		m.W1, m.W2, m.TW, m.WValid = math.NaN(), 100, t, true
+		return
+	})},
+	// Garbage GPS flagged invalid used to be stored and used for the rate of turn
+	{"InvalidGPSGarbage", withBad(func(t float64) (m *Measurement) {
+		m = levelMeasurement(t)
+		m.W1, m.W2, m.W3, m.TW = math.Inf(1), math.NaN(), 1e300, math.NaN()
+		return
+	})},
+	// Time jumping backwards integrated the gyro over a huge negative interval
+	{"TimeBackwards", withBad(func(t float64) (m *Measurement) {
+		m = levelMeasurement(-1e300)
+		m.B1 = 1
+		return
+	})},
+	{"HugeTime", withBad(func(t float64) *Measurement { return levelMeasurement(1.4e160) })},
+	// A provider that has never seen a usable measurement reported the NaN attitude of a zero quaternion
+	{"NeverInitialized", func() []*Measurement {
+		m := levelMeasurement(0)
+		m.M2 = 1e6
+		return []*Measurement{m}
+	}},
+}
+
+func TestFuzzRegressions(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+	for _, c := range fuzzRegressions {
+		for _, prov := range providers {
+			ms := c.ms()
+			p := prov.new(ms[0]).(fuzzable)
+			for _, m := range ms {
+				p.Compute(m)
+				fuzzOutputsOK(t, p, m)
+			}
+			if prov.name != "Simple" || len(ms) == 1 {
+				continue
+			}
+			// The Simple algorithm should shrug off a single bad measurement.
+			if !p.Valid() {
+				t.Errorf("%s: Simple provider didn't recover", c.name)
+			}
+			if roll, pitch, _ := p.RollPitchHeading(); math.Abs(roll) > Small || math.Abs(pitch) > Small {
+				t.Errorf("%s: Simple provider disturbed to roll %f°, pitch %f°", c.name, roll/Deg, pitch/Deg)
+			}
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package ahrs
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// The golden tests replay the measurement logs in testdata through each provider and compare every output
+// against testdata/golden/<log>_<provider>.csv, so that any change to the numerical results is noticed.
+// When a change is intended, regenerate the golden files with
+//
+//	UPDATE_GOLDEN=1 go test -run TestGolden
+//
+// and commit them along with it.
+// The logs are in the same format as the recorded logs read by the simulator.  These ones are simulated,
+// with sensor noise, gyro bias and GPS fixes once a second interpolated in between.
+var goldenLogs = []string{
+	"steepturn", // 45° bank turn at 100 kt
+	"gpsoutage", // Standard rate turn at 100 kt, with no GPS from 20 to 40 s
+	"taxi",      // Taxiing with unbanked turns and heavy vibration
+}
+
+// goldenTolerance is the largest difference in any output accepted as unchanged.
+const goldenTolerance = 1e-6
+
+var goldenColumns = []string{"T", "Roll", "Pitch", "Heading", "MagHeading", "SlipSkid", "RateOfTurn", "GLoad"}
+
+// goldenAngles marks the columns compared modulo 2π.
+var goldenAngles = map[string]bool{"Roll": true, "Heading": true, "MagHeading": true}
+
+// readMeasurementLog reads measurements from a CSV file with a header line of Measurement field names.
+// Unknown columns are ignored.
+func readMeasurementLog(fn string) (ms []*Measurement, err error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	recs, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(recs) < 2 {
+		return nil, fmt.Errorf("%s has no measurements", fn)
+	}
+	for n, rec := range recs[1:] {
+		m := NewMeasurement()
+		fields := map[string]*float64{
+			"T": &m.T, "TW": &m.TW, "W1": &m.W1, "W2": &m.W2, "W3": &m.W3,
+			"A1": &m.A1, "A2": &m.A2, "A3": &m.A3, "B1": &m.B1, "B2": &m.B2, "B3": &m.B3,
+			"M1": &m.M1, "M2": &m.M2, "M3": &m.M3,
+		}
+		flags := map[string]*bool{"WValid": &m.WValid, "MValid": &m.MValid}
+		for i, k := range recs[0] {
+			v, err := strconv.ParseFloat(rec[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %s", fn, n+2, err)
+			}
+			if p, ok := fields[k]; ok {
+				*p = v
+			} else if p, ok := flags[k]; ok {
+				*p = v != 0
+			}
+		}
+		m.SValid = true
+		ms = append(ms, m)
+	}
+	return
+}
+
+// goldenRun replays ms through p, returning a row of goldenColumns after each measurement.
+func goldenRun(p fuzzable, ms []*Measurement) (rows [][]float64) {
+	for _, m := range ms {
+		p.Compute(m)
+		roll, pitch, heading := p.RollPitchHeading()
+		rows = append(rows, []float64{m.T, roll, pitch, heading,
+			p.MagHeading(), p.SlipSkid(), p.RateOfTurn(), p.GLoad()})
+	}
+	return
+}
+
+func writeGolden(fn string, rows [][]float64) error {
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write(goldenColumns)
+	for _, row := range rows {
+		rec := make([]string, len(row))
+		for i, v := range row {
+			rec[i] = strconv.FormatFloat(v, 'g', 10, 64) // Plenty for goldenTolerance
+		}
+		w.Write(rec)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readGolden(fn string) (rows [][]float64, err error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	recs, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range recs[1:] {
+		row := make([]float64, len(rec))
+		for i := range rec {
+			if row[i], err = strconv.ParseFloat(rec[i], 64); err != nil {
+				return nil, err
+			}
+		}
+		rows = append(rows, row)
+	}
+	return
+}
+
+// compareGolden reports, for each output that differs from the golden run by more than goldenTolerance,
+// the largest difference and when it occurs.
+func compareGolden(t *testing.T, golden, rows [][]float64) {
+	if len(rows) != len(golden) {
+		t.Fatalf("got %d samples, golden file has %d", len(rows), len(golden))
+	}
+	for j := 1; j < len(goldenColumns); j++ {
+		var maxDev float64
+		var iMax, nBad int
+		for i := range rows {
+			a, b := rows[i][j], golden[i][j]
+			var dev float64
+			if math.IsNaN(a) || math.IsNaN(b) {
+				if math.IsNaN(a) && math.IsNaN(b) {
+					continue
+				}
+				dev = math.Inf(1)
+			} else if goldenAngles[goldenColumns[j]] && a != Invalid && b != Invalid {
+				dev = math.Abs(AngleDiff(a, b))
+			} else {
+				dev = math.Abs(a - b)
+			}
+			if dev > goldenTolerance {
+				nBad++
+			}
+			if dev > maxDev {
+				maxDev, iMax = dev, i
+			}
+		}
+		if nBad > 0 {
+			t.Errorf("%s differs at %d of %d samples, by up to %g at T=%.2f s: golden %g, got %g",
+				goldenColumns[j], nBad, len(rows), maxDev, golden[iMax][0], golden[iMax][j], rows[iMax][j])
+		}
+	}
+}
+
+func TestGolden(t *testing.T) {
+	update := os.Getenv("UPDATE_GOLDEN") != ""
+	w := log.Writer()
+	t.Cleanup(func() { log.SetOutput(w) })
+	log.SetOutput(ioutil.Discard)
+
+	for _, name := range goldenLogs {
+		for _, prov := range providers {
+			name, prov := name, prov
+			t.Run(name+"/"+prov.name, func(t *testing.T) {
+				if testing.Short() && !update && (prov.name == "Kalman0" || prov.name == "Kalman1") {
+					t.Skip("skipping slow provider in short mode")
+				}
+				t.Parallel()
+				// Each run needs its own copy, since the Kalman filters accumulate statistics in the measurements.
+				ms, err := readMeasurementLog(filepath.Join("testdata", name+".csv"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				rows := goldenRun(prov.new(ms[0]).(fuzzable), ms)
+				fn := filepath.Join("testdata", "golden", name+"_"+prov.name+".csv")
+				if update {
+					if err := writeGolden(fn, rows); err != nil {
+						t.Fatal(err)
+					}
+					t.Logf("updated %s", fn)
+					return
+				}
+				golden, err := readGolden(fn)
+				if err != nil {
+					t.Fatalf("%s; run with UPDATE_GOLDEN=1 to create it", err)
+				}
+				compareGolden(t, golden, rows)
+			})
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package ahrs
+
+// InterpolateGPS fills in the GPS velocity of the measurements ms lying between GPS fixes,
+// for sensors sampled much faster than the GPS.  A fix is a measurement with WValid set; ms must be in time order.
+// Each measurement between two fixes gets W1, W2 and W3 linearly interpolated to its time T from the fix times TW,
+// with TW set to T and WValid set.  Measurements before the first fix or after the last one have no fixes
+// to interpolate between, so they are left as they are.
+func InterpolateGPS(ms []*Measurement) {
+	prev := -1 // Index of the last fix seen
+	for i, m := range ms {
+		if !m.WValid {
+			continue
+		}
+		if prev >= 0 {
+			a := ms[prev]
+			for _, mm := range ms[prev+1 : i] {
+				f := 0.0
+				if m.TW > a.TW {
+					f = (mm.T - a.TW) / (m.TW - a.TW)
+				}
+				mm.W1 = a.W1 + f*(m.W1-a.W1)
+				mm.W2 = a.W2 + f*(m.W2-a.W2)
+				mm.W3 = a.W3 + f*(m.W3-a.W3)
+				mm.TW = mm.T
+				mm.WValid = true
+			}
+		}
+		prev = i
+	}
+}
+
+const gpsFixHistory = 32 // GPS fixes kept by a gpsAligner
+
+// gpsFix is a GPS velocity, kt, at time t, s, on the IMU clock.
+type gpsFix struct {
+	t, w1, w2, w3 float64
+}
+
+// gpsAligner holds the latest GPS fixes, timed on the IMU clock, to give the GPS velocity at any IMU time
+// when the GPS clock is offset from it.
+type gpsAligner struct {
+	fixes [gpsFixHistory]gpsFix // Oldest first
+	n     int
+}
+
+// add adds the fix w1, w2, w3 at time t unless it is no newer than the latest, dropping the oldest if full.
+func (a *gpsAligner) add(t, w1, w2, w3 float64) {
+	if a.n > 0 && t <= a.fixes[a.n-1].t {
+		return
+	}
+	if a.n == len(a.fixes) {
+		copy(a.fixes[:], a.fixes[1:])
+		a.n--
+	}
+	a.fixes[a.n] = gpsFix{t, w1, w2, w3}
+	a.n++
+}
+
+// at returns the GPS velocity at time t: interpolated between the fixes either side of it, or held at
+// the oldest fix before them all.  Beyond the latest fix it is extrapolated from the latest one and an
+// earlier one, if possible at least as far back as t is ahead so as not to magnify the GPS noise much.
+func (a *gpsAligner) at(t float64) (w1, w2, w3 float64) {
+	if a.n == 0 {
+		return
+	}
+	p, q := a.fixes[0], a.fixes[a.n-1]
+	switch {
+	case a.n == 1 || t <= p.t:
+		return p.w1, p.w2, p.w3
+	case t <= q.t:
+		i := 1
+		for a.fixes[i].t < t {
+			i++
+		}
+		p, q = a.fixes[i-1], a.fixes[i]
+	default:
+		for i := a.n - 2; i >= 0; i-- {
+			p = a.fixes[i]
+			if q.t-p.t >= t-q.t {
+				break
+			}
+		}
+	}
+	k := (t - p.t) / (q.t - p.t)
+	return p.w1 + k*(q.w1-p.w1), p.w2 + k*(q.w2-p.w2), p.w3 + k*(q.w3-p.w3)
+}
@@ -0,0 +1,91 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+func TestInterpolateGPS(t *testing.T) {
+	// Gyro at 100 Hz, GPS at 1 Hz starting at 0.5 s, accelerating east at 2 kt/s while climbing at 1 kt/s/s
+	var ms []*Measurement
+	for i := 0; i <= 300; i++ {
+		m := new(Measurement)
+		m.T = float64(i) / 100
+		m.SValid = true
+		if i%100 == 50 {
+			m.W1, m.W2, m.W3 = 2*m.T, 100, m.T
+			m.TW = m.T
+			m.WValid = true
+		}
+		ms = append(ms, m)
+	}
+	InterpolateGPS(ms)
+
+	for i, m := range ms {
+		switch {
+		case m.T < 0.5:
+			if m.WValid {
+				t.Errorf("sample at %4.2f s is before the first fix, shouldn't have WValid set", m.T)
+			}
+		case m.T <= 2.5:
+			if !m.WValid || m.TW != m.T {
+				t.Errorf("sample %d at %4.2f s should carry interpolated GPS at its own time", i, m.T)
+			}
+			if math.Abs(m.W1-2*m.T) > 1e-9 || m.W2 != 100 || math.Abs(m.W3-m.T) > 1e-9 {
+				t.Errorf("at %4.2f s interpolated W was (%f, %f, %f), expected (%f, 100, %f)",
+					m.T, m.W1, m.W2, m.W3, 2*m.T, m.T)
+			}
+		default:
+			if m.WValid || m.W1 != 0 || m.W2 != 0 || m.W3 != 0 {
+				t.Errorf("sample at %4.2f s is after the last fix, should be left as it was", m.T)
+			}
+		}
+	}
+}
+
+func TestInterpolateGPSOutageAtEnd(t *testing.T) {
+	// GPS at 1 Hz for the first 2 s of 5, then lost; the receiver keeps reporting its last velocity, marked invalid.
+	var ms []*Measurement
+	for i := 0; i <= 500; i++ {
+		m := new(Measurement)
+		m.T = float64(i) / 100
+		m.SValid = true
+		m.W1, m.W2, m.W3, m.TW = 50, 100, 0, math.Min(math.Floor(m.T), 2)
+		m.WValid = i%100 == 0 && m.T <= 2
+		ms = append(ms, m)
+	}
+	InterpolateGPS(ms)
+
+	for _, m := range ms {
+		if m.T > 2 && (m.WValid || m.TW != 2 || m.W1 != 50 || m.W2 != 100) {
+			t.Errorf("sample at %4.2f s is in the outage, should be left as it was, got WValid %t, TW %f, W (%f, %f)",
+				m.T, m.WValid, m.TW, m.W1, m.W2)
+		}
+	}
+}
+
+func TestGPSAligner(t *testing.T) {
+	var a gpsAligner
+	// Fixes once a second from 1 s, accelerating east at 2 kt/s
+	for i := 1; i <= 3; i++ {
+		a.add(float64(i), 2*float64(i), 100, 0)
+		a.add(float64(i), 0, 0, 0) // Repeated fix, ignored
+	}
+	for _, c := range []struct{ t, w1 float64 }{
+		{0, 2},   // Held before the first fix
+		{1.5, 3}, // Interpolated
+		{3, 6},
+		{4.5, 9}, // Extrapolated
+	} {
+		if w1, w2, _ := a.at(c.t); math.Abs(w1-c.w1) > 1e-9 || w2 != 100 {
+			t.Errorf("at %.1f s W was (%f, %f), expected (%f, 100)", c.t, w1, w2, c.w1)
+		}
+	}
+
+	for i := 4; i < 4+gpsFixHistory; i++ {
+		a.add(float64(i), 2*float64(i), 100, 0)
+	}
+	if a.n != gpsFixHistory || a.fixes[0].t != 4 {
+		t.Errorf("expected the latest %d fixes from 4 s, got %d from %f s", gpsFixHistory, a.n, a.fixes[0].t)
+	}
+}
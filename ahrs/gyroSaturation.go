@@ -0,0 +1,83 @@
+package ahrs
+
+import "math"
+
+const (
+	gyroSaturationMargin = 0.98  // Fraction of the full-scale range at which a gyro rate counts as saturated
+	gyroSaturationRate   = 100.0 // Error, 1σ, °/s, taken in a saturated gyro rate, which may be far beyond the range
+	gyroSaturationBoost  = 10.0  // Factor by which the reversion to the references is sped up right after a saturation
+)
+
+// gyroSaturation tracks the gyro rates reaching the full-scale range of the sensor, beyond which they clip
+// and the attitude integrated from them goes wrong.
+type gyroSaturation struct {
+	limits     [3]float64 // Full-scale range of each gyro axis, °/s; 0 for unlimited
+	recovery   float64    // Time after a saturation over which to revert faster to the references, s; 0 not to
+	axes       [3]bool    // Axes saturated in the latest reading
+	count      int        // Number of saturations, each lasting until all the axes are back within range
+	tEnd       float64    // Time when the latest saturation ended
+	onSaturate func(t float64, axes [3]bool)
+}
+
+// SetGyroFullScale sets the full-scale range of each gyro axis, °/s, e.g. 250 for a ±250 °/s setting.
+// A rate at or near it is taken to have clipped: the providers tracking their uncertainty inflate it,
+// and the saturation is counted and reported.  A range of 0 leaves that axis unchecked, as by default.
+func (s *State) SetGyroFullScale(r1, r2, r3 float64) {
+	s.gyroSat.limits = [3]float64{r1, r2, r3}
+}
+
+// SetGyroSaturationRecovery sets the time, s, after a saturation over which the providers revert faster
+// towards their GPS and accelerometer references, to shed the attitude error sooner.  0, the default,
+// leaves their reversion unchanged.
+func (s *State) SetGyroSaturationRecovery(t float64) {
+	s.gyroSat.recovery = t
+}
+
+// SetGyroSaturationCallback sets a function to be called from Compute, or the Simple algorithm's
+// UpdateGyro, whenever the gyro starts to saturate, with the time and the saturated axes.
+func (s *State) SetGyroSaturationCallback(f func(t float64, axes [3]bool)) {
+	s.gyroSat.onSaturate = f
+}
+
+// CalcGyroSaturations returns the number of times the gyro has saturated, and whether it is now.
+func (s *State) CalcGyroSaturations() (n int, saturated bool) {
+	a := s.gyroSat.axes
+	return s.gyroSat.count, a[0] || a[1] || a[2]
+}
+
+// checkGyroSaturation records which gyro rates of m are at their full-scale range and returns them,
+// along with whether any is.
+func (s *State) checkGyroSaturation(m *Measurement) (axes [3]bool, saturated bool) {
+	return s.checkGyroRates(m.B1, m.B2, m.B3, m.T)
+}
+
+// checkGyroRates does the work of checkGyroSaturation for the gyro rates b1, b2, b3, °/s, read at time t, s.
+func (s *State) checkGyroRates(b1, b2, b3, t float64) (axes [3]bool, saturated bool) {
+	g := &s.gyroSat
+	was := g.axes[0] || g.axes[1] || g.axes[2]
+	for i, b := range [3]float64{b1, b2, b3} {
+		axes[i] = g.limits[i] > 0 && math.Abs(b) >= gyroSaturationMargin*g.limits[i]
+		saturated = saturated || axes[i]
+	}
+	g.axes = axes
+	switch {
+	case saturated && !was:
+		g.count++
+		if g.onSaturate != nil {
+			g.onSaturate(t, axes)
+		}
+	case was && !saturated:
+		g.tEnd = t
+	}
+	return
+}
+
+// saturationBoost returns the factor by which to speed up the reversion to the references at time t:
+// gyroSaturationBoost right after a saturation, falling back to 1 over the recovery time.
+func (s *State) saturationBoost(t float64) float64 {
+	g := &s.gyroSat
+	if g.recovery <= 0 || g.count == 0 || g.axes[0] || g.axes[1] || g.axes[2] || t-g.tEnd >= g.recovery {
+		return 1
+	}
+	return 1 + (gyroSaturationBoost-1)*(1-(t-g.tEnd)/g.recovery)
+}
@@ -0,0 +1,102 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+// withGyroClip clips the gyro rates in ms at ±limit, °/s, as a gyro with that full-scale range would.
+func withGyroClip(ms []*Measurement, limit float64) []*Measurement {
+	for _, m := range ms {
+		m.B1 = math.Max(-limit, math.Min(limit, m.B1))
+		m.B2 = math.Max(-limit, math.Min(limit, m.B2))
+		m.B3 = math.Max(-limit, math.Min(limit, m.B3))
+	}
+	return ms
+}
+
+// recoveryTime runs p along path over ms and returns the time after t1 until the roll error last
+// exceeded 5°, along with the roll uncertainty, °, at t1.
+func recoveryTime(p AHRSProvider, path flightPath, t1 float64, ms []*Measurement) (tr, droll float64) {
+	droll = math.NaN()
+	for _, m := range ms {
+		p.Compute(m)
+		if m.T < t1 {
+			continue
+		}
+		if math.IsNaN(droll) {
+			droll, _, _ = p.(interface {
+				RollPitchHeadingUncertainty() (float64, float64, float64)
+			}).RollPitchHeadingUncertainty()
+			droll /= Deg
+		}
+		roll, _, _ := p.GetState().CalcRollPitchHeading()
+		rr, _, _, _, _, _ := path(m.T)
+		if angleErr(roll, rr/Deg) > 5 {
+			tr = m.T - t1
+		}
+	}
+	return
+}
+
+func TestGyroSaturation(t *testing.T) {
+	const limit = 150
+	const t1 = 20 + 360.0/270 // End of the roll
+	path := rollPath(20, 270*Deg)
+
+	for _, c := range []struct {
+		name string
+		new  func() AHRSProvider
+	}{
+		{"EKF", func() AHRSProvider { return NewEKFAHRS() }},
+		{"Simple", func() AHRSProvider {
+			s := NewSimpleAHRS()
+			s.SetGyroSaturationRecovery(10)
+			return s
+		}},
+	} {
+		unaware := c.new()
+		tUnaware, dUnaware := recoveryTime(unaware, path, t1, withGyroClip(simMeasurements(path, 0, 120, 0.05), limit))
+
+		aware := c.new()
+		aware.GetState().SetGyroFullScale(limit, limit, limit)
+		var events int
+		aware.GetState().SetGyroSaturationCallback(func(tt float64, axes [3]bool) {
+			events++
+			if tt < 20 || tt > 22 || !axes[0] || axes[1] || axes[2] {
+				t.Errorf("%s: saturation reported at %.2f s on axes %v", c.name, tt, axes)
+			}
+		})
+		tAware, dAware := recoveryTime(aware, path, t1, withGyroClip(simMeasurements(path, 0, 120, 0.05), limit))
+		t.Logf("%s: roll recovered %.1f s after the maneuver, %.1f s knowing the gyro saturated; roll uncertainty %.1f°, %.1f°",
+			c.name, tUnaware, tAware, dUnaware, dAware)
+
+		if n, saturated := aware.GetState().CalcGyroSaturations(); n != 1 || saturated || events != 1 {
+			t.Errorf("%s: counted %d saturations, %d events, still saturated %v; expected one", c.name, n, events, saturated)
+		}
+		if !math.IsNaN(dUnaware) && dAware < 5*dUnaware {
+			t.Errorf("%s: roll uncertainty %.1f° after a saturation, %.1f° without knowing of it", c.name, dAware, dUnaware)
+		}
+		if tAware > tUnaware/2 {
+			t.Errorf("%s: roll took %.1f s to recover knowing the gyro saturated, %.1f s without", c.name, tAware, tUnaware)
+		}
+	}
+}
+
+func TestKalmanInflateAttitude(t *testing.T) {
+	s := InitializeKalman(simMeasurement(straightPath(100, 0), 0, 0.1))
+	s.E0, s.E1, s.E2, s.E3 = 1, 0, 0, 0
+	m0 := s.M.Copy()
+	s.inflateAttitude([3]bool{true, false, false}, 0.1)
+	// Level, a roll of δ changes E1 by δ/2, so its standard deviation grows by half the roll error.
+	if v, expected := s.M.Get(7, 7), math.Pow(math.Sqrt(m0.Get(7, 7))+gyroSaturationRate*Deg*0.1/2, 2); math.Abs(v-expected) > 1e-12 {
+		t.Errorf("variance of E1 inflated to %g, expected %g", v, expected)
+	}
+	for i := 6; i < 10; i++ {
+		for j := 6; j < 10; j++ {
+			if (i != 7 || j != 7) && s.M.Get(i, j) != m0.Get(i, j) {
+				t.Errorf("covariance of E%d, E%d changed from %g to %g by a roll saturation", i-6, j-6, m0.Get(i, j), s.M.Get(i, j))
+			}
+		}
+	}
+}
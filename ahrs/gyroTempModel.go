@@ -0,0 +1,109 @@
+package ahrs
+
+import "math"
+
+const (
+	gyroTempTau    = 600.0 // Time constant over which the gyro bias vs temperature is fitted, s
+	gyroTempSpread = 2.0   // Standard deviation of the temperature over the fit needed to learn the slope, °C
+)
+
+// GyroTempModel is a linear model of the gyro biases vs temperature: on axis i the bias at temperature t,
+// °C, is B0[i] + B1[i]*(t-T0), °/s, sensor frame.
+// The providers that estimate the gyro biases (EKF, UKF, Mahony and Kalman) can use it to follow the
+// biases as the sensor warms up, while slowly learning it in flight from their own estimates.
+// It can be saved and restored with the State, to start the next flight with it, or seeded from a bench
+// calibration with TempComp.GyroTempModel.
+type GyroTempModel struct {
+	Enabled bool       // Whether the model is applied and learned
+	Fitted  bool       // Whether B0 and B1 hold a fit, learned or given, rather than starting from scratch
+	T0      float64    // Reference temperature, °C
+	B0, B1  [3]float64 // Gyro biases at T0, °/s, and their change per °C, °/s/°C
+}
+
+// Bias returns the gyro biases, °/s, predicted by the model at the temperature temp, °C.
+func (tm *GyroTempModel) Bias(temp float64) (b1, b2, b3 float64) {
+	dt := temp - tm.T0
+	return tm.B0[0] + tm.B1[0]*dt, tm.B0[1] + tm.B1[1]*dt, tm.B0[2] + tm.B1[2]*dt
+}
+
+// gyroTempFit holds exponentially decaying, time-weighted sums of the temperature, relative to T0,
+// and of the estimated gyro biases, from which GyroTempModel is fitted by least squares.
+type gyroTempFit struct {
+	started bool
+	t, temp float64    // Time of the last reading, and the temperature the compensation was last brought to
+	w       float64    // Sum of the weights
+	x, xx   float64    // Weighted sums of the temperature and its square
+	y, xy   [3]float64 // Weighted sums of the biases and their products with the temperature
+}
+
+// add adds the temperature x and the biases y, weighted by the time dt since the last reading.
+func (f *gyroTempFit) add(dt, x float64, y [3]float64) {
+	k := math.Exp(-dt / gyroTempTau)
+	f.w = k*f.w + dt
+	f.x = k*f.x + dt*x
+	f.xx = k*f.xx + dt*x*x
+	for i := range y {
+		f.y[i] = k*f.y[i] + dt*y[i]
+		f.xy[i] = k*f.xy[i] + dt*x*y[i]
+	}
+}
+
+// GyroTempModel returns the gyro bias vs temperature model, as given or learned so far.
+func (s *State) GyroTempModel() GyroTempModel {
+	return s.tempModel
+}
+
+// SetGyroTempModel sets the gyro bias vs temperature model to tm and starts learning it over.
+// If tm is Fitted, the gyro biases are set from it at the next valid temperature.
+func (s *State) SetGyroTempModel(tm GyroTempModel) {
+	s.tempModel = tm
+	s.tempFit = gyroTempFit{}
+}
+
+// updateGyroTemp moves the gyro biases D along with the temperature of m as the model predicts, and
+// learns the model from b1, b2, b3, the provider's current estimate of the gyro biases, °/s, sensor frame.
+// Without a valid temperature the compensation is frozen at its last value.
+func (s *State) updateGyroTemp(m *Measurement, b1, b2, b3 float64) {
+	tm, f := &s.tempModel, &s.tempFit
+	if !tm.Enabled {
+		return
+	}
+	dt := m.T - f.t
+	f.t = m.T
+	if !m.TempValid || !(math.Abs(m.Temp) <= maxPlausibleTemp) {
+		return
+	}
+
+	if !f.started {
+		if tm.Fitted {
+			p1, p2, p3 := tm.Bias(m.Temp)
+			s.D1, s.D2, s.D3 = s.D1+p1-b1, s.D2+p2-b2, s.D3+p3-b3
+		} else {
+			tm.T0, tm.B0 = m.Temp, [3]float64{b1, b2, b3}
+		}
+		*f = gyroTempFit{started: true, t: m.T, temp: m.Temp}
+		return
+	}
+
+	d := m.Temp - f.temp
+	f.temp = m.Temp
+	s.D1 += tm.B1[0] * d
+	s.D2 += tm.B1[1] * d
+	s.D3 += tm.B1[2] * d
+	if dt <= 0 {
+		return
+	}
+
+	f.add(dt, m.Temp-tm.T0, [3]float64{b1 + tm.B1[0]*d, b2 + tm.B1[1]*d, b3 + tm.B1[2]*d})
+	mx := f.x / f.w
+	vx := f.xx/f.w - mx*mx
+	if vx < gyroTempSpread*gyroTempSpread {
+		return
+	}
+	for i := range tm.B1 {
+		my := f.y[i] / f.w
+		tm.B1[i] = (f.xy[i]/f.w - mx*my) / vx
+		tm.B0[i] = my - tm.B1[i]*mx
+	}
+	tm.Fitted = true
+}
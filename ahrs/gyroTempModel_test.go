@@ -0,0 +1,122 @@
+package ahrs
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+// Gyro biases of the simulated sensor at 10 °C, °/s, and their change per °C, °/s/°C
+var (
+	warmUpB0    = [3]float64{0.1, -0.2, 0.3}
+	warmUpSlope = [3]float64{0.01, -0.015, 0.02}
+)
+
+// warmUpTemp returns the temperature, °C, of a sensor warming up by 30 °C from 10 °C after time t, s.
+func warmUpTemp(t float64) float64 {
+	return 10 + 30*(1-math.Exp(-t/400))
+}
+
+// withWarmUp adds the temperature of a warming sensor to ms and the gyro biases that follow it.
+func withWarmUp(ms []*Measurement) []*Measurement {
+	for _, m := range ms {
+		m.Temp, m.TempValid = warmUpTemp(m.T), true
+		dt := m.Temp - 10
+		m.B1 += warmUpB0[0] + warmUpSlope[0]*dt
+		m.B2 += warmUpB0[1] + warmUpSlope[1]*dt
+		m.B3 += warmUpB0[2] + warmUpSlope[2]*dt
+	}
+	return ms
+}
+
+// headingDrift returns the largest heading error, °, of p flying ms along path.
+func headingDrift(p AHRSProvider, path flightPath, ms []*Measurement) (drift float64) {
+	for _, m := range ms {
+		p.Compute(m)
+		_, _, heading := p.GetState().CalcRollPitchHeading()
+		_, _, hh, _, _, _ := path(m.T)
+		drift = math.Max(drift, math.Abs(angleErr(heading, hh/Deg)))
+	}
+	return
+}
+
+func TestGyroTempModel(t *testing.T) {
+	path := straightPath(100, 0)
+
+	// A first flight with a magnetometer lets Mahony estimate all the biases and learn how they follow
+	// the temperature.
+	s := NewMahonyAHRS()
+	s.SetGyroTempModel(GyroTempModel{Enabled: true})
+	for _, m := range withWarmUp(withMagnetometer(simMeasurements(path, 0, 1800, 0.1), path)) {
+		s.Compute(m)
+	}
+	tm := s.GyroTempModel()
+	t.Logf("learned model %+v", tm)
+	if !tm.Fitted {
+		t.Fatal("model not fitted over a warm-up")
+	}
+	for i := range tm.B1 {
+		if math.Abs(tm.B1[i]-warmUpSlope[i]) > 0.2*math.Abs(warmUpSlope[i]) {
+			t.Errorf("learned a slope of %.4f °/s/°C on axis %d, expected %.4f", tm.B1[i], i+1, warmUpSlope[i])
+		}
+	}
+
+	// The model is saved with the state and used in the next flight, where without a magnetometer
+	// the heading follows the gyros alone.
+	b, err := json.Marshal(s.GetState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved State
+	if err := json.Unmarshal(b, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.GyroTempModel() != tm {
+		t.Fatalf("model saved as %+v", saved.GyroTempModel())
+	}
+
+	flight := func(tm GyroTempModel) float64 {
+		s := NewMahonyAHRS()
+		s.SetGyroTempModel(tm)
+		s.D1, s.D2, s.D3 = warmUpB0[0], warmUpB0[1], warmUpB0[2] // Calibrated when cold
+		return headingDrift(s, path, withWarmUp(simMeasurements(path, 0, 600, 0.1)))
+	}
+	fixed, compensated := flight(GyroTempModel{}), flight(saved.GyroTempModel())
+	t.Logf("heading drift %.1f° with fixed biases, %.1f° compensated for temperature", fixed, compensated)
+	if compensated > fixed/10 {
+		t.Errorf("heading drifted by %.1f° compensated for temperature, %.1f° with fixed biases", compensated, fixed)
+	}
+}
+
+func TestGyroTempModelFrozen(t *testing.T) {
+	s := new(State)
+	s.SetGyroTempModel(GyroTempModel{Enabled: true, Fitted: true, T0: 10, B0: warmUpB0, B1: warmUpSlope})
+	m := NewMeasurement()
+	step := func(i int, valid bool) {
+		m.T, m.Temp, m.TempValid = float64(i), 10+float64(i)/10, valid
+		s.updateGyroTemp(m, s.D1, s.D2, s.D3)
+	}
+	check := func(temp float64) {
+		t.Helper()
+		b1, b2, b3 := s.CalcGyroBias()
+		p1, p2, p3 := s.tempModel.Bias(temp)
+		if math.Abs(b1-p1) > 1e-9 || math.Abs(b2-p2) > 1e-9 || math.Abs(b3-p3) > 1e-9 {
+			t.Errorf("biases %f, %f, %f compensated for %.1f °C, expected %f, %f, %f", b1, b2, b3, temp, p1, p2, p3)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		step(i, true)
+	}
+	check(19.9)
+	tm := s.GyroTempModel()
+	for i := 100; i < 200; i++ {
+		step(i, false)
+	}
+	check(19.9)
+	if s.GyroTempModel() != tm {
+		t.Errorf("model learned without a temperature: %+v, was %+v", s.GyroTempModel(), tm)
+	}
+	step(200, true)
+	check(30)
+}
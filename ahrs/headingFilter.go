@@ -0,0 +1,59 @@
+package ahrs
+
+import "math"
+
+// HeadingFilter fuses a gyro yaw rate with a magnetometer heading, independently of a full AHRS, e.g. for
+// a standalone magnetometer mounted in the tail away from the panel's interference.  The gyro carries the
+// heading over short times and the magnetometer corrects it over longer ones, the blend crossing over at
+// the time constant.  A gyro yaw-rate bias leaves the heading behind by the bias times the time constant.
+type HeadingFilter struct {
+	tau     float64 // Time constant of the blend, s
+	heading float64 // Fused heading, °
+	started bool    // Whether heading has been set from the magnetometer
+}
+
+// NewHeadingFilter returns a HeadingFilter that blends over the time constant tau, in seconds.
+func NewHeadingFilter(tau float64) *HeadingFilter {
+	return &HeadingFilter{tau: tau}
+}
+
+// Update advances the heading by the gyro yaw rate, °/s positive to the right, over dt seconds,
+// pulls it toward the magnetometer heading magHeading, in degrees, if magValid, and returns it in [0, 360).
+// The first valid magnetometer heading is taken as it is; until then the heading is Invalid.
+func (f *HeadingFilter) Update(gyroYawRate, magHeading float64, magValid bool, dt float64) float64 {
+	if !f.started {
+		if !magValid {
+			return Invalid
+		}
+		f.heading, f.started = magHeading, true
+		return f.wrap()
+	}
+	if dt > 0 {
+		f.heading += gyroYawRate * dt
+		if magValid {
+			k := 1.0
+			if f.tau > 0 {
+				k = 1 - math.Exp(-dt/f.tau)
+			}
+			f.heading += RadToDeg(k * AngleDiff(DegToRad(magHeading), DegToRad(f.heading)))
+		}
+	}
+	return f.wrap()
+}
+
+// Heading returns the fused heading in degrees, in [0, 360), or Invalid before the first magnetometer heading.
+func (f *HeadingFilter) Heading() float64 {
+	if !f.started {
+		return Invalid
+	}
+	return f.heading
+}
+
+// wrap brings the heading into [0, 360) and returns it.
+func (f *HeadingFilter) wrap() float64 {
+	f.heading = math.Mod(f.heading, 360)
+	if f.heading < 0 {
+		f.heading += 360
+	}
+	return f.heading
+}
@@ -0,0 +1,36 @@
+package ahrs
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestHeadingFilter(t *testing.T) {
+	const dt, tau, bias = 0.05, 5.0, 0.05 // s, s, °/s
+	rng := rand.New(rand.NewSource(1))
+	f := NewHeadingFilter(tau)
+	if h := f.Update(0, 0, false, dt); h != Invalid {
+		t.Errorf("expected an Invalid heading before the magnetometer, got %f", h)
+	}
+
+	// Turning at 3°/s through north a few times, with a noisy magnetometer reading every other step.
+	var maxErr, rawErr float64
+	for i := 0; i < 4000; i++ {
+		tt := float64(i) * dt
+		truth := math.Mod(350+3*tt, 360)
+		mag := math.Mod(truth+5*rng.NormFloat64()+360, 360)
+		h := f.Update(3+bias, mag, i%2 == 0, dt)
+		if h < 0 || h >= 360 {
+			t.Fatalf("heading %f out of [0, 360) at %.2f s", h, tt)
+		}
+		if tt > 5*tau {
+			maxErr = math.Max(maxErr, angleErr(h, truth))
+			rawErr = math.Max(rawErr, angleErr(mag, truth))
+		}
+	}
+	t.Logf("Largest heading error: %.2f° fused, %.2f° magnetometer", maxErr, rawErr)
+	if maxErr > 2 {
+		t.Errorf("expected the fused heading to track truth within 2°, but it was off by %.2f°", maxErr)
+	}
+}
@@ -0,0 +1,81 @@
+package ahrs
+
+import (
+	"log"
+	"math"
+)
+
+// RateUnit is the unit of the gyro rates fed to SetIMU.
+type RateUnit int
+
+const (
+	DegreesPerSecond RateUnit = iota // °/s, the unit of Measurement
+	RadiansPerSecond                 // rad/s, as from most sensor drivers
+)
+
+// AccelUnit is the unit of the accelerations fed to SetIMU.
+type AccelUnit int
+
+const (
+	Gs                     AccelUnit = iota // G, the unit of Measurement
+	MetersPerSecondSquared                  // m/s²
+)
+
+// standardGravity is the acceleration due to gravity, m/s², that converts between m/s² and G.
+const standardGravity = 9.80665
+
+// SetIMU sets the accelerometer readings a1, a2, a3, in accel, and the gyro rates b1, b2, b3, in rate, of m,
+// converting them into the G and °/s of a Measurement, and marks them valid.
+func (m *Measurement) SetIMU(accel AccelUnit, a1, a2, a3 float64, rate RateUnit, b1, b2, b3 float64) {
+	if accel == MetersPerSecondSquared {
+		a1, a2, a3 = a1/standardGravity, a2/standardGravity, a3/standardGravity
+	}
+	if rate == RadiansPerSecond {
+		b1, b2, b3 = RadToDeg(b1), RadToDeg(b2), RadToDeg(b3)
+	}
+	m.A1, m.A2, m.A3 = a1, a2, a3
+	m.B1, m.B2, m.B3 = b1, b2, b3
+	m.SValid = true
+}
+
+const (
+	gyroUnitMinTurn  = 90 * Deg // Change of track, rad, needed before comparing it with the gyro
+	gyroUnitMinRatio = 20       // Ratio of track change to gyro turn above which the gyro is taken to be in rad/s
+)
+
+// GyroUnitCheck watches for gyro rates given in rad/s rather than °/s, which leave the attitude sluggish
+// rather than obviously broken.  It compares the turn integrated from the gyro, about the vertical as given
+// by the accelerometer, with the change in the GPS track: given in rad/s, the gyro turns about 57 times too little.
+type GyroUnitCheck struct {
+	track, gyro float64 // Total change in GPS track and turn from the gyro, rad, unsigned
+	w1, w2, t   float64 // Previous GPS velocity and sensor time
+	started     bool
+	suspect     bool
+}
+
+// Check records m and returns whether its gyro rates appear to be in rad/s, logging a warning the first time.
+// It needs valid GPS and sensor readings and 90° of turning before it can tell.
+func (c *GyroUnitCheck) Check(m *Measurement) bool {
+	gs := math.Hypot(m.W1, m.W2)
+	if m.WUnits == MetersPerSecond {
+		gs = MSToKnots(gs)
+	}
+	if !m.WValid || !m.SValid || gs < minGSDefault {
+		return c.suspect
+	}
+	if c.started {
+		if dt := m.T - c.t; dt > 0 {
+			if a := math.Sqrt(m.A1*m.A1 + m.A2*m.A2 + m.A3*m.A3); a > 0 {
+				c.gyro += math.Abs(DegToRad(m.B1*m.A1+m.B2*m.A2+m.B3*m.A3) / a * dt)
+			}
+			c.track += math.Abs(AngleDiff(math.Atan2(m.W1, m.W2), math.Atan2(c.w1, c.w2)))
+		}
+	}
+	c.w1, c.w2, c.t, c.started = m.W1, m.W2, m.T, true
+	if !c.suspect && c.track > gyroUnitMinTurn && c.track > gyroUnitMinRatio*c.gyro {
+		c.suspect = true
+		log.Printf("AHRS Warning: the gyro turned %.1f° while the GPS track turned %.1f°; "+
+			"are its rates in rad/s rather than °/s?\n", RadToDeg(c.gyro), RadToDeg(c.track))
+	}
+	return c.suspect
+}
@@ -0,0 +1,56 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSetIMUUnits(t *testing.T) {
+	// The same steep turn fed in °/s and G, and in rad/s and m/s²
+	ms := simMeasurements(turnPath(100, 0, 10, 3*Deg), 0, 60, 0.05)
+	s, r := NewSimpleAHRS(), NewSimpleAHRS()
+	for _, m := range ms {
+		mr := *m
+		mr.SetIMU(MetersPerSecondSquared, m.A1*standardGravity, m.A2*standardGravity, m.A3*standardGravity,
+			RadiansPerSecond, DegToRad(m.B1), DegToRad(m.B2), DegToRad(m.B3))
+		s.Compute(m)
+		r.Compute(&mr)
+
+		roll, pitch, heading := s.CalcRollPitchHeading()
+		rollR, pitchR, headingR := r.CalcRollPitchHeading()
+		if math.Abs(roll-rollR) > 1e-6 || math.Abs(pitch-pitchR) > 1e-6 || angleErr(heading, headingR) > 1e-6 {
+			t.Fatalf("at %.2f s, attitude %f, %f, %f in °/s but %f, %f, %f in rad/s",
+				m.T, roll, pitch, heading, rollR, pitchR, headingR)
+		}
+	}
+}
+
+func TestGyroUnitCheck(t *testing.T) {
+	for _, rad := range []bool{false, true} {
+		var c GyroUnitCheck
+		var suspect bool
+		for _, m := range simMeasurements(turnPath(100, 0, 10, 3*Deg), 0, 60, 0.05) {
+			if rad {
+				m.B1, m.B2, m.B3 = DegToRad(m.B1), DegToRad(m.B2), DegToRad(m.B3)
+			}
+			suspect = c.Check(m)
+		}
+		if suspect != rad {
+			t.Errorf("gyro in rad/s: %t, but suspected %t", rad, suspect)
+		}
+	}
+}
+
+func TestGyroUnitCheckWUnits(t *testing.T) {
+	// A slow turn at 8 kt, under the minimum groundspeed if its 4.1 m/s were mistaken for knots
+	var c GyroUnitCheck
+	var suspect bool
+	for _, m := range simMeasurements(turnPath(8, 0, 10, 3*Deg), 0, 60, 0.05) {
+		m.B1, m.B2, m.B3 = DegToRad(m.B1), DegToRad(m.B2), DegToRad(m.B3)
+		m.W1, m.W2, m.W3, m.WUnits = KnotsToMS(m.W1), KnotsToMS(m.W2), KnotsToMS(m.W3), MetersPerSecond
+		suspect = c.Check(m)
+	}
+	if !suspect {
+		t.Error("gyro in rad/s not suspected with the GPS velocity in m/s")
+	}
+}
@@ -0,0 +1,69 @@
+package ahrs
+
+import "fmt"
+
+// kalmanVector returns pointers to the 32 variables of s in the order of the Kalman covariance M:
+// U, Z, E, H, N, V, C, F, D, L.
+func (s *State) kalmanVector() [32]*float64 {
+	return [32]*float64{
+		&s.U1, &s.U2, &s.U3, &s.Z1, &s.Z2, &s.Z3, &s.E0, &s.E1, &s.E2, &s.E3, &s.H1, &s.H2, &s.H3,
+		&s.N1, &s.N2, &s.N3, &s.V1, &s.V2, &s.V3, &s.C1, &s.C2, &s.C3, &s.F0, &s.F1, &s.F2, &s.F3,
+		&s.D1, &s.D2, &s.D3, &s.L1, &s.L2, &s.L3,
+	}
+}
+
+// RTSSmooth runs a Rauch-Tung-Striebel backward pass over states, the successive states of a KalmanState's
+// forward pass after it computed each of ms, and returns the smoothed states, which use the measurements
+// after each step as well as those before.  Each state must carry its own copy of the covariance M,
+// e.g. st := *s.GetState(); st.M = st.M.Copy(), along with the process noise N.
+// The smoothed state at step k is x + C(x' - x'ₚ), where x'ₚ is x predicted to the time of the next
+// measurement and x' is the next smoothed state, with the gain C = P Fᵀ P'ₚ⁻¹ relating the filtered
+// covariance P to the transition matrix F and the predicted covariance P'ₚ = F P Fᵀ + N dt.
+// It returns an error if the states don't carry the full covariance of all the Kalman filter's blocks,
+// as for the states of the other algorithms.
+func RTSSmooth(states []State, ms []*Measurement) ([]State, error) {
+	if len(states) != len(ms) {
+		return nil, fmt.Errorf("ahrs: %d states for %d measurements", len(states), len(ms))
+	}
+	for k := range states {
+		if m, n := states[k].M, states[k].N; m == nil || n == nil || m.Rows() != 32 || n.Rows() != 32 {
+			return nil, fmt.Errorf("ahrs: state %d has no Kalman covariance to smooth", k)
+		}
+	}
+	if len(states) == 0 {
+		return nil, nil
+	}
+
+	out := make([]State, len(states))
+	n := len(states) - 1
+	out[n] = states[n]
+	out[n].M = states[n].M.Copy()
+	for k := n - 1; k >= 0; k-- {
+		pred := KalmanState{State: states[k]}
+		f := pred.calcJacobianState(ms[k+1].T)
+		pred.Predict(ms[k+1].T)
+		ppInv, err := pred.M.Inverse()
+		if err != nil {
+			return nil, fmt.Errorf("ahrs: predicted covariance at state %d: %w", k, err)
+		}
+		c := product(states[k].M, product(f.Transpose(), ppInv))
+
+		dx := NewMatrix(32, 1)
+		xs, xp := out[k+1].kalmanVector(), pred.kalmanVector()
+		for i := 0; i < 32; i++ {
+			dx.Set(i, 0, *xs[i]-*xp[i])
+		}
+		dx = product(c, dx)
+
+		out[k] = states[k]
+		x := out[k].kalmanVector()
+		for i := 0; i < 32; i++ {
+			*x[i] += dx.Get(i, 0)
+		}
+		out[k].normalize()
+		out[k].M = sum(states[k].M, product(c, product(difference(out[k+1].M, pred.M), c.Transpose())))
+		out[k].roll, out[k].pitch, out[k].heading = FromQuaternion(out[k].E0, out[k].E1, out[k].E2, out[k].E3)
+		out[k].calcRotationMatrices()
+	}
+	return out, nil
+}
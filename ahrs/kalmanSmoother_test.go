@@ -0,0 +1,95 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRTSSmooth(t *testing.T) {
+	path := turnPath(100, 0, 2, 3*Deg)
+	ms := withSensorErrors(simMeasurements(path, 0, 6, 0.05))
+	s := InitializeKalman(ms[0])
+	states := make([]State, 0, len(ms))
+	for _, m := range ms {
+		s.Compute(m)
+		st := *s.GetState()
+		st.M = st.M.Copy()
+		states = append(states, st)
+	}
+	smoothed, err := RTSSmooth(states, ms)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rms := func(states []State) float64 {
+		var e float64
+		for i := range states {
+			roll, pitch, _ := states[i].CalcRollPitchHeading()
+			r, p, _, _, _, _ := path(ms[i].T)
+			e += math.Pow(angleErr(roll, r/Deg), 2) + math.Pow(angleErr(pitch, p/Deg), 2)
+		}
+		return math.Sqrt(e / float64(len(states)))
+	}
+	forward, backward := rms(states), rms(smoothed)
+	t.Logf("RMS attitude error: forward %.3f°, smoothed %.3f°", forward, backward)
+	if backward >= forward {
+		t.Errorf("expected smoothing to reduce the attitude error below the forward %.3f°, got %.3f°", forward, backward)
+	}
+
+	// The Simple algorithm keeps no covariance to smooth with.
+	simple := NewSimpleAHRS()
+	simple.Compute(ms[0])
+	if _, err := RTSSmooth([]State{*simple.GetState()}, ms[:1]); err == nil {
+		t.Error("expected an error smoothing states without covariance")
+	}
+}
+
+func TestRTSSmoothAgainstTruth(t *testing.T) {
+	// With a magnetometer each of roll, pitch and heading should come closer to the truth, and the smoothed
+	// attitude be no less certain than the forward one.
+	path := turnPath(100, 0, 2, 3*Deg)
+	ms := withMagnetometer(withSensorErrors(simMeasurements(path, 0, 6, 0.05)), path)
+	s := InitializeKalman(ms[0])
+	states := make([]State, 0, len(ms))
+	for _, m := range ms {
+		s.Compute(m)
+		st := *s.GetState()
+		st.M = st.M.Copy()
+		states = append(states, st)
+	}
+	smoothed, err := RTSSmooth(states, ms)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rms := func(states []State) (e [3]float64) {
+		for i := range states {
+			roll, pitch, heading := states[i].CalcRollPitchHeading()
+			r, p, h, _, _, _ := path(ms[i].T)
+			for j, d := range [3]float64{angleErr(roll, r/Deg), angleErr(pitch, p/Deg), angleErr(heading, h/Deg)} {
+				e[j] += d * d
+			}
+		}
+		for j := range e {
+			e[j] = math.Sqrt(e[j] / float64(len(states)))
+		}
+		return e
+	}
+	forward, backward := rms(states), rms(smoothed)
+	for j, name := range []string{"roll", "pitch", "heading"} {
+		if backward[j] >= forward[j] {
+			t.Errorf("expected smoothing to reduce the RMS %s error below the forward %.3f°, got %.3f°",
+				name, forward[j], backward[j])
+		}
+	}
+
+	for k := range states {
+		var pf, ps float64
+		for i := 6; i <= 9; i++ {
+			pf, ps = pf+states[k].M.Get(i, i), ps+smoothed[k].M.Get(i, i)
+		}
+		if ps > pf*(1+1e-9) {
+			t.Errorf("smoothed attitude variance %g at step %d is more than the forward %g", ps, k, pf)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package ahrs
+
+// LeverArm corrects the accelerometer readings of a sensor mounted away from the aircraft's CG, e.g. in the
+// tail, to what they would be at the CG.  Rotating about the CG, the sensor also feels the centripetal
+// acceleration ω×(ω×r) and the tangential acceleration ω̇×r, where r is its offset from the CG, ω the
+// rotation rate measured by the gyro and ω̇ its rate of change between successive measurements.
+type LeverArm struct {
+	R1, R2, R3 float64 // Position of the sensor relative to the CG, ft, in the sensor's axes
+
+	t       float64    // Time of the previous gyro rates, s
+	w       [3]float64 // Previous gyro rates, rad/s
+	started bool       // Whether w holds a previous measurement
+}
+
+// Apply subtracts the lever-arm accelerations from the accelerometer readings A1, A2, A3 of m, using the gyro
+// rates B1, B2, B3 of m and the previous measurement applied.  The rate of change of the rotation is taken
+// as zero for the first measurement, and after one without valid sensor readings or going back in time.
+func (l *LeverArm) Apply(m *Measurement) {
+	if !m.SValid {
+		l.started = false
+		return
+	}
+	w := [3]float64{DegToRad(m.B1), DegToRad(m.B2), DegToRad(m.B3)}
+	var dw [3]float64
+	if dt := m.T - l.t; l.started && dt > 0 {
+		for i := range dw {
+			dw[i] = (w[i] - l.w[i]) / dt
+		}
+	}
+	l.t, l.w, l.started = m.T, w, true
+
+	r := [3]float64{l.R1, l.R2, l.R3}
+	wr := cross(w, r)
+	c := cross(w, wr)
+	d := cross(dw, r)
+	// ft/s² to G
+	k := MSToKnots(FeetToMeters(1)) / G
+	m.A1 -= (c[0] + d[0]) * k
+	m.A2 -= (c[1] + d[1]) * k
+	m.A3 -= (c[2] + d[2]) * k
+}
+
+// cross returns the cross product a×b.
+func cross(a, b [3]float64) [3]float64 {
+	return [3]float64{a[1]*b[2] - a[2]*b[1], a[2]*b[0] - a[0]*b[2], a[0]*b[1] - a[1]*b[0]}
+}
@@ -0,0 +1,68 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLeverArm(t *testing.T) {
+	// A sensor 15 ft behind the CG of an aircraft spinning up about its vertical axis, the CG at rest:
+	// it feels w²L toward the CG and αL to the side, on top of the 1 G of the ground.
+	const length, alpha = 15.0, 0.2 // ft, rad/s²
+	l := LeverArm{R1: -length}
+	for i := 0; i <= 50; i++ {
+		tt := float64(i) * 0.1
+		w := alpha * tt
+		m := NewMeasurement()
+		m.SValid, m.T = true, tt
+		m.B3 = RadToDeg(w)
+		m.A1 = w * w * length / 32.174
+		m.A2 = -alpha * length / 32.174
+		m.A3 = 1
+		if i == 0 {
+			m.A2 = 0 // The sensor can't yet know of the angular acceleration
+		}
+		l.Apply(m)
+		if math.Abs(m.A1) > 1e-6 || math.Abs(m.A2) > 1e-6 || math.Abs(m.A3-1) > 1e-9 {
+			t.Errorf("at %.1f s, %.1f rad/s, corrected accelerometer reads (%f, %f, %f), expected (0, 0, 1)",
+				tt, w, m.A1, m.A2, m.A3)
+		}
+	}
+
+	// At the CG there is nothing to correct.
+	l = LeverArm{}
+	m := simMeasurement(turnPath(100, 0, 0, 10*Deg), 5, 0.05)
+	a1, a2, a3 := m.A1, m.A2, m.A3
+	l.Apply(m)
+	if m.A1 != a1 || m.A2 != a2 || m.A3 != a3 {
+		t.Error("a zero lever arm changed the accelerometer readings")
+	}
+}
+
+func TestLeverArmFrames(t *testing.T) {
+	// The correction is the same physics in any frame: worked in the sensor's axes by Apply and rotated
+	// into the earth frame, it matches ω×(ω×r) worked in the earth frame, and rotates back unchanged.
+	s := new(State)
+	s.E0, s.E1, s.E2, s.E3 = ToQuaternion(20*Deg, -10*Deg, 135*Deg)
+	w := [3]float64{0.3, -0.2, 0.5} // rad/s
+	r := [3]float64{-12, 2, 1.5}    // ft
+	l := LeverArm{R1: r[0], R2: r[1], R3: r[2]}
+	m := NewMeasurement()
+	m.SValid, m.B1, m.B2, m.B3 = true, RadToDeg(w[0]), RadToDeg(w[1]), RadToDeg(w[2])
+	l.Apply(m)
+	// ft/s² to G
+	k := MSToKnots(FeetToMeters(1)) / G
+	c1, c2, c3 := s.RotateBodyToEarth(-m.A1/k, -m.A2/k, -m.A3/k)
+
+	var we, re [3]float64
+	we[0], we[1], we[2] = s.RotateBodyToEarth(w[0], w[1], w[2])
+	re[0], re[1], re[2] = s.RotateBodyToEarth(r[0], r[1], r[2])
+	c := cross(we, cross(we, re))
+	if math.Abs(c1-c[0]) > 1e-9 || math.Abs(c2-c[1]) > 1e-9 || math.Abs(c3-c[2]) > 1e-9 {
+		t.Errorf("correction in the earth frame is (%f, %f, %f), expected (%f, %f, %f)", c1, c2, c3, c[0], c[1], c[2])
+	}
+	if a1, a2, a3 := s.RotateEarthToBody(c1, c2, c3); math.Abs(a1+m.A1/k) > 1e-9 ||
+		math.Abs(a2+m.A2/k) > 1e-9 || math.Abs(a3+m.A3/k) > 1e-9 {
+		t.Errorf("correction rotated back to (%f, %f, %f), expected (%f, %f, %f)", a1, a2, a3, -m.A1/k, -m.A2/k, -m.A3/k)
+	}
+}
@@ -0,0 +1,75 @@
+package ahrs
+
+import "math"
+
+const (
+	magMonitorBins      = 32       // Number of intervals making up the window
+	magMonitorWindow    = 4.0      // Time over which the heading changes are compared, s
+	magMonitorTolerance = 5 * Deg  // Disagreement within which the magnetometer is fully trusted, Rad
+	magMonitorScale     = 10 * Deg // Further disagreement at which the reliability has fallen to 1/2, Rad
+)
+
+// magMonitor compares the change in heading integrated from the gyro with the change in the magnetometer's
+// tilt-compensated heading over a sliding window.  Over a few seconds the gyro is good, so disagreement
+// means the magnetic field is being disturbed, e.g. by a passing vehicle or a radio transmitting.
+// The window is kept as bins of the heading changes so that updating it doesn't allocate.
+type magMonitor struct {
+	gyro, mag [magMonitorBins]float64 // Heading changes within each bin, Rad
+	next      int                     // Bin being accumulated
+	tBin      float64                 // Time when the bin being accumulated was started
+	last      float64                 // Magnetometer heading at the last update, Rad
+	started   bool
+}
+
+// update adds the heading changes from the gyro, dGyro, and to the magnetometer heading magHeading at time t.
+func (w *magMonitor) update(t, dGyro, magHeading float64) {
+	if !w.started {
+		*w = magMonitor{tBin: t, last: magHeading, started: true}
+		return
+	}
+	w.gyro[w.next] += dGyro
+	w.mag[w.next] += AngleDiff(magHeading, w.last)
+	w.last = magHeading
+	if t-w.tBin >= magMonitorWindow/magMonitorBins {
+		w.next = (w.next + 1) % magMonitorBins
+		w.gyro[w.next], w.mag[w.next] = 0, 0
+		w.tBin = t
+	}
+}
+
+// reliability returns 1 while the gyro and magnetometer agree on the change in heading over the window,
+// falling towards 0 as they diverge.
+func (w *magMonitor) reliability() float64 {
+	var d float64
+	for i := range w.gyro {
+		d += w.mag[i] - w.gyro[i]
+	}
+	excess := math.Abs(d) - magMonitorTolerance
+	if excess <= 0 {
+		return 1
+	}
+	return 1 / (1 + excess*excess/(magMonitorScale*magMonitorScale))
+}
+
+// checkMag feeds the magnetometer monitor with the gyro rates w1, w2, w3, aircraft frame, °/s, over dt
+// and the magnetometer reading m1, m2, m3, aircraft frame, and returns the magnetometer's reliability.
+// Without a magnetometer reading (ok false) the monitor starts over.
+func (s *State) checkMag(w1, w2, w3, m1, m2, m3, dt float64, ok bool) float64 {
+	if !ok {
+		s.magMon = magMonitor{}
+		return 1
+	}
+	_, _, r3 := s.RotateBodyToEarth(DegToRad(w1), DegToRad(w2), DegToRad(w3))
+	h1, h2, _ := s.RotateBodyToEarth(m1, m2, m3)
+	_, _, heading := FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+	s.magMon.update(s.T+dt, -r3*dt, heading-math.Atan2(h1, h2)) // Heading is clockwise from north
+	return s.magMon.reliability()
+}
+
+// CalcMagReliability returns how far the magnetometer can be trusted, from 1 while the changes in heading
+// it shows agree with the gyro over the last few seconds to 0 as they diverge, as when the magnetic field
+// is disturbed.  The providers using the magnetometer down-weight it accordingly.
+// It is 1 for those that don't use it.
+func (s *State) CalcMagReliability() float64 {
+	return s.magMon.reliability()
+}
@@ -0,0 +1,69 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+// withMagDisturbance turns the magnetometer readings in ms about the vertical by up to peak radians
+// between t0 and t1, as a vehicle passing close by would.
+func withMagDisturbance(ms []*Measurement, t0, t1, peak float64) []*Measurement {
+	for _, m := range ms {
+		if m.T <= t0 || m.T >= t1 {
+			continue
+		}
+		d := peak * math.Pow(math.Sin(Pi*(m.T-t0)/(t1-t0)), 2)
+		m.M1, m.M2 = m.M1*math.Cos(d)-m.M2*math.Sin(d), m.M1*math.Sin(d)+m.M2*math.Cos(d)
+	}
+	return ms
+}
+
+func TestMagReliability(t *testing.T) {
+	path := turnPath(0, 0, 10, 3*Deg) // Slowly turning in place
+	for _, c := range []struct {
+		name string
+		new  func() AHRSProvider
+	}{
+		{"EKF", func() AHRSProvider { return NewEKFAHRS() }},
+		{"Madgwick", func() AHRSProvider { return NewMadgwickAHRS() }},
+		{"Mahony", func() AHRSProvider { return NewMahonyAHRS() }},
+	} {
+		ms := withMagDisturbance(withMagnetometer(simMeasurements(path, 0, 60, 0.01), path), 20, 30, 60*Deg)
+		p := c.new()
+		minRel, maxErr := 1.0, 0.0
+		for _, m := range ms {
+			p.Compute(m)
+			rel := p.GetState().CalcMagReliability()
+			switch {
+			case m.T < 20 && rel < 0.99:
+				t.Fatalf("%s: reliability %.3f at %.2f s before the disturbance", c.name, rel, m.T)
+			case m.T >= 20 && m.T < 30:
+				minRel = math.Min(minRel, rel)
+				_, _, h := p.GetState().CalcRollPitchHeading()
+				_, _, hh, _, _, _ := path(m.T)
+				maxErr = math.Max(maxErr, angleErr(h, hh/Deg))
+			}
+		}
+		rel := p.GetState().CalcMagReliability()
+		t.Logf("%s: reliability fell to %.3f, heading error at most %.1f°, recovered to %.3f", c.name, minRel, maxErr, rel)
+		if minRel > 0.5 {
+			t.Errorf("%s: reliability only fell to %.3f during the disturbance", c.name, minRel)
+		}
+		if rel < 0.99 {
+			t.Errorf("%s: reliability only recovered to %.3f", c.name, rel)
+		}
+		if maxErr > 30 {
+			t.Errorf("%s: heading error of %.1f° during a 60° disturbance", c.name, maxErr)
+		}
+	}
+}
+
+func TestMagReliabilityWithoutMagnetometer(t *testing.T) {
+	s := NewMahonyAHRS()
+	for _, m := range simMeasurements(turnPath(0, 0, 10, 3*Deg), 0, 10, 0.01) {
+		s.Compute(m)
+	}
+	if rel := s.CalcMagReliability(); rel != 1 {
+		t.Errorf("expected a reliability of 1 without a magnetometer, got %f", rel)
+	}
+}
@@ -0,0 +1,273 @@
+package ahrs
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+)
+
+// Matrix is a small dense matrix of float64, stored by rows, as used for the Kalman filter
+// covariances and Jacobians.  Get and Set check their indices against the matrix dimensions.
+type Matrix struct {
+	rows, cols int
+	elements   []float64
+}
+
+// NewMatrix returns a rows x cols matrix of zeros.
+func NewMatrix(rows, cols int) *Matrix {
+	return &Matrix{rows: rows, cols: cols, elements: make([]float64, rows*cols)}
+}
+
+// Rows returns the number of rows of a.
+func (a *Matrix) Rows() int {
+	return a.rows
+}
+
+// Cols returns the number of columns of a.
+func (a *Matrix) Cols() int {
+	return a.cols
+}
+
+// GetSize returns the number of rows and columns of a.
+func (a *Matrix) GetSize() (rows, cols int) {
+	return a.rows, a.cols
+}
+
+// Get returns the element of a at row i, column j.
+func (a *Matrix) Get(i, j int) float64 {
+	a.check(i, j)
+	return a.elements[i*a.cols+j]
+}
+
+// Set sets the element of a at row i, column j to v.
+func (a *Matrix) Set(i, j int, v float64) {
+	a.check(i, j)
+	a.elements[i*a.cols+j] = v
+}
+
+func (a *Matrix) check(i, j int) {
+	if i < 0 || i >= a.rows || j < 0 || j >= a.cols {
+		panic(fmt.Sprintf("ahrs: index (%d, %d) out of range for %dx%d matrix", i, j, a.rows, a.cols))
+	}
+}
+
+// Copy returns a copy of a.
+func (a *Matrix) Copy() *Matrix {
+	b := NewMatrix(a.rows, a.cols)
+	copy(b.elements, a.elements)
+	return b
+}
+
+// Transpose returns the transpose of a.
+func (a *Matrix) Transpose() *Matrix {
+	b := NewMatrix(a.cols, a.rows)
+	for i := 0; i < a.rows; i++ {
+		for j := 0; j < a.cols; j++ {
+			b.elements[j*a.rows+i] = a.elements[i*a.cols+j]
+		}
+	}
+	return b
+}
+
+// Inverse returns the inverse of the square matrix a, by Gauss-Jordan elimination with partial pivoting.
+func (a *Matrix) Inverse() (*Matrix, error) {
+	n := a.rows
+	if n != a.cols {
+		return nil, fmt.Errorf("Error: can't invert a non-square %dx%d matrix", a.rows, a.cols)
+	}
+	b := a.Copy()
+	inv := eye(n)
+	x, y := b.elements, inv.elements
+	for c := 0; c < n; c++ {
+		p := c
+		for r := c + 1; r < n; r++ {
+			if math.Abs(x[r*n+c]) > math.Abs(x[p*n+c]) {
+				p = r
+			}
+		}
+		if x[p*n+c] == 0 {
+			return nil, fmt.Errorf("Error: matrix is singular")
+		}
+		if p != c {
+			for j := 0; j < n; j++ {
+				x[c*n+j], x[p*n+j] = x[p*n+j], x[c*n+j]
+				y[c*n+j], y[p*n+j] = y[p*n+j], y[c*n+j]
+			}
+		}
+		d := x[c*n+c]
+		for j := 0; j < n; j++ {
+			x[c*n+j] /= d
+			y[c*n+j] /= d
+		}
+		for r := 0; r < n; r++ {
+			if r == c {
+				continue
+			}
+			f := x[r*n+c]
+			if f == 0 {
+				continue
+			}
+			for j := 0; j < n; j++ {
+				x[r*n+j] -= f * x[c*n+j]
+				y[r*n+j] -= f * y[c*n+j]
+			}
+		}
+	}
+	return inv, nil
+}
+
+// Symmetrize replaces the square matrix a by (a + aᵀ)/2, removing the asymmetry that rounding builds up
+// in a covariance.
+func (a *Matrix) Symmetrize() {
+	n := a.rows
+	for i := 0; i < n; i++ {
+		for j := 0; j < i; j++ {
+			v := (a.elements[i*n+j] + a.elements[j*n+i]) / 2
+			a.elements[i*n+j], a.elements[j*n+i] = v, v
+		}
+	}
+}
+
+// Cholesky returns the lower-triangular L such that L Lᵀ = a for the symmetric matrix a,
+// or an error if a isn't positive-definite.
+func (a *Matrix) Cholesky() (*Matrix, error) {
+	n := a.rows
+	if n != a.cols {
+		return nil, fmt.Errorf("Error: can't factorize a non-square %dx%d matrix", a.rows, a.cols)
+	}
+	l := NewMatrix(n, n)
+	x, y := a.elements, l.elements
+	for j := 0; j < n; j++ {
+		d := x[j*n+j]
+		for k := 0; k < j; k++ {
+			d -= y[j*n+k] * y[j*n+k]
+		}
+		if !(d > 0) || math.IsInf(d, 0) {
+			return nil, fmt.Errorf("Error: matrix isn't positive-definite at row %d", j)
+		}
+		y[j*n+j] = math.Sqrt(d)
+		for i := j + 1; i < n; i++ {
+			v := x[i*n+j]
+			for k := 0; k < j; k++ {
+				v -= y[i*n+k] * y[j*n+k]
+			}
+			y[i*n+j] = v / y[j*n+j]
+		}
+	}
+	return l, nil
+}
+
+// String formats a with one row per line.
+func (a *Matrix) String() string {
+	var buf bytes.Buffer
+	for i := 0; i < a.rows; i++ {
+		buf.WriteString("{")
+		for j := 0; j < a.cols; j++ {
+			if j > 0 {
+				buf.WriteString(", ")
+			}
+			fmt.Fprintf(&buf, "%g", a.elements[i*a.cols+j])
+		}
+		buf.WriteString("}\n")
+	}
+	return buf.String()
+}
+
+// eye returns the n x n identity matrix.
+func eye(n int) *Matrix {
+	a := NewMatrix(n, n)
+	for i := 0; i < n; i++ {
+		a.elements[i*n+i] = 1
+	}
+	return a
+}
+
+// submatrix returns the matrix of the elements of a in the given rows and columns, or all of them if nil.
+func submatrix(a *Matrix, rows, cols []int) *Matrix {
+	if rows == nil {
+		rows = make([]int, a.rows)
+		for i := range rows {
+			rows[i] = i
+		}
+	}
+	if cols == nil {
+		cols = make([]int, a.cols)
+		for j := range cols {
+			cols[j] = j
+		}
+	}
+	b := NewMatrix(len(rows), len(cols))
+	for i, r := range rows {
+		for j, c := range cols {
+			b.elements[i*b.cols+j] = a.Get(r, c)
+		}
+	}
+	return b
+}
+
+// diagonal returns the square matrix with d along its diagonal.
+func diagonal(d []float64) *Matrix {
+	n := len(d)
+	a := NewMatrix(n, n)
+	for i, v := range d {
+		a.elements[i*n+i] = v
+	}
+	return a
+}
+
+// scaled returns a scaled by f.
+func scaled(a *Matrix, f float64) *Matrix {
+	b := NewMatrix(a.rows, a.cols)
+	for i, v := range a.elements {
+		b.elements[i] = f * v
+	}
+	return b
+}
+
+// sum returns a + b.
+func sum(a, b *Matrix) *Matrix {
+	checkSameSize(a, b)
+	c := NewMatrix(a.rows, a.cols)
+	for i := range c.elements {
+		c.elements[i] = a.elements[i] + b.elements[i]
+	}
+	return c
+}
+
+// difference returns a - b.
+func difference(a, b *Matrix) *Matrix {
+	checkSameSize(a, b)
+	c := NewMatrix(a.rows, a.cols)
+	for i := range c.elements {
+		c.elements[i] = a.elements[i] - b.elements[i]
+	}
+	return c
+}
+
+// product returns the matrix product a*b.
+func product(a, b *Matrix) *Matrix {
+	if a.cols != b.rows {
+		panic(fmt.Sprintf("ahrs: can't multiply %dx%d by %dx%d matrix", a.rows, a.cols, b.rows, b.cols))
+	}
+	c := NewMatrix(a.rows, b.cols)
+	for i := 0; i < a.rows; i++ {
+		ci := c.elements[i*b.cols : (i+1)*b.cols]
+		for k := 0; k < a.cols; k++ {
+			f := a.elements[i*a.cols+k]
+			if f == 0 {
+				continue
+			}
+			bk := b.elements[k*b.cols : (k+1)*b.cols]
+			for j, v := range bk {
+				ci[j] += f * v
+			}
+		}
+	}
+	return c
+}
+
+func checkSameSize(a, b *Matrix) {
+	if a.rows != b.rows || a.cols != b.cols {
+		panic(fmt.Sprintf("ahrs: mismatched %dx%d and %dx%d matrices", a.rows, a.cols, b.rows, b.cols))
+	}
+}
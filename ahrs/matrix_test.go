@@ -0,0 +1,119 @@
+package ahrs
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func randomMatrix(rows, cols int) *Matrix {
+	a := NewMatrix(rows, cols)
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			a.Set(i, j, rand.Float64()*2-1)
+		}
+	}
+	return a
+}
+
+func maxAbsDiff(a, b *Matrix) (d float64) {
+	for i := 0; i < a.Rows(); i++ {
+		for j := 0; j < a.Cols(); j++ {
+			d = math.Max(d, math.Abs(a.Get(i, j)-b.Get(i, j)))
+		}
+	}
+	return
+}
+
+func TestMatrixProduct(t *testing.T) {
+	a := diagonal([]float64{1, 2})
+	a.Set(0, 1, 3)
+	b := NewMatrix(2, 3)
+	for j := 0; j < 3; j++ {
+		b.Set(0, j, float64(j))
+		b.Set(1, j, 1)
+	}
+	c := product(a, b)
+	expected := [][]float64{{3, 4, 5}, {2, 2, 2}}
+	if r, cc := c.GetSize(); r != 2 || cc != 3 {
+		t.Fatalf("product has size %dx%d, expected 2x3", r, cc)
+	}
+	for i := range expected {
+		for j, v := range expected[i] {
+			if c.Get(i, j) != v {
+				t.Errorf("product[%d][%d] is %f, expected %f", i, j, c.Get(i, j), v)
+			}
+		}
+	}
+
+	at := c.Transpose()
+	if at.Rows() != 3 || at.Cols() != 2 || at.Get(2, 0) != 5 {
+		t.Errorf("bad transpose:\n%s", at)
+	}
+}
+
+func TestMatrixInverse(t *testing.T) {
+	for _, n := range []int{1, 3, 15, 32} {
+		a := sum(randomMatrix(n, n), scaled(eye(n), float64(n)))
+		ai, err := a.Inverse()
+		if err != nil {
+			t.Fatalf("couldn't invert %dx%d matrix: %s", n, n, err)
+		}
+		if d := maxAbsDiff(product(a, ai), eye(n)); d > 1e-12 {
+			t.Errorf("%dx%d inverse off by %g", n, n, d)
+		}
+	}
+
+	if _, err := NewMatrix(3, 3).Inverse(); err == nil {
+		t.Error("expected an error inverting a singular matrix")
+	}
+	if _, err := NewMatrix(2, 3).Inverse(); err == nil {
+		t.Error("expected an error inverting a non-square matrix")
+	}
+}
+
+func TestMatrixCholesky(t *testing.T) {
+	for _, n := range []int{1, 3, 15, 32} {
+		r := randomMatrix(n, n)
+		a := sum(product(r, r.Transpose()), eye(n))
+		l, err := a.Cholesky()
+		if err != nil {
+			t.Fatalf("couldn't factorize %dx%d matrix: %s", n, n, err)
+		}
+		if d := maxAbsDiff(product(l, l.Transpose()), a); d > 1e-12 {
+			t.Errorf("%dx%d Cholesky factor off by %g", n, n, d)
+		}
+	}
+
+	a := diagonal([]float64{1, -1, 1})
+	if _, err := a.Cholesky(); err == nil {
+		t.Error("expected an error factorizing an indefinite matrix")
+	}
+	a = diagonal([]float64{1, 1})
+	a.Set(0, 1, 2)
+	a.Symmetrize()
+	if a.Get(0, 1) != 1 || a.Get(1, 0) != 1 {
+		t.Errorf("symmetrized matrix is\n%s", a)
+	}
+	if _, err := a.Cholesky(); err == nil {
+		t.Error("expected an error factorizing a singular matrix")
+	}
+}
+
+func TestMatrixBounds(t *testing.T) {
+	a := NewMatrix(3, 2)
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic reading outside the matrix")
+		}
+	}()
+	// Element (0, 2) would alias (1, 0) in the backing slice.
+	a.Get(0, 2)
+}
+
+func TestMatrixDifference(t *testing.T) {
+	a := randomMatrix(4, 5)
+	if d := maxAbsDiff(difference(a, a.Copy()), NewMatrix(4, 5)); d != 0 {
+		t.Errorf("a - a is not zero, off by %g", d)
+	}
+}
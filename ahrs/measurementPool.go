@@ -0,0 +1,29 @@
+package ahrs
+
+import "sync"
+
+// MeasurementPool recycles Measurements, for sensor loops that would otherwise allocate one per sample.
+// Since providers don't retain a Measurement past Compute, it may be returned to the pool as soon as
+// Compute has returned.  It is safe for concurrent use.
+type MeasurementPool struct {
+	p sync.Pool
+}
+
+// NewMeasurementPool returns an empty MeasurementPool.
+func NewMeasurementPool() *MeasurementPool {
+	mp := new(MeasurementPool)
+	mp.p.New = func() interface{} { return NewMeasurement() }
+	return mp
+}
+
+// Get returns a Measurement from the pool, or a new one if the pool is empty.
+// It is always in the state of a newly created Measurement, with all validity flags false.
+func (mp *MeasurementPool) Get() *Measurement {
+	return mp.p.Get().(*Measurement)
+}
+
+// Put resets m and returns it to the pool.  m must not be used afterwards.
+func (mp *MeasurementPool) Put(m *Measurement) {
+	m.Reset()
+	mp.p.Put(m)
+}
@@ -0,0 +1,71 @@
+package ahrs
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// checkFresh reports any field of m that differs from a newly created Measurement.
+func checkFresh(t *testing.T, m *Measurement) {
+	fresh := NewMeasurement()
+	v, f := reflect.ValueOf(*m), reflect.ValueOf(*fresh)
+	for i := 0; i < v.NumField(); i++ {
+		switch v.Field(i).Kind() {
+		case reflect.Bool, reflect.Float64:
+			if v.Field(i).Interface() != f.Field(i).Interface() {
+				t.Errorf("stale %s: %v", v.Type().Field(i).Name, v.Field(i).Interface())
+			}
+		}
+	}
+	if m.M == nil || maxAbsDiff(m.M, fresh.M) != 0 {
+		t.Error("stale measurement noise covariance")
+	}
+	for i, a := range m.Accums {
+		if n, _, _ := a(0); n != 1 {
+			t.Errorf("stale accumulator %d has seen %f values", i, n-1)
+		}
+	}
+}
+
+func TestMeasurementReset(t *testing.T) {
+	m := NewMeasurement()
+	m.UValid, m.WValid, m.SValid, m.MValid = true, true, true, true
+	m.U1, m.W2, m.A3, m.B1, m.M3, m.T, m.TW, m.TU = 1, 2, 3, 4, 5, 6, 7, 8
+	m.M.Set(3, 4, 1)
+	m.M.Set(5, 5, 0.1)
+	m.Accums[6](1)
+	m.Reset()
+	checkFresh(t, m)
+
+	// A Measurement created with new() gains a covariance and accumulators.
+	m = new(Measurement)
+	m.WValid = true
+	m.Reset()
+	checkFresh(t, m)
+}
+
+func TestMeasurementPool(t *testing.T) {
+	mp := NewMeasurementPool()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				m := mp.Get()
+				if m.UValid || m.WValid || m.SValid || m.MValid || m.W1 != 0 || m.A3 != 0 || m.T != 0 {
+					t.Errorf("pooled measurement has stale data: %+v", *m)
+					return
+				}
+				m.WValid, m.SValid, m.MValid = true, true, true
+				m.W1, m.A3, m.T = 100, 1, float64(i)
+				mp.Put(m)
+			}
+		}()
+	}
+	wg.Wait()
+
+	m := mp.Get()
+	checkFresh(t, m)
+}
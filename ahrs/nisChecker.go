@@ -0,0 +1,114 @@
+package ahrs
+
+import (
+	"fmt"
+	"math"
+)
+
+// chiSquare95 holds the 95th percentile of the chi-square distribution for 1 to 15 degrees of freedom.
+var chiSquare95 = [...]float64{
+	3.841, 5.991, 7.815, 9.488, 11.070, 12.592, 14.067, 15.507,
+	16.919, 18.307, 19.675, 21.026, 22.362, 23.685, 24.996,
+}
+
+// NISChecker checks whether a Kalman filter's noise covariances are consistent with reality,
+// using the Normalized Innovation Squared of each update, NIS = y' S^-1 y.
+// If the filter is consistent, NIS follows a chi-square distribution with one degree of freedom for each
+// valid measurement channel, so it lies within the 95% bound for 95% of the updates and averages
+// the number of degrees of freedom.  Too many updates outside the bound mean the noise is underestimated;
+// a mean NIS well below its expected value means it is overestimated.
+// Use Record as a KalmanState's innovation hook.
+type NISChecker struct {
+	n, inside int
+	sumNIS    float64
+	sumDOF    float64
+}
+
+// NewNISChecker returns a NISChecker with no updates recorded.
+func NewNISChecker() *NISChecker {
+	return new(NISChecker)
+}
+
+// Record computes the NIS for the innovation y with covariance ss, ignoring channels with a variance
+// of Big or more, which have no valid measurement.
+func (c *NISChecker) Record(y, ss *Matrix) {
+	var idx []int
+	for i := 0; i < ss.Rows(); i++ {
+		if ss.Get(i, i) < Big {
+			idx = append(idx, i)
+		}
+	}
+	k := len(idx)
+	if k == 0 || k > len(chiSquare95) {
+		return
+	}
+	sv := NewMatrix(k, k)
+	for i, ii := range idx {
+		for j, jj := range idx {
+			sv.Set(i, j, ss.Get(ii, jj))
+		}
+	}
+	si, err := sv.Inverse()
+	if err != nil {
+		return
+	}
+	var nis float64
+	for i, ii := range idx {
+		for j, jj := range idx {
+			nis += y.Get(ii, 0) * si.Get(i, j) * y.Get(jj, 0)
+		}
+	}
+	if math.IsNaN(nis) {
+		return
+	}
+
+	c.n++
+	c.sumNIS += nis
+	c.sumDOF += float64(k)
+	if nis <= chiSquare95[k-1] {
+		c.inside++
+	}
+}
+
+// N returns the number of updates recorded.
+func (c *NISChecker) N() int {
+	return c.n
+}
+
+// FractionInside returns the fraction of updates whose NIS was within the 95% bound.
+func (c *NISChecker) FractionInside() float64 {
+	return float64(c.inside) / float64(c.n)
+}
+
+// MeanNIS returns the mean NIS over all updates, along with its expected value for a consistent filter,
+// the mean number of degrees of freedom.
+func (c *NISChecker) MeanNIS() (nis, expected float64) {
+	return c.sumNIS / float64(c.n), c.sumDOF / float64(c.n)
+}
+
+// Diagnosis returns "consistent", "noise underestimated" or "noise overestimated".
+func (c *NISChecker) Diagnosis() string {
+	nis, expected := c.MeanNIS()
+	switch {
+	case c.FractionInside() < 0.9 || nis > 1.5*expected:
+		return "noise underestimated"
+	case nis < 0.5*expected:
+		return "noise overestimated"
+	}
+	return "consistent"
+}
+
+// Consistent returns whether the noise covariances appear to match the innovations.
+func (c *NISChecker) Consistent() bool {
+	return c.n > 0 && c.Diagnosis() == "consistent"
+}
+
+// String summarizes the NIS statistics.
+func (c *NISChecker) String() string {
+	if c.n == 0 {
+		return "NIS: no updates recorded"
+	}
+	nis, expected := c.MeanNIS()
+	return fmt.Sprintf("NIS: %.1f%% of %d updates within the 95%% bound, mean %.2f (expected %.2f): %s",
+		100*c.FractionInside(), c.n, nis, expected, c.Diagnosis())
+}
@@ -0,0 +1,89 @@
+package ahrs
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// recordInnovations feeds n synthetic innovations to c, drawn with scale times the standard deviations
+// given by their covariance: 12 valid channels, two of them correlated, and 3 invalid ones.
+func recordInnovations(c *NISChecker, n int, scale float64) {
+	rng := rand.New(rand.NewSource(1))
+	ss := NewMatrix(15, 15)
+	sd := make([]float64, 15)
+	for i := range sd {
+		sd[i] = 0.1 + 3*rng.Float64()
+		ss.Set(i, i, sd[i]*sd[i])
+	}
+	for _, i := range []int{12, 13, 14} {
+		ss.Set(i, i, Big)
+	}
+	const rho = 0.8
+	ss.Set(0, 1, rho*sd[0]*sd[1])
+	ss.Set(1, 0, rho*sd[0]*sd[1])
+
+	y := NewMatrix(15, 1)
+	for k := 0; k < n; k++ {
+		z := make([]float64, 12)
+		for i := range z {
+			z[i] = scale * rng.NormFloat64()
+		}
+		y.Set(0, 0, sd[0]*z[0])
+		y.Set(1, 0, sd[1]*(rho*z[0]+math.Sqrt(1-rho*rho)*z[1]))
+		for i := 2; i < 12; i++ {
+			y.Set(i, 0, sd[i]*z[i])
+		}
+		c.Record(y, ss)
+	}
+}
+
+func TestNISChecker(t *testing.T) {
+	c := NewNISChecker()
+	recordInnovations(c, 2000, 1)
+	t.Log(c)
+	if f := c.FractionInside(); f < 0.93 || f > 0.97 {
+		t.Errorf("expected about 95%% of a consistent filter's updates inside the bound, got %.1f%%", 100*f)
+	}
+	if nis, expected := c.MeanNIS(); expected != 12 || math.Abs(nis-expected) > 0.5 {
+		t.Errorf("expected mean NIS of 12 for 12 valid channels, got %f (expected %f)", nis, expected)
+	}
+	if !c.Consistent() {
+		t.Errorf("correctly tuned filter diagnosed as %s", c.Diagnosis())
+	}
+
+	// Innovations twice as large as the filter expects: its noise is underestimated.
+	c = NewNISChecker()
+	recordInnovations(c, 2000, 2)
+	t.Log(c)
+	if c.Consistent() || c.Diagnosis() != "noise underestimated" {
+		t.Errorf("under-tuned filter diagnosed as %s", c.Diagnosis())
+	}
+
+	c = NewNISChecker()
+	recordInnovations(c, 2000, 0.5)
+	if c.Diagnosis() != "noise overestimated" {
+		t.Errorf("over-tuned filter diagnosed as %s", c.Diagnosis())
+	}
+}
+
+func TestKalmanInnovationHook(t *testing.T) {
+	ms := kalmanScenario()
+	s := InitializeKalman(ms[0])
+	c := NewNISChecker()
+	var n int
+	s.SetInnovationHook(func(y, ss *Matrix) {
+		n++
+		if y.Rows() != 15 || y.Cols() != 1 || ss.Rows() != 15 || ss.Cols() != 15 {
+			t.Fatalf("hook got a %dx%d innovation and %dx%d covariance", y.Rows(), y.Cols(), ss.Rows(), ss.Cols())
+		}
+		c.Record(y, ss)
+	})
+	for _, m := range ms[1:] {
+		s.Compute(m)
+	}
+	if n != len(ms)-1 || c.N() != n {
+		t.Errorf("expected the hook to record all %d updates, called %d times, recorded %d", len(ms)-1, n, c.N())
+	}
+	t.Log(c)
+}
@@ -0,0 +1,5 @@
+//go:build !race
+
+package ahrs
+
+const raceEnabled = false
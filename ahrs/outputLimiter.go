@@ -0,0 +1,93 @@
+package ahrs
+
+import "math"
+
+// OutputLimiter wraps an AHRSProvider and limits how fast the attitude it reports may change,
+// so that a sensor glitch doesn't make a display judder.  The provider's own state is left alone.
+type OutputLimiter struct {
+	AHRSProvider
+	maxRate [3]float64 // Largest roll, pitch and heading rates reported, °/s
+	out     [3]float64 // Last roll, pitch and heading reported, °
+	t       float64    // Time of the state last reported
+	started bool       // Whether out holds a reported attitude
+}
+
+// NewOutputLimiter returns an OutputLimiter wrapping p, whose reported roll, pitch and heading change
+// by no more than maxRoll, maxPitch and maxHeading °/s.
+func NewOutputLimiter(p AHRSProvider, maxRoll, maxPitch, maxHeading float64) *OutputLimiter {
+	return &OutputLimiter{AHRSProvider: p, maxRate: [3]float64{maxRoll, maxPitch, maxHeading}}
+}
+
+// CalcRollPitchHeading returns the provider's roll, pitch and heading in degrees, each moved from its
+// last reported value towards the provider's by no more than its maximum rate allows over the time
+// the provider's state has advanced.  Roll and heading turn the short way round, within (-180, 180]
+// and [0, 360).
+// The limiter starts over from the provider's values when it isn't valid or its time goes backwards;
+// an Invalid heading is passed through and restarts the heading.
+func (l *OutputLimiter) CalcRollPitchHeading() (roll float64, pitch float64, heading float64) {
+	r, p, h := l.AHRSProvider.RollPitchHeading()
+	t := l.GetState().T
+	in := [3]float64{RadToDeg(r), RadToDeg(p), RadToDeg(h)}
+	if h == Invalid {
+		in[2] = Invalid
+	}
+
+	dt := t - l.t
+	if !l.started || !l.Valid() || dt < 0 {
+		l.out, l.t, l.started = in, t, true
+		return in[0], in[1], in[2]
+	}
+	for i := range in {
+		if in[i] == Invalid || l.out[i] == Invalid {
+			l.out[i] = in[i]
+			continue
+		}
+		d := in[i] - l.out[i]
+		if i != 1 { // Roll and heading wrap around
+			d = RadToDeg(AngleDiff(DegToRad(in[i]), DegToRad(l.out[i])))
+		}
+		maxD := l.maxRate[i] * dt
+		l.out[i] += math.Max(-maxD, math.Min(maxD, d))
+	}
+	if l.out[0] > 180 {
+		l.out[0] -= 360
+	} else if l.out[0] <= -180 {
+		l.out[0] += 360
+	}
+	if l.out[2] != Invalid {
+		l.out[2] = math.Mod(l.out[2]+360, 360)
+	}
+	l.t = t
+	return l.out[0], l.out[1], l.out[2]
+}
+
+// RollPitchHeading returns the limited attitude of CalcRollPitchHeading in radians, so that Stream,
+// SafeProvider and anything else reading the provider's attitude in radians see it limited too.
+func (l *OutputLimiter) RollPitchHeading() (roll float64, pitch float64, heading float64) {
+	roll, pitch, heading = l.CalcRollPitchHeading()
+	if heading != Invalid {
+		heading = DegToRad(heading)
+	}
+	return DegToRad(roll), DegToRad(pitch), heading
+}
+
+// CalcAttitude returns the provider's Attitude with the limited roll, pitch and heading of CalcRollPitchHeading.
+func (l *OutputLimiter) CalcAttitude() Attitude {
+	a := l.AHRSProvider.CalcAttitude()
+	a.Roll, a.Pitch, a.Heading = l.CalcRollPitchHeading()
+	return a
+}
+
+// CalcQuaternion returns the attitude quaternion rebuilt from the limited angles of CalcRollPitchHeading,
+// keeping the provider's sign, and its heading while the limited heading is Invalid.
+func (l *OutputLimiter) CalcQuaternion() (w, x, y, z float64) {
+	e0, e1, e2, e3 := l.AHRSProvider.CalcQuaternion()
+	roll, pitch, heading := l.CalcRollPitchHeading()
+	if heading == Invalid {
+		_, _, heading = FromQuaternion(e0, e1, e2, e3)
+	} else {
+		heading = DegToRad(heading)
+	}
+	w, x, y, z = ToQuaternion(DegToRad(roll), DegToRad(pitch), heading)
+	return QuaternionSign(w, x, y, z, e0, e1, e2, e3)
+}
@@ -0,0 +1,88 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+func TestOutputLimiter(t *testing.T) {
+	const (
+		dt      = 0.02  // s
+		maxRate = 100.0 // °/s, so 2° per frame
+	)
+	s := NewSimpleAHRS()
+	s.needsInitialization = false
+	l := NewOutputLimiter(s, maxRate, maxRate, maxRate)
+	set := func(frame int, roll, pitch, heading float64) {
+		s.E0, s.E1, s.E2, s.E3 = ToQuaternion(roll*Deg, pitch*Deg, heading*Deg)
+		s.T = float64(frame) * dt
+	}
+
+	set(0, 10, 5, 350)
+	if r, p, h := l.CalcRollPitchHeading(); math.Abs(r-10) > 1e-9 || math.Abs(p-5) > 1e-9 || math.Abs(h-350) > 1e-9 {
+		t.Fatalf("expected the first output to pass through, got %f, %f, %f", r, p, h)
+	}
+
+	// A 40° jump on every axis, across north for the heading, limited to 2° per frame.
+	want := [3]float64{10, 5, 350}
+	for frame := 1; frame <= 25; frame++ {
+		set(frame, 50, 45, 30)
+		for i, to := range [3]float64{50, 45, 390} {
+			want[i] = math.Min(to, want[i]+maxRate*dt)
+		}
+		r, p, h := l.CalcRollPitchHeading()
+		if math.Abs(r-want[0]) > 1e-6 || math.Abs(p-want[1]) > 1e-6 || angleErr(h, want[2]) > 1e-6 {
+			t.Fatalf("frame %d: expected %f, %f, %f, got %f, %f, %f", frame, want[0], want[1], want[2], r, p, h)
+		}
+		if h < 0 || h >= 360 {
+			t.Errorf("frame %d: heading %f out of range", frame, h)
+		}
+	}
+
+	// Asking again within the same frame doesn't move the output.
+	r0, p0, h0 := l.CalcRollPitchHeading()
+	if r, p, h := l.CalcRollPitchHeading(); r != r0 || p != p0 || h != h0 {
+		t.Error("output moved without the state advancing")
+	}
+
+	// The provider is untouched.
+	if r, p, h := s.CalcRollPitchHeading(); math.Abs(r-50) > 1e-9 || math.Abs(p-45) > 1e-9 || math.Abs(h-30) > 1e-9 {
+		t.Errorf("provider attitude changed to %f, %f, %f", r, p, h)
+	}
+
+	// Starting over after a reset passes the provider's values straight through.
+	set(0, -20, 0, 100)
+	if r, _, h := l.CalcRollPitchHeading(); math.Abs(r+20) > 1e-9 || math.Abs(h-100) > 1e-9 {
+		t.Errorf("expected the limiter to start over when time went backwards, got roll %f, heading %f", r, h)
+	}
+}
+
+func TestOutputLimiterRollPitchHeading(t *testing.T) {
+	// Readers in radians, such as SafeProvider, see the limited attitude too.
+	s := NewSimpleAHRS()
+	s.needsInitialization = false
+	sp := NewSafeProvider(NewOutputLimiter(s, 10, 10, 10))
+	s.E0, s.E1, s.E2, s.E3 = ToQuaternion(0, 0, 0)
+	sp.RollPitchHeading()
+
+	s.E0, s.E1, s.E2, s.E3 = ToQuaternion(30*Deg, 20*Deg, 40*Deg)
+	s.T = 0.5
+	if r, p, h := sp.RollPitchHeading(); math.Abs(r-5*Deg) > 1e-9 || math.Abs(p-5*Deg) > 1e-9 || math.Abs(h-5*Deg) > 1e-9 {
+		t.Errorf("expected the attitude limited to 5° on each axis, got %f°, %f°, %f°", r/Deg, p/Deg, h/Deg)
+	}
+
+	// So do the Attitude and the quaternion, which agree with it.
+	l := NewOutputLimiter(s, 10, 10, 10)
+	s.E0, s.E1, s.E2, s.E3 = ToQuaternion(0, 0, 0)
+	s.T = 0
+	l.CalcRollPitchHeading()
+	s.E0, s.E1, s.E2, s.E3 = ToQuaternion(30*Deg, 20*Deg, 40*Deg)
+	s.T = 0.5
+	if a := l.CalcAttitude(); math.Abs(a.Roll-5) > 1e-9 || math.Abs(a.Pitch-5) > 1e-9 || math.Abs(a.Heading-5) > 1e-9 {
+		t.Errorf("expected the Attitude limited to 5° on each axis, got %f°, %f°, %f°", a.Roll, a.Pitch, a.Heading)
+	}
+	r, p, h := FromQuaternion(l.CalcQuaternion())
+	if math.Abs(r-5*Deg) > 1e-9 || math.Abs(p-5*Deg) > 1e-9 || math.Abs(h-5*Deg) > 1e-9 {
+		t.Errorf("expected the quaternion limited to 5° on each axis, got %f°, %f°, %f°", r/Deg, p/Deg, h/Deg)
+	}
+}
@@ -0,0 +1,237 @@
+package ahrs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// simpleParams, ekfParams and mahonyParams list the params accepted by those providers.
+var simpleParams = []string{"minGS", "maxDT", "fastSmoothConst", "slowSmoothConst", "verySlowSmoothConst",
+	"gpsWeight", "accelWeight", "blendTime", "taxiHeadingTau"}
+var mahonyParams = []string{"maxDT", "kp", "ki"}
+var ekfParams = []string{"minGS", "maxDT", "gyroNoise", "gyroBiasNoise", "accelNoise", "gpsNoise", "trackNoise",
+	"gravityNoise", "magNoise"}
+var ekf7Params = []string{"maxDT", "gyroNoise", "gyroBiasNoise", "gravityNoise", "magNoise"}
+
+// ProviderFunc constructs an AHRSProvider from cfg and the first measurement m, which may be nil.
+type ProviderFunc func(cfg Config, m *Measurement) (AHRSProvider, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]ProviderFunc{
+		"simple":   newSimpleProvider,
+		"kalman":   newKalmanProvider,
+		"ekf":      newEKFProvider,
+		"ukf":      newUKFProvider,
+		"ekf7":     newEKF7Provider,
+		"madgwick": newMadgwickProvider,
+		"mahony":   newMahonyProvider,
+		"hybrid":   newHybridProvider,
+	}
+)
+
+// Register makes a provider available to NewAHRSProvider and NewProvider under name, case-insensitively,
+// so that other packages can add their own algorithms.  It panics if name is already registered or f is nil.
+func Register(name string, f ProviderFunc) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	name = strings.ToLower(name)
+	if f == nil {
+		panic("ahrs: Register provider " + name + " is nil")
+	}
+	if _, ok := registry[name]; ok {
+		panic("ahrs: Register called twice for provider " + name)
+	}
+	registry[name] = f
+}
+
+// Providers returns the sorted names of the registered providers.
+func Providers() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for n := range registry {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewAHRSProvider returns the registered AHRSProvider called name, case-insensitively, configured by cfg,
+// for host applications choosing an algorithm from their configuration.  m is the first measurement,
+// needed by "kalman".  It returns an error for an unknown name, listing the registered ones, or for an invalid cfg.
+func NewAHRSProvider(name string, cfg Config, m *Measurement) (AHRSProvider, error) {
+	name = strings.ToLower(name)
+	registryMu.RLock()
+	f, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("ahrs: unknown provider %q, expected one of %s", name, strings.Join(Providers(), ", "))
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	p, err := f(cfg, m)
+	if err == nil && cfg.SensorQuaternion != nil {
+		f := *cfg.SensorQuaternion
+		p.SetSensorQuaternion(&f)
+	}
+	return p, err
+}
+
+// NewProvider is NewAHRSProvider with the tunables given as params keyed by the names that SetConfig uses:
+// "minGS", "gpsNoise", "beta" and so on, as listed in Config.  A param the provider doesn't have is an error.
+func NewProvider(name string, m *Measurement, params map[string]float64) (AHRSProvider, error) {
+	cfg := Config{strict: true}
+	for k, v := range params {
+		found := false
+		for _, f := range configFields {
+			if f.name == k {
+				v := v
+				*f.field(&cfg) = &v
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("ahrs: provider %q has no param %q", strings.ToLower(name), k)
+		}
+	}
+	return NewAHRSProvider(name, cfg, m)
+}
+
+func newSimpleProvider(cfg Config, _ *Measurement) (AHRSProvider, error) {
+	params, err := cfg.Check("simple", simpleParams...)
+	if err != nil {
+		return nil, err
+	}
+	s := NewSimpleAHRS()
+	if v, ok := params["minGS"]; ok {
+		s.SetMinGS(v)
+	}
+	if v, ok := params["maxDT"]; ok {
+		s.SetMaxDT(v)
+	}
+	if v, ok := params["blendTime"]; ok {
+		s.SetBlendTime(v)
+	}
+	if v, ok := params["taxiHeadingTau"]; ok {
+		s.SetTaxiHeadingTimeConstant(v)
+	}
+	s.SetVehicleType(cfg.VehicleType)
+	if len(params) > 0 {
+		s.SetConfig(params)
+	}
+	return s, nil
+}
+
+func newKalmanProvider(cfg Config, m *Measurement) (AHRSProvider, error) {
+	if _, err := cfg.Check("kalman"); err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, fmt.Errorf("ahrs: provider %q needs a first measurement", "kalman")
+	}
+	return InitializeKalman(m), nil
+}
+
+func newEKFProvider(cfg Config, _ *Measurement) (AHRSProvider, error) {
+	s := NewEKFAHRS()
+	if err := configureEKF("ekf", s, cfg); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newUKFProvider(cfg Config, _ *Measurement) (AHRSProvider, error) {
+	s := NewUKFAHRS()
+	if err := configureEKF("ukf", &s.EKFState, cfg); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func configureEKF(name string, s *EKFState, cfg Config) error {
+	params, err := cfg.Check(name, ekfParams...)
+	if err != nil {
+		return err
+	}
+	if v, ok := params["minGS"]; ok {
+		s.SetMinGS(v)
+	}
+	if v, ok := params["maxDT"]; ok {
+		s.SetMaxDT(v)
+	}
+	s.SetConfig(params)
+	return nil
+}
+
+func newEKF7Provider(cfg Config, _ *Measurement) (AHRSProvider, error) {
+	params, err := cfg.Check("ekf7", ekf7Params...)
+	if err != nil {
+		return nil, err
+	}
+	s := NewEKF7AHRS()
+	if v, ok := params["maxDT"]; ok {
+		s.SetMaxDT(v)
+	}
+	s.SetConfig(params)
+	return s, nil
+}
+
+func newMadgwickProvider(cfg Config, _ *Measurement) (AHRSProvider, error) {
+	params, err := cfg.Check("madgwick", "maxDT", "beta")
+	if err != nil {
+		return nil, err
+	}
+	s := NewMadgwickAHRS()
+	if v, ok := params["maxDT"]; ok {
+		s.SetMaxDT(v)
+	}
+	s.SetConfig(params)
+	return s, nil
+}
+
+func newMahonyProvider(cfg Config, _ *Measurement) (AHRSProvider, error) {
+	params, err := cfg.Check("mahony", mahonyParams...)
+	if err != nil {
+		return nil, err
+	}
+	s := NewMahonyAHRS()
+	if v, ok := params["maxDT"]; ok {
+		s.SetMaxDT(v)
+	}
+	s.SetConfig(params)
+	return s, nil
+}
+
+// newHybridProvider blends the Simple and Mahony providers, each configured from cfg.
+func newHybridProvider(cfg Config, m *Measurement) (AHRSProvider, error) {
+	allowed := append([]string{"gpsTau", "imuTau"}, simpleParams...)
+	params, err := cfg.Check("hybrid", append(allowed, mahonyParams...)...)
+	if err != nil {
+		return nil, err
+	}
+	cfg.strict = false // Each solution picks out its own params
+	gps, err := newSimpleProvider(cfg, m)
+	if err != nil {
+		return nil, err
+	}
+	imu, err := newMahonyProvider(cfg, m)
+	if err != nil {
+		return nil, err
+	}
+	s := NewHybridAHRS(gps, imu)
+	s.SetConfig(params)
+	return s, nil
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
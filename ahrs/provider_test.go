@@ -0,0 +1,255 @@
+package ahrs
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNewProvider(t *testing.T) {
+	m := kalmanScenario()[0]
+	for _, c := range []struct {
+		name string
+		ok   func(p AHRSProvider) bool
+	}{
+		{"simple", func(p AHRSProvider) bool { _, ok := p.(*SimpleState); return ok }},
+		{"Simple", func(p AHRSProvider) bool { _, ok := p.(*SimpleState); return ok }},
+		{"kalman", func(p AHRSProvider) bool { _, ok := p.(*KalmanState); return ok }},
+		{"ekf", func(p AHRSProvider) bool { _, ok := p.(*EKFState); return ok }},
+		{"UKF", func(p AHRSProvider) bool { _, ok := p.(*UKFState); return ok }},
+		{"madgwick", func(p AHRSProvider) bool { _, ok := p.(*MadgwickState); return ok }},
+		{"Mahony", func(p AHRSProvider) bool { _, ok := p.(*MahonyState); return ok }},
+		{"hybrid", func(p AHRSProvider) bool { _, ok := p.(*HybridState); return ok }},
+	} {
+		p, err := NewProvider(c.name, m, nil)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !c.ok(p) {
+			t.Errorf("%s: got a %T", c.name, p)
+		}
+	}
+
+	for _, c := range []struct {
+		name   string
+		m      *Measurement
+		params map[string]float64
+	}{
+		{"unknown", m, nil},
+		{"", m, nil},
+		{"mahony", m, map[string]float64{"beta": 0.1}},
+		{"kalman", nil, nil},
+		{"simple", m, map[string]float64{"beta": 0.1}},
+		{"kalman", m, map[string]float64{"gpsNoise": 1}},
+	} {
+		if p, err := NewProvider(c.name, c.m, c.params); err == nil {
+			t.Errorf("%q with params %v: expected an error, got a %T", c.name, c.params, p)
+		} else {
+			t.Log(err)
+		}
+	}
+}
+
+func TestNewProviderParams(t *testing.T) {
+	defer NewSimpleAHRS().SetConfig(map[string]float64{
+		"gpsWeight": gpsWeightDefault, "accelWeight": accelWeightDefault})
+
+	p, err := NewProvider("simple", nil, map[string]float64{"minGS": 8, "maxDT": 2, "gpsWeight": 0.1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := p.(*SimpleState); s.minGS != 8 || s.maxDT != 2 || gpsWeight != 0.1 || accelWeight != accelWeightDefault {
+		t.Errorf("simple params not applied: minGS %f, maxDT %f, gpsWeight %f, accelWeight %f",
+			s.minGS, s.maxDT, gpsWeight, accelWeight)
+	}
+
+	p, err = NewProvider("ekf", nil, map[string]float64{"minGS": 8, "gpsNoise": 3, "trackNoise": 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := p.(*EKFState); s.minGS != 8 || s.maxDT != maxDTDefault || s.gpsNoise != 3 ||
+		s.trackNoise != 20*Deg || s.magNoise != ekfMagNoiseDefault*Deg {
+		t.Errorf("ekf params not applied: minGS %f, maxDT %f, gpsNoise %f, trackNoise %f°, magNoise %f°",
+			s.minGS, s.maxDT, s.gpsNoise, s.trackNoise/Deg, s.magNoise/Deg)
+	}
+
+	p, err = NewProvider("ukf", nil, map[string]float64{"maxDT": 2, "gyroNoise": 0.2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := p.(*UKFState); s.maxDT != 2 || math.Abs(s.N.Get(0, 0)-0.04*Deg*Deg) > Small {
+		t.Errorf("ukf params not applied: maxDT %f, gyro noise variance %g", s.maxDT, s.N.Get(0, 0))
+	}
+
+	p, err = NewProvider("madgwick", nil, map[string]float64{"beta": 0.05})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := p.(*MadgwickState); s.beta != 0.05 || s.maxDT != maxDTDefault {
+		t.Errorf("madgwick params not applied: beta %f, maxDT %f", s.beta, s.maxDT)
+	}
+
+	p, err = NewProvider("mahony", nil, map[string]float64{"maxDT": 2, "ki": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := p.(*MahonyState); s.kp != mahonyKpDefault || s.ki != 0 || s.maxDT != 2 {
+		t.Errorf("mahony params not applied: kp %f, ki %f, maxDT %f", s.kp, s.ki, s.maxDT)
+	}
+
+	p, err = NewProvider("hybrid", nil, map[string]float64{"imuTau": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := p.(*HybridState); s.gpsTau != hybridGPSTauDefault || s.imuTau != 1 {
+		t.Errorf("hybrid params not applied: gpsTau %f, imuTau %f", s.gpsTau, s.imuTau)
+	}
+}
+
+// externalProvider stands for a provider registered from another package.
+type externalProvider struct {
+	*MadgwickState
+	cfg Config
+}
+
+var registerExternal sync.Once
+
+func TestNewAHRSProvider(t *testing.T) {
+	registerExternal.Do(func() {
+		Register("External", func(cfg Config, m *Measurement) (AHRSProvider, error) {
+			if _, err := cfg.Check("external", "beta"); err != nil {
+				return nil, err
+			}
+			return &externalProvider{NewMadgwickAHRS(), cfg}, nil
+		})
+	})
+
+	// A config as read from a settings file
+	var cfg Config
+	if err := json.Unmarshal([]byte(`{"beta": 0.05, "maxDT": 2}`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewAHRSProvider("Madgwick", cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := p.(*MadgwickState); s.beta != 0.05 || s.maxDT != 2 {
+		t.Errorf("madgwick config not applied: beta %f, maxDT %f", s.beta, s.maxDT)
+	}
+
+	// The registered provider round-trips through the factory with its config.
+	p, err = NewAHRSProvider("external", Config{Beta: cfg.Beta}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := p.(*externalProvider); !ok || e.cfg.Beta == nil || *e.cfg.Beta != 0.05 {
+		t.Errorf("expected the external provider with its config, got %T %+v", p, p)
+	}
+	if !containsString(Providers(), "external") {
+		t.Errorf("external provider not listed in %v", Providers())
+	}
+	if _, err := NewAHRSProvider("external", cfg, nil); err != nil {
+		t.Errorf("expected the external provider to ignore maxDT: %v", err)
+	}
+
+	zero, negative, nan := 0.0, -1.0, math.NaN()
+	for _, c := range []struct {
+		name string
+		cfg  Config
+	}{
+		{"unknown", Config{}},
+		{"madgwick", Config{Beta: &negative}},
+		{"madgwick", Config{MaxDT: &zero}},
+		{"ekf", Config{GPSNoise: &nan}},
+		{"mahony", Config{Kp: &zero}},
+	} {
+		if p, err := NewAHRSProvider(c.name, c.cfg, nil); err == nil {
+			t.Errorf("%q with config %v: expected an error, got a %T", c.name, c.cfg.Params(), p)
+		} else {
+			t.Log(err)
+		}
+	}
+	if _, err := NewAHRSProvider("unknown", Config{}, nil); err == nil || !strings.Contains(err.Error(), "external") {
+		t.Errorf("expected the error to list the registered providers, got %v", err)
+	}
+	// A shared config's params for other providers are ignored.
+	if _, err := NewAHRSProvider("simple", Config{Beta: cfg.Beta}, nil); err != nil {
+		t.Errorf("expected simple to ignore beta: %v", err)
+	}
+	if _, err := NewAHRSProvider("mahony", Config{Ki: &zero}, nil); err != nil {
+		t.Errorf("expected ki 0 to be accepted: %v", err)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a name twice to panic")
+		}
+	}()
+	Register("Simple", newSimpleProvider)
+}
+
+func TestDescribe(t *testing.T) {
+	defer NewSimpleAHRS().SetConfig(map[string]float64{"gpsWeight": gpsWeightDefault})
+
+	p, err := NewProvider("simple", nil, map[string]float64{"minGS": 8, "gpsWeight": 0.1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := p.Describe()
+	if d.Name != "simple" || d.Params["minGS"] != 8 || d.Params["gpsWeight"] != 0.1 ||
+		d.Params["accelWeight"] != accelWeightDefault {
+		t.Errorf("simple described as %+v", d)
+	}
+	// The description reflects later changes to the tunables.
+	p.SetConfig(map[string]float64{"gpsWeight": 0.2})
+	if w := p.Describe().Params["gpsWeight"]; w != 0.2 {
+		t.Errorf("simple described with gpsWeight %f after setting 0.2", w)
+	}
+
+	m := kalmanScenario()[0]
+	for _, c := range []struct {
+		name   string
+		params map[string]float64
+	}{
+		{"simple", nil},
+		{"kalman", nil},
+		{"ekf", map[string]float64{"gpsNoise": 2}},
+		{"ukf", map[string]float64{"gpsNoise": 2}},
+		{"madgwick", map[string]float64{"beta": 0.05}},
+		{"mahony", map[string]float64{"kp": 3, "ki": 0.2}},
+		{"hybrid", map[string]float64{"gpsTau": 5}},
+	} {
+		p, err := NewProvider(c.name, m, c.params)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		d := p.Describe()
+		if d.Name != c.name {
+			t.Errorf("%T described as %q, expected %q", p, d.Name, c.name)
+		}
+		for k, v := range c.params {
+			if got, ok := d.Params[k]; !ok || got != v {
+				t.Errorf("%s: described %s as %v, expected %f", c.name, k, d.Params[k], v)
+			}
+		}
+		if sd := NewSafeProvider(p).Describe(); sd.Name != c.name || len(sd.Params) != len(d.Params) {
+			t.Errorf("%s: safe provider described as %+v", c.name, sd)
+		}
+	}
+}
+
+func TestNewProviderSimpleTransitions(t *testing.T) {
+	p, err := NewProvider("simple", nil, map[string]float64{"blendTime": 0, "taxiHeadingTau": 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := p.(*SimpleState); s.blendTime != 0 || s.taxiTau != 8 {
+		t.Errorf("blendTime %g and taxiHeadingTau %g, expected 0 and 8", s.blendTime, s.taxiTau)
+	}
+}
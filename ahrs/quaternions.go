@@ -23,26 +23,81 @@ func ToQuaternion(phi, theta, psi float64) (float64, float64, float64, float64)
 	return q0, q1, q2, q3
 }
 
+// toQuaternionDerivatives returns the derivatives of the quaternion ToQuaternion returns
+// with respect to each of phi, theta and psi.
+func toQuaternionDerivatives(phi, theta, psi float64) (d [3][4]float64) {
+	theta = -theta
+	psi = math.Pi/2 - psi
+	cphi := math.Cos(phi / 2)
+	sphi := math.Sin(phi / 2)
+	ctheta := math.Cos(theta / 2)
+	stheta := math.Sin(theta / 2)
+	cpsi := math.Cos(psi / 2)
+	spsi := math.Sin(psi / 2)
+
+	d[0] = [4]float64{
+		0.5 * (-sphi*ctheta*cpsi + cphi*stheta*spsi),
+		0.5 * (cphi*ctheta*cpsi + sphi*stheta*spsi),
+		0.5 * (-sphi*stheta*cpsi + cphi*ctheta*spsi),
+		0.5 * (-sphi*ctheta*spsi - cphi*stheta*cpsi),
+	}
+	// theta and psi were negated above
+	d[1] = [4]float64{
+		-0.5 * (-cphi*stheta*cpsi + sphi*ctheta*spsi),
+		-0.5 * (-sphi*stheta*cpsi - cphi*ctheta*spsi),
+		-0.5 * (cphi*ctheta*cpsi - sphi*stheta*spsi),
+		-0.5 * (-cphi*stheta*spsi - sphi*ctheta*cpsi),
+	}
+	d[2] = [4]float64{
+		-0.5 * (-cphi*ctheta*spsi + sphi*stheta*cpsi),
+		-0.5 * (-sphi*ctheta*spsi - cphi*stheta*cpsi),
+		-0.5 * (-cphi*stheta*spsi + sphi*ctheta*cpsi),
+		-0.5 * (cphi*ctheta*cpsi + sphi*stheta*spsi),
+	}
+	return
+}
+
 // FromQuaternion calculates the Tait-Bryan angles phi, theta, psi corresponding to
-// the quaternion
+// the quaternion, with the same conventions as ToQuaternion: psi in [0, 2π).
+// At the pitch poles theta = ±π/2 roll and heading rotate about the same axis and only
+// their combination is defined; there phi is returned as 0 and the whole rotation is folded into psi.
 func FromQuaternion(q0, q1, q2, q3 float64) (phi float64, theta float64, psi float64) {
-	phi = math.Atan2(2*(q0*q1+q2*q3), (q0*q0 - q1*q1 - q2*q2 + q3*q3))
-
-	v := -2 * (q0*q2 - q3*q1) / (q0*q0 + q1*q1 + q2*q2 + q3*q3)
-	if v >= 1 {
-		theta = Pi / 2
-	} else if v <= -1 {
-		theta = -Pi / 2
-	} else {
-		theta = math.Asin(v)
+	// Work with the half angles a, b, c of ToQuaternion's internal phi, -theta and π/2-psi, for which
+	// q0-q2, q1+q3 = (cos b - sin b) (cos, sin)(a+c) and q0+q2, q1-q3 = (cos b + sin b) (cos, sin)(a-c).
+	// Each sum and difference comes from a pair of components of the same magnitude, which stays well
+	// conditioned right up to the poles, where one of the pairs vanishes.
+	hm := math.Hypot(q0-q2, q1+q3)
+	hp := math.Hypot(q0+q2, q1-q3)
+	b := math.Atan2(hp, hm) - math.Pi/4
+	var sum, diff float64
+	switch {
+	case hp < poleTolerance*hm: // Pitch up
+		sum = math.Atan2(q1+q3, q0-q2)
+		diff = -sum
+	case hm < poleTolerance*hp: // Pitch down
+		diff = math.Atan2(q1-q3, q0+q2)
+		sum = -diff
+	default:
+		sum = math.Atan2(q1+q3, q0-q2)
+		diff = math.Atan2(q1-q3, q0+q2)
 	}
-	psi = math.Pi/2 - math.Atan2(2*(q0*q3+q1*q2), (q0*q0+q1*q1-q2*q2-q3*q3))
+
+	phi = math.Remainder(sum+diff, 2*math.Pi)
+	theta = -2 * b
+	psi = math.Mod(math.Pi/2-(sum-diff), 2*math.Pi)
 	if psi < 0 {
 		psi += 2 * math.Pi
 	}
+	if psi >= 2*math.Pi {
+		psi = 0
+	}
 	return
 }
 
+// poleTolerance is how small a pair of components in FromQuaternion must be relative to the other
+// for the attitude to be taken as being at a pitch pole.
+const poleTolerance = 1e-14
+
 // VarFromQuaternion returns the standard deviation of the Tate-Bryan angles phi, theta, psi
 // corresponding to the quaternion q0, q1, q2, q3 with stdev dq0, dq1, dq2, dq3
 func VarFromQuaternion(q0, q1, q2, q3, dq0, dq1, dq2, dq3 float64) (float64, float64, float64) {
@@ -93,22 +148,133 @@ func QuaternionAToB(a1, a2, a3, b1, b2, b3 float64) (q0, q1, q2, q3 float64) {
 	return QuaternionNormalize(q0, q1, q2, q3)
 }
 
-// QuaternionRotate rotates a quaternion Qea by a small rate-of-change vector Ha
-// (e.g. as measured by a gyro in the aircraft frame), Qea -> Qea + 0.5*Qea*Ha
+// QuaternionRotate rotates a quaternion Qea by a rotation vector Ha, in radians
+// (e.g. the rates measured by a gyro in the aircraft frame times the time step), Qea -> Qea*exp(Ha/2).
+// The exponential map is exact for a constant rate over the step, however large the step's angle.
 func QuaternionRotate(q0, q1, q2, q3, h1, h2, h3 float64) (r0, r1, r2, r3 float64) {
-	r0 = q0 + 0.5*(-q1*h1-q2*h2-q3*h3)
-	r1 = q1 + 0.5*(q0*h1-q3*h2+q2*h3)
-	r2 = q2 + 0.5*(q3*h1+q0*h2-q1*h3)
-	r3 = q3 + 0.5*(-q2*h1+q1*h2+q0*h3)
+	c, k1, k2, k3 := QuaternionExp(0, h1/2, h2/2, h3/2)
+	r0 = q0*c - q1*k1 - q2*k2 - q3*k3
+	r1 = q1*c + q0*k1 - q3*k2 + q2*k3
+	r2 = q2*c + q3*k1 + q0*k2 - q1*k3
+	r3 = q3*c - q2*k1 + q1*k2 + q0*k3
 	return QuaternionNormalize(r0, r1, r2, r3)
 }
 
+// quaternionRK4 integrates q' = 0.5*q*w over dt by fourth-order Runge-Kutta, given the rates w, rad/s,
+// a1, a2, a3 at the start of the interval, m1, m2, m3 at its middle and b1, b2, b3 at its end.
+// Unlike a single rotation by one rate, this follows the rate vector as it turns within the interval,
+// which otherwise leaves a coning error.
+func quaternionRK4(q0, q1, q2, q3, a1, a2, a3, m1, m2, m3, b1, b2, b3, dt float64) (r0, r1, r2, r3 float64) {
+	f := func(q0, q1, q2, q3, w1, w2, w3 float64) (d0, d1, d2, d3 float64) {
+		return 0.5 * (-q1*w1 - q2*w2 - q3*w3), 0.5 * (q0*w1 - q3*w2 + q2*w3),
+			0.5 * (q3*w1 + q0*w2 - q1*w3), 0.5 * (-q2*w1 + q1*w2 + q0*w3)
+	}
+	k10, k11, k12, k13 := f(q0, q1, q2, q3, a1, a2, a3)
+	k20, k21, k22, k23 := f(q0+dt/2*k10, q1+dt/2*k11, q2+dt/2*k12, q3+dt/2*k13, m1, m2, m3)
+	k30, k31, k32, k33 := f(q0+dt/2*k20, q1+dt/2*k21, q2+dt/2*k22, q3+dt/2*k23, m1, m2, m3)
+	k40, k41, k42, k43 := f(q0+dt*k30, q1+dt*k31, q2+dt*k32, q3+dt*k33, b1, b2, b3)
+	return QuaternionNormalize(
+		q0+dt/6*(k10+2*k20+2*k30+k40),
+		q1+dt/6*(k11+2*k21+2*k31+k41),
+		q2+dt/6*(k12+2*k22+2*k32+k42),
+		q3+dt/6*(k13+2*k23+2*k33+k43),
+	)
+}
+
+// QuaternionSlerp returns the quaternion a fraction t of the way from quaternion a to quaternion b,
+// interpolating at a constant rate along the shorter rotation between them.
+// t is clamped to [0, 1], so it never extrapolates beyond a or b.
+func QuaternionSlerp(a0, a1, a2, a3, b0, b1, b2, b3, t float64) (r0, r1, r2, r3 float64) {
+	t = math.Max(0, math.Min(1, t))
+	d := a0*b0 + a1*b1 + a2*b2 + a3*b3
+	if d < 0 {
+		b0, b1, b2, b3, d = -b0, -b1, -b2, -b3, -d
+	}
+	ka, kb := 1-t, t
+	if d < 1-Small {
+		th := math.Acos(d)
+		ka, kb = math.Sin(ka*th)/math.Sin(th), math.Sin(kb*th)/math.Sin(th)
+	}
+	return QuaternionNormalize(ka*a0+kb*b0, ka*a1+kb*b1, ka*a2+kb*b2, ka*a3+kb*b3)
+}
+
+// QuaternionExp returns the exponential of quaternion q, e^q0 * (cos|v|, sin|v| v/|v|) for the vector part v.
+// The exponential of a pure vector v is the unit quaternion rotating by 2|v| about v.
+func QuaternionExp(q0, q1, q2, q3 float64) (r0, r1, r2, r3 float64) {
+	vv := math.Sqrt(q1*q1 + q2*q2 + q3*q3)
+	k := 1 - vv*vv/6 // sin|v|/|v|, by its series for small |v|
+	if vv > 1e-4 {
+		k = math.Sin(vv) / vv
+	}
+	e := math.Exp(q0)
+	return e * math.Cos(vv), e * k * q1, e * k * q2, e * k * q3
+}
+
+// QuaternionLog returns the natural logarithm of quaternion q, (ln|q|, atan2(|v|, q0) v/|v|) for the vector part v,
+// the inverse of QuaternionExp.  For a unit quaternion the vector part is half the rotation vector.
+// A negative real q has no unique logarithm; the one about the first axis is returned.
+func QuaternionLog(q0, q1, q2, q3 float64) (r0, r1, r2, r3 float64) {
+	vv := math.Sqrt(q1*q1 + q2*q2 + q3*q3)
+	qq := math.Sqrt(q0*q0 + vv*vv)
+	if vv < 1e-4*qq && q0 <= 0 {
+		if vv == 0 {
+			return math.Log(qq), math.Pi, 0, 0
+		}
+		return math.Log(qq), math.Pi * q1 / vv, math.Pi * q2 / vv, math.Pi * q3 / vv
+	}
+	var k float64 // atan2(|v|, q0)/|v|
+	if x := vv / q0; vv < 1e-4*qq {
+		k = (1 - x*x/3) / q0 // by its series for small |v|
+	} else {
+		k = math.Atan2(vv, q0) / vv
+	}
+	return math.Log(qq), k * q1, k * q2, k * q3
+}
+
+// QuaternionRates returns the body rates, in °/s, that rotate quaternion a into quaternion e over time dt:
+// the rotation conj(a)*e expressed as a rate about each axis of the rotated frame.
+func QuaternionRates(a0, a1, a2, a3, e0, e1, e2, e3, dt float64) (b1, b2, b3 float64) {
+	d0 := a0*e0 + a1*e1 + a2*e2 + a3*e3
+	d1 := a0*e1 - a1*e0 - a2*e3 + a3*e2
+	d2 := a0*e2 + a1*e3 - a2*e0 - a3*e1
+	d3 := a0*e3 - a1*e2 + a2*e1 - a3*e0
+	if d0 < 0 {
+		d0, d1, d2, d3 = -d0, -d1, -d2, -d3
+	}
+	if dd := math.Sqrt(d1*d1 + d2*d2 + d3*d3); dd > 0 && dt > 0 {
+		k := RadToDeg(2 * math.Atan2(dd, d0) / dd / dt)
+		b1, b2, b3 = d1*k, d2*k, d3*k
+	}
+	return
+}
+
 // RotationMatrixToQuaternion computes the quaternion q corresponding to a rotation matrix r.
+// It takes the largest component from the diagonal and the rest from it, so that it stays accurate
+// near a half turn, where q0 is small; q0 is then not necessarily positive.
 func RotationMatrixToQuaternion(r [3][3]float64) (q0, q1, q2, q3 float64) {
-	q0 = math.Sqrt(1+r[0][0]+r[1][1]+r[2][2]) / 2
-	q1 = (r[2][1] - r[1][2]) / (4 * q0)
-	q2 = (r[0][2] - r[2][0]) / (4 * q0)
-	q3 = (r[1][0] - r[0][1]) / (4 * q0)
+	t0, t1, t2, t3 := r[0][0]+r[1][1]+r[2][2], r[0][0], r[1][1], r[2][2]
+	switch {
+	case t0 >= t1 && t0 >= t2 && t0 >= t3:
+		q0 = math.Sqrt(1+t0) / 2
+		q1 = (r[2][1] - r[1][2]) / (4 * q0)
+		q2 = (r[0][2] - r[2][0]) / (4 * q0)
+		q3 = (r[1][0] - r[0][1]) / (4 * q0)
+	case t1 >= t2 && t1 >= t3:
+		q1 = math.Sqrt(1+t1-r[1][1]-r[2][2]) / 2
+		q0 = (r[2][1] - r[1][2]) / (4 * q1)
+		q2 = (r[0][1] + r[1][0]) / (4 * q1)
+		q3 = (r[0][2] + r[2][0]) / (4 * q1)
+	case t2 >= t3:
+		q2 = math.Sqrt(1+t2-r[0][0]-r[2][2]) / 2
+		q0 = (r[0][2] - r[2][0]) / (4 * q2)
+		q1 = (r[0][1] + r[1][0]) / (4 * q2)
+		q3 = (r[1][2] + r[2][1]) / (4 * q2)
+	default:
+		q3 = math.Sqrt(1+t3-r[0][0]-r[1][1]) / 2
+		q0 = (r[1][0] - r[0][1]) / (4 * q3)
+		q1 = (r[0][2] + r[2][0]) / (4 * q3)
+		q2 = (r[1][2] + r[2][1]) / (4 * q3)
+	}
 	return
 }
 
@@ -70,6 +70,37 @@ func TestRoundTrips(t *testing.T) {
 	}
 }
 
+func TestEulerQuaternionRoundTrip(t *testing.T) {
+	pitches := []float64{-90, -89.999, -89.995, -89.99, -75, -45, -10, 0, 10, 45, 75, 89.99, 89.995, 89.999, 90}
+	for roll := -180.0; roll <= 180; roll += 7.5 {
+		for _, pitch := range pitches {
+			for heading := 0.0; heading < 360; heading += 7.5 {
+				q0, q1, q2, q3 := ToQuaternion(roll*Deg, pitch*Deg, heading*Deg)
+				phi, theta, psi := FromQuaternion(q0, q1, q2, q3)
+				if psi < 0 || psi >= 2*Pi {
+					t.Errorf("heading %.3f out of range for %.3f, %.3f, %.3f", psi/Deg, roll, pitch, heading)
+				}
+				r0, r1, r2, r3 := ToQuaternion(phi, theta, psi)
+				if r0*q0+r1*q1+r2*q2+r3*q3 < 0 {
+					r0, r1, r2, r3 = -r0, -r1, -r2, -r3
+				}
+				if d := math.Max(math.Max(math.Abs(r0-q0), math.Abs(r1-q1)), math.Max(math.Abs(r2-q2), math.Abs(r3-q3))); d > 1e-12 {
+					t.Errorf("%.3f, %.3f, %.3f -> %.6f, %.6f, %.6f: quaternions differ by %g",
+						roll, pitch, heading, phi/Deg, theta/Deg, psi/Deg, d)
+				}
+			}
+		}
+	}
+
+	// At the poles the roll is folded into the heading.
+	for _, pitch := range []float64{-90, 90} {
+		phi, theta, _ := FromQuaternion(ToQuaternion(30*Deg, pitch*Deg, 60*Deg))
+		if phi != 0 || math.Abs(theta-pitch*Deg) > 1e-12 {
+			t.Errorf("expected roll 0 and pitch %.0f at the pole, got %.6f, %.6f", pitch, phi/Deg, theta/Deg)
+		}
+	}
+}
+
 func TestSpecificToQuaternion(t *testing.T) {
 	phis := []float64{0, 0, 0, 0, 0, 0, 0, Pi / 3, Pi / 3, -2 * Pi / 3}
 	thetas := []float64{0, 0, 0, 0, 0, Pi / 3, -Pi / 3, 0, 0, 0}
@@ -374,3 +405,125 @@ func TestSmallCompositions(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestQuaternionRotateLargeSteps(t *testing.T) {
+	// Integrate a full turn about a skew axis, which brings the quaternion back to minus itself.
+	n1, n2, n3 := 1.0/3, 2.0/3, -2.0/3
+	q0, q1, q2, q3 := ToQuaternion(10*Deg, -20*Deg, 30*Deg)
+	// firstOrder is the previous integration, Qea -> Qea + 0.5*Qea*Ha, for comparison.
+	firstOrder := func(q0, q1, q2, q3, h1, h2, h3 float64) (float64, float64, float64, float64) {
+		return QuaternionNormalize(q0+0.5*(-q1*h1-q2*h2-q3*h3), q1+0.5*(q0*h1-q3*h2+q2*h3),
+			q2+0.5*(q3*h1+q0*h2-q1*h3), q3+0.5*(-q2*h1+q1*h2+q0*h3))
+	}
+	turnErr := func(rotate func(q0, q1, q2, q3, h1, h2, h3 float64) (float64, float64, float64, float64),
+		step float64) float64 {
+		r0, r1, r2, r3 := q0, q1, q2, q3
+		for i := 0; i < int(math.Round(360/step)); i++ {
+			r0, r1, r2, r3 = rotate(r0, r1, r2, r3, n1*step*Deg, n2*step*Deg, n3*step*Deg)
+		}
+		return math.Max(math.Max(math.Abs(r0+q0), math.Abs(r1+q1)), math.Max(math.Abs(r2+q2), math.Abs(r3+q3)))
+	}
+
+	for _, step := range []float64{0.1, 0.5, 1, 2, 5, 10, 20} {
+		exact, approx := turnErr(QuaternionRotate, step), turnErr(firstOrder, step)
+		t.Logf("%4.1f° steps: error %.1e, first-order %.1e", step, exact, approx)
+		if exact > 1e-12 {
+			t.Errorf("%4.1f° steps: a full turn was off by %g", step, exact)
+		}
+		// The first-order error per step is O(θ³), so O(θ²) over the turn.
+		if step >= 1 && approx < 1e-6*step*step {
+			t.Errorf("%4.1f° steps: expected the first-order integration to be off by O(θ²), got %g", step, approx)
+		}
+	}
+}
+
+func BenchmarkQuaternionRotate(b *testing.B) {
+	q0, q1, q2, q3 := ToQuaternion(10*Deg, -20*Deg, 30*Deg)
+	for i := 0; i < b.N; i++ {
+		q0, q1, q2, q3 = QuaternionRotate(q0, q1, q2, q3, 0.01, 0.02, -0.02)
+	}
+}
+
+func TestQuaternionSlerp(t *testing.T) {
+	a0, a1, a2, a3 := ToQuaternion(0, 0, 350*Deg)
+	b0, b1, b2, b3 := ToQuaternion(0, 0, 30*Deg)
+	// Either sign of b is the same rotation: the interpolation goes the short way, across north.
+	for _, sign := range []float64{1, -1} {
+		for _, f := range []float64{0, 0.25, 0.5, 1} {
+			r0, r1, r2, r3 := QuaternionSlerp(a0, a1, a2, a3, sign*b0, sign*b1, sign*b2, sign*b3, f)
+			if !checkQ(quaternion.Quaternion{W: r0, X: r1, Y: r2, Z: r3}, 0, 0, -10*Deg+f*40*Deg) {
+				t.Errorf("slerp %.2f of the way from 350° to 30° (sign %.0f) is wrong", f, sign)
+			}
+		}
+	}
+
+	// Nearly identical quaternions don't divide by zero.
+	r0, r1, r2, r3 := QuaternionSlerp(a0, a1, a2, a3, a0, a1, a2, a3, 0.5)
+	if math.Abs(r0-a0) > Small || math.Abs(r1-a1) > Small || math.Abs(r2-a2) > Small || math.Abs(r3-a3) > Small {
+		t.Errorf("slerp between a quaternion and itself gave %f, %f, %f, %f", r0, r1, r2, r3)
+	}
+}
+
+func TestRotationMatrixToQuaternion(t *testing.T) {
+	// Round trips, including half turns about each axis, where 1 + the trace of the matrix is 0.
+	for _, a := range [][3]float64{
+		{0, 0, 0}, {10, -20, 30}, {0, 0, 180}, {180, 0, 0}, {0, 90, 0}, {15.36, 0, 180}, {15.36, 0, -179.9999},
+		{-170, 40, 100}, {180, 0, 180}, {30, -60, -150},
+	} {
+		e0, e1, e2, e3 := ToQuaternion(a[0]*Deg, a[1]*Deg, a[2]*Deg)
+		q0, q1, q2, q3 := RotationMatrixToQuaternion(*QuaternionToRotationMatrix(e0, e1, e2, e3))
+		q0, q1, q2, q3 = QuaternionSign(q0, q1, q2, q3, e0, e1, e2, e3)
+		if d := math.Abs(q0-e0) + math.Abs(q1-e1) + math.Abs(q2-e2) + math.Abs(q3-e3); !(d < 1e-12) {
+			t.Errorf("attitude %v came back as %f, %f, %f, %f, expected %f, %f, %f, %f",
+				a, q0, q1, q2, q3, e0, e1, e2, e3)
+		}
+	}
+}
+
+func TestQuaternionExpLog(t *testing.T) {
+	for _, v := range [][3]float64{
+		{0, 0, 0}, {1e-9, 0, 0}, {1e-6, -2e-6, 3e-6}, {1e-3, 0, -1e-3},
+		{0.1, 0.2, -0.3}, {0.5, -0.5, 0.5}, {0, 1.2, 0}, {-1, 0.5, 0.8},
+	} {
+		q0, q1, q2, q3 := QuaternionExp(0, v[0], v[1], v[2])
+		if n := math.Sqrt(q0*q0 + q1*q1 + q2*q2 + q3*q3); math.Abs(n-1) > Small {
+			t.Errorf("exp of pure vector %v isn't a unit quaternion: norm %g", v, n)
+		}
+		r0, r1, r2, r3 := QuaternionLog(q0, q1, q2, q3)
+		if math.Abs(r0) > 1e-12 || math.Abs(r1-v[0]) > 1e-12 || math.Abs(r2-v[1]) > 1e-12 || math.Abs(r3-v[2]) > 1e-12 {
+			t.Errorf("log(exp(%v)) = %g, %g, %g, %g", v, r0, r1, r2, r3)
+		}
+	}
+
+	// The exponential of half a rotation vector is the rotation quaternion: here a 30° turn to the right.
+	q0, q1, q2, q3 := QuaternionExp(0, 0, 0, -15*Deg)
+	if math.Abs(q0-math.Cos(15*Deg)) > Small || q1 != 0 || q2 != 0 || math.Abs(q3+math.Sin(15*Deg)) > Small {
+		t.Errorf("exp of half a 30° yaw is wrong: %f, %f, %f, %f", q0, q1, q2, q3)
+	}
+
+	// A non-unit quaternion keeps its norm in the real part.
+	r0, r1, r2, r3 := QuaternionLog(QuaternionExp(0.7, 0.1, -0.2, 0.3))
+	if math.Abs(r0-0.7) > 1e-12 || math.Abs(r1-0.1) > 1e-12 || math.Abs(r2+0.2) > 1e-12 || math.Abs(r3-0.3) > 1e-12 {
+		t.Errorf("log(exp(q)) of a non-unit quaternion gave %g, %g, %g, %g", r0, r1, r2, r3)
+	}
+}
+
+func TestToQuaternionDerivatives(t *testing.T) {
+	const d = 1e-6
+	for _, a := range [][3]float64{{0, 0, 0}, {0.3, -0.2, 1}, {-1, 0.6, 4}, {2, 1.2, -0.5}} {
+		dq := toQuaternionDerivatives(a[0], a[1], a[2])
+		for i := 0; i < 3; i++ {
+			ap, am := a, a
+			ap[i] += d
+			am[i] -= d
+			var qp, qm [4]float64
+			qp[0], qp[1], qp[2], qp[3] = ToQuaternion(ap[0], ap[1], ap[2])
+			qm[0], qm[1], qm[2], qm[3] = ToQuaternion(am[0], am[1], am[2])
+			for j := 0; j < 4; j++ {
+				if n := (qp[j] - qm[j]) / (2 * d); math.Abs(n-dq[i][j]) > 1e-8 {
+					t.Errorf("at %v dq%d/da%d is %g, numerically %g", a, j, i, dq[i][j], n)
+				}
+			}
+		}
+	}
+}
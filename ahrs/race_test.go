@@ -0,0 +1,6 @@
+//go:build race
+
+package ahrs
+
+// raceEnabled is set when testing with the race detector, which makes extra allocations.
+const raceEnabled = true
@@ -0,0 +1,40 @@
+package ahrs
+
+// RawMeasurement holds the readings of an IMU and magnetometer as the raw 16-bit counts that their ADCs report,
+// before conversion to the physical units of a Measurement.
+type RawMeasurement struct {
+	SValid, MValid bool    // Do we have valid accel/gyro and magnetometer readings?
+	A1, A2, A3     int16   // Accelerometer counts
+	B1, B2, B3     int16   // Gyro counts
+	M1, M2, M3     int16   // Magnetometer counts
+	T              float64 // Timestamp of the readings, s
+}
+
+// ScaleConfig holds the sensitivities of the sensors, as given in their datasheets for the configured full-scale range.
+type ScaleConfig struct {
+	CountsPerG     float64 // Accelerometer counts per G
+	CountsPerDegS  float64 // Gyro counts per °/s
+	CountsPerGauss float64 // Magnetometer counts per gauss
+}
+
+// gaussToMicroTesla converts a magnetic field in gauss into µT, the unit of Measurement.
+const gaussToMicroTesla = 100
+
+// ToMeasurement returns a new Measurement holding r converted to physical units with the sensitivities c:
+// accelerations in G, gyro rates in °/s and the magnetic field in µT.
+// A sensor whose sensitivity isn't positive is left out, as if its reading weren't valid.
+func (r *RawMeasurement) ToMeasurement(c ScaleConfig) (m *Measurement) {
+	m = NewMeasurement()
+	m.T = r.T
+	if r.SValid && c.CountsPerG > 0 && c.CountsPerDegS > 0 {
+		m.SValid = true
+		m.A1, m.A2, m.A3 = float64(r.A1)/c.CountsPerG, float64(r.A2)/c.CountsPerG, float64(r.A3)/c.CountsPerG
+		m.B1, m.B2, m.B3 = float64(r.B1)/c.CountsPerDegS, float64(r.B2)/c.CountsPerDegS, float64(r.B3)/c.CountsPerDegS
+	}
+	if r.MValid && c.CountsPerGauss > 0 {
+		m.MValid = true
+		k := gaussToMicroTesla / c.CountsPerGauss
+		m.M1, m.M2, m.M3 = float64(r.M1)*k, float64(r.M2)*k, float64(r.M3)*k
+	}
+	return
+}
@@ -0,0 +1,53 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRawMeasurementToMeasurement(t *testing.T) {
+	// An MPU-9250 at ±16 G and ±2000 °/s, with an HMC5883L magnetometer at ±1.3 gauss.
+	c := ScaleConfig{CountsPerG: 2048, CountsPerDegS: 16.4, CountsPerGauss: 1090}
+	r := RawMeasurement{
+		SValid: true, MValid: true,
+		A1: 32767, A2: -32768, A3: 2048,
+		B1: 32767, B2: -32768, B3: -164,
+		M1: 218, M2: -1090, M3: 0,
+		T: 12.5,
+	}
+	m := r.ToMeasurement(c)
+	for _, v := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"A1", m.A1, 32767.0 / 2048}, // Just short of full scale
+		{"A2", m.A2, -16},
+		{"A3", m.A3, 1},
+		{"B1", m.B1, 1997.99},
+		{"B2", m.B2, -1998.05},
+		{"B3", m.B3, -10},
+		{"M1", m.M1, 20},
+		{"M2", m.M2, -100},
+		{"M3", m.M3, 0},
+		{"T", m.T, 12.5},
+	} {
+		if math.Abs(v.got-v.want) > 0.01 {
+			t.Errorf("%s: expected %f, got %f", v.name, v.want, v.got)
+		}
+	}
+	if !m.SValid || !m.MValid || m.WValid || m.UValid {
+		t.Errorf("validity flags wrong: %+v", m)
+	}
+	if m.M == nil {
+		t.Error("converted measurement has no noise covariance")
+	}
+
+	// Without a sensitivity, a sensor is left out.
+	if m := r.ToMeasurement(ScaleConfig{CountsPerG: 2048, CountsPerDegS: 16.4}); m.MValid || m.M1 != 0 {
+		t.Errorf("expected no magnetometer without its sensitivity, got %f valid %t", m.M1, m.MValid)
+	}
+	r.SValid = false
+	if m := r.ToMeasurement(c); m.SValid || m.A3 != 0 {
+		t.Errorf("expected an invalid IMU reading to stay invalid, got %f valid %t", m.A3, m.SValid)
+	}
+}
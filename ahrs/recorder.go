@@ -0,0 +1,82 @@
+package ahrs
+
+// Recorder wraps an AHRSProvider and keeps the latest measurements and the states they led to,
+// for a post-mortem after an anomaly.
+// The buffers are allocated up front, so once the first Compute has sized the matrices
+// Compute makes no further allocations.
+type Recorder struct {
+	AHRSProvider
+	ms   []Measurement
+	ss   []State
+	next int // Index of the slot the next Compute will fill
+	n    int // Number of slots filled
+}
+
+// NewRecorder returns a Recorder wrapping p, which keeps the latest capacity measurements and states.
+func NewRecorder(p AHRSProvider, capacity int) *Recorder {
+	return &Recorder{
+		AHRSProvider: p,
+		ms:           make([]Measurement, capacity),
+		ss:           make([]State, capacity),
+	}
+}
+
+// Compute runs the wrapped provider's computations and records m along with the resulting state.
+func (r *Recorder) Compute(m *Measurement) {
+	if len(r.ms) == 0 {
+		r.AHRSProvider.Compute(m)
+		return
+	}
+
+	// Record m before the provider can update its noise covariance.
+	rm, rs := &r.ms[r.next], &r.ss[r.next]
+	mm := rm.M
+	*rm = *m
+	rm.M = copyMatrixInto(mm, m.M)
+
+	r.AHRSProvider.Compute(m)
+	s := r.AHRSProvider.GetState()
+	sm, sn := rs.M, rs.N
+	*rs = *s
+	rs.M, rs.N = copyMatrixInto(sm, s.M), copyMatrixInto(sn, s.N)
+	rs.logMap = nil
+
+	r.next = (r.next + 1) % len(r.ms)
+	if r.n < len(r.ms) {
+		r.n++
+	}
+}
+
+// Dump returns copies of the recorded measurements and states, oldest first.
+func (r *Recorder) Dump() (ms []*Measurement, ss []*State) {
+	ms, ss = make([]*Measurement, r.n), make([]*State, r.n)
+	start := r.next - r.n
+	if start < 0 {
+		start += len(r.ms)
+	}
+	for i := 0; i < r.n; i++ {
+		j := (start + i) % len(r.ms)
+		m, s := r.ms[j], r.ss[j]
+		m.M, s.M, s.N = copyMatrixInto(nil, m.M), copyMatrixInto(nil, s.M), copyMatrixInto(nil, s.N)
+		ms[i], ss[i] = &m, &s
+	}
+	return
+}
+
+// Clear discards everything recorded so far.
+func (r *Recorder) Clear() {
+	r.next, r.n = 0, 0
+}
+
+// copyMatrixInto copies src into dst, reusing dst if it is the right size, and returns the copy.
+// It returns nil if src is nil.
+func copyMatrixInto(dst, src *Matrix) *Matrix {
+	if src == nil {
+		return nil
+	}
+	if dst == nil || dst.rows != src.rows || dst.cols != src.cols {
+		return src.Copy()
+	}
+	copy(dst.elements, src.elements)
+	return dst
+}
@@ -0,0 +1,77 @@
+package ahrs
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	const capacity = 50
+	ms := representativeMeasurements()[:120]
+	r := NewRecorder(NewSimpleAHRS(), capacity)
+	for _, m := range ms {
+		r.Compute(m)
+	}
+	rms, rss := r.Dump()
+	if len(rms) != capacity || len(rss) != capacity {
+		t.Fatalf("expected %d measurements and states, got %d and %d", capacity, len(rms), len(rss))
+	}
+	for i, m := range ms[len(ms)-capacity:] {
+		if rms[i].T != m.T || rms[i].B3 != m.B3 {
+			t.Errorf("measurement %d: expected T %f, got %f", i, m.T, rms[i].T)
+		}
+		if rss[i].T != m.T {
+			t.Errorf("state %d: expected T %f, got %f", i, m.T, rss[i].T)
+		}
+	}
+	if s, rs := r.GetState(), rss[capacity-1]; rs.E0 != s.E0 || rs.E1 != s.E1 || rs.E2 != s.E2 || rs.E3 != s.E3 {
+		t.Error("latest recorded state doesn't match the provider's")
+	}
+
+	// The dump must not change as the recorder carries on.
+	r.Compute(ms[0])
+	if rms[0].T != ms[len(ms)-capacity].T {
+		t.Error("Dump returned the recorder's own buffers")
+	}
+
+	r.Clear()
+	if rms, _ := r.Dump(); len(rms) != 0 {
+		t.Errorf("expected an empty dump after Clear, got %d measurements", len(rms))
+	}
+}
+
+func TestRecorderPartial(t *testing.T) {
+	ms := representativeMeasurements()[:5]
+	r := NewRecorder(NewSimpleAHRS(), 10)
+	for _, m := range ms {
+		r.Compute(m)
+	}
+	rms, _ := r.Dump()
+	if len(rms) != len(ms) || rms[0].T != ms[0].T || rms[4].T != ms[4].T {
+		t.Errorf("expected the %d measurements computed, oldest first, got %d", len(ms), len(rms))
+	}
+}
+
+func TestRecorderAllocations(t *testing.T) {
+	ms := representativeMeasurements()
+	r := NewRecorder(NewSimpleAHRS(), 100)
+	i := 0
+	for i < 600 {
+		r.Compute(ms[i])
+		i++
+	}
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	n := len(ms) - i
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i < len(ms) {
+		r.Compute(ms[i])
+		i++
+	}
+	runtime.ReadMemStats(&after)
+	if allocs := after.Mallocs - before.Mallocs; allocs > 0 {
+		t.Errorf("Recorder.Compute made %d allocations in %d calls, should make none", allocs, n)
+	}
+}
@@ -0,0 +1,176 @@
+package ahrs
+
+import "math"
+
+// ResidualChannel identifies a measurement channel checked by a ResidualMonitor.
+type ResidualChannel int
+
+const (
+	ResidualW1 ResidualChannel = iota // GPS velocity, kt
+	ResidualW2
+	ResidualW3
+	ResidualA1 // Accelerometer, G
+	ResidualA2
+	ResidualA3
+	ResidualB1 // Gyro, °/s
+	ResidualB2
+	ResidualB3
+	NumResidualChannels
+)
+
+var residualChannelNames = [NumResidualChannels]string{"W1", "W2", "W3", "A1", "A2", "A3", "B1", "B2", "B3"}
+
+func (c ResidualChannel) String() string {
+	return residualChannelNames[c]
+}
+
+// residualSigmaDefaults are the residuals that are tolerated on each channel, in its own units.
+var residualSigmaDefaults = [NumResidualChannels]float64{1, 1, 1, 0.02, 0.02, 0.02, 0.1, 0.1, 0.1}
+
+// PredictingProvider is an AHRSProvider that can predict the measurement implied by its current state.
+type PredictingProvider interface {
+	AHRSProvider
+	PredictMeasurement() *Measurement
+}
+
+// ResidualStats summarizes the residuals, measurement minus prediction, of a channel over the window.
+type ResidualStats struct {
+	Mean, Variance float64
+	N              int     // Number of residuals in the window
+	Normalized     float64 // Mean divided by the channel's sigma
+	Flagged        bool    // Whether Normalized has exceeded the threshold for longer than the minimum time
+}
+
+// residualWindow keeps the latest residuals of a channel in a ring buffer, with their running sums.
+type residualWindow struct {
+	buf       []float64
+	next, n   int
+	sum, sum2 float64
+	tExceed   float64 // Time from which the residual has exceeded the threshold, NaN if it doesn't
+	flagged   bool
+}
+
+func (w *residualWindow) add(v float64) {
+	if w.n == len(w.buf) {
+		old := w.buf[w.next]
+		w.sum -= old
+		w.sum2 -= old * old
+	} else {
+		w.n++
+	}
+	w.buf[w.next] = v
+	w.sum += v
+	w.sum2 += v * v
+	w.next = (w.next + 1) % len(w.buf)
+}
+
+func (w *residualWindow) reset() {
+	w.next, w.n, w.sum, w.sum2 = 0, 0, 0, 0
+	w.tExceed, w.flagged = math.NaN(), false
+}
+
+// ResidualMonitor wraps a PredictingProvider, comparing each measurement passed to Compute against
+// the measurement the provider predicted beforehand.  A channel whose mean residual over the window
+// stays more than threshold times its sigma away from zero for longer than the minimum time is flagged,
+// which is how a failing accelerometer axis or a mis-scaled gyro shows up in flight.
+// Predicting allocates a Measurement, so unlike the wrapped provider Compute isn't allocation-free.
+type ResidualMonitor struct {
+	PredictingProvider
+	threshold float64 // Normalized residual above which a channel is suspect
+	minTime   float64 // Time, s, for which a channel must be suspect before it is flagged
+	sigma     [NumResidualChannels]float64
+	windows   [NumResidualChannels]residualWindow
+	onFlag    func(ch ResidualChannel, stats ResidualStats)
+	mKnots    Measurement // Copy of a measurement given in other units, converted to knots
+}
+
+// NewResidualMonitor returns a ResidualMonitor wrapping p, which keeps statistics over the latest window
+// residuals of each channel and flags a channel once its normalized mean residual has exceeded threshold
+// for minTime seconds.
+func NewResidualMonitor(p PredictingProvider, window int, threshold, minTime float64) (r *ResidualMonitor) {
+	r = &ResidualMonitor{PredictingProvider: p, threshold: threshold, minTime: minTime, sigma: residualSigmaDefaults}
+	for i := range r.windows {
+		r.windows[i].buf = make([]float64, window)
+		r.windows[i].reset()
+	}
+	return
+}
+
+// SetSigma sets the residual tolerated on channel ch, by which its mean residual is normalized.
+func (r *ResidualMonitor) SetSigma(ch ResidualChannel, sigma float64) {
+	r.sigma[ch] = sigma
+}
+
+// SetCallback sets a function to be called from Compute whenever a channel becomes flagged.
+func (r *ResidualMonitor) SetCallback(f func(ch ResidualChannel, stats ResidualStats)) {
+	r.onFlag = f
+}
+
+// Stats returns the current residual statistics for channel ch.
+func (r *ResidualMonitor) Stats(ch ResidualChannel) (s ResidualStats) {
+	w := &r.windows[ch]
+	s.N, s.Flagged = w.n, w.flagged
+	if w.n == 0 {
+		return
+	}
+	s.Mean = w.sum / float64(w.n)
+	s.Variance = math.Max(0, w.sum2/float64(w.n)-s.Mean*s.Mean)
+	s.Normalized = s.Mean / r.sigma[ch]
+	return
+}
+
+// Compute predicts the measurement, runs the wrapped provider's computations and records the residuals.
+// Channels are only recorded when both the measurement and the prediction are valid.  The GPS velocity
+// residuals are in knots whatever the WUnits of m.
+func (r *ResidualMonitor) Compute(m *Measurement) {
+	valid := r.PredictingProvider.Valid()
+	var z *Measurement
+	if valid {
+		z = r.PredictingProvider.PredictMeasurement()
+	}
+	r.PredictingProvider.Compute(m)
+	if !valid {
+		return
+	}
+	m = m.inKnots(&r.mKnots)
+	if m.WValid && z.WValid {
+		r.record(ResidualW1, m.W1-z.W1, m.T)
+		r.record(ResidualW2, m.W2-z.W2, m.T)
+		r.record(ResidualW3, m.W3-z.W3, m.T)
+	}
+	if m.SValid && z.SValid {
+		r.record(ResidualA1, m.A1-z.A1, m.T)
+		r.record(ResidualA2, m.A2-z.A2, m.T)
+		r.record(ResidualA3, m.A3-z.A3, m.T)
+		r.record(ResidualB1, m.B1-z.B1, m.T)
+		r.record(ResidualB2, m.B2-z.B2, m.T)
+		r.record(ResidualB3, m.B3-z.B3, m.T)
+	}
+}
+
+func (r *ResidualMonitor) record(ch ResidualChannel, v, t float64) {
+	w := &r.windows[ch]
+	w.add(v)
+	// Only judge a channel on a full window, so that start-up transients don't flag it.
+	if w.n < len(w.buf) || !(math.Abs(r.Stats(ch).Normalized) > r.threshold) {
+		w.tExceed, w.flagged = math.NaN(), false
+		return
+	}
+	if math.IsNaN(w.tExceed) {
+		w.tExceed = t
+	}
+	if !w.flagged && t-w.tExceed >= r.minTime {
+		w.flagged = true
+		if r.onFlag != nil {
+			r.onFlag(ch, r.Stats(ch))
+		}
+	}
+}
+
+// Reset restarts the wrapped provider and clears the residual statistics.
+func (r *ResidualMonitor) Reset() {
+	r.PredictingProvider.Reset()
+	for i := range r.windows {
+		r.windows[i].reset()
+	}
+}
@@ -0,0 +1,133 @@
+package ahrs
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// noisyTurn returns two minutes of a standard rate turn at 50 Hz as seen by noisy sensors,
+// with GPS fixes once a second, and the gyro B3 axis reading scale times the true rate.
+func noisyTurn(scale float64) []*Measurement {
+	rng := rand.New(rand.NewSource(1))
+	ms := simMeasurements(turnPath(100, 0, 10, 3*Deg), 0, 120, 0.02)
+	for i, m := range ms {
+		m.WValid = i%50 == 0
+	}
+	InterpolateGPS(ms)
+	for _, m := range ms {
+		m.B3 *= scale
+		m.B1 += 0.05 * rng.NormFloat64()
+		m.B2 += 0.05 * rng.NormFloat64()
+		m.B3 += 0.05 * rng.NormFloat64()
+		m.A1 += 0.01 * rng.NormFloat64()
+		m.A2 += 0.01 * rng.NormFloat64()
+		m.A3 += 0.01 * rng.NormFloat64()
+	}
+	return ms
+}
+
+// flaggedChannels runs ms through a ResidualMonitor on a SimpleState and returns the channels it flags.
+func flaggedChannels(t *testing.T, ms []*Measurement) (flagged []ResidualChannel) {
+	r := NewResidualMonitor(NewSimpleAHRS(), 250, 2, 5)
+	r.SetCallback(func(ch ResidualChannel, stats ResidualStats) {
+		flagged = append(flagged, ch)
+	})
+	for _, m := range ms {
+		r.Compute(m)
+	}
+	for ch := ResidualChannel(0); ch < NumResidualChannels; ch++ {
+		s := r.Stats(ch)
+		t.Logf("%s: mean %8.4f, variance %7.4f, normalized %6.2f, flagged %t", ch, s.Mean, s.Variance, s.Normalized, s.Flagged)
+	}
+	return
+}
+
+func TestResidualMonitorGyroScale(t *testing.T) {
+	if flagged := flaggedChannels(t, noisyTurn(1)); len(flagged) != 0 {
+		t.Errorf("expected no channels flagged with good sensors, got %v", flagged)
+	}
+
+	flagged := flaggedChannels(t, noisyTurn(1.1))
+	if len(flagged) != 1 || flagged[0] != ResidualB3 {
+		t.Errorf("expected only B3 flagged with a 10%% gyro scale error, got %v", flagged)
+	}
+}
+
+func TestResidualMonitorWUnits(t *testing.T) {
+	// The same flight with the GPS velocity given in m/s leaves the same residuals, in knots.
+	kt, ms := NewResidualMonitor(NewSimpleAHRS(), 250, 2, 5), NewResidualMonitor(NewSimpleAHRS(), 250, 2, 5)
+	for _, m := range noisyTurn(1) {
+		kt.Compute(m)
+		m.W1, m.W2, m.W3, m.WUnits = KnotsToMS(m.W1), KnotsToMS(m.W2), KnotsToMS(m.W3), MetersPerSecond
+		ms.Compute(m)
+	}
+	for _, ch := range []ResidualChannel{ResidualW1, ResidualW2, ResidualW3} {
+		a, b := kt.Stats(ch), ms.Stats(ch)
+		if a.N == 0 || b.N != a.N || math.Abs(b.Mean-a.Mean) > 1e-9 || b.Flagged {
+			t.Errorf("%s residuals given in m/s: %+v, in knots: %+v", ch, b, a)
+		}
+	}
+}
+
+func TestResidualMonitorReset(t *testing.T) {
+	r := NewResidualMonitor(NewSimpleAHRS(), 10, 2, 0)
+	for _, m := range noisyTurn(1)[:100] {
+		r.Compute(m)
+	}
+	if r.Stats(ResidualA3).N != 10 {
+		t.Errorf("expected a full window of 10 residuals, got %d", r.Stats(ResidualA3).N)
+	}
+	r.Reset()
+	if s := r.Stats(ResidualA3); s.N != 0 || s.Flagged {
+		t.Errorf("expected no statistics after Reset, got %+v", s)
+	}
+}
+
+var _ PredictingProvider = (*KalmanState)(nil)
+
+func TestPredictMeasurement(t *testing.T) {
+	// A standard rate turn at 100 kt, climbing at 5 kt with the nose along the flight path.
+	turn := turnPath(100, 0, 0, 3*Deg)
+	path := func(t float64) (float64, float64, float64, float64, float64, float64) {
+		roll, _, heading, w1, w2, _ := turn(t)
+		return roll, math.Atan2(5, 100), heading, w1, w2, 5
+	}
+	ms := simMeasurements(path, 0, 60, 0.02)
+
+	for _, c := range []struct {
+		name string
+		s    PredictingProvider
+	}{
+		{"Simple", NewSimpleAHRS()},
+		{"EKF", NewEKFAHRS()},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s := c.s
+			if p := s.PredictMeasurement(); p.SValid || p.WValid {
+				t.Error("an uninitialized provider shouldn't predict valid measurements")
+			}
+			for _, m := range ms {
+				s.Compute(m)
+			}
+			m, p := ms[len(ms)-1], s.PredictMeasurement()
+			if !p.SValid || !p.WValid || p.UValid || p.MValid {
+				t.Errorf("expected only valid IMU and GPS predictions, got SValid %t, WValid %t, UValid %t, MValid %t",
+					p.SValid, p.WValid, p.UValid, p.MValid)
+			}
+			for _, c := range []struct {
+				name           string
+				got, want, tol float64
+			}{
+				{"B1", p.B1, m.B1, 0.05}, {"B2", p.B2, m.B2, 0.05}, {"B3", p.B3, m.B3, 0.05}, // °/s
+				{"A1", p.A1, m.A1, 0.01}, {"A2", p.A2, m.A2, 0.01}, {"A3", p.A3, m.A3, 0.01}, // G
+				{"W1", p.W1, m.W1, 0.5}, {"W2", p.W2, m.W2, 0.5}, {"W3", p.W3, m.W3, 0.5}, // kt
+			} {
+				t.Logf("%s predicted %9.5f, measured %9.5f", c.name, c.got, c.want)
+				if math.Abs(c.got-c.want) > c.tol {
+					t.Errorf("%s predicted %f, measured %f", c.name, c.got, c.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package ahrs
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Runner owns an AHRSProvider and calls its Compute from a goroutine of its own, for each measurement
+// sent on Input.  The latest state is published after every Compute and can be read with Snapshot
+// without ever blocking the compute loop.
+// The provider must not be used by anything else once the Runner has been created.
+type Runner struct {
+	provider AHRSProvider
+	policy   BackpressurePolicy
+	in       chan *Measurement
+	queue    chan *Measurement // Measurements waiting for Compute under DropOldest
+
+	state   atomic.Value // *State, replaced whole after each Compute
+	dropped uint64       // Accessed atomically
+
+	clock  Clock                // Time of each Compute, if set, instead of the measurement's
+	ticks  <-chan chan struct{} // Ticks of a SimClock, on each of which to compute once
+	latest *Measurement         // Latest measurement received, for the next tick
+
+	startOnce, stopOnce sync.Once
+	stop                chan struct{}
+	wg                  sync.WaitGroup
+}
+
+// NewRunner returns a Runner for the provider p which queues up to bufSize measurements,
+// applying policy when the queue is full.
+func NewRunner(p AHRSProvider, policy BackpressurePolicy, bufSize int) (r *Runner) {
+	if bufSize < 1 {
+		bufSize = 1
+	}
+	r = &Runner{provider: p, policy: policy, stop: make(chan struct{})}
+	if policy == Block {
+		r.in = make(chan *Measurement, bufSize)
+		r.queue = r.in
+	} else {
+		r.in = make(chan *Measurement)
+		r.queue = make(chan *Measurement, bufSize)
+	}
+	r.publish()
+	return
+}
+
+// Input returns the channel on which to send measurements.
+// A Measurement must not be modified once sent, as it may still be queued; nothing may be sent after Stop.
+func (r *Runner) Input() chan<- *Measurement {
+	return r.in
+}
+
+// SetClock makes the Runner compute at the times given by c rather than those of the measurements.
+// With a SimClock it computes once on each of its Ticks, on the latest measurement received, rather than once
+// for each measurement.  It must be called before Start.
+func (r *Runner) SetClock(c Clock) {
+	r.clock = c
+	if sc, ok := c.(*SimClock); ok {
+		r.ticks = sc.attach(r.stop)
+	}
+}
+
+// Start starts the compute goroutine.  It does nothing if the Runner has already been started.
+func (r *Runner) Start() {
+	r.startOnce.Do(func() {
+		if r.policy != Block {
+			r.wg.Add(1)
+			go r.receive()
+		}
+		r.wg.Add(1)
+		go r.run()
+	})
+}
+
+// Stop stops the Runner and waits for the Compute in progress, if any, to finish.
+// Measurements still queued are discarded.  A stopped Runner can't be restarted.
+func (r *Runner) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+	r.wg.Wait()
+}
+
+// Snapshot returns a copy of the provider's state after the latest Compute.
+// Its covariance matrices are shared with other snapshots of the same Compute and must not be modified.
+func (r *Runner) Snapshot() State {
+	return *r.state.Load().(*State)
+}
+
+// Dropped returns the number of measurements discarded so far under the DropOldest policy.
+func (r *Runner) Dropped() uint64 {
+	return atomic.LoadUint64(&r.dropped)
+}
+
+func (r *Runner) run() {
+	defer r.wg.Done()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case m := <-r.queue:
+			if r.ticks != nil {
+				r.latest = m
+				continue
+			}
+			r.compute(m)
+		case done := <-r.ticks:
+			r.drain()
+			if r.latest != nil {
+				r.compute(r.latest)
+			}
+			close(done)
+		}
+	}
+}
+
+// compute has the provider compute m and publishes the result.  With a clock, m is moved to the clock's time,
+// along with the times of its GPS and airspeed readings, so that they keep their age.
+func (r *Runner) compute(m *Measurement) {
+	if r.clock != nil {
+		mm := *m // The measurement may not be modified once sent
+		dt := r.clock.Now() - m.T
+		mm.T, mm.TW, mm.TU = mm.T+dt, mm.TW+dt, mm.TU+dt
+		m = &mm
+	}
+	r.provider.Compute(m)
+	r.publish()
+}
+
+// drain takes the measurements already queued, keeping the latest.
+func (r *Runner) drain() {
+	for {
+		select {
+		case m := <-r.queue:
+			r.latest = m
+		default:
+			return
+		}
+	}
+}
+
+// receive moves measurements from the input channel to the queue.
+func (r *Runner) receive() {
+	defer r.wg.Done()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case m := <-r.in:
+			r.enqueue(m)
+		}
+	}
+}
+
+// enqueue queues m, discarding the oldest queued measurement while the queue is full.
+func (r *Runner) enqueue(m *Measurement) {
+	for {
+		select {
+		case r.queue <- m:
+			return
+		default:
+		}
+		select {
+		case <-r.queue:
+			atomic.AddUint64(&r.dropped, 1)
+		default:
+		}
+	}
+}
+
+// publish stores a copy of the provider's state, with its own covariance matrices and without the log map.
+func (r *Runner) publish() {
+	s := *r.provider.GetState()
+	if s.M != nil {
+		s.M = s.M.Copy()
+	}
+	if s.N != nil {
+		s.N = s.N.Copy()
+	}
+	s.logMap = nil
+	r.state.Store(&s)
+}
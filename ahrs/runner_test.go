@@ -0,0 +1,182 @@
+package ahrs
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedProvider holds each Compute of the wrapped provider until gate is closed,
+// then reports the time of the measurement computed on done.
+type gatedProvider struct {
+	AHRSProvider
+	gate chan struct{}
+	done chan float64
+}
+
+func (p *gatedProvider) Compute(m *Measurement) {
+	<-p.gate
+	p.AHRSProvider.Compute(m)
+	p.done <- m.T
+}
+
+// readSnapshots reads snapshots from r until stop is closed, checking that time never goes backwards.
+func readSnapshots(t *testing.T, r *Runner, stop chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	var lastT float64
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		s := r.Snapshot()
+		if s.T < lastT {
+			t.Errorf("snapshot went back in time from %f to %f", lastT, s.T)
+			return
+		}
+		lastT = s.T
+		runtime.Gosched()
+	}
+}
+
+// waitForSnapshot waits up to a second for r to publish the state at time tt.
+func waitForSnapshot(t *testing.T, r *Runner, tt float64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for r.Snapshot().T != tt {
+		if time.Now().After(deadline) {
+			t.Fatalf("runner stalled at time %f, expected %f", r.Snapshot().T, tt)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRunnerBlock(t *testing.T) {
+	n0 := runtime.NumGoroutine()
+	const n = 200
+	r := NewRunner(NewSimpleAHRS(), Block, 4)
+	r.Start()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go readSnapshots(t, r, stop, &wg)
+	}
+
+	for i := 1; i <= n; i++ {
+		r.Input() <- levelMeasurement(float64(i) * 0.01)
+	}
+	waitForSnapshot(t, r, float64(n)*0.01)
+	close(stop)
+	wg.Wait()
+	r.Stop()
+
+	if r.Dropped() != 0 {
+		t.Errorf("Block policy dropped %d measurements", r.Dropped())
+	}
+	checkNoGoroutineLeak(t, n0)
+}
+
+func TestRunnerDropOldest(t *testing.T) {
+	n0 := runtime.NumGoroutine()
+	const n = 100
+	p := &gatedProvider{NewSimpleAHRS(), make(chan struct{}), make(chan float64)}
+	r := NewRunner(p, DropOldest, 2)
+	r.Start()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go readSnapshots(t, r, stop, &wg)
+
+	// The sender must never wait for the provider, which is held until everything has been sent.
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 1; i <= n; i++ {
+			r.Input() <- levelMeasurement(float64(i) * 0.01)
+		}
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatalf("sender blocked by a held provider under DropOldest")
+	}
+	close(p.gate)
+
+	// The newest measurement is never dropped, and comes last.
+	var computed uint64
+	for tt := 0.0; tt != float64(n)*0.01; computed++ {
+		tt = <-p.done
+	}
+	close(stop)
+	wg.Wait()
+	r.Stop()
+	r.Stop()
+
+	if r.Dropped() == 0 {
+		t.Error("expected measurements to be dropped by a held provider")
+	}
+	if computed+r.Dropped() != n {
+		t.Errorf("%d measurements computed and %d dropped out of %d", computed, r.Dropped(), n)
+	}
+	checkNoGoroutineLeak(t, n0)
+}
+
+func TestRunnerSnapshotIsolated(t *testing.T) {
+	r := NewRunner(NewSimpleAHRS(), Block, 1)
+	r.Start()
+	defer r.Stop()
+	r.Input() <- levelMeasurement(0.01)
+	waitForSnapshot(t, r, 0.01)
+
+	s := r.Snapshot()
+	if s.logMap != nil {
+		t.Error("snapshot shares the provider's log map")
+	}
+	if s.M != nil && s.M == r.provider.GetState().M {
+		t.Error("snapshot shares the provider's covariance matrix")
+	}
+}
+
+// countingProvider counts the Computes of the wrapped provider.
+type countingProvider struct {
+	AHRSProvider
+	n int
+}
+
+func (p *countingProvider) Compute(m *Measurement) {
+	p.n++
+	p.AHRSProvider.Compute(m)
+}
+
+func TestRunnerSimClock(t *testing.T) {
+	n0 := runtime.NumGoroutine()
+	const n = 50
+	p := &countingProvider{AHRSProvider: NewSimpleAHRS()}
+	r := NewRunner(p, Block, 4)
+	c := NewSimClock(10, 0.05)
+	r.SetClock(c)
+	r.Start()
+
+	// Measurements arriving at their own pace, some between ticks and some not
+	for i := 1; i <= n; i++ {
+		if i%3 != 0 {
+			r.Input() <- levelMeasurement(float64(i) * 0.01)
+		}
+		c.Tick()
+		if s := r.Snapshot(); s.T != c.Now() {
+			t.Fatalf("after tick %d the state is at %f s, expected the clock's %f s", i, s.T, c.Now())
+		}
+	}
+	r.Stop()
+	c.Tick() // Doesn't wait for a stopped Runner
+
+	if p.n != n {
+		t.Errorf("%d ticks gave %d Computes", n, p.n)
+	}
+	checkNoGoroutineLeak(t, n0)
+}
@@ -0,0 +1,168 @@
+package ahrs
+
+import "sync"
+
+// SafeProvider wraps an AHRSProvider so that it may be used from several goroutines at once,
+// typically a sensor loop calling Compute and display or network loops reading the outputs.
+// Compute and the other mutating methods take an exclusive lock; the accessors share a read lock,
+// so they never observe a half-finished Compute.
+// Use Snapshot to read all outputs from the same cycle at once.
+type SafeProvider struct {
+	mu sync.RWMutex
+	p  AHRSProvider
+}
+
+// NewSafeProvider returns a SafeProvider wrapping p.  p must not be used directly afterwards.
+func NewSafeProvider(p AHRSProvider) *SafeProvider {
+	return &SafeProvider{p: p}
+}
+
+// Snapshot returns a consistent set of all the provider's outputs from the latest Compute.
+func (sp *SafeProvider) Snapshot() AttitudeUpdate {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return newAttitudeUpdate(sp.p)
+}
+
+// RollPitchHeading returns the current attitude values.
+func (sp *SafeProvider) RollPitchHeading() (roll float64, pitch float64, heading float64) {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.p.RollPitchHeading()
+}
+
+// MagHeading returns the current magnetic heading in degrees.
+func (sp *SafeProvider) MagHeading() (hdg float64) {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.p.MagHeading()
+}
+
+// SlipSkid returns the slip/skid angle in degrees.
+func (sp *SafeProvider) SlipSkid() (slipSkid float64) {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.p.SlipSkid()
+}
+
+// RateOfTurn returns the turn rate in degrees per second.
+func (sp *SafeProvider) RateOfTurn() (turnRate float64) {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.p.RateOfTurn()
+}
+
+// GLoad returns the current G load, in G's.
+func (sp *SafeProvider) GLoad() (gLoad float64) {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.p.GLoad()
+}
+
+// Compute runs the wrapped provider's computations under an exclusive lock.
+func (sp *SafeProvider) Compute(m *Measurement) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.p.Compute(m)
+}
+
+// SetSensorQuaternion changes the AHRS algorithm's sensor quaternion F.
+func (sp *SafeProvider) SetSensorQuaternion(f *[4]float64) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.p.SetSensorQuaternion(f)
+}
+
+// GetSensorQuaternion returns the AHRS algorithm's sensor quaternion F.
+func (sp *SafeProvider) GetSensorQuaternion() (f *[4]float64) {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.p.GetSensorQuaternion()
+}
+
+// SetCalibrations sets the AHRS accelerometer calibrations to c, gyro calibrations to d,
+// mag scaling to k and mag offset to l.
+func (sp *SafeProvider) SetCalibrations(c, d, k, l *[3]float64) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.p.SetCalibrations(c, d, k, l)
+}
+
+// GetCalibrations returns the AHRS accelerometer calibrations c, gyro calibrations d,
+// mag scaling k and mag offset l.
+func (sp *SafeProvider) GetCalibrations() (c, d, k, l *[3]float64) {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.p.GetCalibrations()
+}
+
+// SetConfig allows for configuration of AHRS to be set on the fly.
+func (sp *SafeProvider) SetConfig(configMap map[string]float64) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.p.SetConfig(configMap)
+}
+
+// Valid returns whether the current state is a valid estimate.
+func (sp *SafeProvider) Valid() bool {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.p.Valid()
+}
+
+// Reset restarts the algorithm from scratch.
+func (sp *SafeProvider) Reset() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.p.Reset()
+}
+
+// GetState returns a copy of the current state.
+// The covariance matrices and log map are shared with the live state and must only be read
+// while no Compute is running.
+func (sp *SafeProvider) GetState() *State {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	s := *sp.p.GetState()
+	return &s
+}
+
+// CalcQuaternion returns the attitude quaternion, scalar first, rotating the aircraft frame into the earth frame.
+func (sp *SafeProvider) CalcQuaternion() (w, x, y, z float64) {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.p.CalcQuaternion()
+}
+
+// CalcQuaternionRate returns the rate of change of CalcQuaternion, per second.
+func (sp *SafeProvider) CalcQuaternionRate() (w, x, y, z float64) {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.p.CalcQuaternionRate()
+}
+
+// CalcAttitude returns a compact copy of the attitude.
+func (sp *SafeProvider) CalcAttitude() Attitude {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.p.CalcAttitude()
+}
+
+// Describe describes the wrapped provider.
+func (sp *SafeProvider) Describe() ProviderInfo {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.p.Describe()
+}
+
+// GetLogMap returns a copy of the wrapped provider's log map.
+// It takes an exclusive lock since providers may start maintaining the map on the first call.
+func (sp *SafeProvider) GetLogMap() map[string]interface{} {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	p := make(map[string]interface{}, len(sp.p.GetLogMap()))
+	for k, v := range sp.p.GetLogMap() {
+		p[k] = v
+	}
+	return p
+}
@@ -0,0 +1,106 @@
+package ahrs
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// hammer runs one goroutine calling Compute on p with a simulated turn while several others read its outputs.
+func hammer(p AHRSProvider, read func(p AHRSProvider)) {
+	ms := simMeasurements(turnPath(100, 0, 2, 3*Deg), 0, 10, 0.01)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					read(p)
+					runtime.Gosched()
+				}
+			}
+		}()
+	}
+	for _, m := range ms {
+		p.Compute(m)
+		runtime.Gosched() // Let the readers in between, even on a single CPU
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestSafeProviderConcurrent(t *testing.T) {
+	sp := NewSafeProvider(NewSimpleAHRS())
+	var mu sync.Mutex
+	var lastT float64
+	hammer(sp, func(p AHRSProvider) {
+		p.RollPitchHeading()
+		p.RateOfTurn()
+		p.GetLogMap()
+		// Take the snapshot under mu so that readers record their times in the order they read them.
+		mu.Lock()
+		defer mu.Unlock()
+		u := p.(*SafeProvider).Snapshot()
+		if u.T < lastT {
+			t.Errorf("snapshot went back in time from %f to %f", lastT, u.T)
+		}
+		lastT = u.T
+	})
+}
+
+// TestRawProviderRace shows what SafeProvider is for: hammering a bare provider from several goroutines
+// is a data race.  The hammering runs in a child process, since the race detector fails the test that races.
+func TestRawProviderRace(t *testing.T) {
+	if os.Getenv("AHRS_RAW_RACE") != "" {
+		hammer(NewSimpleAHRS(), func(p AHRSProvider) {
+			p.RollPitchHeading()
+			p.RateOfTurn()
+		})
+		return
+	}
+	if !raceEnabled {
+		t.Skip("needs the race detector")
+	}
+	if testing.Short() {
+		t.Skip("runs a child test process")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRawProviderRace$")
+	cmd.Env = append(os.Environ(), "AHRS_RAW_RACE=1", "GORACE=halt_on_error=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "DATA RACE") {
+		t.Errorf("expected a data race on the raw provider, got %v:\n%s", err, out)
+	}
+}
+
+func benchmarkCompute(b *testing.B, p AHRSProvider) {
+	ms := simMeasurements(turnPath(100, 0, 2, 3*Deg), 0, 10, 0.01)
+	p.Compute(ms[0])
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := ms[1+i%(len(ms)-1)]
+		if i%(len(ms)-1) == 0 { // Start the path over without a time jump backwards
+			p.Reset()
+			p.Compute(ms[0])
+		}
+		p.Compute(m)
+	}
+}
+
+// BenchmarkCompute compares a bare provider with the same provider wrapped in a SafeProvider,
+// to show the cost of the locking and of the snapshot taken after each Compute.
+func BenchmarkCompute(b *testing.B) {
+	b.Run("Raw", func(b *testing.B) {
+		benchmarkCompute(b, NewSimpleAHRS())
+	})
+	b.Run("Safe", func(b *testing.B) {
+		benchmarkCompute(b, NewSafeProvider(NewSimpleAHRS()))
+	})
+}
@@ -0,0 +1,188 @@
+package ahrs
+
+import (
+	"math"
+	"time"
+)
+
+// flightPath gives the true attitude (roll, pitch, heading, rad) and earth-frame GPS velocity
+// (w1 east, w2 north, w3 up, kt) of a simulated aircraft at time t.
+type flightPath func(t float64) (roll, pitch, heading, w1, w2, w3 float64)
+
+// simMeasurement synthesizes the noiseless measurement that perfect, aligned sensors would report at time t
+// along path.  Gyro rates are the body rotation over the preceding interval dt and the accelerometer
+// reports the specific force, including the change in GPS velocity over that interval.
+func simMeasurement(path flightPath, t, dt float64) (m *Measurement) {
+	m = NewMeasurement()
+	r0, p0, h0, v1, v2, v3 := path(t - dt)
+	r1, p1, h1, w1, w2, w3 := path(t)
+	a0, a1, a2, a3 := ToQuaternion(r0, p0, h0)
+	e0, e1, e2, e3 := ToQuaternion(r1, p1, h1)
+
+	// Body-frame rotation from the previous attitude to the current one: conj(a)*e
+	d0 := a0*e0 + a1*e1 + a2*e2 + a3*e3
+	d1 := a0*e1 - a1*e0 - a2*e3 + a3*e2
+	d2 := a0*e2 + a1*e3 - a2*e0 - a3*e1
+	d3 := a0*e3 - a1*e2 + a2*e1 - a3*e0
+	if d0 < 0 {
+		d0, d1, d2, d3 = -d0, -d1, -d2, -d3
+	}
+	if dd := math.Sqrt(d1*d1 + d2*d2 + d3*d3); dd > 0 {
+		k := 2 * math.Atan2(dd, d0) / dd / dt / Deg
+		m.B1, m.B2, m.B3 = d1*k, d2*k, d3*k
+	}
+
+	// Specific force in earth frame is kinematic acceleration plus 1G upwards; rotate into aircraft frame.
+	f1 := (w1 - v1) / dt / G
+	f2 := (w2 - v2) / dt / G
+	f3 := (w3-v3)/dt/G + 1
+	r := QuaternionToRotationMatrix(e0, e1, e2, e3)
+	m.A1 = r[0][0]*f1 + r[1][0]*f2 + r[2][0]*f3
+	m.A2 = r[0][1]*f1 + r[1][1]*f2 + r[2][1]*f3
+	m.A3 = r[0][2]*f1 + r[1][2]*f2 + r[2][2]*f3
+
+	m.W1, m.W2, m.W3 = w1, w2, w3
+	m.WValid, m.SValid = true, true
+	m.T, m.TW = t, t
+	return
+}
+
+// simMeasurements returns the measurements along path from t0 to t1 at interval dt.
+func simMeasurements(path flightPath, t0, t1, dt float64) (ms []*Measurement) {
+	n := int(math.Floor((t1-t0)/dt + 0.5))
+	ms = make([]*Measurement, 0, n+1)
+	for i := 0; i <= n; i++ {
+		ms = append(ms, simMeasurement(path, t0+float64(i)*dt, dt))
+	}
+	return
+}
+
+// straightPath flies straight and level at groundspeed gs (kt) on heading hdg (rad).
+func straightPath(gs, hdg float64) flightPath {
+	return func(t float64) (float64, float64, float64, float64, float64, float64) {
+		return 0, 0, hdg, gs * math.Sin(hdg), gs * math.Cos(hdg), 0
+	}
+}
+
+// turnPath flies straight and level at groundspeed gs (kt) on heading hdg (rad) until time t0,
+// then makes a coordinated level turn at rate tr (rad/s, positive to the right).
+func turnPath(gs, hdg, t0, tr float64) flightPath {
+	return func(t float64) (float64, float64, float64, float64, float64, float64) {
+		var roll float64
+		h := hdg
+		if t > t0 {
+			h += tr * (t - t0)
+			roll = math.Atan(gs * tr / G)
+		}
+		return roll, 0, h, gs * math.Sin(h), gs * math.Cos(h), 0
+	}
+}
+
+// sTurnPath flies coordinated level S-turns at groundspeed gs (kt), swinging the heading sinusoidally
+// by amp (rad) either side of north with the given period (s).  It starts at the steepest bank.
+func sTurnPath(gs, amp, period float64) flightPath {
+	w := 2 * Pi / period
+	return func(t float64) (float64, float64, float64, float64, float64, float64) {
+		h := amp * math.Sin(w*t)
+		roll := math.Atan(gs * amp * w * math.Cos(w*t) / G)
+		return roll, 0, h, gs * math.Sin(h), gs * math.Cos(h), 0
+	}
+}
+
+// angleErr returns the absolute difference between two angles in degrees, accounting for wraparound.
+func angleErr(a, b float64) float64 {
+	return math.Abs(AngleDiff(a*Deg, b*Deg)) / Deg
+}
+
+// scenario is a named flight shared by the accuracy tests and the benchmarks.
+type scenario struct {
+	name     string
+	path     flightPath
+	duration float64    // Length of the flight, s
+	outage   [2]float64 // GPS is unavailable from outage[0] to outage[1], s
+}
+
+var scenarios = []scenario{
+	{name: "StraightAndLevel", path: straightPath(100, 30*Deg), duration: 60},
+	// 45° of bank at 100 kt
+	{name: "SteepTurn", path: turnPath(100, 0, 10, G/100), duration: 60},
+	{name: "GPSOutage", path: turnPath(100, 0, 10, 3*Deg), duration: 60, outage: [2]float64{20, 40}},
+}
+
+// measurements returns the measurements along the scenario with the IMU sampled at hz,
+// as real hardware would see them: GPS fixes once a second, interpolated in between.
+func (sc scenario) measurements(hz float64) (ms []*Measurement) {
+	ms = simMeasurements(sc.path, 0, sc.duration, 1/hz)
+	perFix := int(hz + 0.5)
+	for i, m := range ms {
+		m.WValid = i%perFix == 0 && !sc.inOutage(m.T)
+	}
+	InterpolateGPS(ms)
+	for _, m := range ms {
+		if sc.inOutage(m.T) {
+			m.W1, m.W2, m.W3, m.WValid = 0, 0, 0, false
+		}
+	}
+	return
+}
+
+func (sc scenario) inOutage(t float64) bool {
+	return t >= sc.outage[0] && t < sc.outage[1]
+}
+
+// attitudeFilter is what is needed to run a provider through a scenario.
+// Kalman0State and Kalman1State don't implement the whole AHRSProvider.
+type attitudeFilter interface {
+	Compute(m *Measurement)
+	GetState() *State
+}
+
+// providers lists constructors for each of the algorithms; m is the first measurement.
+var providers = []struct {
+	name string
+	new  func(m *Measurement) attitudeFilter
+}{
+	{"Simple", func(*Measurement) attitudeFilter { return NewSimpleAHRS() }},
+	{"Kalman", func(m *Measurement) attitudeFilter { return InitializeKalman(m) }},
+	{"Kalman0", func(*Measurement) attitudeFilter { return NewKalman0AHRS() }},
+	{"Kalman1", func(*Measurement) attitudeFilter { return NewKalman1AHRS() }},
+	{"EKF", func(*Measurement) attitudeFilter { return NewEKFAHRS() }},
+	{"UKF", func(*Measurement) attitudeFilter { return NewUKFAHRS() }},
+	{"EKF7", func(*Measurement) attitudeFilter { return NewEKF7AHRS() }},
+	{"Madgwick", func(*Measurement) attitudeFilter { return NewMadgwickAHRS() }},
+	{"Mahony", func(*Measurement) attitudeFilter { return NewMahonyAHRS() }},
+	{"Hybrid", func(*Measurement) attitudeFilter { return NewHybridAHRS(NewSimpleAHRS(), NewMahonyAHRS()) }},
+}
+
+// attitudeErrors holds the RMS roll, pitch and heading errors in degrees of a run through a scenario,
+// ignoring the first settle seconds, along with the mean time taken per Compute.
+type attitudeErrors struct {
+	roll, pitch, heading float64
+	perCompute           time.Duration
+}
+
+func runScenario(sc scenario, hz, settle float64, f func(m *Measurement) attitudeFilter) (e attitudeErrors) {
+	ms := sc.measurements(hz)
+	p := f(ms[0])
+	var n float64
+	var elapsed time.Duration
+	for _, m := range ms {
+		start := time.Now()
+		p.Compute(m)
+		elapsed += time.Since(start)
+		if m.T < settle {
+			continue
+		}
+		roll, pitch, heading := p.GetState().CalcRollPitchHeading()
+		r, pp, h, _, _, _ := sc.path(m.T)
+		e.roll += math.Pow(angleErr(roll, r/Deg), 2)
+		e.pitch += math.Pow(angleErr(pitch, pp/Deg), 2)
+		e.heading += math.Pow(angleErr(heading, h/Deg), 2)
+		n++
+	}
+	e.roll = math.Sqrt(e.roll / n)
+	e.pitch = math.Sqrt(e.pitch / n)
+	e.heading = math.Sqrt(e.heading / n)
+	e.perCompute = elapsed / time.Duration(len(ms))
+	return
+}
@@ -0,0 +1,131 @@
+package ahrs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// FormatVersion is the version, "major.minor", written into every serialized Measurement and State.
+// The major version changes when the meaning of existing fields changes, and data with any other major
+// version is rejected.  The minor version changes when fields are added, and unknown fields are ignored.
+const FormatVersion = "1.2"
+
+// FormatVersionError is returned when unmarshalling data with a major version this package can't read.
+type FormatVersionError struct {
+	Version string // Version found in the data
+}
+
+func (e *FormatVersionError) Error() string {
+	return fmt.Sprintf("ahrs: unsupported format version %q, expected major version %s",
+		e.Version, majorVersion(FormatVersion))
+}
+
+func majorVersion(v string) string {
+	return strings.SplitN(v, ".", 2)[0]
+}
+
+// checkFormatVersion returns an error unless the JSON object b has a supported major version.
+func checkFormatVersion(b []byte) error {
+	var v struct{ Version string }
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if v.Version == "" || majorVersion(v.Version) != majorVersion(FormatVersion) {
+		return &FormatVersionError{Version: v.Version}
+	}
+	return nil
+}
+
+// MarshalJSON encodes the sensor readings in m along with the FormatVersion.
+// The variance accumulators and noise covariance aren't included.
+func (m *Measurement) MarshalJSON() ([]byte, error) {
+	type measurement Measurement // Without the methods, to avoid recursion
+	return json.Marshal(struct {
+		Version string
+		*measurement
+	}{FormatVersion, (*measurement)(m)})
+}
+
+// UnmarshalJSON decodes sensor readings written by MarshalJSON into m, which is first Reset.
+// It returns a *FormatVersionError if they were written with an unsupported major version.
+func (m *Measurement) UnmarshalJSON(b []byte) error {
+	if err := checkFormatVersion(b); err != nil {
+		return err
+	}
+	m.Reset()
+	type measurement Measurement
+	return json.Unmarshal(b, (*measurement)(m))
+}
+
+// stateJSON holds the unexported parts of a State that are needed to restore it.
+type stateJSON struct {
+	Roll, Pitch, Heading float64
+	HeadingMag           float64
+	SlipSkid             float64
+	GLoad                float64
+	TurnRate             float64
+	NeedsInitialization  bool
+	ANorm                float64
+	GyroTempModel        GyroTempModel
+}
+
+// MarshalJSON encodes s, including its covariances and outputs, along with the FormatVersion.
+// Providers embedding a State only serialize the State itself.
+func (s *State) MarshalJSON() ([]byte, error) {
+	type state State
+	return json.Marshal(struct {
+		Version string
+		*state
+		stateJSON
+	}{FormatVersion, (*state)(s), stateJSON{
+		s.roll, s.pitch, s.heading, s.headingMag, s.slipSkid, s.gLoad, s.turnRate, s.needsInitialization, s.aNorm,
+		s.tempModel,
+	}})
+}
+
+// UnmarshalJSON decodes a State written by MarshalJSON into s.
+// It returns a *FormatVersionError if it was written with an unsupported major version.
+func (s *State) UnmarshalJSON(b []byte) error {
+	if err := checkFormatVersion(b); err != nil {
+		return err
+	}
+	type state State
+	v := struct {
+		*state
+		stateJSON
+	}{state: (*state)(s)}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	s.roll, s.pitch, s.heading = v.Roll, v.Pitch, v.Heading
+	s.headingMag, s.slipSkid, s.gLoad, s.turnRate = v.HeadingMag, v.SlipSkid, v.GLoad, v.TurnRate
+	s.needsInitialization, s.aNorm = v.NeedsInitialization, v.ANorm
+	s.SetGyroTempModel(v.GyroTempModel)
+	s.calcRotationMatrices()
+	return nil
+}
+
+// MarshalJSON encodes a as its dimensions and its elements by rows.
+func (a *Matrix) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Rows, Cols int
+		Elements   []float64
+	}{a.rows, a.cols, a.elements})
+}
+
+// UnmarshalJSON decodes a matrix written by MarshalJSON into a.
+func (a *Matrix) UnmarshalJSON(b []byte) error {
+	var v struct {
+		Rows, Cols int
+		Elements   []float64
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if v.Rows < 0 || v.Cols < 0 || len(v.Elements) != v.Rows*v.Cols {
+		return fmt.Errorf("ahrs: %d elements don't make a %dx%d matrix", len(v.Elements), v.Rows, v.Cols)
+	}
+	a.rows, a.cols, a.elements = v.Rows, v.Cols, v.Elements
+	return nil
+}
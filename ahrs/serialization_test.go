@@ -0,0 +1,88 @@
+package ahrs
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMeasurementJSON(t *testing.T) {
+	m := kalmanScenario()[40]
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"Version":"`+FormatVersion+`"`) {
+		t.Errorf("serialized measurement has no version: %s", b)
+	}
+
+	mm := new(Measurement)
+	if err := json.Unmarshal(b, mm); err != nil {
+		t.Fatal(err)
+	}
+	if mm.M == nil || mm.Accums[0] == nil {
+		t.Error("unmarshalled measurement should be ready for use")
+	}
+	got, want := *mm, *m
+	for _, v := range []*Measurement{&got, &want} {
+		v.Accums, v.M = [15]func(float64) (float64, float64, float64){}, nil // Not serialized
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("measurement changed in round trip:\n%+v\n%+v", want, got)
+	}
+}
+
+func TestStateJSON(t *testing.T) {
+	ms := kalmanScenario()
+	s := InitializeKalman(ms[0])
+	for _, m := range ms[1:] {
+		s.Compute(m)
+	}
+	b, err := json.Marshal(s.GetState())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss := new(State)
+	if err := json.Unmarshal(b, ss); err != nil {
+		t.Fatal(err)
+	}
+	r0, p0, h0 := s.RollPitchHeading()
+	r1, p1, h1 := ss.RollPitchHeading()
+	if r0 != r1 || p0 != p1 || h0 != h1 || s.GLoad() != ss.GLoad() || ss.Valid() != s.State.Valid() {
+		t.Errorf("outputs changed in round trip: %f %f %f, %f %f %f", r0, p0, h0, r1, p1, h1)
+	}
+	if d := maxAbsDiff(s.M, ss.M); d != 0 {
+		t.Errorf("covariance changed in round trip by %g", d)
+	}
+	if ss.e11 != s.e11 || ss.f33 != s.f33 {
+		t.Error("rotation matrices weren't restored")
+	}
+}
+
+func TestFormatVersion(t *testing.T) {
+	// A future minor version may add fields, which are ignored.
+	m := new(Measurement)
+	if err := json.Unmarshal([]byte(`{"Version":"1.9","T":12.5,"Baro":1013.2}`), m); err != nil {
+		t.Errorf("expected a future minor version to be read, got %s", err)
+	}
+	if m.T != 12.5 {
+		t.Errorf("expected T to be read as 12.5, got %f", m.T)
+	}
+
+	// A future major version may have changed the meaning of fields.
+	for _, c := range []struct{ payload, version string }{
+		{`{"Version":"2.0","T":12.5}`, "2.0"},
+		{`{"T":12.5}`, ""},
+	} {
+		for _, v := range []json.Unmarshaler{new(Measurement), new(State)} {
+			err := json.Unmarshal([]byte(c.payload), v)
+			if e, ok := err.(*FormatVersionError); !ok {
+				t.Errorf("expected a FormatVersionError for %s, got %v", c.payload, err)
+			} else if e.Version != c.version {
+				t.Errorf("error reported version %q for %s", e.Version, c.payload)
+			}
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package ahrs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math"
+	"os"
+)
+
+// ekfStepFloats is the number of float64s in an encoded ekfStep.
+const ekfStepFloats = 1 + 4 + 1 + ekfN + 3*ekfN*ekfN
+
+// ekfStep records one step of an EKFState's forward pass: the filtered attitude and covariance,
+// and the prediction and correction that led to them.
+type ekfStep struct {
+	t              float64
+	e0, e1, e2, e3 float64       // Filtered attitude quaternion
+	reset          bool          // Whether the filter restarted or reset part of its state, so no smoothing across
+	dx             [ekfN]float64 // Correction from the predicted to the filtered state
+	p, pPred, phi  ekfMatrix     // Filtered and predicted covariance and the transition matrix from the last step
+}
+
+// SmoothedAttitude is one sample of the attitude time series produced by a Smoother.
+type SmoothedAttitude struct {
+	T                    float64
+	E0, E1, E2, E3       float64 // Attitude quaternion
+	Roll, Pitch, Heading float64 // Attitude, Rad
+}
+
+// Smoother records the forward pass of an EKFState, set by SetSmoother, and runs a Rauch-Tung-Striebel
+// backward pass over it for post-flight reprocessing, using the measurements after each step as well as
+// those before to estimate the attitude.
+// Each step takes about 2 kB, so for a long flight the forward pass can be spooled to a temporary file.
+type Smoother struct {
+	steps []ekfStep // Steps recorded in memory
+	f     *os.File  // Spool file, if spooling
+	w     *bufio.Writer
+	buf   []byte
+	n     int   // Number of steps recorded
+	err   error // First error spooling, returned by Smooth
+}
+
+// NewSmoother returns a Smoother that keeps the forward pass in memory.
+func NewSmoother() *Smoother {
+	return new(Smoother)
+}
+
+// NewSpooledSmoother returns a Smoother that spools the forward pass to a temporary file in dir,
+// or the default directory for temporary files if dir is "".  Close removes the file.
+func NewSpooledSmoother(dir string) (*Smoother, error) {
+	f, err := os.CreateTemp(dir, "ahrs-smoother-*.spool")
+	if err != nil {
+		return nil, err
+	}
+	return &Smoother{f: f, w: bufio.NewWriter(f), buf: make([]byte, 8*ekfStepFloats)}, nil
+}
+
+// Len returns the number of steps recorded.
+func (sm *Smoother) Len() int {
+	return sm.n
+}
+
+// Close releases the Smoother's resources, removing its spool file.
+func (sm *Smoother) Close() error {
+	sm.steps, sm.n = nil, 0
+	if sm.f == nil {
+		return nil
+	}
+	err := sm.f.Close()
+	if e := os.Remove(sm.f.Name()); err == nil {
+		err = e
+	}
+	sm.f = nil
+	return err
+}
+
+func (sm *Smoother) add(st *ekfStep) {
+	if sm.err != nil {
+		return
+	}
+	sm.n++
+	if sm.f == nil {
+		sm.steps = append(sm.steps, *st)
+		return
+	}
+	st.encode(sm.buf)
+	_, sm.err = sm.w.Write(sm.buf)
+}
+
+// step reads the i'th step recorded into st.
+func (sm *Smoother) step(i int, st *ekfStep) error {
+	if sm.f == nil {
+		*st = sm.steps[i]
+		return nil
+	}
+	if _, err := sm.f.ReadAt(sm.buf, int64(i)*int64(len(sm.buf))); err != nil {
+		return err
+	}
+	st.decode(sm.buf)
+	return nil
+}
+
+// floats calls f with a pointer to each float64 field of st but reset, in their encoded order.
+func (st *ekfStep) floats(f func(v *float64)) {
+	for _, v := range []*float64{&st.t, &st.e0, &st.e1, &st.e2, &st.e3} {
+		f(v)
+	}
+	for i := range st.dx {
+		f(&st.dx[i])
+	}
+	for _, m := range []*ekfMatrix{&st.p, &st.pPred, &st.phi} {
+		for i := range m {
+			for j := range m[i] {
+				f(&m[i][j])
+			}
+		}
+	}
+}
+
+func (st *ekfStep) encode(b []byte) {
+	var reset float64
+	if st.reset {
+		reset = 1
+	}
+	binary.LittleEndian.PutUint64(b, math.Float64bits(reset))
+	b = b[8:]
+	st.floats(func(v *float64) {
+		binary.LittleEndian.PutUint64(b, math.Float64bits(*v))
+		b = b[8:]
+	})
+}
+
+func (st *ekfStep) decode(b []byte) {
+	st.reset = math.Float64frombits(binary.LittleEndian.Uint64(b)) != 0
+	b = b[8:]
+	st.floats(func(v *float64) {
+		*v = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		b = b[8:]
+	})
+}
+
+// Smooth runs the backward pass over the steps recorded so far and returns the smoothed attitude at each.
+// The smoothed error state at step k is C(dx' + e') from the correction dx' and smoothed error e' at the next
+// step, where the gain C = P Φ'ᵀ P'⁻¹ relates the filtered covariance P to the next step's transition
+// matrix Φ' and predicted covariance P'.  Smoothing doesn't cross the points where the filter restarted.
+func (sm *Smoother) Smooth() ([]SmoothedAttitude, error) {
+	if sm.err != nil {
+		return nil, sm.err
+	}
+	if sm.w != nil {
+		if err := sm.w.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	out := make([]SmoothedAttitude, sm.n)
+	var cur, next ekfStep
+	var e, enext [ekfN]float64 // Smoothed error state relative to the filtered state
+	for k := sm.n - 1; k >= 0; k-- {
+		if err := sm.step(k, &cur); err != nil {
+			return nil, err
+		}
+		e = [ekfN]float64{}
+		if k < sm.n-1 && !next.reset {
+			if c, ok := smootherGain(&cur.p, &next.phi, &next.pPred); ok {
+				for i := 0; i < ekfN; i++ {
+					for j := 0; j < ekfN; j++ {
+						e[i] += c[i][j] * (next.dx[j] + enext[j])
+					}
+				}
+			}
+		}
+
+		// Rotate the filtered attitude by the smoothed attitude error, as EKFState.correct does.
+		d1, d2, d3 := e[0]/2, e[1]/2, e[2]/2
+		a := &out[k]
+		a.T = cur.t
+		a.E0, a.E1, a.E2, a.E3 = QuaternionNormalize(
+			cur.e0-d1*cur.e1-d2*cur.e2-d3*cur.e3,
+			cur.e1+d1*cur.e0+d2*cur.e3-d3*cur.e2,
+			cur.e2-d1*cur.e3+d2*cur.e0+d3*cur.e1,
+			cur.e3+d1*cur.e2-d2*cur.e1+d3*cur.e0,
+		)
+		a.Roll, a.Pitch, a.Heading = FromQuaternion(a.E0, a.E1, a.E2, a.E3)
+
+		next, enext = cur, e
+	}
+	return out, nil
+}
+
+// smootherGain returns the RTS gain P Φᵀ Q⁻¹, or false if the predicted covariance q is singular.
+func smootherGain(p, phi, q *ekfMatrix) (c ekfMatrix, ok bool) {
+	qm := NewMatrix(ekfN, ekfN)
+	for i := 0; i < ekfN; i++ {
+		for j := 0; j < ekfN; j++ {
+			qm.Set(i, j, q[i][j])
+		}
+	}
+	qi, err := qm.Inverse()
+	if err != nil {
+		return c, false
+	}
+	var t ekfMatrix // P Φᵀ
+	for i := 0; i < ekfN; i++ {
+		for j := 0; j < ekfN; j++ {
+			for k := 0; k < ekfN; k++ {
+				t[i][j] += p[i][k] * phi[j][k]
+			}
+		}
+	}
+	for i := 0; i < ekfN; i++ {
+		for j := 0; j < ekfN; j++ {
+			for k := 0; k < ekfN; k++ {
+				c[i][j] += t[i][k] * qi.Get(k, j)
+			}
+		}
+	}
+	return c, true
+}
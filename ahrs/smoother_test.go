@@ -0,0 +1,72 @@
+package ahrs
+
+import (
+	"math"
+	"os"
+	"testing"
+)
+
+// smootherErrors runs the EKF with sm recording over a noisy, biased S-turn flight and returns the RMS
+// attitude errors, °, of the filtered and smoothed attitudes after the first 10 s.
+func smootherErrors(t *testing.T, sm *Smoother) (filtered, smoothed float64, out []SmoothedAttitude) {
+	path := sTurnPath(100, 30*Deg, 40)
+	ms := withSensorErrors(simMeasurements(path, 0, 120, 0.02))
+	s := NewEKFAHRS()
+	s.SetSmoother(sm)
+	var n float64
+	for _, m := range ms {
+		s.Compute(m)
+		if m.T < 10 {
+			continue
+		}
+		r, p, h, _, _, _ := path(m.T)
+		roll, pitch, heading := s.RollPitchHeading()
+		filtered += math.Pow(angleErr(roll/Deg, r/Deg), 2) + math.Pow(angleErr(pitch/Deg, p/Deg), 2) +
+			math.Pow(angleErr(heading/Deg, h/Deg), 2)
+		n++
+	}
+	if sm.Len() != len(ms) {
+		t.Fatalf("expected %d steps recorded, got %d", len(ms), sm.Len())
+	}
+	out, err := sm.Smooth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range out {
+		if a.T < 10 {
+			continue
+		}
+		r, p, h, _, _, _ := path(a.T)
+		smoothed += math.Pow(angleErr(a.Roll/Deg, r/Deg), 2) + math.Pow(angleErr(a.Pitch/Deg, p/Deg), 2) +
+			math.Pow(angleErr(a.Heading/Deg, h/Deg), 2)
+	}
+	return math.Sqrt(filtered / n), math.Sqrt(smoothed / n), out
+}
+
+func TestSmoother(t *testing.T) {
+	filtered, smoothed, out := smootherErrors(t, NewSmoother())
+	t.Logf("RMS attitude error: filtered %.3f°, smoothed %.3f°", filtered, smoothed)
+	if smoothed > 0.7*filtered {
+		t.Errorf("expected smoothing to reduce the attitude error well below the filtered %.3f°, got %.3f°",
+			filtered, smoothed)
+	}
+
+	// Spooling to a file gives the same result and the file is removed on Close.
+	sm, err := NewSpooledSmoother(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, spooled := smootherErrors(t, sm)
+	name := sm.f.Name()
+	for i := range out {
+		if spooled[i] != out[i] {
+			t.Fatalf("spooled smoother differs at %.2f s: %v, in memory %v", out[i].T, spooled[i], out[i])
+		}
+	}
+	if err := sm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("expected the spool file to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package ahrs
+
+import (
+	"context"
+	"sync"
+)
+
+// BackpressurePolicy determines what a Stream does when its output channel is full,
+// and what a Runner does when its input queue is full.
+type BackpressurePolicy int
+
+const (
+	// Block makes the Stream wait for the consumer before computing the next measurement.
+	// Input measurements then queue up in the input channel; a Runner's senders likewise wait.
+	Block BackpressurePolicy = iota
+	// DropOldest discards the oldest unread update to make room for the newest one,
+	// so a slow consumer always sees the most recent attitude and never stalls the computation.
+	// A Runner discards its oldest queued measurement instead, so senders never wait on a slow provider.
+	DropOldest
+)
+
+// AttitudeUpdate is the attitude computed by a provider after one measurement.
+// Angles are in degrees, as are the other AHRSProvider outputs; Heading is Invalid when not known.
+type AttitudeUpdate struct {
+	T                    float64 // Sensor timestamp of the measurement that produced this update
+	Roll, Pitch, Heading float64 // Attitude, °
+	MagHeading           float64 // Magnetic heading, °
+	SlipSkid             float64 // Slip/skid angle, °
+	TurnRate             float64 // Rate of turn, °/s
+	GLoad                float64 // G load, G
+	Valid                bool    // Whether the provider considered its state valid
+	Seq                  uint64  // Number of measurements computed so far, starting at 1
+	Dropped              uint64  // Number of updates discarded so far under the DropOldest policy
+}
+
+// Stream connects an AHRSProvider to channels, for systems in which the sensor readers
+// and the consumers of the attitude run in separate goroutines.
+// The provider must not be used by anything else while the Stream is running.
+type Stream struct {
+	provider AHRSProvider
+	policy   BackpressurePolicy
+	bufSize  int
+
+	mu      sync.Mutex
+	latest  AttitudeUpdate
+	dropped uint64
+}
+
+// NewStream returns a Stream that runs the provider p, buffering up to bufSize updates
+// on its output channel and applying policy when that buffer is full.
+func NewStream(p AHRSProvider, policy BackpressurePolicy, bufSize int) (st *Stream) {
+	if bufSize < 1 {
+		bufSize = 1
+	}
+	return &Stream{provider: p, policy: policy, bufSize: bufSize}
+}
+
+// Run starts a goroutine that calls Compute for each measurement received on in and emits
+// the resulting attitude on the returned channel.
+// The goroutine stops, and the returned channel is closed, when ctx is cancelled or in is closed.
+// Providers don't retain the Measurement past Compute, so the caller may reuse it once it has been
+// received from the channel and a subsequent measurement has been sent.
+func (st *Stream) Run(ctx context.Context, in <-chan *Measurement) <-chan AttitudeUpdate {
+	out := make(chan AttitudeUpdate, st.bufSize)
+	go func() {
+		defer close(out)
+		var seq uint64
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case m, ok := <-in:
+				if !ok {
+					return
+				}
+				st.provider.Compute(m)
+				seq++
+				u := st.snapshot(m.T, seq)
+				if !st.send(ctx, out, u) {
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// GetLatest returns the most recent attitude update, for consumers that poll rather than read the channel.
+func (st *Stream) GetLatest() AttitudeUpdate {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.latest
+}
+
+// newAttitudeUpdate collects the current outputs of provider p.
+func newAttitudeUpdate(p AHRSProvider) (u AttitudeUpdate) {
+	u.T = p.GetState().T
+	u.MagHeading = p.MagHeading()
+	u.SlipSkid = p.SlipSkid()
+	u.TurnRate = p.RateOfTurn()
+	u.GLoad = p.GLoad()
+	u.Valid = p.Valid()
+	u.Roll, u.Pitch, u.Heading = p.RollPitchHeading()
+	u.Roll = RadToDeg(u.Roll)
+	u.Pitch = RadToDeg(u.Pitch)
+	if u.Heading != Invalid {
+		u.Heading = RadToDeg(u.Heading)
+	}
+	return
+}
+
+func (st *Stream) snapshot(t float64, seq uint64) AttitudeUpdate {
+	u := newAttitudeUpdate(st.provider)
+	u.T = t
+	u.Seq = seq
+
+	st.mu.Lock()
+	u.Dropped = st.dropped
+	st.latest = u
+	st.mu.Unlock()
+	return u
+}
+
+// send delivers u on out according to the backpressure policy.
+// It returns false if ctx was cancelled before u could be delivered.
+func (st *Stream) send(ctx context.Context, out chan AttitudeUpdate, u AttitudeUpdate) bool {
+	if st.policy == Block {
+		select {
+		case out <- u:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for {
+		st.mu.Lock()
+		u.Dropped = st.dropped
+		st.mu.Unlock()
+		select {
+		case out <- u:
+			return true
+		case <-ctx.Done():
+			return false
+		default:
+		}
+		// Buffer is full: discard the oldest update and try again.
+		select {
+		case <-out:
+			st.mu.Lock()
+			st.dropped++
+			st.latest.Dropped = st.dropped
+			st.mu.Unlock()
+		default:
+		}
+	}
+}
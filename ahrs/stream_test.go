@@ -0,0 +1,150 @@
+package ahrs
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// levelMeasurement returns a measurement of a stationary, level sensor at time t.
+func levelMeasurement(t float64) (m *Measurement) {
+	m = NewMeasurement()
+	m.SValid = true
+	m.A3 = 1
+	m.T = t
+	return
+}
+
+// checkNoGoroutineLeak fails the test if the number of goroutines doesn't return to n within a second.
+func checkNoGoroutineLeak(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("goroutine leak: %d running, expected %d\n%s",
+				runtime.NumGoroutine(), n, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStreamBlock(t *testing.T) {
+	n0 := runtime.NumGoroutine()
+	in := make(chan *Measurement)
+	out := NewStream(NewSimpleAHRS(), Block, 1).Run(context.Background(), in)
+
+	go func() {
+		for i := 0; i < 50; i++ {
+			in <- levelMeasurement(float64(i) * 0.1)
+		}
+		close(in)
+	}()
+
+	var seq uint64
+	for u := range out {
+		seq++
+		if u.Seq != seq {
+			t.Errorf("expected update %d, got %d", seq, u.Seq)
+		}
+		if u.Dropped != 0 {
+			t.Errorf("Block policy dropped %d updates", u.Dropped)
+		}
+	}
+	if seq != 50 {
+		t.Errorf("expected 50 updates, got %d", seq)
+	}
+	checkNoGoroutineLeak(t, n0)
+}
+
+func TestStreamCancel(t *testing.T) {
+	n0 := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan *Measurement)
+	st := NewStream(NewSimpleAHRS(), Block, 1)
+	out := st.Run(ctx, in)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case in <- levelMeasurement(float64(i) * 0.1):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		<-out
+	}
+	cancel()
+	for range out { // Must be closed promptly after cancellation
+	}
+	<-done
+
+	if u := st.GetLatest(); u.Seq < 10 {
+		t.Errorf("GetLatest returned update %d, expected at least 10", u.Seq)
+	}
+	checkNoGoroutineLeak(t, n0)
+}
+
+// stallingProvider computes n measurements with the wrapped provider, then signals stalled
+// and holds the next Compute until release is closed, skipping it.
+type stallingProvider struct {
+	AHRSProvider
+	n                int
+	stalled, release chan struct{}
+}
+
+func (p *stallingProvider) Compute(m *Measurement) {
+	if p.n == 0 {
+		close(p.stalled)
+		<-p.release
+		return
+	}
+	p.n--
+	p.AHRSProvider.Compute(m)
+}
+
+func TestStreamDropOldest(t *testing.T) {
+	n0 := runtime.NumGoroutine()
+	const n = 100
+	in := make(chan *Measurement, n+1)
+	for i := 0; i <= n; i++ {
+		in <- levelMeasurement(float64(i) * 0.1)
+	}
+	close(in)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &stallingProvider{NewSimpleAHRS(), n, make(chan struct{}), make(chan struct{})}
+	st := NewStream(p, DropOldest, 2)
+	out := st.Run(ctx, in)
+
+	// Slow consumer: don't read anything until the stream has sent all n updates and is computing the next.
+	<-p.stalled
+	if u := st.GetLatest(); u.Seq != n {
+		t.Errorf("stream stalled at update %d under DropOldest, expected %d", u.Seq, n)
+	}
+	var got []AttitudeUpdate // Nothing more is sent while the provider is held
+	for len(out) > 0 {
+		got = append(got, <-out)
+	}
+	cancel()
+	close(p.release)
+	for range out {
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("expected the 2 newest updates to be buffered, got %d", len(got))
+	}
+	if got[0].Seq != n-1 || got[1].Seq != n {
+		t.Errorf("expected updates %d and %d, got %d and %d", n-1, n, got[0].Seq, got[1].Seq)
+	}
+	if got[1].Dropped != n-2 {
+		t.Errorf("expected %d dropped updates, got %d", n-2, got[1].Dropped)
+	}
+	checkNoGoroutineLeak(t, n0)
+}
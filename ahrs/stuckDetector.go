@@ -0,0 +1,68 @@
+package ahrs
+
+import "math"
+
+// StuckReport lists which sensors appear to be frozen, reporting the same value over and over.
+type StuckReport struct {
+	Gyro, Accel, Mag bool
+}
+
+// Any returns whether any sensor appears to be frozen.
+func (r StuckReport) Any() bool {
+	return r.Gyro || r.Accel || r.Mag
+}
+
+// stuckChannel tracks how long a 3-axis sensor has held the same value.
+type stuckChannel struct {
+	ref     [3]float64 // Value when the sensor last changed
+	tRef    float64    // Time when the sensor last changed
+	n       int        // Number of samples since the sensor last changed
+	started bool
+}
+
+// check records the sample v at time t and returns the number of samples and time for which
+// no axis has moved more than epsilon away from the last changed value.
+func (c *stuckChannel) check(v [3]float64, t, epsilon float64) (n int, dt float64) {
+	if !c.started || math.Abs(v[0]-c.ref[0]) > epsilon ||
+		math.Abs(v[1]-c.ref[1]) > epsilon || math.Abs(v[2]-c.ref[2]) > epsilon {
+		c.ref, c.tRef, c.n, c.started = v, t, 0, true
+		return 0, 0
+	}
+	c.n++
+	return c.n, t - c.tRef
+}
+
+// StuckDetector detects a sensor that keeps reporting the same value.
+// A stuck sensor is worse than a missing one, since its validity flag stays true;
+// the caller can use CheckStuck to decide when to clear it.
+type StuckDetector struct {
+	epsilon    float64 // Smallest change that counts as the sensor moving
+	maxSamples int     // Number of unchanged samples after which a sensor is stuck, 0 to ignore
+	maxTime    float64 // Time, s, without change after which a sensor is stuck, 0 to ignore
+
+	gyro, accel, mag stuckChannel
+}
+
+// NewStuckDetector returns a StuckDetector that reports a sensor as stuck once none of its axes
+// has changed by more than epsilon for more than maxSamples samples or maxTime seconds.
+// Either limit may be 0 to disable it.
+func NewStuckDetector(epsilon float64, maxSamples int, maxTime float64) *StuckDetector {
+	return &StuckDetector{epsilon: epsilon, maxSamples: maxSamples, maxTime: maxTime}
+}
+
+// CheckStuck records the measurement m and reports which of its sensors appear to be stuck.
+// The magnetometer is only checked while m.MValid is set.
+func (d *StuckDetector) CheckStuck(m *Measurement) (r StuckReport) {
+	r.Gyro = d.stuck(d.gyro.check([3]float64{m.B1, m.B2, m.B3}, m.T, d.epsilon))
+	r.Accel = d.stuck(d.accel.check([3]float64{m.A1, m.A2, m.A3}, m.T, d.epsilon))
+	if m.MValid {
+		r.Mag = d.stuck(d.mag.check([3]float64{m.M1, m.M2, m.M3}, m.T, d.epsilon))
+	} else {
+		d.mag = stuckChannel{}
+	}
+	return
+}
+
+func (d *StuckDetector) stuck(n int, dt float64) bool {
+	return (d.maxSamples > 0 && n > d.maxSamples) || (d.maxTime > 0 && dt > d.maxTime)
+}
@@ -0,0 +1,70 @@
+package ahrs
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestStuckDetectorFrozenGyro(t *testing.T) {
+	d := NewStuckDetector(1e-6, 0, 1)
+	var r StuckReport
+	var tStuck float64
+	for i := 0; i <= 100; i++ { // 2 s at 50 Hz
+		m := NewMeasurement()
+		m.T = float64(i) * 0.02
+		m.B1, m.B2, m.B3 = 0.3, -0.1, 0.2 // Frozen
+		m.A1, m.A2, m.A3 = 0.01*rand.NormFloat64(), 0.01*rand.NormFloat64(), 1+0.01*rand.NormFloat64()
+		r = d.CheckStuck(m)
+		if r.Gyro && tStuck == 0 {
+			tStuck = m.T
+		}
+	}
+	if !r.Gyro {
+		t.Error("frozen gyro wasn't detected after 2 s")
+	}
+	if tStuck <= 1 || tStuck > 1.1 {
+		t.Errorf("frozen gyro was detected at %f s, expected just after 1 s", tStuck)
+	}
+	if r.Accel || r.Mag {
+		t.Errorf("only the gyro should be stuck, got %+v", r)
+	}
+}
+
+func TestStuckDetectorSamples(t *testing.T) {
+	d := NewStuckDetector(1e-6, 10, 0)
+	m := NewMeasurement()
+	m.A3 = 1
+	for i := 0; i <= 10; i++ {
+		m.T = float64(i)
+		if d.CheckStuck(m).Accel {
+			t.Fatalf("accelerometer reported stuck after only %d repeats", i)
+		}
+	}
+	m.T = 11
+	if r := d.CheckStuck(m); !r.Accel || !r.Gyro || !r.Any() {
+		t.Errorf("expected accelerometer and gyro stuck after 11 repeats, got %+v", r)
+	}
+	m.A3 = 1.01
+	if d.CheckStuck(m).Accel {
+		t.Error("accelerometer should no longer be stuck once it changes")
+	}
+}
+
+func TestStuckDetectorSlowData(t *testing.T) {
+	d := NewStuckDetector(1e-6, 50, 1)
+	noise := func() float64 { return 1e-5 * rand.NormFloat64() } // Far quieter than a real MEMS sensor
+	for i := 0; i <= 30000; i++ {                                // 10 minutes at 50 Hz
+		m := NewMeasurement()
+		m.T = float64(i) * 0.02
+		m.B1 = 0.05*math.Sin(m.T/60) + noise()
+		m.B2 = 1e-7*float64(i) + noise()
+		m.B3 = -0.02 + noise()
+		m.A1, m.A2, m.A3 = noise(), 0.001*math.Cos(m.T/30)+noise(), 1+noise()
+		m.M1, m.M2, m.M3 = 20+0.1*math.Sin(m.T/100)+noise(), noise(), -45+noise()
+		m.MValid = true
+		if r := d.CheckStuck(m); r.Any() {
+			t.Fatalf("slowly varying data reported stuck at %f s: %+v", m.T, r)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package ahrs
+
+import "math"
+
+// TempCompDegree is the highest power of temperature used when fitting gyro bias vs temperature.
+const TempCompDegree = 2
+
+// TempSample is a static gyro recording at a known temperature.
+// With the sensor at rest, the measured rates are the gyro biases at that temperature.
+type TempSample struct {
+	TempC      float64 // Sensor temperature, °C
+	B1, B2, B3 float64 // Mean gyro rates measured at rest, °/s
+}
+
+// TempComp holds a per-axis polynomial model of gyro bias vs temperature, fitted on the bench by FitTempComp.
+// The bias on axis i at temperature t is C_i[0] + C_i[1]*(t-T0) + C_i[2]*(t-T0)^2 + ...
+// It can correct the measurements directly with Apply, or seed the linear GyroTempModel that the providers
+// estimating the gyro biases learn in flight, with GyroTempModel.
+type TempComp struct {
+	T0         float64   // Reference temperature, °C
+	C1, C2, C3 []float64 // Polynomial coefficients for each gyro axis, °/s per °C^k
+}
+
+// Bias returns the temperature-predicted gyro biases in °/s.
+func (tc *TempComp) Bias(tempC float64) (b1, b2, b3 float64) {
+	dt := tempC - tc.T0
+	return evalPoly(tc.C1, dt), evalPoly(tc.C2, dt), evalPoly(tc.C3, dt)
+}
+
+// Apply subtracts the gyro bias predicted at the temperature of m from its gyro rates B1, B2, B3.
+// Without a valid temperature, m is left as it is.
+func (tc *TempComp) Apply(m *Measurement) {
+	if !m.TempValid || !(math.Abs(m.Temp) <= maxPlausibleTemp) {
+		return
+	}
+	b1, b2, b3 := tc.Bias(m.Temp)
+	m.B1 -= b1
+	m.B2 -= b2
+	m.B3 -= b3
+}
+
+// GyroTempModel returns the linear model matching tc at T0, to seed a provider with SetGyroTempModel.
+// Any higher-order terms are left for the provider to follow as it learns the model in flight.
+func (tc *TempComp) GyroTempModel() (tm GyroTempModel) {
+	tm.Enabled, tm.Fitted, tm.T0 = true, true, tc.T0
+	for i, c := range [3][]float64{tc.C1, tc.C2, tc.C3} {
+		if len(c) > 0 {
+			tm.B0[i] = c[0]
+		}
+		if len(c) > 1 {
+			tm.B1[i] = c[1]
+		}
+	}
+	return
+}
+
+// FitTempComp fits a TempComp by least squares to static recordings made at various temperatures.
+// The polynomial degree is TempCompDegree, reduced if there are too few distinct temperatures to support it.
+func FitTempComp(samples []TempSample) (tc TempComp) {
+	if len(samples) == 0 {
+		return
+	}
+
+	for _, s := range samples {
+		tc.T0 += s.TempC
+	}
+	tc.T0 /= float64(len(samples))
+
+	deg := TempCompDegree
+	if n := countDistinctTemps(samples) - 1; n < deg {
+		deg = n
+	}
+
+	// Normal equations: (X^T X) c = X^T y, with X[k][j] = (t_k-T0)^j
+	n := deg + 1
+	xx := make([][]float64, n)
+	xy := make([][3]float64, n)
+	for i := range xx {
+		xx[i] = make([]float64, n)
+	}
+	pows := make([]float64, 2*n-1)
+	for _, s := range samples {
+		dt := s.TempC - tc.T0
+		pows[0] = 1
+		for j := 1; j < len(pows); j++ {
+			pows[j] = pows[j-1] * dt
+		}
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				xx[i][j] += pows[i+j]
+			}
+			xy[i][0] += pows[i] * s.B1
+			xy[i][1] += pows[i] * s.B2
+			xy[i][2] += pows[i] * s.B3
+		}
+	}
+
+	c := solveNormalEquations(xx, xy)
+	tc.C1 = make([]float64, n)
+	tc.C2 = make([]float64, n)
+	tc.C3 = make([]float64, n)
+	for i := 0; i < n; i++ {
+		tc.C1[i], tc.C2[i], tc.C3[i] = c[i][0], c[i][1], c[i][2]
+	}
+	return
+}
+
+// evalPoly evaluates the polynomial with coefficients c at x using Horner's method.
+func evalPoly(c []float64, x float64) (y float64) {
+	for i := len(c) - 1; i >= 0; i-- {
+		y = y*x + c[i]
+	}
+	return
+}
+
+func countDistinctTemps(samples []TempSample) (n int) {
+	seen := make(map[float64]bool)
+	for _, s := range samples {
+		if !seen[s.TempC] {
+			seen[s.TempC] = true
+			n++
+		}
+	}
+	return
+}
+
+// solveNormalEquations solves a x = b by Gaussian elimination with partial pivoting,
+// for three right-hand sides at once.  a and b are overwritten.
+func solveNormalEquations(a [][]float64, b [][3]float64) (x [][3]float64) {
+	n := len(a)
+	for c := 0; c < n; c++ {
+		p := c
+		for r := c + 1; r < n; r++ {
+			if math.Abs(a[r][c]) > math.Abs(a[p][c]) {
+				p = r
+			}
+		}
+		a[c], a[p] = a[p], a[c]
+		b[c], b[p] = b[p], b[c]
+		if math.Abs(a[c][c]) < Small {
+			continue
+		}
+		for r := c + 1; r < n; r++ {
+			f := a[r][c] / a[c][c]
+			for j := c; j < n; j++ {
+				a[r][j] -= f * a[c][j]
+			}
+			for k := 0; k < 3; k++ {
+				b[r][k] -= f * b[c][k]
+			}
+		}
+	}
+
+	x = make([][3]float64, n)
+	for r := n - 1; r >= 0; r-- {
+		if math.Abs(a[r][r]) < Small {
+			continue
+		}
+		for k := 0; k < 3; k++ {
+			v := b[r][k]
+			for j := r + 1; j < n; j++ {
+				v -= a[r][j] * x[j][k]
+			}
+			x[r][k] = v / a[r][r]
+		}
+	}
+	return
+}
@@ -0,0 +1,77 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFitTempCompLinear(t *testing.T) {
+	// Known linear bias-vs-temperature relationship on each axis
+	bias := func(tempC float64) (float64, float64, float64) {
+		return 0.5 + 0.02*tempC, -0.3 - 0.01*tempC, 0.1 + 0.005*tempC
+	}
+
+	var samples []TempSample
+	for tempC := -10.0; tempC <= 50; tempC += 5 {
+		b1, b2, b3 := bias(tempC)
+		samples = append(samples, TempSample{TempC: tempC, B1: b1, B2: b2, B3: b3})
+	}
+
+	tc := FitTempComp(samples)
+
+	for _, tempC := range []float64{-5, 12.3, 25, 47} {
+		b1, b2, b3 := bias(tempC)
+		m := NewMeasurement()
+		m.B1, m.B2, m.B3 = b1, b2, b3 // Sensor at rest, so measured rates are pure bias
+		m.Temp, m.TempValid = tempC, true
+		tc.Apply(m)
+		if math.Abs(m.B1) > 1e-9 || math.Abs(m.B2) > 1e-9 || math.Abs(m.B3) > 1e-9 {
+			t.Errorf("at %4.1f°C, residual bias after correction was %g, %g, %g", tempC, m.B1, m.B2, m.B3)
+		}
+	}
+}
+
+func TestFitTempCompTwoTemps(t *testing.T) {
+	// Only two distinct temperatures: the fit must fall back to a straight line.
+	tc := FitTempComp([]TempSample{
+		{TempC: 0, B1: 1, B2: 2, B3: 3},
+		{TempC: 0, B1: 1, B2: 2, B3: 3},
+		{TempC: 20, B1: 2, B2: 1, B3: 3},
+	})
+	if len(tc.C1) != 2 {
+		t.Fatalf("expected a linear fit, got %d coefficients", len(tc.C1))
+	}
+	b1, b2, b3 := tc.Bias(10)
+	if math.Abs(b1-1.5) > 1e-9 || math.Abs(b2-1.5) > 1e-9 || math.Abs(b3-3) > 1e-9 {
+		t.Errorf("interpolated bias was %g, %g, %g", b1, b2, b3)
+	}
+}
+
+func TestTempCompMeasurement(t *testing.T) {
+	tc := FitTempComp([]TempSample{
+		{TempC: 0, B1: 1, B2: 2, B3: 3},
+		{TempC: 20, B1: 2, B2: 1, B3: 3},
+		{TempC: 40, B1: 3, B2: 0, B3: 3},
+	})
+
+	// Without a valid temperature the rates are left alone.
+	m := NewMeasurement()
+	m.B1, m.B2, m.B3, m.Temp = 1.5, 1.5, 3, 10
+	tc.Apply(m)
+	if m.B1 != 1.5 || m.B2 != 1.5 || m.B3 != 3 {
+		t.Errorf("rates corrected to %g, %g, %g without a valid temperature", m.B1, m.B2, m.B3)
+	}
+
+	// The model seeded from the calibration predicts the same biases as the calibration.
+	tm := tc.GyroTempModel()
+	if !tm.Enabled || !tm.Fitted {
+		t.Errorf("seeded model %+v isn't enabled and fitted", tm)
+	}
+	for _, tempC := range []float64{-10, 10, 35} {
+		c1, c2, c3 := tc.Bias(tempC)
+		b1, b2, b3 := tm.Bias(tempC)
+		if math.Abs(b1-c1) > 1e-9 || math.Abs(b2-c2) > 1e-9 || math.Abs(b3-c3) > 1e-9 {
+			t.Errorf("at %g°C the model predicts %g, %g, %g, the calibration %g, %g, %g", tempC, b1, b2, b3, c1, c2, c3)
+		}
+	}
+}
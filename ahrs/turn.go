@@ -0,0 +1,88 @@
+package ahrs
+
+import "math"
+
+// StandardRate is the rate of a standard-rate turn, °/s.
+const StandardRate = 3.0
+
+// StandardRateBank returns the bank angle, °, for a coordinated standard-rate turn at groundspeed gs, kt.
+func StandardRateBank(gs float64) float64 {
+	return BankFromTurnRate(StandardRate, gs)
+}
+
+// BankFromTurnRate returns the bank angle, °, for a coordinated turn at rate tr, °/s, and groundspeed gs, kt,
+// from the centripetal acceleration gs*tr/G that SimpleState uses.  It is negative for a left turn.
+func BankFromTurnRate(tr, gs float64) float64 {
+	return RadToDeg(math.Atan(gs * DegToRad(tr) / G))
+}
+
+// TurnRateFromBank returns the rate, °/s, of a coordinated turn at bank angle bank, ° with right wing down
+// positive, and groundspeed gs, kt.  It is 0 at zero groundspeed.
+func TurnRateFromBank(bank, gs float64) float64 {
+	if gs == 0 {
+		return 0
+	}
+	return RadToDeg(math.Tan(DegToRad(bank)) * G / gs)
+}
+
+// CrabAngle returns the angle, °, of the heading right of the track, both °, across north as need be:
+// a heading of 003° on a track of 358° is a crab of 5° into a wind from the right.
+func CrabAngle(heading, track float64) float64 {
+	return RadToDeg(AngleDiff(DegToRad(heading), DegToRad(track)))
+}
+
+// trackFromVelocity returns the ground track, ° in [0, 360), of the earth-frame velocity w1 east, w2 north.
+func trackFromVelocity(w1, w2 float64) float64 {
+	return math.Mod(RadToDeg(math.Atan2(w1, w2))+360, 360)
+}
+
+// RemoveManeuveringAccel returns the accelerometer reading of m, G, sensor frame, less the centripetal
+// acceleration of turning at rate turnRate, °/s with right turns positive, at groundspeed gs, kt, leaving
+// an estimate of gravity alone for the filters that take the accelerometer as their level reference.
+// The acceleration is taken to be horizontal and square to the nose, at the current attitude E.
+// Changes of speed along the track aren't known from gs and turnRate, so they are left in.
+func (s *State) RemoveManeuveringAccel(m *Measurement, gs, turnRate float64) (ax, ay, az float64) {
+	r := s.CalcRotationMatrix()
+	n1, n2 := r[0][0], r[1][0] // Nose, earth frame
+	nn := math.Hypot(n1, n2)
+	if nn < Small {
+		return m.A1, m.A2, m.A3 // Pointing straight up or down, there's no horizontal direction to the turn
+	}
+	ac := gs * DegToRad(turnRate) / G / nn
+	c1, c2, c3 := s.RotateEarthToBody(ac*n2, -ac*n1, 0) // To the right of the nose
+	c1, c2, c3 = s.rotateByF(c1, c2, c3, true)
+	return m.A1 - c1, m.A2 - c2, m.A3 - c3
+}
+
+// turnCoordinatorCantDefault is the usual cant of a turn coordinator's gyro, °, nose up from the yaw axis.
+const turnCoordinatorCantDefault = 30.0
+
+// TurnCoordinator configures CalcTurnCoordinator.  A zero value takes the defaults.
+type TurnCoordinator struct {
+	Cant      *float64 // Angle, ° below 90, by which the gyro is canted nose up to respond to the roll rate too; 30 by default
+	Reference float64  // Turn rate, °/s, at which the needle reads 1; StandardRate by default
+}
+
+// SetTurnCoordinator sets the cant and reference rate of CalcTurnCoordinator.
+func (s *State) SetTurnCoordinator(tc TurnCoordinator) {
+	s.turnCoordinator = tc
+}
+
+// CalcTurnCoordinator returns the deflection of a turn coordinator's needle, 1 at the reference rate to the
+// right and -1 to the left, along with the slip/skid angle, °, for its ball.  Like the instrument, it reads
+// a gyro canted nose up in the plane of the roll and yaw axes, taking its rate from the body rates alone, so
+// that it needs neither the GPS nor the attitude.  It leads into and out of a turn with the roll rate, and
+// it is scaled to read 1 at the reference rate of yaw, so in a steady coordinated turn it reads the cosine
+// of the bank less: 0.96 for a standard-rate turn at 100 kt.
+func (s *State) CalcTurnCoordinator() (deflection, slipSkid float64) {
+	cant, ref := turnCoordinatorCantDefault, s.turnCoordinator.Reference
+	if s.turnCoordinator.Cant != nil {
+		cant = *s.turnCoordinator.Cant
+	}
+	if ref == 0 {
+		ref = StandardRate
+	}
+	p, _, r := s.CalcBodyRates()
+	sinCant, cosCant := math.Sincos(DegToRad(cant))
+	return (r*cosCant + p*sinCant) / (ref * cosCant), s.SlipSkid()
+}
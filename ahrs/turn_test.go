@@ -0,0 +1,120 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStandardRateBank(t *testing.T) {
+	bank := StandardRateBank(120)
+	t.Logf("standard-rate bank at 120 kt is %.2f°", bank)
+	if bank < 17 || bank > 20 {
+		t.Errorf("expected a standard-rate bank of 17-20° at 120 kt, got %.2f°", bank)
+	}
+	if tr := TurnRateFromBank(bank, 120); math.Abs(tr-StandardRate) > 1e-9 {
+		t.Errorf("expected a %.2f° bank at 120 kt to give a standard-rate turn, got %f°/s", bank, tr)
+	}
+	if b := BankFromTurnRate(-StandardRate, 120); math.Abs(b+bank) > 1e-9 {
+		t.Errorf("expected a left turn to bank the other way, got %f°", b)
+	}
+	if tr := TurnRateFromBank(30, 0); tr != 0 {
+		t.Errorf("expected no turn rate at zero groundspeed, got %f°/s", tr)
+	}
+}
+
+func TestRemoveManeuveringAccel(t *testing.T) {
+	// A coordinated turn at 120 kt and twice standard rate, to the right and the left.
+	for _, tr := range []float64{2 * StandardRate, -2 * StandardRate} {
+		path := turnPath(120, 40*Deg, 0, DegToRad(tr))
+		m := simMeasurement(path, 10, 0.01)
+		s := new(State)
+		s.F0 = 1
+		s.calcRotationMatrices()
+		roll, pitch, heading, _, _, _ := path(10)
+		s.E0, s.E1, s.E2, s.E3 = ToQuaternion(roll, pitch, heading)
+
+		// Angle off the vertical of the accelerometer reading in the earth frame
+		tilt := func(a1, a2, a3 float64) float64 {
+			x, y, z := s.RotateBodyToEarth(a1, a2, a3)
+			return math.Atan2(math.Hypot(x, y), z) / Deg
+		}
+		raw := tilt(m.A1, m.A2, m.A3)
+		ax, ay, az := s.RemoveManeuveringAccel(m, 120, tr)
+		corrected := tilt(ax, ay, az)
+		t.Logf("turning at %.0f°/s, the accelerometer is %.2f° off the vertical, %.2f° corrected", tr, raw, corrected)
+		if raw < 10 || corrected > 0.5 {
+			t.Errorf("turning at %.0f°/s, expected the correction to bring the accelerometer from %.2f° to the vertical, got %.2f°",
+				tr, raw, corrected)
+		}
+		if g := math.Sqrt(ax*ax + ay*ay + az*az); math.Abs(g-1) > 0.01 {
+			t.Errorf("turning at %.0f°/s, expected 1 G of gravity left, got %.3f G", tr, g)
+		}
+	}
+}
+
+func TestCalcTurnCoordinator(t *testing.T) {
+	// In a steady coordinated turn the gyro sees the cosine of the bank of the turn rate.
+	for _, c := range []struct {
+		name string
+		gs   float64 // kt
+		rate float64 // °/s
+		gps  bool
+	}{
+		{"standard rate", 100, StandardRate, true},
+		{"half standard rate", 100, StandardRate / 2, true},
+		{"standard rate left", 100, -StandardRate, true},
+		{"standard rate without GPS", 100, StandardRate, false},
+		{"standard rate left without GPS", 150, -StandardRate, false},
+		{"double standard rate without GPS", 120, 2 * StandardRate, false},
+	} {
+		s := NewSimpleAHRS()
+		for _, m := range simMeasurements(turnPath(c.gs, 0, 0, c.rate*Deg), 0, 30, 0.05) {
+			m.WValid = c.gps
+			s.Compute(m)
+		}
+		want := c.rate / StandardRate * math.Cos(DegToRad(BankFromTurnRate(c.rate, c.gs)))
+		d, slip := s.CalcTurnCoordinator()
+		if math.Abs(d-want) > 0.02*math.Abs(want) || (c.gps && math.Abs(slip) > 1) {
+			t.Errorf("%s: needle at %.3f, ball at %.2f°, expected %.3f, 0", c.name, d, slip, want)
+		}
+	}
+
+	// Referenced to 1.5°/s, a standard-rate turn is off the scale.
+	s := NewSimpleAHRS()
+	s.SetTurnCoordinator(TurnCoordinator{Reference: 1.5})
+	for _, m := range simMeasurements(turnPath(100, 0, 0, StandardRate*Deg), 0, 30, 0.05) {
+		s.Compute(m)
+	}
+	want := 2 * math.Cos(DegToRad(BankFromTurnRate(StandardRate, 100)))
+	if d, _ := s.CalcTurnCoordinator(); math.Abs(d-want) > 0.04 {
+		t.Errorf("needle at %.3f referenced to 1.5°/s, expected %.3f", d, want)
+	}
+
+	// Rolling through level from one turn of an S-turn to the next, the canted gyro leads by the roll rate.
+	s = NewSimpleAHRS()
+	for _, m := range simMeasurements(sTurnPath(100, 30*Deg, 60), 0, 15, 0.05) {
+		s.Compute(m)
+	}
+	lead, _ := s.CalcTurnCoordinator()
+	zero := 0.0
+	s.SetTurnCoordinator(TurnCoordinator{Cant: &zero})
+	yaw, _ := s.CalcTurnCoordinator()
+	p, _, r := s.CalcBodyRates()
+	if math.Abs(yaw-r/StandardRate) > 1e-9 || math.Abs(lead-yaw-math.Tan(30*Deg)*p/StandardRate) > 1e-9 || p > -0.5 {
+		t.Errorf("needle at %.3f canted 30°, %.3f uncanted, rolling at %.2f°/s and yawing at %.2f°/s", lead, yaw, p, r)
+	}
+}
+
+func TestCrabAngle(t *testing.T) {
+	for _, c := range []struct{ heading, track, want float64 }{
+		{45, 30, 15},
+		{30, 45, -15},
+		{3, 358, 5},
+		{358, 3, -5},
+		{180, 170, 10},
+	} {
+		if got := CrabAngle(c.heading, c.track); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("heading %.0f° on a track of %.0f° is a crab of %f°, expected %.0f°", c.heading, c.track, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package ahrs
+
+/*
+Units used throughout the package, unless a field or function documents otherwise:
+speeds are in knots, altitudes in feet and vertical speeds in feet per minute, as in aviation;
+accelerations are in G, where G itself is in kt/s; rotation rates are in °/s; and angles are in
+radians internally, in state and in RollPitchHeading, but in degrees where returned for display,
+as by CalcRollPitchHeading, MagHeading and SlipSkid.  Times are in seconds.
+*/
+
+const (
+	metersPerFoot = 0.3048
+	metersPerNM   = 1852.0
+)
+
+// KnotsToMS converts a speed in knots to m/s.
+func KnotsToMS(kt float64) float64 {
+	return kt * metersPerNM / 3600
+}
+
+// MSToKnots converts a speed in m/s to knots.
+func MSToKnots(ms float64) float64 {
+	return ms * 3600 / metersPerNM
+}
+
+// FeetToMeters converts a length in feet to meters.
+func FeetToMeters(ft float64) float64 {
+	return ft * metersPerFoot
+}
+
+// MetersToFeet converts a length in meters to feet.
+func MetersToFeet(m float64) float64 {
+	return m / metersPerFoot
+}
+
+// FPMToMS converts a vertical speed in feet per minute to m/s.
+func FPMToMS(fpm float64) float64 {
+	return fpm * metersPerFoot / 60
+}
+
+// MSToFPM converts a vertical speed in m/s to feet per minute.
+func MSToFPM(ms float64) float64 {
+	return ms * 60 / metersPerFoot
+}
+
+// DegToRad converts an angle, or a rotation rate, in degrees to radians.
+func DegToRad(deg float64) float64 {
+	return deg * Deg
+}
+
+// RadToDeg converts an angle, or a rotation rate, in radians to degrees.
+func RadToDeg(rad float64) float64 {
+	return rad / Deg
+}
@@ -0,0 +1,28 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+func TestUnits(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		to, from func(float64) float64
+		x, want  float64 // A value and its conversion
+	}{
+		{"knots", KnotsToMS, MSToKnots, 100, 51.44444444444444},
+		{"feet", FeetToMeters, MetersToFeet, 1000, 304.8},
+		{"fpm", FPMToMS, MSToFPM, 500, 2.54},
+		{"degrees", DegToRad, RadToDeg, 180, math.Pi},
+	} {
+		if got := c.to(c.x); math.Abs(got-c.want) > 1e-12*c.want {
+			t.Errorf("%s: %g converts to %g, expected %g", c.name, c.x, got, c.want)
+		}
+		for _, x := range []float64{0, 1, -2.5, 123.456, 1e6} {
+			if got := c.from(c.to(x)); math.Abs(got-x) > 1e-12*math.Max(1, math.Abs(x)) {
+				t.Errorf("%s: %g round-trips to %g", c.name, x, got)
+			}
+		}
+	}
+}
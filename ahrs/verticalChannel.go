@@ -0,0 +1,85 @@
+package ahrs
+
+const verticalTauDefault = 5.0 // Default time constant, s, of the vertical channel
+
+// VerticalChannel blends the vertical acceleration, taken from the accelerometer by a provider's attitude,
+// with a barometric altitude, for a vertical speed without the lag of the GPS or the noise of the baro rate.
+// It is a third-order complementary filter: the acceleration is integrated into the vertical speed and the
+// altitude, the baro washes out their drift over the time constant, and the accelerometer bias along the
+// vertical is estimated over it too, so that the integration doesn't run away.
+// While the provider's attitude isn't valid, or there is no accelerometer reading, it follows the baro alone.
+type VerticalChannel struct {
+	tau     float64 // Time constant, s
+	h, v    float64 // Altitude, ft, and vertical speed, ft/s
+	bias    float64 // Accelerometer bias along the vertical, ft/s²
+	t       float64 // Time of the last update, s
+	started bool    // Whether h holds a baro altitude
+}
+
+// NewVerticalChannel returns a VerticalChannel whose blend and bias estimate settle over tau seconds.
+// A non-positive tau takes the default, 5 s.
+func NewVerticalChannel(tau float64) *VerticalChannel {
+	if tau <= 0 {
+		tau = verticalTauDefault
+	}
+	return &VerticalChannel{tau: tau}
+}
+
+// Update advances the channel to the time of m, the measurement last computed by p, with the barometric
+// altitude baroAlt, ft, if baroValid.  It starts from the first valid baro altitude.
+func (vc *VerticalChannel) Update(m *Measurement, p AHRSProvider, baroAlt float64, baroValid bool) {
+	if !vc.started {
+		if baroValid {
+			vc.h, vc.v, vc.bias, vc.t, vc.started = baroAlt, 0, 0, m.T, true
+		}
+		return
+	}
+	dt := m.T - vc.t
+	if dt <= 0 {
+		return
+	}
+	vc.t = m.T
+
+	// Vertical acceleration, ft/s²: the specific force rotated into the earth frame, less gravity.
+	var a float64
+	inertial := m.SValid && p.Valid()
+	if inertial {
+		s := p.GetState()
+		f1, f2, f3 := s.rotateByF(m.A1, m.A2, m.A3, false)
+		_, _, fu := s.RotateBodyToEarth(f1, f2, f3)
+		a = (fu-1)*G*MetersToFeet(KnotsToMS(1)) - vc.bias
+	}
+
+	var e float64
+	if baroValid {
+		e = baroAlt - vc.h
+	}
+	// Gains placing all three poles at -1/tau
+	k1, k2, k3 := 3/vc.tau, 3/(vc.tau*vc.tau), 1/(vc.tau*vc.tau*vc.tau)
+	vc.h += (vc.v + k1*e) * dt
+	vc.v += (a + k2*e) * dt
+	if inertial {
+		vc.bias -= k3 * e * dt
+	}
+}
+
+// VerticalSpeed returns the blended vertical speed in ft/min, or Invalid before the first baro altitude.
+func (vc *VerticalChannel) VerticalSpeed() float64 {
+	if !vc.started {
+		return Invalid
+	}
+	return vc.v * 60
+}
+
+// Altitude returns the blended altitude in ft, or Invalid before the first baro altitude.
+func (vc *VerticalChannel) Altitude() float64 {
+	if !vc.started {
+		return Invalid
+	}
+	return vc.h
+}
+
+// AccelBias returns the estimated bias of the accelerometer along the vertical, in G.
+func (vc *VerticalChannel) AccelBias() float64 {
+	return vc.bias / (G * MetersToFeet(KnotsToMS(1)))
+}
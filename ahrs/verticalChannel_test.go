@@ -0,0 +1,78 @@
+package ahrs
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// runVerticalChannel feeds the measurements along path from 0 to t1 s to a SimpleAHRS and a VerticalChannel,
+// with an accelerometer bias of accelBias G on the vertical, accelerometer and baro noise, and calls f
+// with the true vertical speed, ft/min, after each step.
+func runVerticalChannel(path flightPath, t1, accelBias float64, f func(m *Measurement, vc *VerticalChannel, vs float64)) {
+	rng := rand.New(rand.NewSource(1))
+	s := NewSimpleAHRS()
+	vc := NewVerticalChannel(0)
+	var h, w3Prev float64
+	for _, m := range simMeasurements(path, 0, t1, 0.05) {
+		h += (w3Prev + m.W3) / 2 * 0.05 * MetersToFeet(KnotsToMS(1))
+		w3Prev = m.W3
+		m.A1 += 0.02 * rng.NormFloat64()
+		m.A2 += 0.02 * rng.NormFloat64()
+		m.A3 += accelBias + 0.02*rng.NormFloat64()
+		s.Compute(m)
+		vc.Update(m, s, h+3*rng.NormFloat64(), true)
+		f(m, vc, MSToFPM(KnotsToMS(m.W3)))
+	}
+}
+
+func TestVerticalChannelPullUp(t *testing.T) {
+	const lag = 1.0 // GPS latency, s
+	// A sharp pull-up into a climb at about 1500 ft/min
+	var tVC, tGPS float64
+	runVerticalChannel(pullUpPath(100, 60, 8.5*Deg), 70, 0, func(m *Measurement, vc *VerticalChannel, vs float64) {
+		if tVC == 0 && m.T > 50 && vc.VerticalSpeed() > 750 {
+			tVC = m.T
+		}
+		if tGPS == 0 && vs > 750 {
+			tGPS = m.T + lag
+		}
+	})
+	if lead := tGPS - tVC; tVC == 0 || lead < 0.7*lag || lead > 1.3*lag {
+		t.Errorf("blended vertical speed reached 750 ft/min at %.2f s, GPS at %.2f s, expected a lead of about %.1f s",
+			tVC, tGPS, lag)
+	}
+}
+
+func TestVerticalChannelNoDrift(t *testing.T) {
+	const bias = 0.01
+	var maxVS, maxAlt float64
+	var vc *VerticalChannel
+	runVerticalChannel(straightPath(100, 0), 1800, bias, func(m *Measurement, c *VerticalChannel, vs float64) {
+		vc = c
+		if m.T > 60 {
+			maxVS = math.Max(maxVS, math.Abs(c.VerticalSpeed()))
+			maxAlt = math.Max(maxAlt, math.Abs(c.Altitude()))
+		}
+	})
+	if maxVS > 100 || maxAlt > 10 {
+		t.Errorf("level for 30 min, vertical speed reached %.0f ft/min and altitude %.1f ft", maxVS, maxAlt)
+	}
+	if b := vc.AccelBias(); math.Abs(b-bias) > 0.002 {
+		t.Errorf("accelerometer bias estimated as %.4f G, expected %.4f G", b, bias)
+	}
+}
+
+func TestVerticalChannelBaroOnly(t *testing.T) {
+	// Without accelerometer readings or a valid attitude it follows the baro alone.
+	vc := NewVerticalChannel(2)
+	s := NewSimpleAHRS()
+	for i := 0; i <= 600; i++ {
+		m := NewMeasurement()
+		m.T = float64(i) * 0.05
+		vc.Update(m, s, 10*m.T, true) // 600 ft/min
+	}
+	if vs := vc.VerticalSpeed(); math.Abs(vs-600) > 5 {
+		t.Errorf("baro-only vertical speed %.1f ft/min, expected 600", vs)
+	}
+}
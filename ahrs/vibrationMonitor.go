@@ -0,0 +1,79 @@
+package ahrs
+
+import "math"
+
+const (
+	vibrationBins      = 16   // Number of intervals making up the window
+	vibrationWindow    = 1.0  // Time over which the accelerometer magnitude is measured, s
+	vibrationTolerance = 0.02 // Vibration within which the accelerometer is fully trusted, G
+	vibrationScale     = 0.05 // Further vibration at which the accelerometer's weight has fallen to 1/2, G
+)
+
+// vibrationMonitor measures the spread of the accelerometer magnitude over a sliding window.  Steady
+// flight holds it near 1 G, so its standard deviation is mostly engine and airframe vibration,
+// which the accelerometer can't be trusted through.
+// The window is kept as bins of running sums so that updating it doesn't allocate.
+type vibrationMonitor struct {
+	n, sum, sum2 [vibrationBins]float64 // Count, sum and sum of squares of the magnitudes within each bin
+	next         int                    // Bin being accumulated
+	tBin         float64                // Time when the bin being accumulated was started
+	started      bool
+}
+
+// update adds the accelerometer magnitude a at time t.
+func (w *vibrationMonitor) update(t, a float64) {
+	if !w.started {
+		*w = vibrationMonitor{tBin: t, started: true}
+	}
+	w.n[w.next]++
+	w.sum[w.next] += a
+	w.sum2[w.next] += a * a
+	if t-w.tBin >= vibrationWindow/vibrationBins {
+		w.next = (w.next + 1) % vibrationBins
+		w.n[w.next], w.sum[w.next], w.sum2[w.next] = 0, 0, 0
+		w.tBin = t
+	}
+}
+
+// sigma returns the standard deviation of the accelerometer magnitude over the window.
+func (w *vibrationMonitor) sigma() float64 {
+	var n, sum, sum2 float64
+	for i := range w.n {
+		n += w.n[i]
+		sum += w.sum[i]
+		sum2 += w.sum2[i]
+	}
+	if n < 2 {
+		return 0
+	}
+	mean := sum / n
+	return math.Sqrt(math.Max(0, sum2/n-mean*mean))
+}
+
+// weight returns the factor by which to scale the weight given to the accelerometer: 1 while the
+// vibration is within tolerance, falling towards 0 as it grows.
+func (w *vibrationMonitor) weight() float64 {
+	excess := w.sigma() - vibrationTolerance
+	if excess <= 0 {
+		return 1
+	}
+	return 1 / (1 + excess*excess/(vibrationScale*vibrationScale))
+}
+
+// checkVibration feeds the vibration monitor with the accelerometer reading a1, a2, a3, G, at time t
+// and returns the vibration, G.  Without an accelerometer reading (ok false) the monitor starts over.
+func (s *State) checkVibration(a1, a2, a3, t float64, ok bool) float64 {
+	if !ok {
+		s.vibMon = vibrationMonitor{}
+		return 0
+	}
+	s.vibMon.update(t, math.Sqrt(a1*a1+a2*a2+a3*a3))
+	return s.vibMon.sigma()
+}
+
+// CalcVibration returns the standard deviation of the accelerometer magnitude over the last second, G,
+// a measure of the engine and airframe vibration.  The providers aided by the accelerometer down-weight
+// it accordingly.  It is 0 for those that don't track it.
+func (s *State) CalcVibration() float64 {
+	return s.vibMon.sigma()
+}
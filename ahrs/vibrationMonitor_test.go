@@ -0,0 +1,93 @@
+package ahrs
+
+import (
+	"math"
+	"testing"
+)
+
+// withVibration adds to the accelerometer readings in ms a vibration of amplitude amp, G, on each axis,
+// its frequency sweeping between 30 and 60 Hz as the engine RPM changes.
+func withVibration(ms []*Measurement, amp float64) []*Measurement {
+	var phase float64
+	for i, m := range ms {
+		if i > 0 {
+			phase += 2 * Pi * (45 + 15*math.Sin(0.3*m.T)) * (m.T - ms[i-1].T)
+		}
+		m.A1 += amp * math.Sin(phase)
+		m.A2 += amp * math.Sin(1.3*phase+1)
+		m.A3 += amp * math.Sin(0.7*phase+2)
+	}
+	return ms
+}
+
+// rmsTiltError returns the RMS roll and pitch error, °, of p along path after the first settle seconds.
+func rmsTiltError(p AHRSProvider, path flightPath, settle float64, ms []*Measurement) float64 {
+	var e, n float64
+	for _, m := range ms {
+		p.Compute(m)
+		if m.T < settle {
+			continue
+		}
+		roll, pitch, _ := p.GetState().CalcRollPitchHeading()
+		rr, pp, _, _, _, _ := path(m.T)
+		e += math.Pow(angleErr(roll, rr/Deg), 2) + math.Pow(angleErr(pitch, pp/Deg), 2)
+		n++
+	}
+	return math.Sqrt(e / n)
+}
+
+func TestCalcVibration(t *testing.T) {
+	path := straightPath(100, 0)
+	for _, c := range []struct {
+		amp, min, max float64
+	}{{0, 0, 0.005}, {0.1, 0.05, 0.1}, {0.3, 0.15, 0.3}} {
+		ms := withVibration(simMeasurements(path, 0, 5, 0.05), c.amp)
+		s := InitializeKalman(ms[0])
+		for _, m := range ms[1:] {
+			s.Compute(m)
+		}
+		if v := s.CalcVibration(); v < c.min || v > c.max {
+			t.Errorf("vibration of %.2f G measured as %.3f G", c.amp, v)
+		}
+	}
+
+	s := new(State)
+	for i := 0; i < 20; i++ {
+		s.checkVibration(0, 0, 1+0.1*float64(i%2), float64(i)*0.05, true)
+	}
+	if s.CalcVibration() == 0 {
+		t.Fatal("no vibration measured")
+	}
+	if s.checkVibration(0, 0, 1, 1, false); s.CalcVibration() != 0 {
+		t.Error("vibration wasn't cleared without an accelerometer reading")
+	}
+}
+
+func TestKalmanVibrationScaling(t *testing.T) {
+	path := straightPath(100, 0)
+	run := func(gain float64) float64 {
+		ms := withVibration(simMeasurements(path, 0, 30, 0.05), 0.1)
+		s := InitializeKalman(ms[0])
+		s.SetVibrationScaling(gain, 0)
+		return rmsTiltError(s, path, 10, ms[1:])
+	}
+	fixed, adapted := run(0), run(100)
+	t.Logf("RMS tilt error %.1f° without adapting the accelerometer noise, %.1f° adapted to the vibration", fixed, adapted)
+	if adapted > 2 || adapted > fixed/2 {
+		t.Errorf("adapting to the vibration gave an RMS tilt error of %.1f°, against %.1f° without", adapted, fixed)
+	}
+}
+
+func TestSimpleVibration(t *testing.T) {
+	path := sTurnPath(100, 15*Deg, 30)
+	clean := rmsTiltError(NewSimpleAHRS(), path, 10, simMeasurements(path, 0, 60, 0.05))
+	s := NewSimpleAHRS()
+	shaken := rmsTiltError(s, path, 10, withVibration(simMeasurements(path, 0, 60, 0.05), 0.1))
+	t.Logf("RMS tilt error %.2f° clean, %.2f° with vibration", clean, shaken)
+	if w := s.vibMon.weight(); w > 0.6 {
+		t.Errorf("accelerometer weight only reduced by %.2f for %.3f G of vibration", w, s.CalcVibration())
+	}
+	if shaken > 1.5 {
+		t.Errorf("RMS tilt error %.2f° with vibration", shaken)
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"strconv"
 
 	"../ahrs"
-	"github.com/skelterjohn/go.matrix"
 )
 
 type SituationFromFile struct {
@@ -202,7 +201,7 @@ func (s *SituationFromFile) UpdateMeasurement(m *ahrs.Measurement,
 	m.MValid = m.M1 != 0 || m.M2 != 0 || m.M3 != 0
 	m.T = s.t[s.ix]
 
-	m.M = matrix.Zeros(15, 15)
+	m.M = ahrs.NewMatrix(15, 15)
 	return nil
 }
 
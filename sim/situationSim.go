@@ -3,7 +3,6 @@ package main
 import (
 	"../ahrs"
 	"errors"
-	"github.com/skelterjohn/go.matrix"
 	"math"
 	"math/rand"
 	"sort"
@@ -109,8 +108,8 @@ func (s *SituationSim) Interpolate(t float64, st *ahrs.State, aBias, bBias, mBia
 
 	st.T = t
 
-	st.M = matrix.Zeros(32, 32)
-	st.N = matrix.Zeros(32, 32)
+	st.M = ahrs.NewMatrix(32, 32)
+	st.N = ahrs.NewMatrix(32, 32)
 
 	return nil
 }